@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+const defaultAckTimeout = 10 * time.Second
+
+// ackFrame is what a receiver writes back on a chat stream: AckFor once
+// it has recorded a message, and ReadFor once it has shown it. Peers that
+// predate read receipts skip frames without AckFor.
+type ackFrame struct {
+	AckFor  string `json:"ackFor,omitempty"`
+	ReadFor string `json:"readFor,omitempty"`
+}
+
+func writeAck(w io.Writer, id string) error {
+	data, err := json.Marshal(ackFrame{AckFor: id})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// writeReceipt tells the sender of message id that it has been read.
+func writeReceipt(w io.Writer, id string) error {
+	data, err := json.Marshal(ackFrame{ReadFor: id})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// readAckFrame reads the next ACK or read receipt from r. Lines that are
+// neither are skipped.
+func readAckFrame(r *bufio.Reader) (ackFrame, error) {
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return ackFrame{}, err
+		}
+		var ack ackFrame
+		if json.Unmarshal(line, &ack) == nil && (ack.AckFor != "" || ack.ReadFor != "") {
+			return ack, nil
+		}
+	}
+}
+
+// readAck reads the next ACK from r, skipping everything else.
+func readAck(r *bufio.Reader) (string, error) {
+	for {
+		ack, err := readAckFrame(r)
+		if err != nil || ack.AckFor != "" {
+			return ack.AckFor, err
+		}
+	}
+}
+
+// ackTracker matches ACKs against sent messages. A message is delivered
+// once every peer it went to has acknowledged it; if that doesn't happen
+// within timeout, done is called with the peers still missing.
+type ackTracker struct {
+	timeout time.Duration
+	done    func(m ChatMessage, missing []peer.ID)
+
+	mu      sync.Mutex
+	pending map[string]*pendingAck
+}
+
+type pendingAck struct {
+	msg     ChatMessage
+	waiting map[peer.ID]struct{}
+	acked   int
+	timer   *time.Timer
+}
+
+func newAckTracker(timeout time.Duration, done func(m ChatMessage, missing []peer.ID)) *ackTracker {
+	return &ackTracker{timeout: timeout, done: done, pending: make(map[string]*pendingAck)}
+}
+
+// Expect records that m is about to be sent to id. It is a no-op on a nil
+// tracker, as are Ack and Drop.
+func (t *ackTracker) Expect(m ChatMessage, id peer.ID) {
+	if t == nil || m.ID == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.pending[m.ID]
+	if !ok {
+		p = &pendingAck{msg: m, waiting: make(map[peer.ID]struct{})}
+		p.timer = time.AfterFunc(t.timeout, func() { t.expire(m.ID) })
+		t.pending[m.ID] = p
+	}
+	p.waiting[id] = struct{}{}
+}
+
+// Ack records that id confirmed the message msgID. Unknown or repeated
+// ACKs are ignored.
+func (t *ackTracker) Ack(msgID string, id peer.ID) {
+	if t == nil {
+		return
+	}
+	t.settle(msgID, id, true)
+}
+
+// Drop stops waiting on id for msgID, because the send to it failed.
+func (t *ackTracker) Drop(msgID string, id peer.ID) {
+	if t == nil {
+		return
+	}
+	t.settle(msgID, id, false)
+}
+
+// Pending reports how many sent messages are still waiting on an ACK or
+// their timeout. It is zero on a nil tracker.
+func (t *ackTracker) Pending() int {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.pending)
+}
+
+func (t *ackTracker) settle(msgID string, id peer.ID, acked bool) {
+	t.mu.Lock()
+	p, ok := t.pending[msgID]
+	if !ok {
+		t.mu.Unlock()
+		return
+	}
+	if _, waiting := p.waiting[id]; !waiting {
+		t.mu.Unlock()
+		return
+	}
+	delete(p.waiting, id)
+	if acked {
+		p.acked++
+	}
+	finished := len(p.waiting) == 0
+	if finished {
+		p.timer.Stop()
+		delete(t.pending, msgID)
+	}
+	t.mu.Unlock()
+
+	// A message no peer could be sent has nothing to report; the send
+	// failure already was
+	if finished && p.acked > 0 {
+		t.done(p.msg, nil)
+	}
+}
+
+func (t *ackTracker) expire(msgID string) {
+	t.mu.Lock()
+	p, ok := t.pending[msgID]
+	if ok {
+		delete(t.pending, msgID)
+	}
+	t.mu.Unlock()
+	if !ok {
+		return
+	}
+	missing := make([]peer.ID, 0, len(p.waiting))
+	for id := range p.waiting {
+		missing = append(missing, id)
+	}
+	slices.SortFunc(missing, func(a, b peer.ID) int { return strings.Compare(string(a), string(b)) })
+	t.done(p.msg, missing)
+}
+
+// printDelivery is the Node's ackTracker callback.
+func printDelivery(m ChatMessage, missing []peer.ID) {
+	preview := truncateRunes(m.Body, 40)
+	if len(missing) == 0 {
+		out.Printf("✓ delivered: %s\n", preview)
+		return
+	}
+	names := make([]string, len(missing))
+	for i, id := range missing {
+		names[i] = peerName(id)
+	}
+	out.Printf("⏳ unacked: %s (no reply from %s)\n", preview, strings.Join(names, ", "))
+}
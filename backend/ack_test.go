@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+type ackResult struct {
+	msg     ChatMessage
+	missing []peer.ID
+}
+
+func newRecordingTracker(timeout time.Duration) (*ackTracker, chan ackResult) {
+	results := make(chan ackResult, 10)
+	t := newAckTracker(timeout, func(m ChatMessage, missing []peer.ID) {
+		results <- ackResult{m, missing}
+	})
+	return t, results
+}
+
+func TestHandleStreamAcksMessage(t *testing.T) {
+	ctx := context.Background()
+	hostA, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host A: %v", err)
+	}
+	defer hostA.Close()
+	hostB, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host B: %v", err)
+	}
+	defer hostB.Close()
+
+	hostB.SetStreamHandler("/chat/1.0.0", func(s network.Stream) {
+		handleStream(s, newMessageLog(10), nil, nil)
+	})
+	if err := hostA.Connect(ctx, peer.AddrInfo{ID: hostB.ID(), Addrs: hostB.Addrs()}); err != nil {
+		t.Fatalf("Failed to connect host A to host B: %v", err)
+	}
+	s, err := hostA.NewStream(ctx, hostB.ID(), "/chat/1.0.0")
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	defer s.Close()
+
+	msg := newChatMessage(hostA.ID(), "alice", "did you get this?")
+	if err := writeMessage(s, msg); err != nil {
+		t.Fatalf("Failed to write message: %v", err)
+	}
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := readAck(bufio.NewReader(s))
+	if err != nil {
+		t.Fatalf("Failed to read ACK: %v", err)
+	}
+	if got != msg.ID {
+		t.Errorf("Expected ACK for %s, got %s", msg.ID, got)
+	}
+}
+
+func TestAckTrackerDelivered(t *testing.T) {
+	tracker, results := newRecordingTracker(time.Minute)
+	bob, carol := newTestPeerID(t), newTestPeerID(t)
+	msg := newChatMessage("", "", "hi all")
+
+	tracker.Expect(msg, bob)
+	tracker.Expect(msg, carol)
+	tracker.Ack(msg.ID, bob)
+	tracker.Ack("some-other-id", carol)
+	select {
+	case r := <-results:
+		t.Fatalf("Expected no result before every peer acked, got %+v", r)
+	default:
+	}
+
+	tracker.Ack(msg.ID, carol)
+	tracker.Ack(msg.ID, carol)
+	r := <-results
+	if r.msg.ID != msg.ID || len(r.missing) != 0 {
+		t.Errorf("Expected %s delivered, got %+v", msg.ID, r)
+	}
+	select {
+	case r := <-results:
+		t.Errorf("Expected a single result, got another %+v", r)
+	default:
+	}
+}
+
+func TestAckTrackerTimeout(t *testing.T) {
+	tracker, results := newRecordingTracker(50 * time.Millisecond)
+	bob, carol := newTestPeerID(t), newTestPeerID(t)
+	msg := newChatMessage("", "", "anyone there?")
+
+	tracker.Expect(msg, bob)
+	tracker.Expect(msg, carol)
+	tracker.Ack(msg.ID, bob)
+
+	select {
+	case r := <-results:
+		if len(r.missing) != 1 || r.missing[0] != carol {
+			t.Errorf("Expected carol reported missing, got %v", r.missing)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the message to time out")
+	}
+}
+
+func TestAckTrackerDropWithoutAcks(t *testing.T) {
+	tracker, results := newRecordingTracker(50 * time.Millisecond)
+	msg := newChatMessage("", "", "lost")
+	bob := newTestPeerID(t)
+
+	tracker.Expect(msg, bob)
+	tracker.Drop(msg.ID, bob)
+	select {
+	case r := <-results:
+		t.Errorf("Expected nothing reported for a message no peer got, got %+v", r)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestNodeMessageIsAcked(t *testing.T) {
+	alice, _, _ := newTestPair(t)
+	tracker, results := newRecordingTracker(5 * time.Second)
+	alice.mgr.acks = tracker
+
+	if err := alice.Send("ack me"); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	r := <-results
+	if r.msg.Body != "ack me" || len(r.missing) != 0 {
+		t.Errorf("Expected the message delivered, got %+v", r)
+	}
+}
+
+func TestNodeMessageIsRead(t *testing.T) {
+	buf := useJSONOutput(t)
+	alice, bob, _ := newTestPair(t)
+
+	if err := alice.Send("read me"); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	waitFor(t, "bob's read receipt", func() bool {
+		got := alice.history.Recent(1)
+		return len(got) == 1 && slices.Equal(got[0].ReadBy, []peer.ID{bob.host.ID()})
+	})
+	waitFor(t, "a read event", func() bool {
+		for _, ev := range events(t, buf) {
+			if ev["type"] == "read" && ev["body"] == "read me" && ev["peer"] == bob.host.ID().String() {
+				return true
+			}
+		}
+		return false
+	})
+	if got := readMark(alice.history.Recent(1)[0], bob.host.ID()); got != " ✓✓" {
+		t.Errorf("Expected the /history line marked read, got %q", got)
+	}
+}
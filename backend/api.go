@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// apiServer exposes a Node over local HTTP for a browser UI:
+//
+//	GET  /peers    registered peers and their connection state
+//	GET  /whoami   our peer ID, shareable addresses and reachability
+//	GET  /who      saved contacts and online peers, and whether each is online
+//	POST /connect  {"addr": "<multiaddr>"}
+//	POST /send     {"body": "<text>"}
+//	GET  /history  ?peer=<peerID|@alias>&n=<count>: the last n messages
+//	               (default 20), or the last n with peer, oldest first
+//	GET  /ws       incoming messages as JSON; {"body": ...} frames are sent.
+//	               With ?events=1, connection and presence (ONLINE,
+//	               OFFLINE) events are streamed too.
+//
+// Requests from pages on other origins are refused, WebSocket upgrades
+// included, events or not, so a site open in the browser can't drive the
+// node or watch who it talks to. POST bodies must be application/json.
+type apiServer struct {
+	node     *Node
+	upgrader websocket.Upgrader
+}
+
+func newAPIHandler(n *Node) http.Handler {
+	a := &apiServer{node: n, upgrader: websocket.Upgrader{CheckOrigin: sameOrigin}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /peers", a.handlePeers)
+	mux.HandleFunc("GET /whoami", a.handleWhoami)
+	mux.HandleFunc("GET /who", a.handleWho)
+	mux.HandleFunc("POST /connect", a.handleConnect)
+	mux.HandleFunc("POST /send", a.handleSend)
+	mux.HandleFunc("GET /history", a.handleHistory)
+	mux.HandleFunc("GET /ws", a.handleWS)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !sameOrigin(r) {
+			writeJSON(w, http.StatusForbidden, apiError{"cross-origin requests are not allowed"})
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// sameOrigin reports whether r came from a page the API served, or from no
+// page at all, like curl. Browsers name the page's origin in an Origin
+// header on cross-origin requests.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// isJSON reports whether r's body is declared as JSON. A page on another
+// origin can only POST JSON with a preflight, which the origin check then
+// refuses.
+func isJSON(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// apiListenAddr is addr with 127.0.0.1 for its host if it names none, like
+// ":8080", so the API is only reachable from other machines when asked.
+func apiListenAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != "" {
+		return addr
+	}
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+// startAPI listens on addr, on loopback unless it names a host, and serves
+// the API in the background. Listening happens up front so a bad address
+// or busy port is reported immediately.
+func startAPI(addr string, n *Node) (*http.Server, net.Addr, error) {
+	ln, err := net.Listen("tcp", apiListenAddr(addr))
+	if err != nil {
+		return nil, nil, err
+	}
+	srv := &http.Server{Handler: newAPIHandler(n)}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("HTTP API stopped", "error", err)
+		}
+	}()
+	return srv, ln.Addr(), nil
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// sendStatus maps a Node.Send error onto an HTTP status.
+func sendStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNoActivePeer):
+		return http.StatusConflict
+	case errors.Is(err, ErrMessageTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrPeerUnreachable):
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// connectStatus maps a Node.Connect error onto an HTTP status: the
+// caller's fault for an address we can't use, the peer's otherwise.
+func connectStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidMultiaddr), errors.Is(err, errUnknownAlias), errors.Is(err, ErrNoAddresses), errors.Is(err, ErrSelfDial):
+		return http.StatusBadRequest
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+func (a *apiServer) handlePeers(w http.ResponseWriter, r *http.Request) {
+	peers := a.node.Peers()
+	if peers == nil {
+		peers = []peerStatus{}
+	}
+	writeJSON(w, http.StatusOK, peers)
+}
+
+func (a *apiServer) handleWhoami(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.node.Info())
+}
+
+func (a *apiServer) handleWho(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.node.Who())
+}
+
+func (a *apiServer) handleConnect(w http.ResponseWriter, r *http.Request) {
+	if !isJSON(r) {
+		writeJSON(w, http.StatusUnsupportedMediaType, apiError{"expected Content-Type: application/json"})
+		return
+	}
+	var req struct {
+		Addr string `json:"addr"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Addr == "" {
+		writeJSON(w, http.StatusBadRequest, apiError{"expected {\"addr\": \"<multiaddr>\"}"})
+		return
+	}
+	if err := a.node.Connect(req.Addr); err != nil {
+		writeJSON(w, connectStatus(err), apiError{err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type sendRequest struct {
+	Body string `json:"body"`
+}
+
+func (a *apiServer) handleSend(w http.ResponseWriter, r *http.Request) {
+	if !isJSON(r) {
+		writeJSON(w, http.StatusUnsupportedMediaType, apiError{"expected Content-Type: application/json"})
+		return
+	}
+	var req sendRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, int64(maxMessageBytes))).Decode(&req); err != nil || req.Body == "" {
+		writeJSON(w, http.StatusBadRequest, apiError{"expected {\"body\": \"<text>\"}"})
+		return
+	}
+	if err := a.node.Send(req.Body); err != nil {
+		writeJSON(w, sendStatus(err), apiError{err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *apiServer) handleHistory(w http.ResponseWriter, r *http.Request) {
+	count := 20
+	if v := r.URL.Query().Get("n"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeJSON(w, http.StatusBadRequest, apiError{"n must be a positive number"})
+			return
+		}
+		count = n
+	}
+	var msgs []ChatMessage
+	if target := r.URL.Query().Get("peer"); target != "" {
+		id, err := a.node.ResolvePeer(target)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, apiError{err.Error()})
+			return
+		}
+		msgs = a.node.history.With(id, count)
+	} else {
+		msgs = a.node.history.Recent(count)
+	}
+	if msgs == nil {
+		msgs = []ChatMessage{}
+	}
+	writeJSON(w, http.StatusOK, msgs)
+}
+
+// handleWS pushes every message from other peers to the client and sends
+// whatever the client writes. Each client gets its own subscription, which
+// is dropped when the client goes away.
+func (a *apiServer) handleWS(w http.ResponseWriter, r *http.Request) {
+	conn, err := a.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	msgs, unsubscribe := a.node.Subscribe()
+	defer unsubscribe()
+	// A nil channel never delivers, so without ?events=1 that case is idle
+	var events <-chan connEvent
+	if r.URL.Query().Get("events") == "1" {
+		var unsubscribeEvents func()
+		events, unsubscribeEvents = a.node.SubscribeEvents()
+		defer unsubscribeEvents()
+	}
+
+	// gorilla/websocket allows one writer at a time; both loops write
+	var writeMu sync.Mutex
+	write := func(v any) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return conn.WriteJSON(v)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn.SetReadLimit(int64(maxMessageBytes))
+		for {
+			var req sendRequest
+			if err := conn.ReadJSON(&req); err != nil {
+				return
+			}
+			if req.Body == "" {
+				continue
+			}
+			if err := a.node.Send(req.Body); err != nil {
+				write(apiError{err.Error()})
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		case m, ok := <-msgs:
+			if !ok {
+				return
+			}
+			if m.Direction == directionSent {
+				continue
+			}
+			if err := write(m); err != nil {
+				return
+			}
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := write(e); err != nil {
+				return
+			}
+		}
+	}
+}
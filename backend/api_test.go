@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// connectedAPIPair returns alice behind a test API server, connected to bob.
+func connectedAPIPair(t *testing.T) (*httptest.Server, *Node, *Node) {
+	t.Helper()
+	alice := newTestNode(t, "alice")
+	bob := newTestNode(t, "bob")
+	srv := httptest.NewServer(newAPIHandler(alice))
+	t.Cleanup(srv.Close)
+
+	addr := nodeAddr(bob)
+	body := fmt.Sprintf(`{"addr": %q}`, addr)
+	resp, err := http.Post(srv.URL+"/connect", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to POST /connect: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected 204 from /connect, got %d", resp.StatusCode)
+	}
+	return srv, alice, bob
+}
+
+func TestAPIPeers(t *testing.T) {
+	srv, _, bob := connectedAPIPair(t)
+
+	resp, err := http.Get(srv.URL + "/peers")
+	if err != nil {
+		t.Fatalf("Failed to GET /peers: %v", err)
+	}
+	defer resp.Body.Close()
+	var peers []peerStatus
+	if err := json.NewDecoder(resp.Body).Decode(&peers); err != nil {
+		t.Fatalf("Failed to decode /peers: %v", err)
+	}
+	if len(peers) != 1 || peers[0].ID != bob.host.ID() || peers[0].State != "connected" {
+		t.Errorf("Unexpected peer list: %+v", peers)
+	}
+}
+
+func TestAPISend(t *testing.T) {
+	srv, _, bob := connectedAPIPair(t)
+
+	resp, err := http.Post(srv.URL+"/send", "application/json", strings.NewReader(`{"body": "from the browser"}`))
+	if err != nil {
+		t.Fatalf("Failed to POST /send: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected 204 from /send, got %d", resp.StatusCode)
+	}
+	waitFor(t, "bob to receive the message", func() bool {
+		got := bob.history.Recent(1)
+		return len(got) == 1 && got[0].Body == "from the browser"
+	})
+
+	resp, err = http.Post(srv.URL+"/send", "application/json", strings.NewReader(`not json`))
+	if err != nil {
+		t.Fatalf("Failed to POST /send: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a malformed body, got %d", resp.StatusCode)
+	}
+}
+
+func TestAPISendWithoutPeers(t *testing.T) {
+	srv := httptest.NewServer(newAPIHandler(newTestNode(t, "")))
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/send", "application/json", strings.NewReader(`{"body": "anyone?"}`))
+	if err != nil {
+		t.Fatalf("Failed to POST /send: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected 409 with no peers, got %d", resp.StatusCode)
+	}
+}
+
+func TestAPIWebSocket(t *testing.T) {
+	srv, alice, bob := connectedAPIPair(t)
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	// Two clients at once; both should see bob's message
+	var clients []*websocket.Conn
+	for i := 0; i < 2; i++ {
+		c, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		if err != nil {
+			t.Fatalf("Failed to dial /ws: %v", err)
+		}
+		defer c.Close()
+		clients = append(clients, c)
+	}
+	// The subscription is taken after the upgrade; give the handlers a moment
+	time.Sleep(100 * time.Millisecond)
+
+	if err := clients[0].WriteJSON(sendRequest{Body: "typed in the browser"}); err != nil {
+		t.Fatalf("Failed to write to /ws: %v", err)
+	}
+	waitFor(t, "bob to receive the websocket message", func() bool {
+		got := bob.history.Recent(1)
+		return len(got) == 1 && got[0].Body == "typed in the browser"
+	})
+
+	// Bob now knows alice and can answer
+	if err := bob.Send("hello browser"); err != nil {
+		t.Fatalf("Failed to send from bob: %v", err)
+	}
+	for i, c := range clients {
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var m ChatMessage
+		if err := c.ReadJSON(&m); err != nil {
+			t.Fatalf("Client %d failed to read: %v", i, err)
+		}
+		if m.Body != "hello browser" || m.From != bob.host.ID() {
+			t.Errorf("Client %d got unexpected message: %+v", i, m)
+		}
+	}
+
+	// Disconnected clients drop their subscriptions
+	for _, c := range clients {
+		c.Close()
+	}
+	waitFor(t, "subscriptions to be released", func() bool {
+		alice.history.mu.Lock()
+		defer alice.history.mu.Unlock()
+		return len(alice.history.subs) == 0
+	})
+}
+
+func TestAPIHistory(t *testing.T) {
+	srv, alice, bob := connectedAPIPair(t)
+	if err := alice.Send("first"); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	if err := alice.Send("second"); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+
+	get := func(query string) (int, []ChatMessage) {
+		resp, err := http.Get(srv.URL + "/history" + query)
+		if err != nil {
+			t.Fatalf("Failed to GET /history: %v", err)
+		}
+		defer resp.Body.Close()
+		var msgs []ChatMessage
+		json.NewDecoder(resp.Body).Decode(&msgs)
+		return resp.StatusCode, msgs
+	}
+	if status, msgs := get("?n=1"); status != http.StatusOK || len(msgs) != 1 || msgs[0].Body != "second" {
+		t.Errorf("Expected the newest message, got %d %+v", status, msgs)
+	}
+	if status, msgs := get("?peer=" + bob.host.ID().String()); status != http.StatusOK || len(msgs) != 2 {
+		t.Errorf("Expected both messages sent to bob, got %d %+v", status, msgs)
+	}
+	if status, msgs := get("?peer=" + newTestPeerID(t).String()); status != http.StatusOK || msgs == nil || len(msgs) != 0 {
+		t.Errorf("Expected an empty list for a stranger, got %d %+v", status, msgs)
+	}
+	if status, _ := get("?n=zero"); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a bad count, got %d", status)
+	}
+	if status, _ := get("?peer=@nobody"); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown alias, got %d", status)
+	}
+}
+
+func TestAPIWebSocketEvents(t *testing.T) {
+	srv, alice, _ := connectedAPIPair(t)
+	c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws?events=1", nil)
+	if err != nil {
+		t.Fatalf("Failed to dial /ws: %v", err)
+	}
+	defer c.Close()
+	waitFor(t, "the event subscription", func() bool {
+		alice.events.mu.Lock()
+		defer alice.events.mu.Unlock()
+		return len(alice.events.subs) == 1
+	})
+
+	carol := newTestNode(t, "carol")
+	if err := alice.Connect(nodeAddr(carol)); err != nil {
+		t.Fatalf("Failed to connect to carol: %v", err)
+	}
+	// Presence events share the stream, so skip ahead to carol's
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var e connEvent
+		if err := c.ReadJSON(&e); err != nil {
+			t.Fatalf("Failed to read carol's connection event: %v", err)
+		}
+		if e.Kind == eventConnected && e.Peer == carol.host.ID() {
+			break
+		}
+	}
+
+	// Connection events say who we talk to; another site mustn't see them
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws?events=1", http.Header{"Origin": {"https://evil.example"}})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected the event stream to be refused to another origin, got %v", err)
+	}
+}
+
+func TestAPIRefusesCrossOrigin(t *testing.T) {
+	srv, _, _ := connectedAPIPair(t)
+
+	post := func(origin, contentType string) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/send", strings.NewReader(`{"body": "hi"}`))
+		req.Header.Set("Content-Type", contentType)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to POST /send: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := post("https://evil.example", "application/json"); status != http.StatusForbidden {
+		t.Errorf("Expected 403 for another origin, got %d", status)
+	}
+	if status := post(srv.URL, "application/json; charset=utf-8"); status != http.StatusNoContent {
+		t.Errorf("Expected 204 from the API's own origin, got %d", status)
+	}
+	if status := post("", "text/plain"); status != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected 415 for a body that isn't JSON, got %d", status)
+	}
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {"https://evil.example"}})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected the upgrade from another origin to be refused, got %v", err)
+	}
+}
+
+func TestAPIListenAddrDefaultsToLoopback(t *testing.T) {
+	for addr, want := range map[string]string{
+		":8080":         "127.0.0.1:8080",
+		"0.0.0.0:8080":  "0.0.0.0:8080",
+		"[::1]:8080":    "[::1]:8080",
+		"localhost:80":  "localhost:80",
+		"not-an-addr":   "not-an-addr",
+		"example.org:0": "example.org:0",
+	} {
+		if got := apiListenAddr(addr); got != want {
+			t.Errorf("Expected %q to listen on %q, got %q", addr, want, got)
+		}
+	}
+}
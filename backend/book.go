@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+var (
+	errInvalidAlias = errors.New("aliases are 1-32 letters, digits, '-' or '_'")
+	errAliasExists  = errors.New("alias already saved")
+	errUnknownAlias = errors.New("no such alias in the address book")
+)
+
+var aliasPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,31}$`)
+
+// bookEntry is one row of /book.
+type bookEntry struct {
+	Alias string `json:"alias"`
+	Addr  string `json:"addr"`
+}
+
+// addressBook maps aliases to full /p2p/ multiaddrs, or to a bare
+// /p2p/<ID> for peers saved by ID alone, so "/connect @bob" works across
+// restarts. It's stored as a JSON object in path and rewritten whole on
+// every change.
+type addressBook struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]string
+	// names is the reverse index for AliasOf: each saved peer's first
+	// alias in sort order.
+	names map[peer.ID]string
+}
+
+// contacts is the book whose aliases name peers in output; main sets it to
+// the node's book.
+var contacts *addressBook
+
+// peerName is how output refers to id: @alias if it's in contacts,
+// otherwise the short form of its ID.
+func peerName(id peer.ID) string {
+	if alias, ok := contacts.AliasOf(id); ok {
+		return "@" + alias
+	}
+	return shortID(id)
+}
+
+// loadAddressBook reads the book at path. A missing file is an empty book.
+func loadAddressBook(path string) (*addressBook, error) {
+	b := &addressBook{path: path, entries: make(map[string]string)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &b.entries); err != nil {
+		return nil, fmt.Errorf("malformed address book %s: %w", path, err)
+	}
+	b.index()
+	return b, nil
+}
+
+// index rebuilds names from entries. Callers hold mu, or own b.
+func (b *addressBook) index() {
+	b.names = make(map[peer.ID]string)
+	for alias, addr := range b.entries {
+		info, err := peer.AddrInfoFromString(addr)
+		if err != nil {
+			continue
+		}
+		if prev, ok := b.names[info.ID]; !ok || alias < prev {
+			b.names[info.ID] = alias
+		}
+	}
+}
+
+// Save adds alias for addr, a multiaddr ending in /p2p/<ID> or just a
+// peer ID, and writes the book out. Aliases can't be reused; the entry
+// isn't kept if the write fails.
+func (b *addressBook) Save(alias, addr string) error {
+	if !aliasPattern.MatchString(alias) {
+		return fmt.Errorf("%w: %q", errInvalidAlias, alias)
+	}
+	if id, err := peer.Decode(addr); err == nil {
+		addr = "/p2p/" + id.String()
+	}
+	if _, err := peer.AddrInfoFromString(addr); err != nil {
+		return fmt.Errorf("invalid multiaddr %q: %w", addr, err)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.entries[alias]; ok {
+		return fmt.Errorf("%w: %q", errAliasExists, alias)
+	}
+	b.entries[alias] = addr
+	if err := b.write(); err != nil {
+		delete(b.entries, alias)
+		return err
+	}
+	b.index()
+	return nil
+}
+
+// Peers returns each saved peer with its alias. It is empty on a nil
+// book.
+func (b *addressBook) Peers() map[peer.ID]string {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return maps.Clone(b.names)
+}
+
+// AliasOf returns the alias id is saved under. It reports false on a nil
+// book.
+func (b *addressBook) AliasOf(id peer.ID) (string, bool) {
+	if b == nil {
+		return "", false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	alias, ok := b.names[id]
+	return alias, ok
+}
+
+// Resolve returns the multiaddr saved as alias. It reports false on a nil
+// book.
+func (b *addressBook) Resolve(alias string) (string, bool) {
+	if b == nil {
+		return "", false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	addr, ok := b.entries[alias]
+	return addr, ok
+}
+
+// List returns every entry, ordered by alias.
+func (b *addressBook) List() []bookEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := make([]bookEntry, 0, len(b.entries))
+	for alias, addr := range b.entries {
+		out = append(out, bookEntry{Alias: alias, Addr: addr})
+	}
+	slices.SortFunc(out, func(x, y bookEntry) int { return strings.Compare(x.Alias, y.Alias) })
+	return out
+}
+
+// write replaces the file with the current entries via a temp file and a
+// rename, so a crash mid-write can't leave half a book. Callers hold mu.
+func (b *addressBook) write() error {
+	data, err := json.MarshalIndent(b.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(b.path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".peers-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(append(data, '\n'))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), b.path)
+}
+
+// resolveTarget turns "@alias" into the multiaddr saved for it in book.
+// Anything else is returned as is.
+func resolveTarget(book *addressBook, target string) (string, error) {
+	alias, ok := strings.CutPrefix(target, "@")
+	if !ok {
+		return target, nil
+	}
+	addr, ok := book.Resolve(alias)
+	if !ok {
+		return "", fmt.Errorf("%w: %q", errUnknownAlias, alias)
+	}
+	return addr, nil
+}
+
+// formatBook renders entries for /book.
+func formatBook(entries []bookEntry) string {
+	if len(entries) == 0 {
+		return "📒 Address book is empty; add peers with /alias <name> <peerID|multiaddr>"
+	}
+	var b strings.Builder
+	b.WriteString("📒 Address book:")
+	for _, e := range entries {
+		fmt.Fprintf(&b, "\n   @%s  %s", e.Alias, e.Addr)
+	}
+	return b.String()
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAddressBookSaveAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "artivus", "peers.json")
+	book, err := loadAddressBook(path)
+	if err != nil {
+		t.Fatalf("Failed to load missing book: %v", err)
+	}
+	if len(book.List()) != 0 {
+		t.Fatal("Expected a missing file to load as an empty book")
+	}
+
+	bob := "/ip4/127.0.0.1/tcp/4001/p2p/" + newTestPeerID(t).String()
+	if err := book.Save("bob", bob); err != nil {
+		t.Fatalf("Failed to save alias: %v", err)
+	}
+	if err := book.Save("bob", bob); !errors.Is(err, errAliasExists) {
+		t.Errorf("Expected errAliasExists for a duplicate alias, got %v", err)
+	}
+
+	reloaded, err := loadAddressBook(path)
+	if err != nil {
+		t.Fatalf("Failed to reload book: %v", err)
+	}
+	if got := reloaded.List(); len(got) != 1 || got[0] != (bookEntry{Alias: "bob", Addr: bob}) {
+		t.Errorf("Unexpected entries after reload: %v", got)
+	}
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("Expected no temp files left behind, got %d entries", len(entries))
+	}
+}
+
+func TestAddressBookRejectsInvalidEntries(t *testing.T) {
+	book, _ := loadAddressBook(filepath.Join(t.TempDir(), "peers.json"))
+	valid := "/ip4/127.0.0.1/tcp/4001/p2p/" + newTestPeerID(t).String()
+	tests := []struct {
+		alias, addr string
+	}{
+		{"", valid},
+		{"has space", valid},
+		{"@bob", valid},
+		{"bob", "/ip4/127.0.0.1/tcp/4001"},
+		{"bob", "not-a-multiaddr"},
+	}
+	for _, tt := range tests {
+		if err := book.Save(tt.alias, tt.addr); err == nil {
+			t.Errorf("Expected Save(%q, %q) to fail", tt.alias, tt.addr)
+		}
+	}
+	if len(book.List()) != 0 {
+		t.Error("Expected rejected entries to stay out of the book")
+	}
+}
+
+func TestResolveTarget(t *testing.T) {
+	book, _ := loadAddressBook(filepath.Join(t.TempDir(), "peers.json"))
+	bob := "/ip4/127.0.0.1/tcp/4001/p2p/" + newTestPeerID(t).String()
+	book.Save("bob", bob)
+
+	if got, err := resolveTarget(book, "@bob"); err != nil || got != bob {
+		t.Errorf("Expected @bob to resolve to %s, got %q, %v", bob, got, err)
+	}
+	if got, err := resolveTarget(book, bob); err != nil || got != bob {
+		t.Errorf("Expected a multiaddr to pass through, got %q, %v", got, err)
+	}
+	if _, err := resolveTarget(book, "@carol"); !errors.Is(err, errUnknownAlias) {
+		t.Errorf("Expected errUnknownAlias, got %v", err)
+	}
+	if _, err := resolveTarget(nil, "@bob"); !errors.Is(err, errUnknownAlias) {
+		t.Errorf("Expected errUnknownAlias without a book, got %v", err)
+	}
+}
+
+func TestConnectByAlias(t *testing.T) {
+	alice := newTestNode(t, "alice")
+	bob := newTestNode(t, "bob")
+	alice.book, _ = loadAddressBook(filepath.Join(t.TempDir(), "peers.json"))
+
+	if err := alice.SaveAlias("bob", nodeAddr(bob)); err != nil {
+		t.Fatalf("Failed to save alias: %v", err)
+	}
+	if err := alice.Connect("@bob"); err != nil {
+		t.Fatalf("Failed to connect by alias: %v", err)
+	}
+	if got := alice.Peers(); len(got) != 1 || got[0].ID != bob.host.ID() {
+		t.Errorf("Expected bob in alice's peers, got %v", got)
+	}
+}
+
+func TestAddressBookAliasOf(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers.json")
+	book, _ := loadAddressBook(path)
+	bob, carol := newTestPeerID(t), newTestPeerID(t)
+
+	// A bare peer ID is saved as /p2p/<ID>
+	if err := book.Save("bob", bob.String()); err != nil {
+		t.Fatalf("Failed to save an alias for a peer ID: %v", err)
+	}
+	if addr, _ := book.Resolve("bob"); addr != "/p2p/"+bob.String() {
+		t.Errorf("Expected /p2p/%s, got %q", bob, addr)
+	}
+	if err := book.Save("bobby", "/ip4/127.0.0.1/tcp/4001/p2p/"+bob.String()); err != nil {
+		t.Fatalf("Failed to save a second alias: %v", err)
+	}
+
+	reloaded, _ := loadAddressBook(path)
+	for _, b := range []*addressBook{book, reloaded} {
+		if alias, ok := b.AliasOf(bob); !ok || alias != "bob" {
+			t.Errorf("Expected bob's first alias, got %q, %v", alias, ok)
+		}
+		if _, ok := b.AliasOf(carol); ok {
+			t.Error("Expected no alias for carol")
+		}
+	}
+	if _, ok := (*addressBook)(nil).AliasOf(bob); ok {
+		t.Error("Expected a nil book to know no aliases")
+	}
+}
+
+func TestPeerNameUsesContacts(t *testing.T) {
+	book, _ := loadAddressBook(filepath.Join(t.TempDir(), "peers.json"))
+	bob, carol := newTestPeerID(t), newTestPeerID(t)
+	book.Save("bob", bob.String())
+	old := contacts
+	contacts = book
+	t.Cleanup(func() { contacts = old })
+
+	if got := peerName(bob); got != "@bob" {
+		t.Errorf("Expected @bob, got %q", got)
+	}
+	if got := peerName(carol); got != shortID(carol) {
+		t.Errorf("Expected the short ID for a stranger, got %q", got)
+	}
+	if got := displayName("", bob); got != "@bob" {
+		t.Errorf("Expected the alias when there's no nick, got %q", got)
+	}
+}
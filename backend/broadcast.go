@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+const defaultBroadcastWorkers = 8
+
+// broadcastTimeout bounds a whole broadcast, so a handful of stuck peers
+// can't hold up the REPL past it.
+var broadcastTimeout = 30 * time.Second
+
+// broadcastResult is how a broadcast went: how many peers it was for, and
+// which of them it failed to reach.
+type broadcastResult struct {
+	total  int
+	sent   int
+	failed []peer.ID
+}
+
+// String summarizes r, e.g. "sent 9/10 (1 failed: 12D3Koo…)".
+func (r broadcastResult) String() string {
+	s := fmt.Sprintf("sent %d/%d", r.sent, r.total)
+	if len(r.failed) == 0 {
+		return s
+	}
+	names := make([]string, len(r.failed))
+	for i, id := range r.failed {
+		names[i] = peerName(id)
+	}
+	return fmt.Sprintf("%s (%d failed: %s)", s, len(r.failed), strings.Join(names, ", "))
+}
+
+// broadcast sends msg to each of peers, at most workers at a time, and
+// gives up on any still pending after broadcastTimeout. A failure for one
+// peer is logged and doesn't stop delivery to the rest.
+func broadcast(ctx context.Context, peers []peer.AddrInfo, send func(context.Context, peer.ID, ChatMessage) error, msg ChatMessage, workers int) broadcastResult {
+	workers = min(max(workers, 1), len(peers))
+
+	ctx, cancel := context.WithTimeout(ctx, broadcastTimeout)
+	defer cancel()
+
+	// Each worker writes only the slots of the peers it took, so the
+	// results need no lock
+	errs := make([]error, len(peers))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				errs[i] = send(ctx, peers[i].ID, msg)
+			}
+		}()
+	}
+	for i := range peers {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	res := broadcastResult{total: len(peers)}
+	for i, err := range errs {
+		id := peers[i].ID
+		switch {
+		case errors.Is(err, errNegotiationTimeout):
+			logger.Warn("peer is connected but not answering", "peer_id", id, "error", err)
+		case errors.Is(err, errSendTimeout):
+			logger.Warn("peer stopped reading, dropped its stream", "peer_id", id, "error", err)
+		case err != nil:
+			logger.Warn("failed to send", "peer_id", id, "error", err)
+		default:
+			res.sent++
+			continue
+		}
+		res.failed = append(res.failed, id)
+	}
+	return res
+}
+
+// peerLocks is a mutex per peer, created on first use.
+type peerLocks struct {
+	mu    sync.Mutex
+	locks map[peer.ID]*sync.Mutex
+}
+
+// Lock locks id's mutex and returns the func that unlocks it.
+func (l *peerLocks) Lock(id peer.ID) (unlock func()) {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[peer.ID]*sync.Mutex)
+	}
+	m, ok := l.locks[id]
+	if !ok {
+		m = &sync.Mutex{}
+		l.locks[id] = m
+	}
+	l.mu.Unlock()
+	m.Lock()
+	return m.Unlock
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	host "github.com/libp2p/go-libp2p/core/host"
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestBroadcastToManyPeers(t *testing.T) {
+	ctx := context.Background()
+	sender, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create sender host: %v", err)
+	}
+	defer sender.Close()
+
+	const peers = 10
+	var mu sync.Mutex
+	received := make(map[peer.ID]string)
+	reg := newPeerRegistry()
+	receivers := make([]host.Host, peers)
+	for i := range receivers {
+		h, err := createTestHost(t)
+		if err != nil {
+			t.Fatalf("Failed to create receiver host: %v", err)
+		}
+		defer h.Close()
+		h.SetStreamHandler("/chat/1.0.0", func(s network.Stream) {
+			defer s.Close()
+			if m, err := readMessage(bufio.NewReader(s)); err == nil {
+				mu.Lock()
+				received[h.ID()] = m.Body
+				mu.Unlock()
+			}
+		})
+		info := peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()}
+		if err := sender.Connect(ctx, info); err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		reg.Add(info)
+		receivers[i] = h
+	}
+	closed := receivers[3]
+	closed.Close()
+	waitFor(t, "the closed peer to drop", func() bool {
+		return sender.Network().Connectedness(closed.ID()) != network.Connected
+	})
+	// Fail the redial at once rather than after a QUIC handshake timeout
+	sender.Peerstore().ClearAddrs(closed.ID())
+
+	mgr := newStreamManager(sender, streamOpener{timeout: 5 * time.Second}, nil)
+	defer mgr.Close()
+	res := broadcast(ctx, reg.List(), mgr.Send, newChatMessage(sender.ID(), "", "hello all"), 4)
+	if res.sent != peers-1 || len(res.failed) != 1 || res.failed[0] != closed.ID() {
+		t.Fatalf("Expected 9 sent and the closed peer failed, got %+v", res)
+	}
+	if want := fmt.Sprintf("sent 9/10 (1 failed: %s)", shortID(closed.ID())); res.String() != want {
+		t.Errorf("Expected summary %q, got %q", want, res.String())
+	}
+
+	waitFor(t, "every open peer to receive the message", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) == peers-1
+	})
+	for id, body := range received {
+		if id == closed.ID() || body != "hello all" {
+			t.Errorf("Unexpected delivery to %s: %q", id, body)
+		}
+	}
+}
+
+func TestBroadcastBoundsConcurrency(t *testing.T) {
+	reg := newPeerRegistry()
+	for i := 0; i < 20; i++ {
+		reg.Add(peer.AddrInfo{ID: peer.ID(fmt.Sprintf("peer-%02d", i))})
+	}
+	var inFlight, most atomic.Int32
+	send := func(context.Context, peer.ID, ChatMessage) error {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := most.Load()
+			if n <= m || most.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		return nil
+	}
+
+	res := broadcast(context.Background(), reg.List(), send, newChatMessage("", "", "hi"), 3)
+	if res.sent != 20 || res.String() != "sent 20/20" {
+		t.Errorf("Expected every send to succeed, got %s", res)
+	}
+	if got := most.Load(); got > 3 {
+		t.Errorf("Expected at most 3 sends in flight, saw %d", got)
+	}
+}
+
+func TestBroadcastTimeout(t *testing.T) {
+	old := broadcastTimeout
+	broadcastTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { broadcastTimeout = old })
+
+	reg := newPeerRegistry()
+	reg.Add(peer.AddrInfo{ID: peer.ID("stuck")})
+	send := func(ctx context.Context, _ peer.ID, _ ChatMessage) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	res := broadcast(context.Background(), reg.List(), send, newChatMessage("", "", "hi"), 1)
+	if res.sent != 0 || !strings.Contains(res.String(), "1 failed") {
+		t.Errorf("Expected the stuck peer to fail once the broadcast timed out, got %s", res)
+	}
+}
+
+func BenchmarkBroadcast(b *testing.B) {
+	reg := newPeerRegistry()
+	for i := 0; i < 32; i++ {
+		reg.Add(peer.AddrInfo{ID: peer.ID(fmt.Sprintf("peer-%02d", i))})
+	}
+	send := func(context.Context, peer.ID, ChatMessage) error {
+		time.Sleep(100 * time.Microsecond)
+		return nil
+	}
+	msg := newChatMessage("", "", "hi")
+	for _, workers := range []int{1, defaultBroadcastWorkers} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for b.Loop() {
+				broadcast(context.Background(), reg.List(), send, msg, workers)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	host "github.com/libp2p/go-libp2p/core/host"
+	protocol "github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// defaultChannel is the name /channel uses for plain chatProtocol, which
+// every peer speaks. Messages on it carry an empty Channel.
+const defaultChannel = "default"
+
+var (
+	errInvalidChannel  = errors.New("channel names are 1-32 lowercase letters, digits, '-' or '_'")
+	errNotInChannel    = errors.New("not in that channel")
+	errSecureChannels  = errors.New("channels aren't encrypted, so they're off with -secure")
+	channelPattern     = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+	channelProtoPrefix = "/artivus/chat/"
+	channelProtoSuffix = "/1.0.0"
+)
+
+// channelProtocol is the stream protocol for channel name, "" being the
+// default channel.
+func channelProtocol(name string) protocol.ID {
+	if name == "" {
+		return chatProtocol
+	}
+	return protocol.ID(channelProtoPrefix + name + channelProtoSuffix)
+}
+
+// channelOf is the channel a chat stream speaking proto belongs to, or ""
+// for the default channel.
+func channelOf(proto protocol.ID) string {
+	name, ok := strings.CutPrefix(string(proto), channelProtoPrefix)
+	if !ok {
+		return ""
+	}
+	name, _ = strings.CutSuffix(name, channelProtoSuffix)
+	return name
+}
+
+// checkChannel validates a channel name typed by the user and maps
+// defaultChannel to "".
+func checkChannel(name string) (string, error) {
+	if name == defaultChannel {
+		return "", nil
+	}
+	if !channelPattern.MatchString(name) {
+		return "", fmt.Errorf("%w: %q", errInvalidChannel, name)
+	}
+	return name, nil
+}
+
+// channelTag is how a message's channel is shown before its sender.
+func channelTag(name string) string {
+	if name == "" {
+		return ""
+	}
+	return "#" + name + " "
+}
+
+// resetChannelStreams resets every open stream on proto, so peers notice
+// we've left the channel instead of writing into the void.
+func resetChannelStreams(h host.Host, proto protocol.ID) {
+	for _, c := range h.Network().Conns() {
+		for _, s := range c.GetStreams() {
+			if s.Protocol() == proto {
+				s.Reset()
+			}
+		}
+	}
+}
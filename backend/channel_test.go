@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestChannelProtocol(t *testing.T) {
+	if got := channelProtocol(""); got != "/chat/2.0.0" {
+		t.Errorf("Expected the default channel on /chat/2.0.0, got %s", got)
+	}
+	if got := channelProtocol("dev"); got != "/artivus/chat/dev/1.0.0" {
+		t.Errorf("Unexpected protocol for dev: %s", got)
+	}
+	for _, name := range []string{"", "dev", "ops-2"} {
+		if got := channelOf(channelProtocol(name)); got != name {
+			t.Errorf("channelOf(channelProtocol(%q)) = %q", name, got)
+		}
+	}
+	if got := channelOf(secureChatProtocol); got != "" {
+		t.Errorf("Expected secure chat on the default channel, got %q", got)
+	}
+	for _, bad := range []string{"", "Dev", "a/b", "-x", "has space"} {
+		if _, err := checkChannel(bad); !errors.Is(err, errInvalidChannel) {
+			t.Errorf("Expected %q to be rejected, got %v", bad, err)
+		}
+	}
+}
+
+func TestChannelsAreSeparate(t *testing.T) {
+	alice, bob, cleanup := newTestPair(t)
+	defer cleanup()
+
+	if err := bob.JoinChannel("a"); err != nil {
+		t.Fatalf("Failed to join channel: %v", err)
+	}
+	if err := alice.JoinChannel("b"); err != nil {
+		t.Fatalf("Failed to join channel: %v", err)
+	}
+	if err := alice.Send("for b only"); !errors.Is(err, ErrPeerUnreachable) {
+		t.Fatalf("Expected a send no peer's channel accepts to fail with ErrPeerUnreachable, got %v", err)
+	}
+	if err := alice.JoinChannel("a"); err != nil {
+		t.Fatalf("Failed to switch channel: %v", err)
+	}
+	if err := alice.Send("for a"); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	waitFor(t, "message on channel a", func() bool { return len(bob.history.Recent(-1)) > 0 })
+	time.Sleep(100 * time.Millisecond)
+
+	got := bob.history.Recent(-1)
+	if len(got) != 1 || got[0].Body != "for a" || got[0].Channel != "a" {
+		t.Fatalf("Expected only the channel a message, tagged a, got %+v", got)
+	}
+	if want := []string{"a", "b"}; !slices.Equal(alice.Channels(), want) {
+		t.Errorf("Expected alice in %v, got %v", want, alice.Channels())
+	}
+
+	if err := bob.LeaveChannel("a"); err != nil {
+		t.Fatalf("Failed to leave channel: %v", err)
+	}
+	if slices.Contains(bob.host.Mux().Protocols(), channelProtocol("a")) {
+		t.Error("Expected the channel handler to be removed")
+	}
+	if err := bob.LeaveChannel("a"); !errors.Is(err, errNotInChannel) {
+		t.Errorf("Expected errNotInChannel, got %v", err)
+	}
+
+	// The default channel still reaches bob
+	if err := alice.JoinChannel(defaultChannel); err != nil {
+		t.Fatalf("Failed to switch to the default channel: %v", err)
+	}
+	if err := alice.Send("hello default"); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	waitFor(t, "message on the default channel", func() bool { return len(bob.history.Recent(-1)) == 2 })
+	if m := bob.history.Recent(1)[0]; m.Channel != "" {
+		t.Errorf("Expected an untagged default-channel message, got %q", m.Channel)
+	}
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+var (
+	errExit           = errors.New("exit")
+	errUsage          = errors.New("usage")
+	errUnknownCommand = errors.New("unknown command, try /help")
+	errNotInRoom      = errors.New("not in a room")
+	errNotFocused     = errors.New("not focused on a peer")
+)
+
+// command is one REPL command. run gets the words after the name and the
+// raw text after it, for commands whose argument may contain spaces.
+type command struct {
+	name  string
+	args  string
+	help  string
+	run   func(args []string, rest string) error
+	nargs func(n int) bool
+}
+
+// repl turns lines typed at the prompt into commands or chat messages.
+type repl struct {
+	ctx              context.Context
+	node             *Node
+	relaysConfigured bool
+	// focus, if set, is the only peer plain lines go to, named focusName
+	// as the user typed it.
+	focus     peer.ID
+	focusName string
+	// conversations are the peers focused on so far, in the order they
+	// were opened, for /to to switch between.
+	conversations []peer.ID
+
+	commands []*command
+	byName   map[string]*command
+}
+
+func newREPL(ctx context.Context, node *Node, relaysConfigured bool) *repl {
+	r := &repl{ctx: ctx, node: node, relaysConfigured: relaysConfigured, byName: make(map[string]*command)}
+	r.registerCommands()
+	return r
+}
+
+// register adds a command. nargs validates the number of words after the
+// name; nil accepts any.
+func (r *repl) register(name, args, help string, nargs func(int) bool, run func(args []string, rest string) error) {
+	c := &command{name: name, args: args, help: help, run: run, nargs: nargs}
+	r.commands = append(r.commands, c)
+	r.byName[name] = c
+}
+
+// commandResult is what a query command found: Text to show at the
+// prompt, and Value, which -output json emits as a "result" event's result
+// so scripts needn't parse Text. Value's type is the command's result
+// shape, and should marshal lists as [] rather than null.
+type commandResult struct {
+	Text  string
+	Value any
+}
+
+// registerQuery adds a command that reports rather than acts, like /peers,
+// with its result going through out.Result.
+func (r *repl) registerQuery(name, args, help string, nargs func(int) bool, query func(args []string, rest string) (commandResult, error)) {
+	r.register(name, args, help, nargs, func(args []string, rest string) error {
+		res, err := query(args, rest)
+		if err != nil {
+			return err
+		}
+		out.Result(name, res.Text, res.Value)
+		return nil
+	})
+}
+
+// orEmpty is s, or an empty slice for nil, so it marshals as [].
+func orEmpty[T any](s []T) []T {
+	if s == nil {
+		return []T{}
+	}
+	return s
+}
+
+func exactly(n int) func(int) bool { return func(got int) bool { return got == n } }
+func atLeast(n int) func(int) bool { return func(got int) bool { return got >= n } }
+func atMost(n int) func(int) bool  { return func(got int) bool { return got <= n } }
+
+// dispatch runs line: a /command, "exit", or otherwise a chat message to
+// send. It returns errExit when the user wants to leave, and an error
+// wrapping errUsage when a command got the wrong arguments.
+func (r *repl) dispatch(line string) error {
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" {
+		return nil
+	}
+	if trimmed == "exit" {
+		return errExit
+	}
+	if !strings.HasPrefix(trimmed, "/") {
+		send := r.node.Send
+		if r.focus != "" {
+			send = func(body string) error { return r.node.SendTo(body, r.focus) }
+		}
+		if err := send(line); err != nil {
+			return fmt.Errorf("failed to send: %w", err)
+		}
+		return nil
+	}
+
+	fields := strings.Fields(trimmed)
+	c, ok := r.byName[fields[0]]
+	if !ok {
+		return fmt.Errorf("%w: %s", errUnknownCommand, fields[0])
+	}
+	args := fields[1:]
+	if c.nargs != nil && !c.nargs(len(args)) {
+		return fmt.Errorf("%w: %s %s", errUsage, c.name, c.args)
+	}
+	rest := strings.TrimSpace(strings.TrimPrefix(trimmed, c.name))
+	return c.run(args, rest)
+}
+
+// run reads lines from in and dispatches them until "exit", the end of
+// input or the REPL's context ending. afterRead, if set, is called after every read.
+func (r *repl) run(in inputSource, afterRead func()) {
+	for {
+		line, err := readInput(r.ctx, in, r.prompt())
+		if afterRead != nil {
+			afterRead()
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) && r.ctx.Err() == nil {
+				out.Error("Failed to read input", err)
+			}
+			return
+		}
+		err = r.dispatch(line)
+		if errors.Is(err, errExit) {
+			return
+		}
+		report(err)
+	}
+}
+
+// complete returns what the last word of line could be completed to:
+// command names while typing the first word of a command, and saved
+// aliases for a word starting with "@".
+func (r *repl) complete(line string) []string {
+	var candidates []string
+	word := line[strings.LastIndexByte(line, ' ')+1:]
+	switch {
+	case strings.HasPrefix(line, "/") && !strings.Contains(line, " "):
+		for _, c := range r.commands {
+			candidates = append(candidates, c.name)
+		}
+	case strings.HasPrefix(word, "@"):
+		for _, e := range r.node.Book() {
+			candidates = append(candidates, "@"+e.Alias)
+		}
+	}
+	return candidates
+}
+
+// focusOn sends plain lines to id from now on, opening a conversation
+// with it if there wasn't one.
+func (r *repl) focusOn(id peer.ID) {
+	if !slices.Contains(r.conversations, id) {
+		r.conversations = append(r.conversations, id)
+	}
+	r.focus, r.focusName = id, peerName(id)
+	out.Printf("🎯 Messages now go only to %s (/unfocus to send to everyone)\n", r.focusName)
+}
+
+// formatConversations lists everyone and each open conversation, marking
+// the one lines go to.
+func (r *repl) formatConversations() string {
+	mark := func(current bool) string {
+		if current {
+			return "▶"
+		}
+		return " "
+	}
+	lines := []string{mark(r.focus == "") + " all (everyone)"}
+	for _, id := range r.conversations {
+		line := mark(id == r.focus) + " " + peerName(id)
+		if r.node.host.Network().Connectedness(id) != network.Connected {
+			line += " (offline)"
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// prompt is what the REPL asks for input with, naming the focused peer if
+// there is one.
+func (r *repl) prompt() string {
+	if r.focus != "" {
+		return fmt.Sprintf("✏️ Message to %s (or /unfocus): ", r.focusName)
+	}
+	return "✏️ Enter message (or /help): "
+}
+
+// help renders every command with its arguments and description.
+func (r *repl) help() string {
+	var b strings.Builder
+	b.WriteString("📖 Commands:\n")
+	tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	for _, c := range r.commands {
+		fmt.Fprintf(tw, "  %s\t%s\n", strings.TrimSpace(c.name+" "+c.args), c.help)
+	}
+	fmt.Fprintf(tw, "  exit\tQuit\n")
+	tw.Flush()
+	b.WriteString("Anything else is sent as a chat message.")
+	return b.String()
+}
+
+// report shows the outcome of dispatch to the user.
+func report(err error) {
+	var connErr *ConnectError
+	switch {
+	case err == nil:
+	case errors.Is(err, errUsage):
+		out.Println("⚠️ Usage:", strings.TrimPrefix(err.Error(), errUsage.Error()+": "))
+	case errors.Is(err, errUnknownCommand), errors.Is(err, errNotInRoom), errors.Is(err, errNotFocused), errors.Is(err, errNoSuchPeer), errors.Is(err, errAmbiguousMessage):
+		out.Println("⚠️", err)
+	case errors.Is(err, ErrNoActivePeer):
+		out.Println("⚠️ No peer connected.")
+	case errors.As(err, &connErr):
+		out.Error("Failed to connect to "+connErr.Addr, connErr.Err)
+	default:
+		out.Error("", err)
+	}
+}
+
+func (r *repl) registerCommands() {
+	n := r.node
+	r.register("/help", "", "List commands", exactly(0), func([]string, string) error {
+		out.Println(r.help())
+		return nil
+	})
+	r.register("/connect", "<multiaddr|@alias>", "Dial a peer and chat with it", exactly(1), func(args []string, _ string) error {
+		return n.Connect(args[0])
+	})
+	r.register("/find", "<peerID>", "Look a peer up in the DHT and connect to it", exactly(1), func(args []string, _ string) error {
+		info, err := n.FindPeer(args[0])
+		if err != nil {
+			return fmt.Errorf("failed to find peer: %w", err)
+		}
+		out.Printf("🔎 Found %s at %d address(es):\n", peerName(info.ID), len(info.Addrs))
+		for _, addr := range info.Addrs {
+			out.Println("  ", addr)
+		}
+		return n.Connect("/p2p/" + info.ID.String())
+	})
+	r.register("/dm", "<peerID|@alias|n> [message]", "Send a message to one peer (n from /peers), or send every line to it until /unfocus", atLeast(1), func(args []string, rest string) error {
+		id, err := n.ResolvePeer(args[0])
+		if err != nil {
+			return err
+		}
+		if body := strings.TrimSpace(strings.TrimPrefix(rest, args[0])); body != "" {
+			if err := n.SendTo(body, id); err != nil {
+				return fmt.Errorf("failed to send: %w", err)
+			}
+			return nil
+		}
+		r.focusOn(id)
+		return nil
+	})
+	r.register("/reply", "<msgID> <message>", "Reply to a message, by the ID /history shows or the start of it", atLeast(2), func(args []string, rest string) error {
+		id, err := n.history.ResolveID(args[0])
+		if err != nil {
+			return err
+		}
+		body := strings.TrimSpace(strings.TrimPrefix(rest, args[0]))
+		if r.focus != "" {
+			err = n.Reply(id, body, r.focus)
+		} else {
+			err = n.Reply(id, body)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to send: %w", err)
+		}
+		return nil
+	})
+	r.register("/to", "[peerID|@alias|n|all]", "Switch which conversation lines go to, all for everyone; with nothing, list the open ones", atMost(1), func(args []string, _ string) error {
+		if len(args) == 0 {
+			out.Println(r.formatConversations())
+			return nil
+		}
+		if args[0] == "all" {
+			if r.focus != "" {
+				out.Printf("🎯 No longer focused on %s; messages go to everyone\n", r.focusName)
+			}
+			r.focus, r.focusName = "", ""
+			return nil
+		}
+		id, err := n.ResolvePeer(args[0])
+		if err != nil {
+			return err
+		}
+		r.focusOn(id)
+		return nil
+	})
+	r.register("/unfocus", "", "Send messages to everyone again after /dm", exactly(0), func([]string, string) error {
+		if r.focus == "" {
+			return errNotFocused
+		}
+		out.Printf("🎯 No longer focused on %s; messages go to everyone\n", r.focusName)
+		r.focus, r.focusName = "", ""
+		return nil
+	})
+	r.register("/msg", "<alias|peerID|n> <message>", "Send one message to one peer", atLeast(2), func(args []string, rest string) error {
+		id, err := n.ResolvePeer(args[0])
+		if err != nil {
+			return err
+		}
+		if err := n.SendTo(strings.TrimSpace(strings.TrimPrefix(rest, args[0])), id); err != nil {
+			return fmt.Errorf("failed to send: %w", err)
+		}
+		return nil
+	})
+	saveAlias := func(args []string, _ string) error {
+		if err := n.SaveAlias(args[0], args[1]); err != nil {
+			return fmt.Errorf("failed to save alias: %w", err)
+		}
+		out.Printf("📒 Saved @%s; use it with /msg %s or /connect @%s\n", args[0], args[0], args[0])
+		return nil
+	}
+	r.register("/alias", "<name> <peerID|multiaddr>", "Save a peer in the address book under name", exactly(2), saveAlias)
+	r.register("/save", "<name> <peerID|multiaddr>", "Same as /alias", exactly(2), saveAlias)
+	r.registerQuery("/book", "", "List the address book", exactly(0), func([]string, string) (commandResult, error) {
+		book := n.Book()
+		return commandResult{formatBook(book), orEmpty(book)}, nil
+	})
+	r.register("/nick", "<name>", "Set the name peers see", atLeast(1), func(_ []string, rest string) error {
+		name := n.SetNick(rest)
+		if name == "" {
+			return fmt.Errorf("%w: /nick <name>", errUsage)
+		}
+		out.Println("🏷️ Nickname set to", name)
+		return nil
+	})
+	r.registerQuery("/history", "[peerID|@alias] [n]", "Show the last n messages (default 20), or only those with one peer", atMost(2), func(args []string, _ string) (commandResult, error) {
+		count := 20
+		if len(args) > 0 {
+			if v, err := strconv.Atoi(args[len(args)-1]); err == nil && v > 0 {
+				count = v
+				args = args[:len(args)-1]
+			}
+		}
+		var lines []string
+		if len(args) == 0 {
+			msgs := n.history.Recent(count)
+			for _, m := range msgs {
+				lines = append(lines, formatHistoryLine(m)+readMark(m, ""))
+			}
+			return commandResult{strings.Join(lines, "\n"), orEmpty(msgs)}, nil
+		}
+		id, err := n.ResolvePeer(args[0])
+		if err != nil {
+			return commandResult{}, err
+		}
+		msgs := n.history.With(id, count)
+		for _, m := range msgs {
+			arrow := "←"
+			if m.Direction == directionSent {
+				arrow = "→"
+			}
+			lines = append(lines, arrow+" "+formatHistoryLine(m)+readMark(m, id))
+		}
+		return commandResult{strings.Join(lines, "\n"), orEmpty(msgs)}, nil
+	})
+	r.register("/channel", "[name]", "Switch direct chat to a channel, or list channels", atMost(1), func(args []string, _ string) error {
+		if len(args) == 0 {
+			out.Printf("📺 Sending to #%s; joined: %s\n", cmp.Or(n.Channel(), defaultChannel), strings.Join(append([]string{defaultChannel}, n.Channels()...), ", "))
+			return nil
+		}
+		if err := n.JoinChannel(args[0]); err != nil {
+			return fmt.Errorf("failed to join channel: %w", err)
+		}
+		out.Printf("📺 Messages now go to channel #%s\n", args[0])
+		return nil
+	})
+	r.register("/part", "<channel>", "Leave a channel", exactly(1), func(args []string, _ string) error {
+		if err := n.LeaveChannel(args[0]); err != nil {
+			return fmt.Errorf("failed to leave channel: %w", err)
+		}
+		out.Printf("📺 Left channel #%s; sending to #%s\n", args[0], cmp.Or(n.Channel(), defaultChannel))
+		return nil
+	})
+	r.register("/join", "<topic>", "Join a gossipsub room; messages go to the room", exactly(1), func(args []string, _ string) error {
+		if err := n.Join(args[0]); err != nil {
+			return fmt.Errorf("failed to join room: %w", err)
+		}
+		out.Printf("🚪 Joined room #%s; messages up to %s now go to the room (/leave for direct chat)\n", args[0], formatBytes(int64(roomMaxBytes())))
+		return nil
+	})
+	r.register("/leave", "", "Leave the room and go back to direct chat", exactly(0), func([]string, string) error {
+		name := n.Room()
+		if name == "" {
+			return errNotInRoom
+		}
+		if err := n.Leave(); err != nil {
+			return fmt.Errorf("failed to leave room: %w", err)
+		}
+		out.Printf("🚪 Left room #%s\n", name)
+		return nil
+	})
+	r.register("/send", "[peerID|@alias|n] <path>", "Send a file, to the /dm peer if none is named", atLeast(1), func(args []string, rest string) error {
+		id, path := r.focus, strings.TrimSpace(rest)
+		// With a focus the first word may just be part of the path
+		if len(args) > 1 {
+			if target, err := n.ResolvePeer(args[0]); err == nil {
+				id, path = target, strings.TrimSpace(strings.TrimPrefix(rest, args[0]))
+			} else if r.focus == "" {
+				return err
+			}
+		}
+		if id == "" {
+			return fmt.Errorf("%w: name the peer to send to, or /dm one first", errNotFocused)
+		}
+		hdr, err := n.SendFile(id, path)
+		if err != nil {
+			return fmt.Errorf("failed to send file: %w", err)
+		}
+		out.Printf("📤 Sent %s (%s, verified by peer)\n", hdr.Name, formatBytes(hdr.Size))
+		return nil
+	})
+	r.register("/ping", "<peerID> [count]", "Measure round-trip time to a peer", func(got int) bool { return got == 1 || got == 2 }, func(args []string, _ string) error {
+		count := defaultPingCount
+		if len(args) > 1 {
+			if v, err := strconv.Atoi(args[1]); err == nil && v > 0 {
+				count = v
+			}
+		}
+		printPing(r.ctx, n.host, args[0], count)
+		return nil
+	})
+	r.register("/nat", "", "Show whether peers can reach us directly", exactly(0), func([]string, string) error {
+		printNAT(n.host, r.relaysConfigured)
+		return nil
+	})
+	r.registerQuery("/events", "[n]", "Show the last n connection events (default 20)", atMost(1), func(args []string, _ string) (commandResult, error) {
+		count := 20
+		if len(args) > 0 {
+			if v, err := strconv.Atoi(args[0]); err == nil && v > 0 {
+				count = v
+			}
+		}
+		events := n.events.Recent(count)
+		return commandResult{formatEvents(events), orEmpty(events)}, nil
+	})
+	r.registerQuery("/whoami", "", "Show our peer ID, shareable addresses and reachability", exactly(0), func([]string, string) (commandResult, error) {
+		info := n.Info()
+		return commandResult{formatNodeInfo(info), info}, nil
+	})
+	r.registerQuery("/peers", "", "List known peers and their status", exactly(0), func([]string, string) (commandResult, error) {
+		peers := n.Peers()
+		return commandResult{formatPeers(peers), orEmpty(peers)}, nil
+	})
+	r.registerQuery("/traffic", "", "Show bytes sent to and received from each peer, and the send limit", exactly(0), func([]string, string) (commandResult, error) {
+		traffic := n.Traffic()
+		return commandResult{formatTraffic(traffic, n.cfg.PeerRate), orEmpty(traffic)}, nil
+	})
+	r.registerQuery("/who", "", "List saved contacts and online peers, and who's reachable", exactly(0), func([]string, string) (commandResult, error) {
+		who := n.Who()
+		return commandResult{formatWho(who, time.Now()), orEmpty(who)}, nil
+	})
+	r.register("/protocols", "[peerID]", "List protocols we, or a peer, speak", atMost(1), func(args []string, _ string) error {
+		target := ""
+		if len(args) > 0 {
+			target = args[0]
+		}
+		printProtocols(n.host, target)
+		return nil
+	})
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	network "github.com/libp2p/go-libp2p/core/network"
+)
+
+func TestDispatchKnownCommand(t *testing.T) {
+	useJSONOutput(t)
+	n := newTestNode(t, "alice")
+	r := newREPL(context.Background(), n, false)
+
+	if err := r.dispatch("/nick  Alice Liddell "); err != nil {
+		t.Fatalf("Expected /nick to succeed, got %v", err)
+	}
+	if got := n.Nick(); got != "Alice Liddell" {
+		t.Errorf("Expected nick %q, got %q", "Alice Liddell", got)
+	}
+	if err := r.dispatch("/help"); err != nil {
+		t.Fatalf("Expected /help to succeed, got %v", err)
+	}
+	if help := r.help(); !strings.Contains(help, "/send [peerID|@alias|n] <path>") {
+		t.Errorf("Expected /help to list /send with its usage, got %s", help)
+	}
+}
+
+func TestDispatchUnknownCommand(t *testing.T) {
+	n := newTestNode(t, "alice")
+	r := newREPL(context.Background(), n, false)
+
+	err := r.dispatch("/frobnicate now")
+	if !errors.Is(err, errUnknownCommand) {
+		t.Fatalf("Expected errUnknownCommand, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "unknown command, try /help") {
+		t.Errorf("Expected the error to point at /help, got %q", err)
+	}
+}
+
+func TestDispatchUsageAndExit(t *testing.T) {
+	n := newTestNode(t, "alice")
+	r := newREPL(context.Background(), n, false)
+
+	if err := r.dispatch("/connect"); !errors.Is(err, errUsage) || !strings.Contains(err.Error(), "/connect <multiaddr|@alias>") {
+		t.Errorf("Expected a /connect usage error, got %v", err)
+	}
+	if err := r.dispatch("  exit "); !errors.Is(err, errExit) {
+		t.Errorf("Expected errExit, got %v", err)
+	}
+	if err := r.dispatch("hello"); !errors.Is(err, ErrNoActivePeer) {
+		t.Errorf("Expected chat with no peers to fail with ErrNoActivePeer, got %v", err)
+	}
+}
+
+func TestPeersCommandEmitsJSONResult(t *testing.T) {
+	buf := useJSONOutput(t)
+	alice, bob, _ := newTestPair(t)
+	r := newREPL(context.Background(), alice, false)
+
+	if err := r.dispatch("/peers"); err != nil {
+		t.Fatalf("Expected /peers to succeed, got %v", err)
+	}
+	evs := events(t, buf)
+	ev := evs[len(evs)-1]
+	if ev["type"] != "result" || ev["command"] != "/peers" {
+		t.Fatalf("Expected a /peers result event, got %v", ev)
+	}
+	peers, ok := ev["result"].([]any)
+	if !ok || len(peers) != 1 {
+		t.Fatalf("Expected a list of one peer, got %v", ev["result"])
+	}
+	p, _ := peers[0].(map[string]any)
+	if p["id"] != bob.host.ID().String() || p["state"] == "" {
+		t.Errorf("Expected bob's ID and state, got %v", p)
+	}
+}
+
+func TestDMReachesOnlyTheTarget(t *testing.T) {
+	useJSONOutput(t)
+	alice, bob, _ := newTestPair(t)
+	carol := newTestNode(t, "carol")
+	if err := alice.Connect(nodeAddr(carol)); err != nil {
+		t.Fatalf("Failed to connect alice to carol: %v", err)
+	}
+	alice.book, _ = loadAddressBook(filepath.Join(t.TempDir(), "peers.json"))
+	if err := alice.SaveAlias("carol", nodeAddr(carol)); err != nil {
+		t.Fatalf("Failed to save alias: %v", err)
+	}
+	r := newREPL(context.Background(), alice, false)
+	received := func(n *Node, body string) bool {
+		for _, m := range n.history.Recent(-1) {
+			if m.Body == body {
+				return true
+			}
+		}
+		return false
+	}
+
+	if err := r.dispatch("/dm " + bob.host.ID().String()); err != nil {
+		t.Fatalf("Expected /dm to focus on bob, got %v", err)
+	}
+	if !strings.Contains(r.prompt(), shortID(bob.host.ID())) {
+		t.Errorf("Expected the prompt to name bob, got %q", r.prompt())
+	}
+	if err := r.dispatch("just for bob"); err != nil {
+		t.Fatalf("Failed to send focused message: %v", err)
+	}
+	if err := r.dispatch("/dm @carol just for carol"); err != nil {
+		t.Fatalf("Failed to send /dm by alias: %v", err)
+	}
+	if err := r.dispatch("/msg carol also for carol"); err != nil {
+		t.Fatalf("Failed to send /msg by bare alias: %v", err)
+	}
+	if err := r.dispatch("/unfocus"); err != nil {
+		t.Fatalf("Expected /unfocus to succeed, got %v", err)
+	}
+	if err := r.dispatch("/unfocus"); !errors.Is(err, errNotFocused) {
+		t.Errorf("Expected errNotFocused when not focused, got %v", err)
+	}
+	if err := r.dispatch("for everyone"); err != nil {
+		t.Fatalf("Failed to broadcast: %v", err)
+	}
+
+	// Messages to each peer arrive in order, so once the broadcast is in
+	// the direct messages have been delivered or weren't sent there
+	waitFor(t, "the broadcast to reach bob", func() bool { return received(bob, "for everyone") })
+	waitFor(t, "the broadcast to reach carol", func() bool { return received(carol, "for everyone") })
+	if !received(bob, "just for bob") || received(carol, "just for bob") {
+		t.Error("Expected the focused message to reach bob alone")
+	}
+	if !received(carol, "just for carol") || received(bob, "just for carol") {
+		t.Error("Expected the /dm to reach carol alone")
+	}
+	if !received(carol, "also for carol") || received(bob, "also for carol") {
+		t.Error("Expected the /msg to reach carol alone")
+	}
+
+	if err := r.dispatch("/dm nobody"); !errors.Is(err, ErrInvalidMultiaddr) {
+		t.Errorf("Expected ErrInvalidMultiaddr for a bad target, got %v", err)
+	}
+	if err := r.dispatch("/dm @nobody hi"); !errors.Is(err, errUnknownAlias) {
+		t.Errorf("Expected errUnknownAlias for an unsaved alias, got %v", err)
+	}
+}
+
+func TestToSwitchesConversations(t *testing.T) {
+	useJSONOutput(t)
+	alice, bob, _ := newTestPair(t)
+	carol := newTestPeerID(t)
+	r := newREPL(context.Background(), alice, false)
+
+	for _, target := range []string{bob.host.ID().String(), carol.String()} {
+		if err := r.dispatch("/to " + target); err != nil {
+			t.Fatalf("Expected /to to switch to %s, got %v", target, err)
+		}
+	}
+	if r.focus != carol {
+		t.Errorf("Expected lines to go to carol, got %s", r.focus)
+	}
+	want := "  all (everyone)\n  " + shortID(bob.host.ID()) + "\n▶ " + shortID(carol) + " (offline)"
+	if got := r.formatConversations(); got != want {
+		t.Errorf("Expected conversations\n%s\ngot\n%s", want, got)
+	}
+
+	// Switching back doesn't open the conversation twice
+	if err := r.dispatch("/to " + bob.host.ID().String()); err != nil || r.focus != bob.host.ID() || len(r.conversations) != 2 {
+		t.Errorf("Expected to switch back to bob, got %s with %d conversations (%v)", r.focus, len(r.conversations), err)
+	}
+	if err := r.dispatch("/to all"); err != nil || r.focus != "" {
+		t.Errorf("Expected /to all to send to everyone, got %s (%v)", r.focus, err)
+	}
+}
+
+func TestCompleteCommandNames(t *testing.T) {
+	n := newTestNode(t, "alice")
+	n.book, _ = loadAddressBook(filepath.Join(t.TempDir(), "peers.json"))
+	if err := n.SaveAlias("bob", "/ip4/127.0.0.1/tcp/4001/p2p/"+newTestPeerID(t).String()); err != nil {
+		t.Fatalf("Failed to save alias: %v", err)
+	}
+	r := newREPL(context.Background(), n, false)
+
+	names := r.complete("/")
+	if len(names) != len(r.commands) || !slices.Contains(names, "/whoami") {
+		t.Errorf("Expected every registered command, got %v", names)
+	}
+	if got, _, _ := completeLine("/unf", 4, r.complete("/unf")); got != "/unfocus " {
+		t.Errorf("Expected /unf to complete to /unfocus, got %q", got)
+	}
+	if got := r.complete("/dm @"); !slices.Equal(got, []string{"@bob"}) {
+		t.Errorf("Expected the saved alias, got %v", got)
+	}
+	if got := r.complete("hello /"); got != nil {
+		t.Errorf("Expected no completions inside a chat message, got %v", got)
+	}
+}
+
+// scriptedInput is an inputSource that replays lines, then reports EOF.
+type scriptedInput struct {
+	lines   []string
+	prompts []string
+}
+
+func (s *scriptedInput) ReadLine(prompt string) (string, error) {
+	s.prompts = append(s.prompts, prompt)
+	if len(s.lines) == 0 {
+		return "", io.EOF
+	}
+	line := s.lines[0]
+	s.lines = s.lines[1:]
+	return line, nil
+}
+
+func TestSendFileToFocusedPeer(t *testing.T) {
+	useJSONOutput(t)
+	alice, bob, _ := newTestPair(t)
+	dir := t.TempDir()
+	bob.host.SetStreamHandler(fileProtocol, newFileHandler(dir, 1<<20, nil))
+	r := newREPL(context.Background(), alice, false)
+	src := filepath.Join(t.TempDir(), "notes.txt")
+	if err := os.WriteFile(src, []byte("see you at 6"), 0o600); err != nil {
+		t.Fatalf("Failed to write source file: %v", err)
+	}
+
+	if err := r.dispatch("/send " + src); !errors.Is(err, errNotFocused) {
+		t.Errorf("Expected errNotFocused without a peer, got %v", err)
+	}
+	if err := r.dispatch("/dm " + bob.host.ID().String()); err != nil {
+		t.Fatalf("Expected /dm to focus on bob, got %v", err)
+	}
+	if err := r.dispatch("/send " + src); err != nil {
+		t.Fatalf("Expected /send to go to the focused peer, got %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(dir, "notes.txt")); err != nil || string(got) != "see you at 6" {
+		t.Errorf("Expected bob to receive the file, got %q, %v", got, err)
+	}
+}
+
+func TestHistoryWithPeer(t *testing.T) {
+	buf := useJSONOutput(t)
+	alice, bob, _ := newTestPair(t)
+	carol := newTestNode(t, "carol")
+	if err := alice.Connect(nodeAddr(carol)); err != nil {
+		t.Fatalf("Failed to connect alice to carol: %v", err)
+	}
+	r := newREPL(context.Background(), alice, false)
+	if err := r.dispatch("/dm " + bob.host.ID().String() + " just for bob"); err != nil {
+		t.Fatalf("Failed to send /dm: %v", err)
+	}
+	if err := r.dispatch("/dm " + carol.host.ID().String() + " just for carol"); err != nil {
+		t.Fatalf("Failed to send /dm: %v", err)
+	}
+
+	if err := r.dispatch("/history " + bob.host.ID().String() + " 5"); err != nil {
+		t.Fatalf("Expected /history with a peer to succeed, got %v", err)
+	}
+	evs := events(t, buf)
+	msgs, _ := evs[len(evs)-1]["result"].([]any)
+	if len(msgs) != 1 {
+		t.Fatalf("Expected only the message to bob, got %v", evs[len(evs)-1])
+	}
+	if m, _ := msgs[0].(map[string]any); m["body"] != "just for bob" || m["direction"] != "sent" {
+		t.Errorf("Expected the message sent to bob, got %v", m)
+	}
+	if err := r.dispatch("/history @nobody"); err == nil {
+		t.Error("Expected an unknown peer to fail")
+	}
+}
+
+func TestREPLRunsScriptedInput(t *testing.T) {
+	useJSONOutput(t)
+	n := newTestNode(t, "alice")
+	r := newREPL(context.Background(), n, false)
+	bob := newTestPeerID(t)
+	in := &scriptedInput{lines: []string{"/nick Al", "/dm " + bob.String(), "/unfocus", "exit", "/nick never"}}
+	reads := 0
+
+	r.run(in, func() { reads++ })
+	if n.Nick() != "Al" {
+		t.Errorf("Expected the scripted /nick to run, got %q", n.Nick())
+	}
+	if reads != 4 || len(in.lines) != 1 {
+		t.Errorf("Expected run to stop at exit after 4 reads, got %d with %v left", reads, in.lines)
+	}
+	if !strings.Contains(in.prompts[2], shortID(bob)) {
+		t.Errorf("Expected the prompt to show the focused peer, got %q", in.prompts[2])
+	}
+
+	// Running out of input ends the loop too
+	r.run(&scriptedInput{}, nil)
+}
+
+// blockedInput is an inputSource that never has a line, like a terminal
+// nobody types at.
+type blockedInput struct{}
+
+func (blockedInput) ReadLine(string) (string, error) { select {} }
+
+func TestREPLStopsWhenContextEnds(t *testing.T) {
+	buf := useJSONOutput(t)
+	n := newTestNode(t, "alice")
+	ctx, cancel := context.WithCancel(context.Background())
+	r := newREPL(ctx, n, false)
+
+	done := make(chan struct{})
+	go func() {
+		r.run(blockedInput{}, nil)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected run to return once its context ended")
+	}
+	if strings.Contains(buf.String(), "Failed to read input") {
+		t.Errorf("Expected no read error on the way out, got %s", buf.String())
+	}
+}
+
+func TestFindLooksUpAndConnects(t *testing.T) {
+	useJSONOutput(t)
+	alice := newTestNode(t, "alice")
+	bob := newTestNode(t, "bob")
+	r := newREPL(context.Background(), alice, false)
+
+	if err := r.dispatch("/find " + bob.host.ID().String()); !errors.Is(err, errDHTOff) {
+		t.Errorf("Expected errDHTOff without a DHT, got %v", err)
+	}
+
+	alice.mu.Lock()
+	alice.router = stubRouter{bob.host.ID(): {ID: bob.host.ID(), Addrs: bob.host.Addrs()}}
+	alice.mu.Unlock()
+	if err := r.dispatch("/find " + newTestPeerID(t).String()); !errors.Is(err, ErrNoAddresses) {
+		t.Errorf("Expected ErrNoAddresses for a peer the DHT doesn't know, got %v", err)
+	}
+	if err := r.dispatch("/find " + bob.host.ID().String()); err != nil {
+		t.Fatalf("Expected /find to connect, got %v", err)
+	}
+	if alice.host.Network().Connectedness(bob.host.ID()) != network.Connected {
+		t.Error("Expected alice to be connected to bob")
+	}
+	if list := alice.registry.List(); len(list) != 1 || list[0].ID != bob.host.ID() {
+		t.Errorf("Expected bob to be registered, got %v", list)
+	}
+}
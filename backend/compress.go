@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+)
+
+// compressThreshold is the body size above which messages are gzipped on
+// the wire. Zero turns compression off. Set from -compress-threshold.
+var compressThreshold = 1024
+
+// maxBodyBytes caps a message body once decompressed, so a small gzip frame
+// can't expand into gigabytes.
+var maxBodyBytes = 1 << 20
+
+const gzipEncoding = "gzip"
+
+// encodeBody gzips b when it's over compressThreshold and gzip makes it
+// smaller, returning the bytes to send and their encoding ("" for raw).
+func encodeBody(b []byte) (data []byte, encoding string) {
+	if compressThreshold <= 0 || len(b) <= compressThreshold {
+		return b, ""
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(b); err != nil {
+		return b, ""
+	}
+	if err := zw.Close(); err != nil || buf.Len() >= len(b) {
+		return b, ""
+	}
+	return buf.Bytes(), gzipEncoding
+}
+
+// decodeBody reverses encodeBody. Bodies that decompress past maxBodyBytes
+// return ErrMessageTooLarge.
+func decodeBody(data []byte, encoding string) ([]byte, error) {
+	switch encoding {
+	case "":
+		return data, nil
+	case gzipEncoding:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		b, err := io.ReadAll(io.LimitReader(zr, int64(maxBodyBytes)+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(b) > maxBodyBytes {
+			return nil, fmt.Errorf("%w: body decompresses past %d bytes", ErrMessageTooLarge, maxBodyBytes)
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("unknown body encoding %q", encoding)
+	}
+}
+
+// compressMessage returns m as it goes on the wire: with a large body
+// gzipped and base64'd into Body, flagged by Encoding.
+func compressMessage(m ChatMessage) ChatMessage {
+	data, encoding := encodeBody([]byte(m.Body))
+	if encoding == "" {
+		return m
+	}
+	if body := base64.StdEncoding.EncodeToString(data); len(body) < len(m.Body) {
+		m.Body, m.Encoding = body, encoding
+	}
+	return m
+}
+
+// decompressMessage reverses compressMessage on a received message.
+func decompressMessage(m ChatMessage) (ChatMessage, error) {
+	if m.Encoding == "" {
+		return m, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(m.Body)
+	if err != nil {
+		return ChatMessage{}, fmt.Errorf("malformed %s body: %w", m.Encoding, err)
+	}
+	body, err := decodeBody(data, m.Encoding)
+	if err != nil {
+		return ChatMessage{}, err
+	}
+	m.Body, m.Encoding = string(body), ""
+	return m, nil
+}
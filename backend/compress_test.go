@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestEncodeBodyRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     []byte
+		encoding string
+	}{
+		{"small stays raw", []byte("hello"), ""},
+		{"large repetitive is gzipped", bytes.Repeat([]byte("long paste "), 500), gzipEncoding},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, encoding := encodeBody(tt.body)
+			if encoding != tt.encoding {
+				t.Fatalf("Expected encoding %q, got %q", tt.encoding, encoding)
+			}
+			if encoding != "" && len(data) >= len(tt.body) {
+				t.Errorf("Expected compression to shrink %d bytes, got %d", len(tt.body), len(data))
+			}
+			got, err := decodeBody(data, encoding)
+			if err != nil {
+				t.Fatalf("Failed to decode body: %v", err)
+			}
+			if !bytes.Equal(got, tt.body) {
+				t.Error("Expected the decoded body to match the original")
+			}
+		})
+	}
+}
+
+func TestDecodeBodyRejectsBomb(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(make([]byte, maxBodyBytes+1))
+	zw.Close()
+	if buf.Len() > maxMessageBytes {
+		t.Fatalf("Expected the bomb to fit in one frame, got %d bytes", buf.Len())
+	}
+
+	if _, err := decodeBody(buf.Bytes(), gzipEncoding); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("Expected ErrMessageTooLarge, got %v", err)
+	}
+	if _, err := decodeBody([]byte("not gzip"), gzipEncoding); err == nil {
+		t.Error("Expected corrupt gzip data to be rejected")
+	}
+	if _, err := decodeBody([]byte("x"), "br"); err == nil {
+		t.Error("Expected an unknown encoding to be rejected")
+	}
+}
+
+func TestCompressedMessageOnTheWire(t *testing.T) {
+	m := newChatMessage("", "alice", strings.Repeat("all work and no play ", 200))
+	var buf bytes.Buffer
+	if err := writeMessage(&buf, compressMessage(m)); err != nil {
+		t.Fatalf("Failed to write message: %v", err)
+	}
+	if !strings.Contains(buf.String(), `"encoding":"gzip"`) || buf.Len() > len(m.Body) {
+		t.Errorf("Expected a compressed envelope, got %d bytes", buf.Len())
+	}
+	if err := checkMessageSize(m); err != nil {
+		t.Errorf("Expected the compressed size to be checked, got %v", err)
+	}
+
+	got, err := readMessage(bufio.NewReader(&buf))
+	if err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	if got.Body != m.Body || got.Encoding != "" {
+		t.Error("Expected the body to arrive decompressed")
+	}
+
+	old := compressThreshold
+	compressThreshold = 0
+	defer func() { compressThreshold = old }()
+	if compressMessage(m).Encoding != "" {
+		t.Error("Expected a zero threshold to turn compression off")
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	"go.yaml.in/yaml/v2"
+)
+
+// appConfig is everything main runs with: the Node's Config plus the
+// settings that live outside the node.
+type appConfig struct {
+	Node            Config
+	LogLevel        string
+	LogJSON         bool
+	Output          string
+	To              string
+	HTTPAddr        string
+	MetricsAddr     string
+	Banner          string
+	AutoDisconnect  time.Duration
+	ExitOnIdle      bool
+	MaxMessageBytes int
+	CompressAbove   int
+	ShowQR          bool
+	ShowLocal       bool
+	ShowVersion     bool
+	Channel         string
+	TUI             bool
+}
+
+// envPrefix starts the environment variable for each flag: -ack-timeout is
+// ARTIVUS_ACK_TIMEOUT.
+const envPrefix = "ARTIVUS_"
+
+// loadConfig builds the configuration from defaults, then the -config file,
+// then the environment, then the command line, each overriding the one
+// before. The file is YAML (or JSON) keyed by flag name, e.g. "listen" or
+// "dht"; list settings may be YAML sequences instead of comma-separated
+// strings.
+func loadConfig(args []string) (appConfig, error) {
+	fs := flag.NewFlagSet("p2p-chat", flag.ContinueOnError)
+	showVersion := fs.Bool("version", false, "print build metadata and exit (see also: version -json)")
+	configPath := fs.String("config", "", "YAML or JSON settings file keyed by flag name; ARTIVUS_<FLAG> environment variables (e.g. ARTIVUS_LOG_LEVEL) and command-line flags override it")
+	peerRate := fs.Int("peer-rate", 0, "max outgoing bytes/sec per peer (0 = unlimited)")
+	inboundRate := fs.Float64("inbound-rate", defaultInboundRate, "max chat messages/sec accepted from each peer; extra ones are dropped (0 = unlimited)")
+	inboundBurst := fs.Int("inbound-burst", defaultInboundBurst, "chat messages a peer may send at once before -inbound-rate applies")
+	autoDisconnect := fs.Duration("auto-disconnect", 0, "disconnect all peers after this long without local input (0 = never)")
+	exitOnIdle := fs.Bool("exit-on-idle", false, "exit instead of idling once -auto-disconnect fires")
+	negotiationTimeout := fs.Duration("negotiation-timeout", 10*time.Second, "max time to negotiate the chat protocol on a new stream")
+	negotiationRetries := fs.Int("negotiation-retries", 1, "extra attempts after a negotiation timeout")
+	watchInterfaces := fs.Bool("watch-interfaces", false, "re-advertise addresses when network interfaces change")
+	motd := fs.String("motd", "", "message of the day (text or file) sent once to each peer that connects")
+	banner := fs.String("banner", "", "banner (text or file) shown at startup")
+	mdns := fs.Bool("mdns", true, "discover peers on the LAN via mDNS")
+	mdnsTag := fs.String("mdns-tag", "artivus-chat", "mDNS service tag for LAN discovery")
+	useDHT := fs.Bool("dht", false, "discover peers across networks via the Kademlia DHT")
+	bootstrap := fs.String("bootstrap", strings.Join(defaultBootstrapPeers(), ","), "comma-separated DHT bootstrap multiaddrs")
+	dhtMode := fs.String("dht-mode", "auto", "DHT mode: server answers other peers' queries, client only asks, auto serves once publicly reachable")
+	dhtNamespace := fs.String("dht-namespace", "artivus-chat", "DHT rendezvous namespace to advertise and search")
+	addressBook := fs.String("address-book", "", "file of peer aliases for /save and /connect @alias, empty to disable it (default <data-dir>/peers.json)")
+	historySize := fs.Int("history-size", defaultHistorySize, "number of messages kept for /history")
+	eventLogFile := fs.String("event-log", "", "append connection events to this JSON-lines file (empty keeps them in memory for /events only)")
+	historyFile := fs.String("history-file", "", "chat history database (BoltDB) reloaded at startup, also keeping messages queued for offline peers; empty to disable it (default <data-dir>/history.db)")
+	nick := fs.String("nick", "", "display name shown to peers (defaults to a short peer ID)")
+	compress := fs.Int("compress-threshold", compressThreshold, "gzip message bodies larger than this many bytes on the wire (0 = never)")
+	maxMsg := fs.Int("max-message-bytes", maxMessageBytes, "largest encoded chat message sent or accepted, in bytes")
+	downloads := fs.String("downloads", "", "directory for files received with /send, empty to refuse files (default <data-dir>/downloads)")
+	maxFileBytes := fs.Int64("max-file-bytes", defaultMaxFileBytes, "largest file sent or accepted, in bytes")
+	secure := fs.Bool("secure", false, "encrypt chat end to end, with a double ratchet where the peer supports it")
+	useQUIC := fs.Bool("quic", false, "use TCP and QUIC transports, listening on QUIC too, at the same port as each -listen TCP address")
+	tcpOnly := fs.Bool("tcp-only", false, "use only the TCP transport")
+	listen := fs.String("listen", "", "comma-separated multiaddrs to listen on, e.g. /ip4/0.0.0.0/tcp/4001 (default: libp2p defaults)")
+	httpAddr := fs.String("http", "", "serve the local HTTP/WebSocket API on this address, e.g. :8080 for 127.0.0.1:8080 (empty disables it)")
+	connLow := fs.Int("conn-low", defaultConnLow, "connections kept when trimming idle ones")
+	connHigh := fs.Int("conn-high", defaultConnHigh, "connections above which idle ones are trimmed down to -conn-low")
+	connGrace := fs.Duration("conn-grace", defaultConnGrace, "how long a new connection is exempt from trimming")
+	broadcastWorkers := fs.Int("broadcast-workers", defaultBroadcastWorkers, "peers a message is sent to concurrently")
+	queueSize := fs.Int("queue-size", defaultQueueSize, "messages held per offline peer until it reconnects (oldest dropped first)")
+	queueExpiry := fs.Duration("queue-expiry", defaultQueueExpiry, "drop messages queued for an offline peer after this long")
+	watchdog := fs.Duration("watchdog", 0, "check this often that the network host still accepts connections, and rebuild it with the same identity after 3 failed checks (0 disables it)")
+	heartbeat := fs.Duration("heartbeat", defaultHeartbeatInterval, "how often to tell connected peers we're alive; peers silent for 3 intervals show as stale")
+	sendTimeout := fs.Duration("send-timeout", defaultSendTimeout, "give up on a peer that reads nothing we send for this long")
+	ackTimeout := fs.Duration("ack-timeout", defaultAckTimeout, "how long to wait for peers to confirm a message before resending it")
+	retryExpiry := fs.Duration("retry-expiry", defaultRetryExpiry, "keep resending a message peers haven't confirmed for this long, then report it unacked")
+	allow := fs.String("allow", "", "comma-separated peer IDs (or files of them) that alone may connect")
+	plaintextPeers := fs.String("plaintext-peers", "", "comma-separated peer IDs (or files of them) to chat with unencrypted even with -secure")
+	devices := fs.String("devices", "", "comma-separated peer IDs (or files of them) of your other devices, each with its own identity, to mirror sent and received messages with")
+	block := fs.String("block", "", "comma-separated peer IDs (or files of them) that may never connect")
+	relays := fs.String("relays", "", "comma-separated relay multiaddrs (ending in /p2p/<ID>) to be reachable through when behind NAT (default: any connected peer offering relay service)")
+	metricsAddr := fs.String("metrics", "", "serve Prometheus metrics at /metrics on this address, e.g. :9090 (empty disables it)")
+	showLocal := fs.Bool("show-local", false, "also list loopback and link-local addresses when showing what to share")
+	showQR := fs.Bool("qr", false, "also print the shareable multiaddr as a QR code")
+	logLevel := fs.String("log-level", "info", "diagnostic log level: debug, info, warn or error")
+	to := fs.String("to", "", "peer multiaddr or @alias to chat with; with piped stdin, send each line to it and exit")
+	output := fs.String("output", "text", "user-facing output: text for the interactive REPL, json for one event object per line on stdout")
+	logJSON := fs.Bool("log-json", false, "write diagnostic logs as JSON lines")
+	identityPath := fs.String("identity", "", "path to the node's private key, created on first run (default <data-dir>/identity.key)")
+	ephemeral := fs.Bool("ephemeral-identity", false, "anonymous mode: a throwaway key kept only in memory, so a new peer ID every run, and no history file or address book")
+	newIdentity := fs.Bool("new-identity", false, "replace the identity with a new key, and so a new peer ID (the old key is kept as <identity>.old-<time>)")
+	dataDir := fs.String("data-dir", "", "directory for the identity, history, address book and downloads (default $ARTIVUS_HOME, else artivus in the user config directory)")
+	channel := fs.String("channel", "", "channel to chat on at startup instead of the default /chat/2.0.0; its protocol is /artivus/chat/<name>/1.0.0")
+	tui := fs.Bool("tui", false, "full-screen terminal UI: a scrolling message pane, a peer list and an input line")
+	if err := fs.Parse(args); err != nil {
+		return appConfig{}, err
+	}
+	if err := applyEnv(fs, os.LookupEnv); err != nil {
+		return appConfig{}, err
+	}
+	if *configPath != "" {
+		if err := applyConfigFile(fs, *configPath); err != nil {
+			return appConfig{}, err
+		}
+	}
+
+	// Paths not given live in the data directory; an explicit empty value
+	// still disables the feature
+	dataDirFlag = *dataDir
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	for _, p := range []struct {
+		flag  string
+		value *string
+		name  string
+	}{
+		{"identity", identityPath, "identity.key"},
+		{"history-file", historyFile, "history.db"},
+		{"address-book", addressBook, "peers.json"},
+		{"downloads", downloads, "downloads"},
+	} {
+		if !explicit[p.flag] {
+			*p.value = dataPath(p.name)
+		}
+	}
+
+	cfg := appConfig{
+		Node: Config{
+			IdentityPath:       *identityPath,
+			ListenAddrs:        splitList(*listen),
+			Nick:               *nick,
+			PeerRate:           *peerRate,
+			NegotiationTimeout: *negotiationTimeout,
+			NegotiationRetries: *negotiationRetries,
+			MOTD:               *motd,
+			MDNSTag:            *mdnsTag,
+			DHT:                *useDHT,
+			Bootstrap:          splitList(*bootstrap),
+			DHTNamespace:       *dhtNamespace,
+			WatchInterfaces:    *watchInterfaces,
+			HistorySize:        *historySize,
+			HistoryFile:        *historyFile,
+			AddressBook:        *addressBook,
+			DownloadsDir:       *downloads,
+			MaxFileBytes:       *maxFileBytes,
+			Secure:             *secure,
+			Relays:             splitList(*relays),
+			QueueSize:          *queueSize,
+			AckTimeout:         *ackTimeout,
+			SendTimeout:        *sendTimeout,
+			HeartbeatInterval:  *heartbeat,
+			Watchdog:           *watchdog,
+			InboundRate:        *inboundRate,
+			InboundBurst:       *inboundBurst,
+			QUIC:               *useQUIC,
+			TCPOnly:            *tcpOnly,
+			BroadcastWorkers:   *broadcastWorkers,
+			EventLogFile:       *eventLogFile,
+			ConnLow:            *connLow,
+			ConnHigh:           *connHigh,
+			ConnGrace:          *connGrace,
+			NewIdentity:        *newIdentity,
+			Ephemeral:          *ephemeral,
+			DHTMode:            *dhtMode,
+			RetryExpiry:        *retryExpiry,
+			QueueExpiry:        *queueExpiry,
+		},
+		LogLevel:        *logLevel,
+		LogJSON:         *logJSON,
+		Output:          *output,
+		To:              *to,
+		HTTPAddr:        *httpAddr,
+		MetricsAddr:     *metricsAddr,
+		Banner:          *banner,
+		AutoDisconnect:  *autoDisconnect,
+		ExitOnIdle:      *exitOnIdle,
+		MaxMessageBytes: *maxMsg,
+		CompressAbove:   *compress,
+		ShowQR:          *showQR,
+		ShowLocal:       *showLocal,
+		ShowVersion:     *showVersion,
+		Channel:         *channel,
+		TUI:             *tui,
+	}
+	if !*mdns {
+		cfg.Node.MDNSTag = ""
+	}
+
+	var errs []error
+	var err error
+	if cfg.Node.Allow, err = parsePeerList(splitList(*allow)); err != nil {
+		errs = append(errs, fmt.Errorf("invalid -allow: %w", err))
+	}
+	if cfg.Node.Block, err = parsePeerList(splitList(*block)); err != nil {
+		errs = append(errs, fmt.Errorf("invalid -block: %w", err))
+	}
+	if cfg.Node.Devices, err = parsePeerList(splitList(*devices)); err != nil {
+		errs = append(errs, fmt.Errorf("invalid -devices: %w", err))
+	}
+	if cfg.Node.PlaintextPeers, err = parsePeerList(splitList(*plaintextPeers)); err != nil {
+		errs = append(errs, fmt.Errorf("invalid -plaintext-peers: %w", err))
+	}
+	if *ephemeral {
+		// Anonymous mode saves nothing, so asking for a file contradicts it
+		for _, name := range []string{"identity", "new-identity", "history-file", "address-book"} {
+			if explicit[name] {
+				errs = append(errs, fmt.Errorf("invalid -ephemeral-identity: can't be used with -%s", name))
+			}
+		}
+	}
+	errs = append(errs, cfg.validate()...)
+	return cfg, errors.Join(errs...)
+}
+
+// envName is the environment variable for the flag name.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// applyEnv sets every flag with a variable in lookup that wasn't given on
+// the command line. Running before the config file, it leaves the file only
+// what neither set.
+func applyEnv(fs *flag.FlagSet, lookup func(string) (string, bool)) error {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := lookup(envName(f.Name))
+		if !ok || explicit[f.Name] {
+			return
+		}
+		if err := fs.Set(f.Name, value); err != nil {
+			errs = append(errs, fmt.Errorf("$%s: %w", envName(f.Name), err))
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// applyConfigFile sets every flag named in the file at path that wasn't
+// given on the command line.
+func applyConfigFile(fs *flag.FlagSet, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	var settings map[string]interface{}
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		if key == "config" || fs.Lookup(key) == nil {
+			return fmt.Errorf("config file %s: unknown setting %q", path, key)
+		}
+		if explicit[key] {
+			continue
+		}
+		if err := fs.Set(key, configValue(settings[key])); err != nil {
+			return fmt.Errorf("config file %s: %s: %w", path, key, err)
+		}
+	}
+	return nil
+}
+
+// configValue renders a YAML value the way it would be typed as a flag.
+func configValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i, item := range v {
+			parts[i] = fmt.Sprint(item)
+		}
+		return strings.Join(parts, ",")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// validate reports every setting that can't work, named by its flag.
+func (c appConfig) validate() []error {
+	var errs []error
+	bad := func(name string, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("invalid -%s: %s", name, fmt.Sprintf(format, args...)))
+	}
+
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		bad("log-level", "%q (want debug, info, warn or error)", c.LogLevel)
+	}
+	if c.Output != "text" && c.Output != "json" {
+		bad("output", "%q (want text or json)", c.Output)
+	} else if c.TUI && c.Output == "json" {
+		bad("tui", "can't be used with -output json")
+	}
+	if _, err := buildListenOptions(c.Node.ListenAddrs); err != nil {
+		bad("listen", "%v", err)
+	}
+	if _, _, err := buildTransportOptions(c.Node); err != nil {
+		bad("tcp-only", "%v", err)
+	}
+	if _, err := buildNATOptions(c.Node.Relays, nil); err != nil {
+		bad("relays", "%v", err)
+	}
+	if _, ok := dhtModes[c.Node.DHTMode]; !ok {
+		bad("dht-mode", "%q (want auto, client or server)", c.Node.DHTMode)
+	}
+	if c.Node.DHT {
+		for _, addr := range c.Node.Bootstrap {
+			if _, err := peer.AddrInfoFromString(addr); err != nil {
+				bad("bootstrap", "%q: %v", addr, err)
+			}
+		}
+	}
+	for _, srv := range [][2]string{{"http", c.HTTPAddr}, {"metrics", c.MetricsAddr}} {
+		if _, _, err := net.SplitHostPort(srv[1]); srv[1] != "" && err != nil {
+			bad(srv[0], "%q is not host:port", srv[1])
+		}
+	}
+	if c.Node.IdentityPath == "" && !c.Node.Ephemeral {
+		bad("identity", "path is empty")
+	}
+	if c.Channel != "" {
+		if _, err := checkChannel(c.Channel); err != nil {
+			bad("channel", "%v", err)
+		} else if c.Node.Secure {
+			bad("channel", "%v", errSecureChannels)
+		}
+	}
+	if len(c.Node.PlaintextPeers) > 0 && !c.Node.Secure {
+		bad("plaintext-peers", "only applies with -secure; without it all chat is unencrypted")
+	}
+	if c.Node.Nick != "" && sanitizeNick(c.Node.Nick) == "" {
+		bad("nick", "%q has no printable characters", c.Node.Nick)
+	}
+
+	positive := []struct {
+		name string
+		ok   bool
+	}{
+		{"history-size", c.Node.HistorySize > 0},
+		{"max-message-bytes", c.MaxMessageBytes > 0},
+		{"max-file-bytes", c.Node.MaxFileBytes > 0},
+		{"queue-size", c.Node.QueueSize > 0},
+		{"queue-expiry", c.Node.QueueExpiry > 0},
+		{"negotiation-timeout", c.Node.NegotiationTimeout > 0},
+		{"ack-timeout", c.Node.AckTimeout > 0},
+		{"retry-expiry", c.Node.RetryExpiry > 0},
+		{"send-timeout", c.Node.SendTimeout > 0},
+		{"heartbeat", c.Node.HeartbeatInterval > 0},
+		{"broadcast-workers", c.Node.BroadcastWorkers > 0},
+		{"conn-low", c.Node.ConnLow > 0},
+		{"conn-high", c.Node.ConnHigh > 0},
+		{"conn-grace", c.Node.ConnGrace > 0},
+	}
+	for _, p := range positive {
+		if !p.ok {
+			bad(p.name, "must be greater than zero")
+		}
+	}
+	if c.Node.ConnHigh < c.Node.ConnLow {
+		bad("conn-high", "must be at least -conn-low (%d)", c.Node.ConnLow)
+	}
+	if c.Node.PeerRate < 0 {
+		bad("peer-rate", "must not be negative")
+	}
+	if c.Node.InboundRate < 0 {
+		bad("inbound-rate", "must not be negative")
+	}
+	if c.Node.InboundRate > 0 && c.Node.InboundBurst <= 0 {
+		bad("inbound-burst", "must be greater than zero when -inbound-rate is set")
+	}
+	if c.CompressAbove < 0 {
+		bad("compress-threshold", "must not be negative")
+	}
+	if c.Node.NegotiationRetries < 0 {
+		bad("negotiation-retries", "must not be negative")
+	}
+	if c.AutoDisconnect < 0 {
+		bad("auto-disconnect", "must not be negative")
+	}
+	if c.Node.Watchdog < 0 {
+		bad("watchdog", "must not be negative")
+	}
+	return errs
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "artivus.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+nick: file-nick
+history-size: 100
+dht: true
+ack-timeout: 3s
+listen:
+  - /ip4/127.0.0.1/tcp/4001
+  - /ip4/127.0.0.1/udp/4001/quic-v1
+`)
+
+	defaults, err := loadConfig(nil)
+	if err != nil {
+		t.Fatalf("Failed to load defaults: %v", err)
+	}
+	if defaults.Node.HistorySize != defaultHistorySize || defaults.Node.Nick != "" || defaults.Node.DHT {
+		t.Errorf("Unexpected defaults: %+v", defaults.Node)
+	}
+
+	fromFile, err := loadConfig([]string{"-config", path})
+	if err != nil {
+		t.Fatalf("Failed to load config file: %v", err)
+	}
+	if fromFile.Node.Nick != "file-nick" || fromFile.Node.HistorySize != 100 || !fromFile.Node.DHT {
+		t.Errorf("Expected file values over defaults, got %+v", fromFile.Node)
+	}
+	if fromFile.Node.AckTimeout != 3*time.Second {
+		t.Errorf("Expected ack-timeout 3s from the file, got %s", fromFile.Node.AckTimeout)
+	}
+	if len(fromFile.Node.ListenAddrs) != 2 {
+		t.Errorf("Expected a YAML list to give two listen addresses, got %v", fromFile.Node.ListenAddrs)
+	}
+	if fromFile.LogLevel != "info" {
+		t.Errorf("Expected settings missing from the file to keep their default, got log-level %q", fromFile.LogLevel)
+	}
+
+	// Flags win, wherever they appear relative to -config
+	withFlags, err := loadConfig([]string{"-history-size", "50", "-config", path, "-nick", "flag-nick"})
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if withFlags.Node.Nick != "flag-nick" || withFlags.Node.HistorySize != 50 {
+		t.Errorf("Expected flag values over the file, got nick %q history-size %d", withFlags.Node.Nick, withFlags.Node.HistorySize)
+	}
+	if !withFlags.Node.DHT {
+		t.Error("Expected dht from the file when no flag overrides it")
+	}
+	// The environment beats the file, and flags beat the environment
+	t.Setenv("ARTIVUS_NICK", "env-nick")
+	t.Setenv("ARTIVUS_HISTORY_SIZE", "75")
+	t.Setenv("ARTIVUS_LOG_LEVEL", "debug")
+	withEnv, err := loadConfig([]string{"-config", path, "-history-size", "50"})
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if withEnv.Node.Nick != "env-nick" || withEnv.Node.HistorySize != 50 || withEnv.LogLevel != "debug" {
+		t.Errorf("Expected env over the file and flags over env, got nick %q history-size %d log-level %q", withEnv.Node.Nick, withEnv.Node.HistorySize, withEnv.LogLevel)
+	}
+	if withEnv.Node.AckTimeout != 3*time.Second {
+		t.Errorf("Expected the file to still fill in what env doesn't set, got ack-timeout %s", withEnv.Node.AckTimeout)
+	}
+
+	// Even the config file can come from the environment
+	t.Setenv("ARTIVUS_CONFIG", path)
+	if fromEnvFile, err := loadConfig(nil); err != nil || !fromEnvFile.Node.DHT {
+		t.Errorf("Expected $ARTIVUS_CONFIG to be read, got dht %v, err %v", fromEnvFile.Node.DHT, err)
+	}
+}
+
+func TestLoadConfigMDNSToggle(t *testing.T) {
+	cfg, err := loadConfig([]string{"-mdns=false"})
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if cfg.Node.MDNSTag != "" {
+		t.Errorf("Expected -mdns=false to disable mDNS, got tag %q", cfg.Node.MDNSTag)
+	}
+}
+
+func TestLoadConfigRejectsInvalidValues(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		file    string
+		wantErr string
+	}{
+		{"bad log level", []string{"-log-level", "loud"}, "", "-log-level"},
+		{"bad listen address", []string{"-listen", "not-a-multiaddr"}, "", "-listen"},
+		{"zero history size", []string{"-history-size", "0"}, "", "-history-size"},
+		{"bad http address", []string{"-http", "8080"}, "", "-http"},
+		{"bad relay", []string{"-relays", "/ip4/1.1.1.1/tcp/4001"}, "", "-relays"},
+		{"bad bootstrap with dht", []string{"-dht", "-bootstrap", "/ip4/1.1.1.1/tcp/4001"}, "", "-bootstrap"},
+		{"bad dht mode", []string{"-dht-mode", "peer"}, "", "-dht-mode"},
+		{"bad allow entry", []string{"-allow", "nobody"}, "", "-allow"},
+		{"inbound rate without burst", []string{"-inbound-burst", "0"}, "", "-inbound-burst"},
+		{"quic with tcp-only", []string{"-quic", "-tcp-only"}, "", "-tcp-only"},
+		{"zero queue expiry", []string{"-queue-expiry", "0s"}, "", "-queue-expiry"},
+		{"zero retry expiry", []string{"-retry-expiry", "0s"}, "", "-retry-expiry"},
+		{"bad channel", []string{"-channel", "Not A Channel"}, "", "-channel"},
+		{"channel with secure", []string{"-channel", "dev", "-secure"}, "", "-channel"},
+		{"tui with json output", []string{"-tui", "-output", "json"}, "", "-tui"},
+		{"conn-high below conn-low", []string{"-conn-low", "50", "-conn-high", "10"}, "", "-conn-high"},
+		{"bad value in file", nil, "queue-size: lots\n", "queue-size"},
+		{"unknown key in file", nil, "colour: blue\n", `unknown setting "colour"`},
+		{"malformed file", nil, "nick: [unclosed\n", "config file"},
+		{"bad level in file", nil, "log-level: loud\n", "-log-level"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			if tt.file != "" {
+				args = append(args, "-config", writeConfigFile(t, tt.file))
+			}
+			_, err := loadConfig(args)
+			if err == nil {
+				t.Fatal("Expected an error")
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Expected an error mentioning %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestLoadConfigRejectsBadEnv(t *testing.T) {
+	t.Setenv("ARTIVUS_QUEUE_SIZE", "lots")
+	_, err := loadConfig(nil)
+	if err == nil || !strings.Contains(err.Error(), "$ARTIVUS_QUEUE_SIZE") {
+		t.Errorf("Expected an error naming $ARTIVUS_QUEUE_SIZE, got %v", err)
+	}
+}
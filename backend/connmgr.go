@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	connmgr "github.com/libp2p/go-libp2p/core/connmgr"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	basicconnmgr "github.com/libp2p/go-libp2p/p2p/net/connmgr"
+)
+
+// Connection manager defaults: once more than defaultConnHigh peers are
+// connected, the least useful are closed until defaultConnLow remain, sparing
+// connections younger than defaultConnGrace.
+const (
+	defaultConnLow   = 100
+	defaultConnHigh  = 400
+	defaultConnGrace = time.Minute
+)
+
+// chatProtectTag marks peers we're chatting with, whose connections the
+// connection manager never trims.
+const chatProtectTag = "chat"
+
+// defaultChatIdle is how long a peer stays protected after the last message
+// to or from it.
+const defaultChatIdle = 10 * time.Minute
+
+// buildConnManager returns the connection manager for cfg's watermarks and
+// grace period, zero values meaning the defaults above.
+func buildConnManager(cfg Config) (connmgr.ConnManager, error) {
+	low, high, grace := cfg.ConnLow, cfg.ConnHigh, cfg.ConnGrace
+	if low <= 0 {
+		low = defaultConnLow
+	}
+	if high <= 0 {
+		high = max(defaultConnHigh, low)
+	}
+	if grace <= 0 {
+		grace = defaultConnGrace
+	}
+	if low > high {
+		return nil, fmt.Errorf("low watermark %d is above high watermark %d", low, high)
+	}
+	return basicconnmgr.NewConnManager(low, high, basicconnmgr.WithGracePeriod(grace))
+}
+
+// chatProtector keeps the connections of peers we're chatting with from
+// being trimmed: each message to or from a peer protects it for another
+// idle period, and it's unprotected once that passes quietly.
+type chatProtector struct {
+	cm   connmgr.ConnManager
+	idle time.Duration
+
+	mu     sync.Mutex
+	timers map[peer.ID]*time.Timer
+}
+
+func newChatProtector(cm connmgr.ConnManager, idle time.Duration) *chatProtector {
+	return &chatProtector{cm: cm, idle: idle, timers: make(map[peer.ID]*time.Timer)}
+}
+
+// Touch protects id for the next idle period. It is a no-op on a nil
+// protector.
+func (p *chatProtector) Touch(id peer.ID) {
+	if p == nil || id == "" {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if t, ok := p.timers[id]; ok && t.Stop() {
+		t.Reset(p.idle)
+		return
+	}
+	// Either id wasn't protected or its timer already fired; in the latter
+	// case expire sees a different timer and leaves id alone.
+	p.cm.Protect(id, chatProtectTag)
+	var t *time.Timer
+	t = time.AfterFunc(p.idle, func() { p.expire(id, t) })
+	p.timers[id] = t
+}
+
+func (p *chatProtector) expire(id peer.ID, t *time.Timer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.timers[id] != t {
+		return
+	}
+	delete(p.timers, id)
+	p.cm.Unprotect(id, chatProtectTag)
+}
+
+// rebind moves the protections to cm, the connection manager of a host
+// that replaced the one p was protecting chats on.
+func (p *chatProtector) rebind(cm connmgr.ConnManager) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cm = cm
+	for id := range p.timers {
+		cm.Protect(id, chatProtectTag)
+	}
+}
+
+// Close stops every pending unprotect.
+func (p *chatProtector) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id, t := range p.timers {
+		t.Stop()
+		delete(p.timers, id)
+	}
+	return nil
+}
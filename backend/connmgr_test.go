@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	basicconnmgr "github.com/libp2p/go-libp2p/p2p/net/connmgr"
+)
+
+func TestBuildConnManager(t *testing.T) {
+	cm, err := buildConnManager(Config{ConnLow: 5, ConnHigh: 10, ConnGrace: 30 * time.Second})
+	if err != nil {
+		t.Fatalf("Failed to build connection manager: %v", err)
+	}
+	defer cm.Close()
+	info := cm.(*basicconnmgr.BasicConnMgr).GetInfo()
+	if info.LowWater != 5 || info.HighWater != 10 || info.GracePeriod != 30*time.Second {
+		t.Errorf("Expected watermarks 5/10 and a 30s grace period, got %+v", info)
+	}
+
+	def, err := buildConnManager(Config{})
+	if err != nil {
+		t.Fatalf("Failed to build default connection manager: %v", err)
+	}
+	defer def.Close()
+	info = def.(*basicconnmgr.BasicConnMgr).GetInfo()
+	if info.LowWater != defaultConnLow || info.HighWater != defaultConnHigh || info.GracePeriod != defaultConnGrace {
+		t.Errorf("Expected the defaults for a zero Config, got %+v", info)
+	}
+
+	if _, err := buildConnManager(Config{ConnLow: 10, ConnHigh: 5}); err == nil {
+		t.Error("Expected an error for a low watermark above the high one")
+	}
+}
+
+func TestChatProtectorProtectsUntilIdle(t *testing.T) {
+	cm, err := buildConnManager(Config{})
+	if err != nil {
+		t.Fatalf("Failed to build connection manager: %v", err)
+	}
+	defer cm.Close()
+	p := newChatProtector(cm, 100*time.Millisecond)
+	defer p.Close()
+	id := newTestPeerID(t)
+
+	p.Touch(id)
+	if !cm.IsProtected(id, chatProtectTag) {
+		t.Fatal("Expected a peer we just chatted with to be protected")
+	}
+	// Activity keeps pushing the expiry back
+	for i := 0; i < 3; i++ {
+		time.Sleep(60 * time.Millisecond)
+		p.Touch(id)
+	}
+	if !cm.IsProtected(id, chatProtectTag) {
+		t.Fatal("Expected an active peer to stay protected")
+	}
+	waitFor(t, "the idle peer to be unprotected", func() bool { return !cm.IsProtected(id, chatProtectTag) })
+
+	var nilProtector *chatProtector
+	nilProtector.Touch(id)
+}
+
+func TestNodeProtectsChatPeers(t *testing.T) {
+	a, b, cleanup := newTestPair(t)
+	defer cleanup()
+	if err := a.Send("hi"); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	if !a.host.ConnManager().IsProtected(b.host.ID(), chatProtectTag) {
+		t.Error("Expected the sender to protect the peer it sent to")
+	}
+	waitFor(t, "the receiver to protect the sender", func() bool {
+		return b.host.ConnManager().IsProtected(a.host.ID(), chatProtectTag)
+	})
+}
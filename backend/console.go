@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// inputSource is where the REPL reads its lines: the console, or a script
+// in tests. ReadLine returns io.EOF once input is over.
+type inputSource interface {
+	ReadLine(prompt string) (string, error)
+}
+
+// readInput reads a line from in, or returns ctx's error once ctx is done,
+// e.g. on Ctrl-C. A read blocked at that point is left behind; the process
+// is on its way out.
+func readInput(ctx context.Context, in inputSource, prompt string) (string, error) {
+	type result struct {
+		line string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		line, err := in.ReadLine(prompt)
+		done <- result{line, err}
+	}()
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case res := <-done:
+		return res.line, res.err
+	}
+}
+
+// console owns stdin/stdout for the REPL. On a TTY it switches stdin to raw
+// mode and reads through x/term's line editor, which gives Emacs-style
+// editing keys, up/down history and tab completion, and clears the prompt
+// and any half-typed input before printing and redraws both afterwards, so
+// incoming messages never scramble what the user is typing. On pipes and
+// files it falls back to a plain scanner and passes output straight through.
+type console struct {
+	term    *term.Terminal
+	ui      *tuiScreen
+	restore func()
+	scanner *bufio.Scanner
+	out     io.Writer
+
+	// keystroke and complete are the OnKeystroke and OnTab callbacks.
+	keystroke func(line string, key rune)
+	complete  func(line string) []string
+}
+
+var _ inputSource = (*console)(nil)
+
+// con is the console used by stream handlers; main replaces it at startup.
+var con = newPlainConsole(os.Stdin, os.Stdout)
+
+func newPlainConsole(in io.Reader, out io.Writer) *console {
+	return &console{scanner: bufio.NewScanner(in), out: out}
+}
+
+// newConsole returns a line-editing console when both in and out are
+// terminals, and a plain one otherwise.
+func newConsole(in, out *os.File) *console {
+	if !term.IsTerminal(int(in.Fd())) || !term.IsTerminal(int(out.Fd())) {
+		return newPlainConsole(in, out)
+	}
+	state, err := term.MakeRaw(int(in.Fd()))
+	if err != nil {
+		return newPlainConsole(in, out)
+	}
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{in, out}
+	return &console{
+		term:    term.NewTerminal(rw, ""),
+		restore: func() { term.Restore(int(in.Fd()), state) },
+		out:     out,
+	}
+}
+
+// newTUIConsole returns a console drawn as a full-screen tuiScreen, or
+// falls back to newConsole when in or out isn't a terminal.
+func newTUIConsole(in, out *os.File) *console {
+	if !term.IsTerminal(int(in.Fd())) || !term.IsTerminal(int(out.Fd())) {
+		return newConsole(in, out)
+	}
+	state, err := term.MakeRaw(int(in.Fd()))
+	if err != nil {
+		return newConsole(in, out)
+	}
+	ui := newTUIScreen(in, out, func() (int, int, error) { return term.GetSize(int(out.Fd())) }, tuiRefresh)
+	return &console{
+		ui: ui,
+		restore: func() {
+			ui.Close()
+			term.Restore(int(in.Fd()), state)
+		},
+		out: out,
+	}
+}
+
+// ShowPeers lists peers in the TUI's sidebar; other consoles ignore it.
+func (c *console) ShowPeers(peers func() []peerStatus) {
+	if c.ui != nil {
+		c.ui.ShowPeers(peers)
+	}
+}
+
+// ReadLine shows prompt and returns the next line of input without its
+// trailing newline. It returns io.EOF once input is exhausted.
+func (c *console) ReadLine(prompt string) (string, error) {
+	if c.ui != nil {
+		return c.ui.ReadLine(prompt)
+	}
+	if c.term != nil {
+		c.term.SetPrompt(prompt)
+		return c.term.ReadLine()
+	}
+	fmt.Fprint(c.out, prompt)
+	if !c.scanner.Scan() {
+		if err := c.scanner.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+	return c.scanner.Text(), nil
+}
+
+// Prompt wraps ReadLine for the REPL. It reports ok=false once input is
+// over: a clean EOF (Ctrl-D, closed pipe) is treated as an implicit exit,
+// while a real read error is logged first.
+func (c *console) Prompt(prompt string) (line string, ok bool) {
+	line, err := c.ReadLine(prompt)
+	if err == nil {
+		return line, true
+	}
+	if !errors.Is(err, io.EOF) {
+		c.Println("❌ Failed to read input:", err)
+	}
+	return "", false
+}
+
+// OnKeystroke calls fn for every key pressed while editing a line, apart
+// from Enter and Tab. It only works on a TTY; plain consoles see whole lines.
+func (c *console) OnKeystroke(fn func(line string, key rune)) {
+	c.keystroke = fn
+	c.installCallback()
+}
+
+// OnTab completes the word before the cursor when Tab is pressed, from the
+// candidates complete returns for the line up to the cursor. Like
+// OnKeystroke it only works on a TTY.
+func (c *console) OnTab(complete func(line string) []string) {
+	c.complete = complete
+	c.installCallback()
+}
+
+func (c *console) installCallback() {
+	if c.ui != nil {
+		c.ui.keystroke, c.ui.complete = c.keystroke, c.complete
+		return
+	}
+	if c.term == nil {
+		return
+	}
+	c.term.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+		if key == '\t' && c.complete != nil {
+			newLine, newPos, candidates := completeLine(line, pos, c.complete(line[:pos]))
+			if len(candidates) > 1 && newPos == pos {
+				c.Println(strings.Join(candidates, "  "))
+			}
+			return newLine, newPos, true
+		}
+		if c.keystroke != nil {
+			c.keystroke(line, key)
+		}
+		return "", 0, false
+	}
+}
+
+// completeLine extends the word ending at pos in line as far as all of
+// candidates agree, adding a space when there is only one. It returns the
+// new line and cursor position, plus the candidates still in play.
+func completeLine(line string, pos int, candidates []string) (string, int, []string) {
+	start := strings.LastIndexByte(line[:pos], ' ') + 1
+	word := line[start:pos]
+	var matches []string
+	for _, c := range candidates {
+		if strings.HasPrefix(c, word) {
+			matches = append(matches, c)
+		}
+	}
+	if len(matches) == 0 {
+		return line, pos, nil
+	}
+	common := matches[0]
+	for _, m := range matches[1:] {
+		for !strings.HasPrefix(m, common) {
+			common = common[:len(common)-1]
+		}
+	}
+	if len(matches) == 1 && !strings.HasPrefix(line[pos:], " ") {
+		common += " "
+	}
+	return line[:start] + common + line[pos:], start + len(common), matches
+}
+
+func (c *console) writer() io.Writer {
+	if c.ui != nil {
+		return c.ui
+	}
+	if c.term != nil {
+		return c.term
+	}
+	return c.out
+}
+
+func (c *console) Println(a ...any) {
+	fmt.Fprintln(c.writer(), a...)
+}
+
+func (c *console) Printf(format string, a ...any) {
+	fmt.Fprintf(c.writer(), format, a...)
+}
+
+// Close puts the terminal back into the mode it was in before newConsole.
+func (c *console) Close() {
+	if c.restore != nil {
+		c.restore()
+		c.restore = nil
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestConsolePromptStopsAtEOF(t *testing.T) {
+	var out bytes.Buffer
+	c := newPlainConsole(strings.NewReader("hello\n"), &out)
+
+	line, ok := c.Prompt("> ")
+	if !ok || line != "hello" {
+		t.Fatalf("Expected hello, got %q (ok=%v)", line, ok)
+	}
+	// EOF must end input every time rather than yielding empty lines
+	for i := 0; i < 3; i++ {
+		if _, ok := c.Prompt("> "); ok {
+			t.Fatal("Expected EOF to end input")
+		}
+	}
+	if strings.Contains(out.String(), "❌") {
+		t.Errorf("Clean EOF should not be logged as an error: %q", out.String())
+	}
+}
+
+func TestConsolePromptLogsReadError(t *testing.T) {
+	var out bytes.Buffer
+	c := newPlainConsole(iotest.ErrReader(errors.New("tty went away")), &out)
+
+	if _, ok := c.Prompt("> "); ok {
+		t.Fatal("Expected read error to end input")
+	}
+	if !strings.Contains(out.String(), "tty went away") {
+		t.Errorf("Expected read error to be logged, got %q", out.String())
+	}
+}
+
+func TestCompleteLine(t *testing.T) {
+	tests := []struct {
+		line     string
+		pos      int
+		want     string
+		wantPos  int
+		matching int
+	}{
+		{"/wh", 3, "/whoami ", 8, 1},
+		{"/p", 2, "/p", 2, 4},
+		{"/pe", 3, "/peers ", 7, 1},
+		{"/x", 2, "/x", 2, 0},
+		{"/connect @b", 11, "/connect @bob ", 14, 1},
+		{"/dm @ca hi", 7, "/dm @carol hi", 10, 1},
+	}
+	candidates := []string{"/part", "/ping", "/peers", "/protocols", "/whoami", "@bob", "@carol"}
+	for _, tt := range tests {
+		got, pos, matches := completeLine(tt.line, tt.pos, candidates)
+		if got != tt.want || pos != tt.wantPos || len(matches) != tt.matching {
+			t.Errorf("completeLine(%q, %d) = %q, %d, %v; want %q, %d with %d matches", tt.line, tt.pos, got, pos, matches, tt.want, tt.wantPos, tt.matching)
+		}
+	}
+}
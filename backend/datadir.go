@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// dataDirFlag is the -data-dir setting; loadConfig sets it.
+var dataDirFlag string
+
+// legacyDataDir is where everything lived before -data-dir, under the home
+// directory. It's still used when it exists, so upgrading keeps the same
+// identity and history.
+const legacyDataDir = ".artivus"
+
+// locateDataDir picks the data directory without touching it: -data-dir,
+// else $ARTIVUS_HOME, else ~/.artivus if an older version created it, else
+// artivus in the user config directory.
+func locateDataDir() (string, error) {
+	if dataDirFlag != "" {
+		return dataDirFlag, nil
+	}
+	if dir := os.Getenv("ARTIVUS_HOME"); dir != "" {
+		return dir, nil
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		legacy := filepath.Join(home, legacyDataDir)
+		if fi, err := os.Stat(legacy); err == nil && fi.IsDir() {
+			return legacy, nil
+		}
+	}
+	base, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("no data directory: set -data-dir or $ARTIVUS_HOME (%w)", err)
+	}
+	return filepath.Join(base, "artivus"), nil
+}
+
+// dataDir returns the data directory, creating it with 0700 permissions if
+// it's missing. It fails if the directory can't be created or written to,
+// which main reports before starting anything that persists state.
+func dataDir() (string, error) {
+	dir, err := locateDataDir()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("failed to create data directory: %w", err)
+	}
+	probe, err := os.CreateTemp(dir, ".write-test-*")
+	if err != nil {
+		var pathErr *os.PathError
+		if errors.As(err, &pathErr) {
+			err = pathErr.Err
+		}
+		return "", fmt.Errorf("data directory %s isn't writable: %w", dir, err)
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	return dir, nil
+}
+
+// dataPath returns the path of name inside the data directory, or inside
+// ./.artivus if there is no data directory to be found.
+func dataPath(name string) string {
+	dir, err := locateDataDir()
+	if err != nil {
+		return filepath.Join(legacyDataDir, name)
+	}
+	return filepath.Join(dir, name)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// useDataDirs points every data directory source at its own temp dir, with
+// no -data-dir set, until the test ends.
+func useDataDirs(t *testing.T) (home, env, config string) {
+	t.Helper()
+	home, env, config = t.TempDir(), t.TempDir(), t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("ARTIVUS_HOME", "")
+	t.Setenv("XDG_CONFIG_HOME", config)
+	old := dataDirFlag
+	dataDirFlag = ""
+	t.Cleanup(func() { dataDirFlag = old })
+	return home, env, config
+}
+
+func TestDataDirPrecedence(t *testing.T) {
+	home, env, config := useDataDirs(t)
+
+	if got := dataPath("identity.key"); got != filepath.Join(config, "artivus", "identity.key") {
+		t.Errorf("Expected the user config directory by default, got %s", got)
+	}
+	legacy := filepath.Join(home, ".artivus")
+	if err := os.Mkdir(legacy, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if got := dataPath("identity.key"); got != filepath.Join(legacy, "identity.key") {
+		t.Errorf("Expected an existing ~/.artivus to be kept, got %s", got)
+	}
+	t.Setenv("ARTIVUS_HOME", env)
+	if got := dataPath("identity.key"); got != filepath.Join(env, "identity.key") {
+		t.Errorf("Expected $ARTIVUS_HOME over the default, got %s", got)
+	}
+
+	flagDir := filepath.Join(t.TempDir(), "data")
+	cfg, err := loadConfig([]string{"-data-dir", flagDir, "-history-file", ""})
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if cfg.Node.IdentityPath != filepath.Join(flagDir, "identity.key") || cfg.Node.DownloadsDir != filepath.Join(flagDir, "downloads") {
+		t.Errorf("Expected -data-dir over $ARTIVUS_HOME, got %s and %s", cfg.Node.IdentityPath, cfg.Node.DownloadsDir)
+	}
+	if cfg.Node.HistoryFile != "" {
+		t.Errorf("Expected an explicit empty -history-file to stay disabled, got %q", cfg.Node.HistoryFile)
+	}
+
+	dir, err := dataDir()
+	if err != nil {
+		t.Fatalf("Failed to create data directory: %v", err)
+	}
+	if fi, err := os.Stat(dir); err != nil || fi.Mode().Perm() != 0o700 {
+		t.Errorf("Expected %s to be created with 0700, got %v, %v", dir, fi, err)
+	}
+}
+
+func TestDataDirNotWritable(t *testing.T) {
+	useDataDirs(t)
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	dataDirFlag = filepath.Join(file, "data")
+	if _, err := dataDir(); err == nil {
+		t.Error("Expected an error for a data directory under a file")
+	}
+
+	if os.Geteuid() == 0 {
+		t.Skip("root can write to read-only directories")
+	}
+	readOnly := t.TempDir()
+	if err := os.Chmod(readOnly, 0o500); err != nil {
+		t.Fatal(err)
+	}
+	dataDirFlag = readOnly
+	if _, err := dataDir(); err == nil || !strings.Contains(err.Error(), "isn't writable") {
+		t.Errorf("Expected a not-writable error, got %v", err)
+	}
+}
+
+func TestEphemeralIdentityLeavesNoFiles(t *testing.T) {
+	useDataDirs(t)
+	dir := t.TempDir()
+	cfg, err := loadConfig([]string{"-data-dir", dir, "-ephemeral-identity", "-mdns=false"})
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	cfg.Node.NegotiationTimeout = 5 * time.Second
+
+	var ids []peer.ID
+	for range 2 {
+		n, err := NewNode(context.Background(), cfg.Node)
+		if err != nil {
+			t.Fatalf("Failed to create node: %v", err)
+		}
+		n.history.Add(ChatMessage{ID: "1", Body: "gone with the process", Direction: directionReceived})
+		if err := n.SaveAlias("bob", nodeAddr(n)); !errors.Is(err, errNoAddressBook) {
+			t.Errorf("Expected the address book to be off, got %v", err)
+		}
+		ids = append(ids, n.host.ID())
+		n.Close()
+	}
+	if ids[0] == ids[1] {
+		t.Error("Expected a new peer ID every run")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		t.Errorf("Expected nothing saved in anonymous mode, found %s", e.Name())
+	}
+
+	if _, err := loadConfig([]string{"-data-dir", dir, "-ephemeral-identity", "-new-identity"}); err == nil {
+		t.Error("Expected -ephemeral-identity to refuse -new-identity")
+	}
+}
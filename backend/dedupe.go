@@ -0,0 +1,44 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+const defaultDedupeSize = 1024
+
+// messageDeduper remembers the IDs of the last size messages received, so
+// one that arrives again by another path is dropped. It's shared by every
+// incoming chat stream.
+type messageDeduper struct {
+	size int
+
+	mu    sync.Mutex
+	order *list.List // most recently seen at the front
+	ids   map[string]*list.Element
+}
+
+func newMessageDeduper(size int) *messageDeduper {
+	return &messageDeduper{size: size, order: list.New(), ids: make(map[string]*list.Element)}
+}
+
+// Seen records id and reports whether it was already there. A nil deduper
+// and an empty ID (plaintext from old peers) never count as seen.
+func (d *messageDeduper) Seen(id string) bool {
+	if d == nil || id == "" {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e, ok := d.ids[id]; ok {
+		d.order.MoveToFront(e)
+		return true
+	}
+	d.ids[id] = d.order.PushFront(id)
+	if d.order.Len() > d.size {
+		oldest := d.order.Back()
+		d.order.Remove(oldest)
+		delete(d.ids, oldest.Value.(string))
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	network "github.com/libp2p/go-libp2p/core/network"
+)
+
+func TestMessageDeduper(t *testing.T) {
+	d := newMessageDeduper(3)
+	if d.Seen("a") || d.Seen("b") {
+		t.Fatal("Expected new IDs to be accepted")
+	}
+	if !d.Seen("a") {
+		t.Error("Expected a repeated ID to be dropped")
+	}
+	if d.Seen("") || d.Seen("") {
+		t.Error("Expected empty IDs never to count as seen")
+	}
+
+	// "a" was just seen again, so "b" is the oldest and goes first
+	d.Seen("c")
+	d.Seen("d")
+	if !d.Seen("a") {
+		t.Error("Expected a recently seen ID to survive eviction")
+	}
+	if d.Seen("b") {
+		t.Error("Expected b to be evicted past capacity")
+	}
+	if got := len(d.ids); got != 3 {
+		t.Errorf("Expected the set to stay at 3 IDs, got %d", got)
+	}
+
+	var nilDeduper *messageDeduper
+	if nilDeduper.Seen("a") || nilDeduper.Seen("a") {
+		t.Error("Expected a nil deduper to accept everything")
+	}
+}
+
+func TestMessageDeduperConcurrent(t *testing.T) {
+	d := newMessageDeduper(defaultDedupeSize)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	accepted := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if !d.Seen(fmt.Sprint(j)) {
+					mu.Lock()
+					accepted++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if accepted != 100 {
+		t.Errorf("Expected each ID accepted once, got %d acceptances", accepted)
+	}
+}
+
+func TestHandleStreamDropsDuplicates(t *testing.T) {
+	a, b, cleanup := newTestPair(t)
+	defer cleanup()
+
+	history := newMessageLog(10)
+	b.host.SetStreamHandler("/chat/1.0.0", func(s network.Stream) {
+		handleStream(s, history, newMessageDeduper(defaultDedupeSize), nil)
+	})
+	s, err := a.host.NewStream(context.Background(), b.host.ID(), "/chat/1.0.0")
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	defer s.Close()
+
+	msg := newChatMessage(a.host.ID(), "alice", "once")
+	writeMessage(s, msg)
+	writeMessage(s, msg)
+	r := bufio.NewReader(s)
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < 2; i++ {
+		if id, err := readAck(r); err != nil || id != msg.ID {
+			t.Fatalf("Expected both copies acked, got %q, %v", id, err)
+		}
+	}
+	if got := history.Recent(-1); len(got) != 1 {
+		t.Errorf("Expected the duplicate to be dropped, got %d messages", len(got))
+	}
+}
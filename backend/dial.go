@@ -0,0 +1,176 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	host "github.com/libp2p/go-libp2p/core/host"
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	routing "github.com/libp2p/go-libp2p/core/routing"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// peerLookupTimeout bounds the DHT search for a peer dialed by ID alone.
+var peerLookupTimeout = 30 * time.Second
+
+// dialAttemptTimeout bounds the dial to each of a peer's addresses, so one
+// that silently drops packets doesn't hold up the rest.
+var dialAttemptTimeout = 5 * time.Second
+
+func hasProtocol(addr ma.Multiaddr, code int) bool {
+	_, err := addr.ValueForProtocol(code)
+	return err == nil
+}
+
+func isQUICAddr(addr ma.Multiaddr) bool {
+	return hasProtocol(addr, ma.P_QUIC_V1) || hasProtocol(addr, ma.P_QUIC)
+}
+
+func isTCPAddr(addr ma.Multiaddr) bool {
+	return hasProtocol(addr, ma.P_TCP)
+}
+
+// transportName is the transport addr uses, for showing next to it.
+func transportName(addr ma.Multiaddr) string {
+	switch {
+	case isQUICAddr(addr):
+		return "QUIC"
+	case hasProtocol(addr, ma.P_WS) || hasProtocol(addr, ma.P_WSS):
+		return "WebSocket"
+	case isTCPAddr(addr):
+		return "TCP"
+	}
+	return ""
+}
+
+// dialRank orders addresses for connectWithFallback: public before LAN
+// before loopback or link-local, and QUIC before TCP within each.
+func dialRank(addr ma.Multiaddr) int {
+	rank := 0
+	switch {
+	case isLocalAddr(addr):
+		rank = 4
+	case !manet.IsPublicAddr(addr):
+		rank = 2
+	}
+	if !isQUICAddr(addr) {
+		rank++
+	}
+	return rank
+}
+
+// dialOrder returns addrs sorted by dialRank, keeping the given order
+// among equals.
+func dialOrder(addrs []ma.Multiaddr) []ma.Multiaddr {
+	sorted := slices.Clone(addrs)
+	slices.SortStableFunc(sorted, func(a, b ma.Multiaddr) int {
+		return cmp.Compare(dialRank(a), dialRank(b))
+	})
+	return sorted
+}
+
+// connectWithFallback dials info's addresses one at a time in dialOrder,
+// giving each dialAttemptTimeout, and stops at the first that connects. If
+// none does, the error lists every address with why it failed. libp2p may
+// also retry addresses it already knew for the peer alongside each one.
+// Peers given without addresses are dialed at whatever the peerstore has.
+func connectWithFallback(ctx context.Context, h host.Host, info peer.AddrInfo) error {
+	if len(info.Addrs) == 0 {
+		return h.Connect(ctx, info)
+	}
+	var errs []error
+	for _, addr := range dialOrder(info.Addrs) {
+		dialCtx, cancel := context.WithTimeout(ctx, dialAttemptTimeout)
+		err := h.Connect(dialCtx, peer.AddrInfo{ID: info.ID, Addrs: []ma.Multiaddr{addr}})
+		cancel()
+		if err == nil {
+			return nil
+		}
+		logger.Debug("dial attempt failed", "peer_id", info.ID, "addr", addr, "error", err)
+		errs = append(errs, fmt.Errorf("%s: %w", addr, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// parseAndConnect resolves a full /.../p2p/<ID> multiaddr, or an @alias
+// saved in book, and dials it. A bare /p2p/<ID> is dialed at whatever
+// addresses discovery already found, or those router finds; router may be
+// nil. A peer we're already connected to isn't dialed again, and our own ID
+// fails with ErrSelfDial. Failures are a *ConnectError for addr.
+func parseAndConnect(ctx context.Context, h host.Host, book *addressBook, router routing.PeerRouting, addr string) (*peer.AddrInfo, error) {
+	info, err := dialTarget(ctx, h, book, router, addr)
+	if err != nil {
+		return nil, &ConnectError{Addr: addr, Err: err}
+	}
+	return info, nil
+}
+
+func dialTarget(ctx context.Context, h host.Host, book *addressBook, router routing.PeerRouting, addr string) (*peer.AddrInfo, error) {
+	addr, err := resolveTarget(book, addr)
+	if err != nil {
+		return nil, err
+	}
+	maddr, err := ma.NewMultiaddr(addr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidMultiaddr, err)
+	}
+	info, err := peer.AddrInfoFromP2pAddr(maddr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidMultiaddr, err)
+	}
+	if info.ID == h.ID() {
+		return nil, ErrSelfDial
+	}
+	if h.Network().Connectedness(info.ID) == network.Connected {
+		if len(info.Addrs) == 0 {
+			info.Addrs = h.Peerstore().Addrs(info.ID)
+		}
+		return info, nil
+	}
+	if len(info.Addrs) == 0 {
+		if info.Addrs, err = findAddrs(ctx, h, router, info.ID); err != nil {
+			return nil, err
+		}
+	}
+	if err := connectWithFallback(ctx, h, *info); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrPeerUnreachable, err)
+	}
+	return info, nil
+}
+
+// findAddrs returns addresses for a peer given without any: those already
+// in the peerstore (from mDNS or an earlier connection), or else those
+// router finds.
+func findAddrs(ctx context.Context, h host.Host, router routing.PeerRouting, id peer.ID) ([]ma.Multiaddr, error) {
+	if addrs := h.Peerstore().Addrs(id); len(addrs) > 0 {
+		return addrs, nil
+	}
+	if router == nil {
+		return nil, fmt.Errorf("%w: give a full multiaddr like /ip4/<ip>/tcp/<port>/p2p/%s, or enable -dht to look it up", ErrNoAddresses, id)
+	}
+	return lookupPeer(ctx, router, id)
+}
+
+// lookupPeer asks router for id's addresses, giving up after
+// peerLookupTimeout.
+func lookupPeer(ctx context.Context, router routing.PeerRouting, id peer.ID) ([]ma.Multiaddr, error) {
+	ctx, cancel := context.WithTimeout(ctx, peerLookupTimeout)
+	defer cancel()
+	found, err := router.FindPeer(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("%w: DHT lookup failed: %w", ErrNoAddresses, err)
+	}
+	if len(found.Addrs) == 0 {
+		return nil, fmt.Errorf("%w: DHT knows the peer but no addresses", ErrNoAddresses)
+	}
+	return found.Addrs, nil
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	libp2p "github.com/libp2p/go-libp2p"
+	crypto "github.com/libp2p/go-libp2p/core/crypto"
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	routing "github.com/libp2p/go-libp2p/core/routing"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestConnectFallsBackToTCP(t *testing.T) {
+	old := dialAttemptTimeout
+	dialAttemptTimeout = 2 * time.Second
+	t.Cleanup(func() { dialAttemptTimeout = old })
+
+	hostA, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host A: %v", err)
+	}
+	defer hostA.Close()
+
+	// Host B only listens on TCP, so its advertised QUIC address is dead
+	privB, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate key for host B: %v", err)
+	}
+	hostB, err := libp2p.New(libp2p.Identity(privB), libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatalf("Failed to create host B: %v", err)
+	}
+	defer hostB.Close()
+
+	deadQUIC, _ := ma.NewMultiaddr("/ip4/127.0.0.1/udp/9/quic-v1")
+	info := peer.AddrInfo{ID: hostB.ID(), Addrs: append([]ma.Multiaddr{deadQUIC}, hostB.Addrs()...)}
+
+	if err := connectWithFallback(context.Background(), hostA, info); err != nil {
+		t.Fatalf("Expected TCP fallback to succeed, got %v", err)
+	}
+	if hostA.Network().Connectedness(hostB.ID()) != network.Connected {
+		t.Error("Expected host A to be connected to host B")
+	}
+}
+
+func TestConnectWithFallbackTriesEveryAddress(t *testing.T) {
+	logs := captureLogs(t)
+	hostA, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host A: %v", err)
+	}
+	defer hostA.Close()
+	hostB, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host B: %v", err)
+	}
+	defer hostB.Close()
+
+	// Nothing listens on port 1, and it sorts first among equals
+	dead, _ := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/1")
+	var live ma.Multiaddr
+	for _, addr := range hostB.Addrs() {
+		if isTCPAddr(addr) {
+			live = addr
+		}
+	}
+	info := peer.AddrInfo{ID: hostB.ID(), Addrs: []ma.Multiaddr{dead, live}}
+
+	if err := connectWithFallback(context.Background(), hostA, info); err != nil {
+		t.Fatalf("Expected the second address to connect, got %v", err)
+	}
+	if hostA.Network().Connectedness(hostB.ID()) != network.Connected {
+		t.Error("Expected host A to be connected to host B")
+	}
+	attrs, ok := logs.find("dial attempt failed")
+	if !ok {
+		t.Fatal("Expected the unreachable address to be tried first")
+	}
+	if addr, _ := attrs["addr"].(ma.Multiaddr); addr == nil || !addr.Equal(dead) {
+		t.Errorf("Expected the failed attempt to be %s, got %v", dead, attrs["addr"])
+	}
+
+	// With nothing reachable every address is reported
+	hostB.Close()
+	hostA.Network().ClosePeer(hostB.ID())
+	hostA.Peerstore().ClearAddrs(hostB.ID())
+	err = connectWithFallback(context.Background(), hostA, info)
+	if err == nil {
+		t.Fatal("Expected an error once host B is gone")
+	}
+	for _, addr := range info.Addrs {
+		if !strings.Contains(err.Error(), addr.String()) {
+			t.Errorf("Expected %s in the error, got %v", addr, err)
+		}
+	}
+}
+
+func TestDialOrder(t *testing.T) {
+	var addrs []ma.Multiaddr
+	for _, s := range []string{
+		"/ip4/127.0.0.1/tcp/4001",
+		"/ip4/192.168.1.5/tcp/4001",
+		"/ip4/127.0.0.1/udp/4001/quic-v1",
+		"/ip4/1.2.3.4/tcp/4001",
+		"/ip4/192.168.1.5/udp/4001/quic-v1",
+		"/ip4/1.2.3.4/udp/4001/quic-v1",
+	} {
+		addrs = append(addrs, ma.StringCast(s))
+	}
+	want := []string{
+		"/ip4/1.2.3.4/udp/4001/quic-v1",
+		"/ip4/1.2.3.4/tcp/4001",
+		"/ip4/192.168.1.5/udp/4001/quic-v1",
+		"/ip4/192.168.1.5/tcp/4001",
+		"/ip4/127.0.0.1/udp/4001/quic-v1",
+		"/ip4/127.0.0.1/tcp/4001",
+	}
+	got := dialOrder(addrs)
+	for i := range want {
+		if got[i].String() != want[i] {
+			t.Fatalf("Expected order %v, got %v", want, got)
+		}
+	}
+}
+
+func TestIsQUICAddr(t *testing.T) {
+	quic, _ := ma.NewMultiaddr("/ip4/1.2.3.4/udp/4001/quic-v1")
+	tcp, _ := ma.NewMultiaddr("/ip4/1.2.3.4/tcp/4001")
+	if !isQUICAddr(quic) || isQUICAddr(tcp) {
+		t.Error("QUIC address detection is wrong")
+	}
+	if !isTCPAddr(tcp) || isTCPAddr(quic) {
+		t.Error("TCP address detection is wrong")
+	}
+}
+
+func TestParseAndConnect(t *testing.T) {
+	ctx := context.Background()
+	hostA, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host A: %v", err)
+	}
+	defer hostA.Close()
+	hostB, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host B: %v", err)
+	}
+	defer hostB.Close()
+
+	if _, err := parseAndConnect(ctx, hostA, nil, nil, "/invalid/multiaddr"); err == nil {
+		t.Error("Expected error for invalid multiaddr")
+	}
+	if _, err := parseAndConnect(ctx, hostA, nil, nil, "/ip4/127.0.0.1/tcp/1234"); err == nil {
+		t.Error("Expected error for multiaddr without peer ID")
+	}
+
+	addr := hostB.Addrs()[0].String() + "/p2p/" + hostB.ID().String()
+	info, err := parseAndConnect(ctx, hostA, nil, nil, addr)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if info.ID != hostB.ID() {
+		t.Errorf("Expected peer %s, got %s", hostB.ID(), info.ID)
+	}
+	if hostA.Network().Connectedness(hostB.ID()) != network.Connected {
+		t.Error("Expected host A to be connected to host B")
+	}
+}
+
+func TestParseAndConnectSelfAndConnected(t *testing.T) {
+	ctx := context.Background()
+	hostA, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host A: %v", err)
+	}
+	defer hostA.Close()
+	hostB, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host B: %v", err)
+	}
+	defer hostB.Close()
+
+	self := hostA.Addrs()[0].String() + "/p2p/" + hostA.ID().String()
+	if _, err := parseAndConnect(ctx, hostA, nil, nil, self); !errors.Is(err, ErrSelfDial) {
+		t.Errorf("Expected ErrSelfDial for our own address, got %v", err)
+	}
+
+	addr := hostB.Addrs()[0].String() + "/p2p/" + hostB.ID().String()
+	if _, err := parseAndConnect(ctx, hostA, nil, nil, addr); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	conns := hostA.Network().ConnsToPeer(hostB.ID())
+	// Even an address that could never be dialed is fine once connected
+	again := "/ip4/127.0.0.1/tcp/1/p2p/" + hostB.ID().String()
+	info, err := parseAndConnect(ctx, hostA, nil, nil, again)
+	if err != nil {
+		t.Fatalf("Expected a second connect to succeed without dialing, got %v", err)
+	}
+	if info.ID != hostB.ID() {
+		t.Errorf("Expected peer %s, got %s", hostB.ID(), info.ID)
+	}
+	if got := hostA.Network().ConnsToPeer(hostB.ID()); len(got) != len(conns) || got[0] != conns[0] {
+		t.Errorf("Expected the existing connection to be reused, had %v, now %v", conns, got)
+	}
+	if info, err := parseAndConnect(ctx, hostA, nil, nil, "/p2p/"+hostB.ID().String()); err != nil || len(info.Addrs) == 0 {
+		t.Errorf("Expected a bare ID for a connected peer to return its known addresses, got %v, %v", info, err)
+	}
+}
+
+// stubRouter answers FindPeer from a fixed table.
+type stubRouter map[peer.ID]peer.AddrInfo
+
+func (r stubRouter) FindPeer(_ context.Context, id peer.ID) (peer.AddrInfo, error) {
+	info, ok := r[id]
+	if !ok {
+		return peer.AddrInfo{}, routing.ErrNotFound
+	}
+	return info, nil
+}
+
+func TestParseAndConnectBarePeerID(t *testing.T) {
+	ctx := context.Background()
+	hostA, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host A: %v", err)
+	}
+	defer hostA.Close()
+	hostB, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host B: %v", err)
+	}
+	defer hostB.Close()
+	bare := "/p2p/" + hostB.ID().String()
+
+	// Without discovery there is nowhere to look
+	if _, err := parseAndConnect(ctx, hostA, nil, nil, bare); !errors.Is(err, ErrNoAddresses) {
+		t.Errorf("Expected ErrNoAddresses with no router, got %v", err)
+	}
+	// A router that doesn't know the peer
+	if _, err := parseAndConnect(ctx, hostA, nil, stubRouter{}, bare); !errors.Is(err, ErrNoAddresses) {
+		t.Errorf("Expected ErrNoAddresses when the lookup fails, got %v", err)
+	}
+
+	router := stubRouter{hostB.ID(): {ID: hostB.ID(), Addrs: hostB.Addrs()}}
+	if _, err := parseAndConnect(ctx, hostA, nil, router, bare); err != nil {
+		t.Fatalf("Expected the looked-up addresses to be dialed, got %v", err)
+	}
+	if hostA.Network().Connectedness(hostB.ID()) != network.Connected {
+		t.Error("Expected host A to be connected to host B")
+	}
+}
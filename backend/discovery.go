@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	host "github.com/libp2p/go-libp2p/core/host"
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	mdns "github.com/libp2p/go-libp2p/p2p/discovery/mdns"
+	drouting "github.com/libp2p/go-libp2p/p2p/discovery/routing"
+	dutil "github.com/libp2p/go-libp2p/p2p/discovery/util"
+)
+
+// dhtFindInterval is how often we look for new peers under our namespace.
+var dhtFindInterval = 30 * time.Second
+
+// discoveryNotifee connects to peers found by discovery and registers them
+// so they receive our broadcasts. source labels where they came from.
+type discoveryNotifee struct {
+	ctx    context.Context
+	h      host.Host
+	reg    *peerRegistry
+	source string
+}
+
+// HandlePeerFound implements mdns.Notifee.
+func (n *discoveryNotifee) HandlePeerFound(pi peer.AddrInfo) {
+	if pi.ID == n.h.ID() {
+		return
+	}
+	logger.Info("peer found", "source", n.source, "peer_id", pi.ID)
+	// Discovery calls us from its own loop; don't hold it up with a dial
+	go func() {
+		if err := n.h.Connect(n.ctx, pi); err != nil {
+			logger.Warn("failed to connect to discovered peer", "source", n.source, "peer_id", pi.ID, "error", err)
+			return
+		}
+		n.reg.Add(pi)
+	}()
+}
+
+// startMDNS advertises us on the LAN under rendezvous and connects to every
+// other node announcing the same tag.
+func startMDNS(h host.Host, rendezvous string, reg *peerRegistry) (mdns.Service, error) {
+	svc := mdns.NewMdnsService(h, rendezvous, &discoveryNotifee{ctx: context.Background(), h: h, reg: reg, source: "LAN"})
+	if err := svc.Start(); err != nil {
+		return nil, err
+	}
+	return svc, nil
+}
+
+// defaultBootstrapPeers returns the public IPFS bootstrap list.
+func defaultBootstrapPeers() []string {
+	out := make([]string, 0, len(dht.DefaultBootstrapPeers))
+	for _, addr := range dht.DefaultBootstrapPeers {
+		out = append(out, addr.String())
+	}
+	return out
+}
+
+// connectBootstraps dials every bootstrap peer in parallel, skipping us if
+// we're on the list. It only fails if none of the others could be reached;
+// individual failures are logged.
+func connectBootstraps(ctx context.Context, h host.Host, bootstraps []string) error {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		ok   int
+		errs []error
+	)
+	for _, addr := range bootstraps {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			info, err := peer.AddrInfoFromString(addr)
+			if err == nil && info.ID == h.ID() {
+				return
+			}
+			if err == nil {
+				err = h.Connect(ctx, *info)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", addr, err))
+				return
+			}
+			ok++
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		logger.Warn("bootstrap peer unreachable", "error", err)
+	}
+	if ok == 0 && len(errs) > 0 {
+		return fmt.Errorf("no bootstrap peer reachable: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// dhtModes maps -dht-mode values onto DHT modes. In auto mode the node
+// serves DHT queries only once AutoNAT says it's publicly reachable.
+var dhtModes = map[string]dht.ModeOpt{
+	"auto":   dht.ModeAuto,
+	"client": dht.ModeClient,
+	"server": dht.ModeServer,
+}
+
+// startDHTDiscovery joins the Kademlia DHT in mode through the given
+// bootstrap peers, advertises us under namespace and keeps connecting to
+// other peers advertising the same namespace until ctx is cancelled.
+func startDHTDiscovery(ctx context.Context, h host.Host, bootstraps []string, namespace string, mode dht.ModeOpt, reg *peerRegistry) (*dht.IpfsDHT, error) {
+	kdht, err := dht.New(ctx, h, dht.Mode(mode))
+	if err != nil {
+		return nil, err
+	}
+	if err := connectBootstraps(ctx, h, bootstraps); err != nil {
+		kdht.Close()
+		return nil, err
+	}
+	if err := kdht.Bootstrap(ctx); err != nil {
+		kdht.Close()
+		return nil, err
+	}
+
+	rd := drouting.NewRoutingDiscovery(kdht)
+	dutil.Advertise(ctx, rd, namespace)
+
+	n := &discoveryNotifee{ctx: ctx, h: h, reg: reg, source: "DHT"}
+	go func() {
+		ticker := time.NewTicker(dhtFindInterval)
+		defer ticker.Stop()
+		for {
+			findDHTPeers(ctx, rd, namespace, n)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return kdht, nil
+}
+
+func findDHTPeers(ctx context.Context, rd *drouting.RoutingDiscovery, namespace string, n *discoveryNotifee) {
+	peers, err := rd.FindPeers(ctx, namespace)
+	if err != nil {
+		return
+	}
+	for pi := range peers {
+		if len(pi.Addrs) == 0 || n.h.Network().Connectedness(pi.ID) == network.Connected {
+			continue
+		}
+		n.HandlePeerFound(pi)
+	}
+}
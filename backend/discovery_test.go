@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestDiscoveryNotifeeConnectsAndRegisters(t *testing.T) {
+	hostA, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host A: %v", err)
+	}
+	defer hostA.Close()
+	hostB, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host B: %v", err)
+	}
+	defer hostB.Close()
+
+	reg := newPeerRegistry()
+	n := &discoveryNotifee{ctx: context.Background(), h: hostA, reg: reg, source: "LAN"}
+
+	// Our own announcement must be ignored
+	n.HandlePeerFound(peer.AddrInfo{ID: hostA.ID(), Addrs: hostA.Addrs()})
+	n.HandlePeerFound(peer.AddrInfo{ID: hostB.ID(), Addrs: hostB.Addrs()})
+
+	for i := 0; i < 100 && len(reg.List()) == 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	list := reg.List()
+	if len(list) != 1 || list[0].ID != hostB.ID() {
+		t.Errorf("Expected only host B to be registered, got %v", list)
+	}
+}
+
+func TestConnectBootstrapsPartialFailure(t *testing.T) {
+	ctx := context.Background()
+	hostA, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host A: %v", err)
+	}
+	defer hostA.Close()
+	hostB, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host B: %v", err)
+	}
+	defer hostB.Close()
+
+	good := hostB.Addrs()[0].String() + "/p2p/" + hostB.ID().String()
+	hostC, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host C: %v", err)
+	}
+	// Host C is gone by the time we dial it
+	bad := hostC.Addrs()[0].String() + "/p2p/" + hostC.ID().String()
+	hostC.Close()
+
+	if err := connectBootstraps(ctx, hostA, []string{bad, good}); err != nil {
+		t.Errorf("Expected success with one reachable bootstrap, got %v", err)
+	}
+	if err := connectBootstraps(ctx, hostA, []string{bad, "/not/an/addr"}); err == nil {
+		t.Error("Expected error when no bootstrap is reachable")
+	}
+	// We may be on a shared bootstrap list; that's neither a dial nor a failure
+	self := hostA.Addrs()[0].String() + "/p2p/" + hostA.ID().String()
+	if err := connectBootstraps(ctx, hostA, []string{self}); err != nil {
+		t.Errorf("Expected our own entry to be skipped, got %v", err)
+	}
+}
+
+func TestStartDHTDiscovery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hostA, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host A: %v", err)
+	}
+	defer hostA.Close()
+	hostB, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host B: %v", err)
+	}
+	defer hostB.Close()
+
+	good := hostB.Addrs()[0].String() + "/p2p/" + hostB.ID().String()
+	kdht, err := startDHTDiscovery(ctx, hostA, []string{good}, "artivus-test", dht.ModeServer, newPeerRegistry())
+	if err != nil {
+		t.Fatalf("Failed to start DHT discovery: %v", err)
+	}
+	defer kdht.Close()
+	if kdht.Mode() != dht.ModeServer {
+		t.Errorf("Expected the DHT in server mode, got %v", kdht.Mode())
+	}
+
+	if _, err := startDHTDiscovery(ctx, hostA, []string{"/not/an/addr"}, "artivus-test", dht.ModeAuto, newPeerRegistry()); err == nil {
+		t.Error("Expected error when no bootstrap is reachable")
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// emitter is where everything the user sees goes. The text emitter prints
+// to the console as always; the JSON one (-output json) writes one event
+// object per line for scripts.
+type emitter interface {
+	// Println and Printf show a notice: status lines, command output.
+	Println(a ...any)
+	Printf(format string, a ...any)
+	// Connected reports a peer we dialed, or redialed after a drop.
+	Connected(id peer.ID, reconnect bool)
+	// Received shows an incoming message, from room if that's set.
+	Received(m ChatMessage, room string, secure bool)
+	// Sent reports a message of ours that went out.
+	Sent(m ChatMessage)
+	// Read reports that by has read m, a message of ours.
+	Read(m ChatMessage, by peer.ID)
+	// Mirrored shows a message another of our devices sent or received.
+	Mirrored(m ChatMessage, device peer.ID)
+	// Result shows what a query command such as /peers found: text for
+	// people, v for scripts.
+	Result(command, text string, v any)
+	// Error reports a failed action, described by what.
+	Error(what string, err error)
+}
+
+// out is the emitter for the whole process; main replaces it for
+// -output json.
+var out emitter = textEmitter{}
+
+// textEmitter prints through con, with the emoji the REPL has always used.
+type textEmitter struct{}
+
+func (textEmitter) Println(a ...any)               { con.Println(a...) }
+func (textEmitter) Printf(format string, a ...any) { con.Printf(format, a...) }
+
+func (textEmitter) Connected(id peer.ID, reconnect bool) {
+	who := id.String()
+	if alias, ok := contacts.AliasOf(id); ok {
+		who = fmt.Sprintf("@%s (%s)", alias, id)
+	}
+	if reconnect {
+		con.Println("✅ Reconnected to peer:", who)
+		return
+	}
+	con.Println("✅ Connected to peer:", who)
+}
+
+func (textEmitter) Received(m ChatMessage, room string, secure bool) {
+	icon, tag := "💬", channelTag(m.Channel)
+	if secure {
+		icon = "🔒"
+	}
+	if room != "" {
+		tag = channelTag(room)
+	}
+	con.Printf("%s%s [%s] %s%s: %s\n", replyQuote(m.ReplyTo), icon, m.Time().Format("15:04"), tag, displayName(m.Nick, m.From), displayBody(m))
+}
+
+// Sent prints nothing; the user just typed the message.
+func (textEmitter) Sent(ChatMessage) {}
+
+func (textEmitter) Read(m ChatMessage, by peer.ID) {
+	con.Printf("✓✓ read by %s: %s\n", peerName(by), truncateRunes(displayBody(m), 40))
+}
+
+func (t textEmitter) Mirrored(m ChatMessage, device peer.ID) {
+	if m.Direction != directionSent {
+		t.Received(m, "", false)
+		return
+	}
+	con.Printf("%s📱 [%s] %syou, on %s: %s\n", replyQuote(m.ReplyTo), m.Time().Format("15:04"), channelTag(m.Channel), peerName(device), displayBody(m))
+}
+
+// threads is the log replies look up the message they answer in; main
+// sets it to the node's history.
+var threads *messageLog
+
+// replyQuote is what goes before a message replying to parent: a line
+// quoting the start of parent, or naming its ID if we never saw it, and an
+// indent putting the reply under it. It's "" when parent is.
+func replyQuote(parent string) string {
+	if parent == "" {
+		return ""
+	}
+	if m, ok := threads.Find(parent); ok {
+		return fmt.Sprintf("  ┆ %s: %s\n  ↳ ", displayName(m.Nick, m.From), truncateRunes(strings.Join(strings.Fields(displayBody(m)), " "), 40))
+	}
+	return fmt.Sprintf("  ┆ reply to #%s\n  ↳ ", shortMessageID(parent))
+}
+
+func (textEmitter) Result(_, text string, _ any) {
+	if text != "" {
+		con.Println(text)
+	}
+}
+
+func (textEmitter) Error(what string, err error) {
+	if what == "" {
+		con.Println("❌", err)
+		return
+	}
+	con.Println("❌ "+what+":", err)
+}
+
+// jsonEvent is one line of -output json. Message events carry the chat
+// envelope's fields inline.
+type jsonEvent struct {
+	Type string `json:"type"`
+	*ChatMessage
+	Peer      peer.ID `json:"peer,omitempty"`
+	Room      string  `json:"room,omitempty"`
+	Secure    bool    `json:"secure,omitempty"`
+	Reconnect bool    `json:"reconnect,omitempty"`
+	Text      string  `json:"text,omitempty"`
+	Error     string  `json:"error,omitempty"`
+	// Command and Result are a query command's name and what it found.
+	Command string `json:"command,omitempty"`
+	Result  any    `json:"result,omitempty"`
+}
+
+type jsonEmitter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func newJSONEmitter(w io.Writer) *jsonEmitter {
+	return &jsonEmitter{w: w}
+}
+
+func (e *jsonEmitter) emit(ev jsonEvent) {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		logger.Error("failed to encode event", "type", ev.Type, "error", err)
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.w.Write(append(data, '\n'))
+}
+
+func (e *jsonEmitter) Println(a ...any) {
+	e.Printf("%s", strings.TrimSuffix(fmt.Sprintln(a...), "\n"))
+}
+
+func (e *jsonEmitter) Printf(format string, a ...any) {
+	text := strings.TrimSpace(fmt.Sprintf(format, a...))
+	if text != "" {
+		e.emit(jsonEvent{Type: "notice", Text: text})
+	}
+}
+
+func (e *jsonEmitter) Connected(id peer.ID, reconnect bool) {
+	e.emit(jsonEvent{Type: "connected", Peer: id, Reconnect: reconnect})
+}
+
+func (e *jsonEmitter) Received(m ChatMessage, room string, secure bool) {
+	e.emit(jsonEvent{Type: "message", ChatMessage: &m, Room: room, Secure: secure})
+}
+
+func (e *jsonEmitter) Sent(m ChatMessage) {
+	e.emit(jsonEvent{Type: "sent", ChatMessage: &m})
+}
+
+func (e *jsonEmitter) Read(m ChatMessage, by peer.ID) {
+	e.emit(jsonEvent{Type: "read", ChatMessage: &m, Peer: by})
+}
+
+func (e *jsonEmitter) Mirrored(m ChatMessage, device peer.ID) {
+	e.emit(jsonEvent{Type: "mirrored", ChatMessage: &m, Peer: device})
+}
+
+func (e *jsonEmitter) Result(command, _ string, v any) {
+	e.emit(jsonEvent{Type: "result", Command: command, Result: v})
+}
+
+func (e *jsonEmitter) Error(what string, err error) {
+	e.emit(jsonEvent{Type: "error", Text: what, Error: err.Error()})
+}
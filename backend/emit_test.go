@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// useJSONOutput sends user-visible output to a buffer as JSON events until
+// the test ends.
+func useJSONOutput(t *testing.T) *syncBuffer {
+	buf := &syncBuffer{}
+	old := out
+	out = newJSONEmitter(buf)
+	t.Cleanup(func() { out = old })
+	return buf
+}
+
+// events decodes every JSON event written so far.
+func events(t *testing.T, buf *syncBuffer) []map[string]any {
+	t.Helper()
+	var evs []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var ev map[string]any
+		if err := json.Unmarshal([]byte(line), &ev); err != nil {
+			t.Fatalf("Expected one JSON object per line, got %q: %v", line, err)
+		}
+		evs = append(evs, ev)
+	}
+	return evs
+}
+
+func TestJSONEmitterShapes(t *testing.T) {
+	buf := useJSONOutput(t)
+	alice := newTestPeerID(t)
+	m := ChatMessage{ID: "m1", From: alice, Nick: "alice", Body: "hi", Timestamp: 1700000000}
+
+	out.Received(m, "lobby", false)
+	out.Printf("📢 MOTD from %s:\n%s\n", "bob", "welcome")
+	out.Error("Failed to send", errors.New("no route"))
+
+	evs := events(t, buf)
+	if len(evs) != 3 {
+		t.Fatalf("Expected 3 events, got %d: %q", len(evs), buf.String())
+	}
+	want := map[string]any{"type": "message", "id": "m1", "from": alice.String(), "nick": "alice", "body": "hi", "ts": float64(1700000000), "room": "lobby"}
+	if len(evs[0]) != len(want) {
+		t.Errorf("Expected message fields %v, got %v", want, evs[0])
+	}
+	for k, v := range want {
+		if evs[0][k] != v {
+			t.Errorf("Expected %s=%v, got %v", k, v, evs[0][k])
+		}
+	}
+	if evs[1]["type"] != "notice" || evs[1]["text"] != "📢 MOTD from bob:\nwelcome" {
+		t.Errorf("Unexpected notice: %v", evs[1])
+	}
+	if evs[2]["type"] != "error" || evs[2]["text"] != "Failed to send" || evs[2]["error"] != "no route" {
+		t.Errorf("Unexpected error event: %v", evs[2])
+	}
+}
+
+func TestJSONOutputForReceivedMessage(t *testing.T) {
+	buf := useJSONOutput(t)
+	alice, bob, cleanup := newTestPair(t)
+	defer cleanup()
+
+	if err := alice.Send("hello bob"); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	var got map[string]any
+	waitFor(t, "message event", func() bool {
+		for _, ev := range events(t, buf) {
+			if ev["type"] == "message" {
+				got = ev
+				return true
+			}
+		}
+		return false
+	})
+	if got["body"] != "hello bob" || got["from"] != alice.host.ID().String() || got["nick"] != "alice" {
+		t.Errorf("Unexpected message event: %v", got)
+	}
+
+	var sent, connected bool
+	for _, ev := range events(t, buf) {
+		sent = sent || ev["type"] == "sent" && ev["body"] == "hello bob"
+		connected = connected || ev["type"] == "connected" && ev["peer"] == bob.host.ID().String()
+	}
+	if !sent || !connected {
+		t.Errorf("Expected connected and sent events, got %q", buf.String())
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors from the connect and send paths, so the REPL and the HTTP API can
+// tell failure modes apart with errors.Is rather than by message text.
+var (
+	ErrInvalidMultiaddr = errors.New("invalid multiaddr")
+	ErrPeerUnreachable  = errors.New("peer unreachable")
+	ErrNoActivePeer     = errors.New("no peer connected")
+	ErrMessageTooLarge  = errors.New("message too large")
+	ErrNoAddresses      = errors.New("no addresses for peer")
+	ErrSelfDial         = errors.New("can't dial our own peer ID")
+)
+
+// ConnectError is a failed connect to Addr, as typed by the user (an
+// @alias stays an alias). Err is the cause, usually wrapping
+// ErrInvalidMultiaddr or ErrPeerUnreachable.
+type ConnectError struct {
+	Addr string
+	Err  error
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("connect to %s: %v", e.Addr, e.Err)
+}
+
+func (e *ConnectError) Unwrap() error {
+	return e.Err
+}
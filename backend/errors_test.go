@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestConnectErrors(t *testing.T) {
+	n := newTestNode(t, "alice")
+	offline := fmt.Sprintf("/ip4/127.0.0.1/tcp/1/p2p/%s", newTestPeerID(t))
+
+	tests := []struct {
+		addr string
+		want error
+	}{
+		{"/invalid/multiaddr", ErrInvalidMultiaddr},
+		{"/ip4/127.0.0.1/tcp/1234", ErrInvalidMultiaddr},
+		{"@nobody", errUnknownAlias},
+		{offline, ErrPeerUnreachable},
+		{nodeAddr(n), ErrSelfDial},
+	}
+	for _, tt := range tests {
+		err := n.Connect(tt.addr)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("Connect(%q): expected %v, got %v", tt.addr, tt.want, err)
+		}
+		var connErr *ConnectError
+		if !errors.As(err, &connErr) || connErr.Addr != tt.addr {
+			t.Errorf("Connect(%q): expected a ConnectError for the address, got %#v", tt.addr, err)
+		}
+	}
+}
+
+func TestSendErrors(t *testing.T) {
+	n := newTestNode(t, "alice")
+	if err := n.Send("hello?"); !errors.Is(err, ErrNoActivePeer) {
+		t.Errorf("Expected ErrNoActivePeer with nobody connected, got %v", err)
+	}
+	if err := n.Send(strings.Repeat("x", maxBodyBytes+1)); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("Expected ErrMessageTooLarge, got %v", err)
+	}
+}
+
+func TestErrorStatuses(t *testing.T) {
+	wrap := func(err error) error { return &ConnectError{Addr: "x", Err: fmt.Errorf("%w: detail", err)} }
+	tests := []struct {
+		name string
+		got  int
+		want int
+	}{
+		{"send with no peers", sendStatus(ErrNoActivePeer), http.StatusConflict},
+		{"send too large", sendStatus(fmt.Errorf("%w: 9 bytes", ErrMessageTooLarge)), http.StatusRequestEntityTooLarge},
+		{"send unreachable", sendStatus(ErrPeerUnreachable), http.StatusBadGateway},
+		{"connect bad address", connectStatus(wrap(ErrInvalidMultiaddr)), http.StatusBadRequest},
+		{"connect unknown alias", connectStatus(wrap(errUnknownAlias)), http.StatusBadRequest},
+		{"connect unreachable", connectStatus(wrap(ErrPeerUnreachable)), http.StatusBadGateway},
+		{"connect to self", connectStatus(wrap(ErrSelfDial)), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.want, tt.got)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	host "github.com/libp2p/go-libp2p/core/host"
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	defaultEventLogSize = 500
+	// eventQueueSize is how many events may wait for the writer before new
+	// ones are dropped.
+	eventQueueSize = 256
+)
+
+// Kinds of connEvent.
+const (
+	eventConnected    = "CONNECTED"
+	eventDisconnected = "DISCONNECTED"
+	eventDialFailed   = "DIAL_FAILED"
+	// eventOnline and eventOffline are presence changes: a peer became
+	// reachable, or its connections or heartbeats stopped.
+	eventOnline  = "ONLINE"
+	eventOffline = "OFFLINE"
+)
+
+// connEvent is one entry in the connection event log.
+type connEvent struct {
+	Time  time.Time `json:"time"`
+	Kind  string    `json:"kind"`
+	Peer  peer.ID   `json:"peer,omitempty"`
+	Addr  string    `json:"addr,omitempty"`
+	Error string    `json:"error,omitempty"`
+}
+
+// String renders e for /events, e.g. "15:04:05 CONNECTED 12D3Koo… via
+// /ip4/…".
+func (e connEvent) String() string {
+	s := e.Time.Format("15:04:05") + " " + e.Kind
+	if e.Peer != "" {
+		s += " " + e.Peer.String()
+	}
+	if e.Addr != "" {
+		s += " via " + e.Addr
+	}
+	if e.Error != "" {
+		s += ": " + e.Error
+	}
+	return s
+}
+
+// eventLog keeps the newest connection events in a ring buffer and, if a
+// path is set, appends every one to that file as a JSON line. Events are
+// queued to a writer goroutine so recording never blocks the swarm.
+type eventLog struct {
+	queue chan connEvent
+	done  chan struct{}
+	path  string
+
+	mu     sync.Mutex
+	closed bool
+	buf    []connEvent
+	next   int
+	count  int
+	subs   map[chan connEvent]struct{}
+}
+
+func newEventLog(capacity int, path string) *eventLog {
+	if capacity <= 0 {
+		capacity = defaultEventLogSize
+	}
+	l := &eventLog{
+		queue: make(chan connEvent, eventQueueSize),
+		done:  make(chan struct{}),
+		path:  path,
+		buf:   make([]connEvent, capacity),
+	}
+	go l.run()
+	return l
+}
+
+// Record queues e, stamping it with the current time if it has none. When
+// the writer is behind, e is dropped. It is a no-op on a nil or closed log.
+func (l *eventLog) Record(e connEvent) {
+	if l == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	select {
+	case l.queue <- e:
+	default:
+		logger.Debug("event log queue full, dropping event", "kind", e.Kind, "peer_id", e.Peer)
+	}
+}
+
+func (l *eventLog) run() {
+	defer close(l.done)
+	var f *os.File
+	if l.path != "" {
+		var err error
+		if err = os.MkdirAll(filepath.Dir(l.path), 0o700); err == nil {
+			f, err = os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		}
+		if err != nil {
+			logger.Warn("failed to open event log", "path", l.path, "error", err)
+		} else {
+			defer f.Close()
+		}
+	}
+	var enc *json.Encoder
+	if f != nil {
+		enc = json.NewEncoder(f)
+	}
+	for e := range l.queue {
+		l.mu.Lock()
+		l.buf[l.next] = e
+		l.next = (l.next + 1) % len(l.buf)
+		if l.count < len(l.buf) {
+			l.count++
+		}
+		for ch := range l.subs {
+			select {
+			case ch <- e:
+			default:
+			}
+		}
+		l.mu.Unlock()
+		if enc != nil {
+			if err := enc.Encode(e); err != nil {
+				logger.Warn("failed to write event log", "path", l.path, "error", err)
+			}
+		}
+	}
+}
+
+// Subscribe returns a channel receiving every event recorded from now on,
+// and a function that unsubscribes and closes it. Like messageLog's, a
+// subscriber that falls behind misses events.
+func (l *eventLog) Subscribe() (<-chan connEvent, func()) {
+	ch := make(chan connEvent, 64)
+	l.mu.Lock()
+	if l.subs == nil {
+		l.subs = make(map[chan connEvent]struct{})
+	}
+	l.subs[ch] = struct{}{}
+	l.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			l.mu.Lock()
+			delete(l.subs, ch)
+			l.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// Recent returns up to n of the newest events, oldest first. A negative n
+// returns them all.
+func (l *eventLog) Recent(n int) []connEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n > l.count || n < 0 {
+		n = l.count
+	}
+	out := make([]connEvent, n)
+	start := (l.next - n + len(l.buf)) % len(l.buf)
+	for i := range out {
+		out[i] = l.buf[(start+i)%len(l.buf)]
+	}
+	return out
+}
+
+// Close stops recording and waits for queued events to be written.
+func (l *eventLog) Close() error {
+	l.mu.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.queue)
+	}
+	l.mu.Unlock()
+	<-l.done
+	return nil
+}
+
+// watch records every connection h opens or closes.
+func (l *eventLog) watch(h host.Host) {
+	h.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(_ network.Network, c network.Conn) {
+			l.Record(connEvent{Kind: eventConnected, Peer: c.RemotePeer(), Addr: c.RemoteMultiaddr().String()})
+		},
+		DisconnectedF: func(_ network.Network, c network.Conn) {
+			l.Record(connEvent{Kind: eventDisconnected, Peer: c.RemotePeer(), Addr: c.RemoteMultiaddr().String()})
+		},
+	})
+}
+
+// formatEvents renders events for /events.
+func formatEvents(events []connEvent) string {
+	if len(events) == 0 {
+		return "📜 No connection events yet."
+	}
+	var b strings.Builder
+	b.WriteString("📜 Connection events:")
+	for _, e := range events {
+		fmt.Fprintf(&b, "\n   %s", e)
+	}
+	return b.String()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// hasEvent reports whether events include kind for id.
+func hasEvent(events []connEvent, kind string, id peer.ID) bool {
+	for _, e := range events {
+		if e.Kind == kind && e.Peer == id {
+			return true
+		}
+	}
+	return false
+}
+
+func TestEventLogConnectDisconnect(t *testing.T) {
+	alice := newTestNode(t, "alice")
+	bob := newTestNode(t, "bob")
+
+	if err := alice.Connect(nodeAddr(bob)); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	waitFor(t, "a CONNECTED event", func() bool {
+		return hasEvent(alice.events.Recent(-1), eventConnected, bob.host.ID())
+	})
+
+	alice.redial.Forget()
+	alice.host.Network().ClosePeer(bob.host.ID())
+	waitFor(t, "a DISCONNECTED event", func() bool {
+		return hasEvent(alice.events.Recent(-1), eventDisconnected, bob.host.ID())
+	})
+
+	// Presence events may follow, so look for the line among the rest
+	var lines []string
+	for _, e := range alice.events.Recent(-1) {
+		lines = append(lines, e.String())
+	}
+	if all := strings.Join(lines, "\n"); !strings.Contains(all, "DISCONNECTED "+bob.host.ID().String()+" via /ip4/127.0.0.1/") {
+		t.Errorf("Unexpected event lines:\n%s", all)
+	}
+}
+
+func TestEventLogFileAndDialFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	l := newEventLog(2, path)
+	at := time.Date(2025, 1, 1, 15, 4, 5, 0, time.Local)
+	l.Record(connEvent{Time: at, Kind: eventDialFailed, Addr: "/ip4/10.0.0.1/tcp/4001", Error: "peer unreachable"})
+	l.Record(connEvent{Time: at, Kind: eventConnected})
+	l.Record(connEvent{Time: at, Kind: eventDisconnected})
+	l.Close()
+	l.Record(connEvent{Kind: eventConnected}) // after Close: ignored
+
+	if got := l.Recent(-1); len(got) != 2 || got[0].Kind != eventConnected || got[1].Kind != eventDisconnected {
+		t.Errorf("Expected the ring to keep the newest 2 events, got %+v", got)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open event log file: %v", err)
+	}
+	defer f.Close()
+	var lines []connEvent
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e connEvent
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatalf("Malformed event line %q: %v", sc.Text(), err)
+		}
+		lines = append(lines, e)
+	}
+	if len(lines) != 3 {
+		t.Fatalf("Expected every event in the file, got %d", len(lines))
+	}
+	if want := "15:04:05 DIAL_FAILED via /ip4/10.0.0.1/tcp/4001: peer unreachable"; lines[0].String() != want {
+		t.Errorf("Expected %q, got %q", want, lines[0].String())
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	host "github.com/libp2p/go-libp2p/core/host"
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// fileProtocol streams one file per stream: a JSON header line, the body
+// as chunks of a uvarint length and that many bytes ending with an empty
+// chunk, then the receiver answers with a fileReply line once it has
+// checked the SHA-256.
+const fileProtocol = "/artivus/file/1.0.0"
+
+const defaultMaxFileBytes = 100 << 20
+
+// fileChunkSize is the largest chunk a sender writes or a receiver accepts.
+const fileChunkSize = 64 << 10
+
+var (
+	errFileTooLarge     = errors.New("file too large")
+	errChecksumMismatch = errors.New("checksum mismatch")
+	errChunkTooLarge    = errors.New("file chunk too large")
+)
+
+type fileHeader struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type fileReply struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// formatBytes renders n for humans, e.g. 532B or 1.2MB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// sendFile streams the file at path to id, over a stream opened by opener,
+// and waits for the receiver to confirm the checksum. Files over maxBytes
+// are refused before any stream is opened, and the transfer gives up once
+// the receiver makes no progress for timeout. Writes are paced by id's
+// bucket in throttle, shared with chat, so a transfer can't crowd out
+// messages to other peers.
+func sendFile(ctx context.Context, h host.Host, opener streamOpener, throttle *peerThrottle, id peer.ID, path string, maxBytes int64, timeout time.Duration) (fileHeader, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileHeader{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return fileHeader{}, fmt.Errorf("%s is not a regular file", path)
+	}
+	if info.Size() > maxBytes {
+		return fileHeader{}, fmt.Errorf("%w: %s is %s, limit is %s", errFileTooLarge, path, formatBytes(info.Size()), formatBytes(maxBytes))
+	}
+	sum, err := fileSHA256(path)
+	if err != nil {
+		return fileHeader{}, err
+	}
+	hdr := fileHeader{Name: filepath.Base(path), Size: info.Size(), SHA256: sum}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return hdr, err
+	}
+	defer f.Close()
+
+	s, err := opener.open(ctx, h, id, fileProtocol)
+	if err != nil {
+		return hdr, err
+	}
+	defer s.Close()
+
+	data, err := json.Marshal(hdr)
+	if err != nil {
+		return hdr, err
+	}
+	w := bufio.NewWriter(throttle.Writer(ctx, id, deadlineWriter{s, timeout}))
+	w.Write(append(data, '\n'))
+	if _, err := writeChunks(w, io.LimitReader(f, hdr.Size)); err != nil {
+		s.Reset()
+		return hdr, err
+	}
+	if err := w.Flush(); err != nil {
+		s.Reset()
+		return hdr, err
+	}
+	s.CloseWrite()
+
+	s.SetReadDeadline(time.Now().Add(timeout))
+	line, err := readLine(bufio.NewReader(s))
+	if err != nil {
+		return hdr, fmt.Errorf("no confirmation from peer: %w", err)
+	}
+	var reply fileReply
+	if err := json.Unmarshal(line, &reply); err != nil {
+		return hdr, fmt.Errorf("malformed confirmation from peer: %w", err)
+	}
+	if !reply.OK {
+		return hdr, fmt.Errorf("peer rejected file: %s", reply.Error)
+	}
+	return hdr, nil
+}
+
+// writeChunks copies r to w as length-prefixed chunks of at most
+// fileChunkSize bytes, followed by the empty chunk that ends the body.
+func writeChunks(w io.Writer, r io.Reader) (int64, error) {
+	var prefix [binary.MaxVarintLen64]byte
+	buf := make([]byte, fileChunkSize)
+	var total int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if _, err := w.Write(prefix[:binary.PutUvarint(prefix[:], uint64(n))]); err != nil {
+				return total, err
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				return total, err
+			}
+			total += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+	_, err := w.Write([]byte{0})
+	return total, err
+}
+
+// readChunks copies chunks from r to w until the empty chunk, failing
+// rather than copying more than limit bytes in all.
+func readChunks(w io.Writer, r *bufio.Reader, limit int64) (int64, error) {
+	var total int64
+	for {
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return total, err
+		}
+		if size == 0 {
+			return total, nil
+		}
+		if size > fileChunkSize {
+			return total, fmt.Errorf("%w: %d bytes", errChunkTooLarge, size)
+		}
+		if total+int64(size) > limit {
+			return total, fmt.Errorf("%w: more than the %s announced", errFileTooLarge, formatBytes(limit))
+		}
+		n, err := io.CopyN(w, r, int64(size))
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// safeFileName strips any directory part a sender put in the header so a
+// file can't be written outside the downloads directory.
+func safeFileName(name string) string {
+	name = filepath.Base(filepath.Clean("/" + strings.ReplaceAll(name, "\\", "/")))
+	if name == "/" || name == "." || name == ".." {
+		return ""
+	}
+	return name
+}
+
+// reservePath claims dir/name, or dir/"name (n).ext" if that's taken, by
+// creating it empty. Creating with O_EXCL is what claims it, so two files
+// arriving under the same name at once can't both get the same path.
+func reservePath(dir, name string) (string, error) {
+	path := filepath.Join(dir, name)
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err == nil {
+			return path, f.Close()
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return "", err
+		}
+		path = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+	}
+}
+
+// receiveFile reads one header and body from r into dir. The body goes to
+// a temporary file that is only renamed into place, over a name claimed by
+// reservePath, once its size and SHA-256 match the header.
+func receiveFile(r *bufio.Reader, dir string, maxBytes int64) (string, fileHeader, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return "", fileHeader{}, err
+	}
+	var hdr fileHeader
+	if err := json.Unmarshal(line, &hdr); err != nil {
+		return "", hdr, fmt.Errorf("malformed file header: %w", err)
+	}
+	name := safeFileName(hdr.Name)
+	if name == "" {
+		return "", hdr, fmt.Errorf("invalid file name %q", hdr.Name)
+	}
+	if hdr.Size < 0 || hdr.Size > maxBytes {
+		return "", hdr, fmt.Errorf("%w: %s, limit is %s", errFileTooLarge, formatBytes(hdr.Size), formatBytes(maxBytes))
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", hdr, err
+	}
+	tmp, err := os.CreateTemp(dir, ".partial-*")
+	if err != nil {
+		return "", hdr, err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	n, err := readChunks(io.MultiWriter(tmp, hash), r, hdr.Size)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", hdr, err
+	}
+	if err != nil || n != hdr.Size {
+		return "", hdr, fmt.Errorf("file truncated: got %d of %d bytes", n, hdr.Size)
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != strings.ToLower(hdr.SHA256) {
+		return "", hdr, errChecksumMismatch
+	}
+
+	path, err := reservePath(dir, name)
+	if err != nil {
+		return "", hdr, err
+	}
+	// Replacing our own empty placeholder
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(path)
+		return "", hdr, err
+	}
+	return path, hdr, nil
+}
+
+// newFileHandler accepts files into dir, replying to the sender with the
+// outcome through throttle. Like a chat stream, one whose sender goes
+// quiet for streamIdleTimeout is dropped.
+func newFileHandler(dir string, maxBytes int64, throttle *peerThrottle) network.StreamHandler {
+	return func(s network.Stream) {
+		defer s.Close()
+		remote := s.Conn().RemotePeer()
+		path, hdr, err := receiveFile(bufio.NewReader(deadlineReader{s, streamIdleTimeout}), dir, maxBytes)
+
+		reply := fileReply{OK: err == nil}
+		if err != nil {
+			reply.Error = err.Error()
+			logger.Warn("rejected file", "peer_id", remote, "name", hdr.Name, "error", err)
+		} else {
+			out.Printf("📁 Received %s (%s, verified) from %s\n", filepath.Base(path), formatBytes(hdr.Size), peerName(remote))
+		}
+		data, _ := json.Marshal(reply)
+		throttle.Writer(context.Background(), remote, s).Write(append(data, '\n'))
+	}
+}
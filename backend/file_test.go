@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	host "github.com/libp2p/go-libp2p/core/host"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestFormatBytes(t *testing.T) {
+	tests := map[int64]string{
+		0:             "0B",
+		532:           "532B",
+		4096:          "4.0KB",
+		1258291:       "1.2MB",
+		5 * (1 << 30): "5.0GB",
+	}
+	for n, want := range tests {
+		if got := formatBytes(n); got != want {
+			t.Errorf("formatBytes(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
+
+func TestSafeFileName(t *testing.T) {
+	tests := map[string]string{
+		"notes.txt":           "notes.txt",
+		"../../etc/passwd":    "passwd",
+		"/abs/path/photo.png": "photo.png",
+		`..\..\win.ini`:       "win.ini",
+		"..":                  "",
+		"":                    "",
+	}
+	for in, want := range tests {
+		if got := safeFileName(in); got != want {
+			t.Errorf("safeFileName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestReservePathIsExclusive(t *testing.T) {
+	dir := t.TempDir()
+	paths := make([]string, 8)
+	var wg sync.WaitGroup
+	for i := range paths {
+		wg.Go(func() {
+			path, err := reservePath(dir, "report.txt")
+			if err != nil {
+				t.Errorf("Failed to reserve a path: %v", err)
+			}
+			paths[i] = path
+		})
+	}
+	wg.Wait()
+	slices.Sort(paths)
+	if got := slices.Compact(slices.Clone(paths)); len(got) != len(paths) {
+		t.Errorf("Expected every arrival to get its own path, got %v", paths)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "report (7).txt")); err != nil {
+		t.Errorf("Expected the names to be numbered up to (7): %v", err)
+	}
+}
+
+// connectedFilePair returns a sender connected to a receiver that saves
+// files into the returned directory.
+func connectedFilePair(t *testing.T) (host.Host, host.Host, string) {
+	t.Helper()
+	hostA, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host A: %v", err)
+	}
+	t.Cleanup(func() { hostA.Close() })
+	hostB, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host B: %v", err)
+	}
+	t.Cleanup(func() { hostB.Close() })
+
+	dir := t.TempDir()
+	hostB.SetStreamHandler(fileProtocol, newFileHandler(dir, 1<<20, nil))
+	if err := hostA.Connect(context.Background(), peer.AddrInfo{ID: hostB.ID(), Addrs: hostB.Addrs()}); err != nil {
+		t.Fatalf("Failed to connect host A to host B: %v", err)
+	}
+	return hostA, hostB, dir
+}
+
+func TestSendFile(t *testing.T) {
+	hostA, hostB, dir := connectedFilePair(t)
+
+	content := bytes.Repeat([]byte("artivus file transfer\n"), 10000)
+	src := filepath.Join(t.TempDir(), "report.txt")
+	if err := os.WriteFile(src, content, 0o600); err != nil {
+		t.Fatalf("Failed to write source file: %v", err)
+	}
+
+	hdr, err := sendFile(context.Background(), hostA, streamOpener{timeout: 5 * time.Second}, nil, hostB.ID(), src, 1<<20, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to send file: %v", err)
+	}
+	if hdr.Name != "report.txt" || hdr.Size != int64(len(content)) {
+		t.Errorf("Unexpected header: %+v", hdr)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "report.txt"))
+	if err != nil {
+		t.Fatalf("Failed to read received file: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Error("Received file differs from the original")
+	}
+
+	// A second copy doesn't overwrite the first
+	if _, err := sendFile(context.Background(), hostA, streamOpener{timeout: 5 * time.Second}, nil, hostB.ID(), src, 1<<20, 5*time.Second); err != nil {
+		t.Fatalf("Failed to send file again: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "report (1).txt")); err != nil {
+		t.Errorf("Expected second copy to be saved alongside: %v", err)
+	}
+}
+
+func TestSendFileChecksumMismatch(t *testing.T) {
+	hostA, hostB, dir := connectedFilePair(t)
+
+	s, err := hostA.NewStream(context.Background(), hostB.ID(), fileProtocol)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	defer s.Close()
+	body := "tampered in transit"
+	hdr, _ := json.Marshal(fileHeader{Name: "evil.txt", Size: int64(len(body)), SHA256: strings.Repeat("0", 64)})
+	s.Write(append(hdr, '\n'))
+	writeChunks(s, strings.NewReader(body))
+	s.CloseWrite()
+
+	line, err := readLine(bufio.NewReader(s))
+	if err != nil {
+		t.Fatalf("Failed to read reply: %v", err)
+	}
+	var reply fileReply
+	if err := json.Unmarshal(line, &reply); err != nil {
+		t.Fatalf("Failed to parse reply: %v", err)
+	}
+	if reply.OK || !strings.Contains(reply.Error, errChecksumMismatch.Error()) {
+		t.Errorf("Expected checksum mismatch reply, got %+v", reply)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Errorf("Expected nothing saved after a mismatch, found %d entries", len(entries))
+	}
+}
+
+func TestFileHandlerDropsIdleSender(t *testing.T) {
+	old := streamIdleTimeout
+	streamIdleTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { streamIdleTimeout = old })
+	hostA, hostB, dir := connectedFilePair(t)
+
+	s, err := hostA.NewStream(context.Background(), hostB.ID(), fileProtocol)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	defer s.Close()
+	hdr, _ := json.Marshal(fileHeader{Name: "stalled.txt", Size: 1000, SHA256: strings.Repeat("0", 64)})
+	s.Write(append(hdr, '\n'))
+	// Half a chunk, then nothing, without closing
+	s.Write(binary.AppendUvarint(nil, 500))
+	s.Write(bytes.Repeat([]byte("x"), 250))
+
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := readLine(bufio.NewReader(s))
+	if err != nil {
+		t.Fatalf("Expected a reply once the receiver gave up, got %v", err)
+	}
+	var reply fileReply
+	if err := json.Unmarshal(line, &reply); err != nil || reply.OK {
+		t.Errorf("Expected the stalled transfer to be rejected, got %+v (%v)", reply, err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Expected nothing saved from a stalled transfer, found %d entries", len(entries))
+	}
+}
+
+func TestSendFileTooLarge(t *testing.T) {
+	hostA, hostB, _ := connectedFilePair(t)
+
+	src := filepath.Join(t.TempDir(), "big.bin")
+	if err := os.WriteFile(src, make([]byte, 2048), 0o600); err != nil {
+		t.Fatalf("Failed to write source file: %v", err)
+	}
+	if _, err := sendFile(context.Background(), hostA, streamOpener{timeout: 5 * time.Second}, nil, hostB.ID(), src, 1024, 5*time.Second); !errors.Is(err, errFileTooLarge) {
+		t.Errorf("Expected errFileTooLarge, got %v", err)
+	}
+}
+
+func TestChunks(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 2*fileChunkSize+10)
+	var wire bytes.Buffer
+	if n, err := writeChunks(&wire, bytes.NewReader(content)); err != nil || n != int64(len(content)) {
+		t.Fatalf("writeChunks = %d, %v", n, err)
+	}
+
+	var got bytes.Buffer
+	if n, err := readChunks(&got, bufio.NewReader(bytes.NewReader(wire.Bytes())), int64(len(content))); err != nil || n != int64(len(content)) {
+		t.Fatalf("readChunks = %d, %v", n, err)
+	}
+	if !bytes.Equal(got.Bytes(), content) {
+		t.Error("Chunked body differs from the original")
+	}
+
+	// More than announced, or a chunk bigger than any sender writes
+	if _, err := readChunks(io.Discard, bufio.NewReader(bytes.NewReader(wire.Bytes())), 100); !errors.Is(err, errFileTooLarge) {
+		t.Errorf("Expected errFileTooLarge past the limit, got %v", err)
+	}
+	huge := binary.AppendUvarint(nil, fileChunkSize+1)
+	if _, err := readChunks(io.Discard, bufio.NewReader(bytes.NewReader(huge)), 1<<30); !errors.Is(err, errChunkTooLarge) {
+		t.Errorf("Expected errChunkTooLarge, got %v", err)
+	}
+	// A body without the closing empty chunk was cut short
+	if _, err := readChunks(io.Discard, bufio.NewReader(bytes.NewReader(wire.Bytes()[:wire.Len()-1])), 1<<30); !errors.Is(err, io.EOF) {
+		t.Errorf("Expected EOF without the closing chunk, got %v", err)
+	}
+}
+
+func TestSendFileIsThrottled(t *testing.T) {
+	hostA, hostB, _ := connectedFilePair(t)
+	src := filepath.Join(t.TempDir(), "big.bin")
+	if err := os.WriteFile(src, make([]byte, 64_000), 0o600); err != nil {
+		t.Fatalf("Failed to write source file: %v", err)
+	}
+
+	// 64KB at 32KB/s: the first second's worth goes at once, the rest waits
+	start := time.Now()
+	if _, err := sendFile(context.Background(), hostA, streamOpener{timeout: 5 * time.Second}, newPeerThrottle(32_000), hostB.ID(), src, 1<<20, 5*time.Second); err != nil {
+		t.Fatalf("Failed to send file: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond {
+		t.Errorf("Expected the transfer to be paced, finished in %v", elapsed)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	connmgr "github.com/libp2p/go-libp2p/core/connmgr"
+	control "github.com/libp2p/go-libp2p/core/control"
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// gater enforces -allow and -block on every connection, in both
+// directions, before any protocol handler sees the peer. A blocked peer is
+// always refused; with a non-empty allowlist, so is everyone not on it.
+type gater struct {
+	allow map[peer.ID]struct{}
+	block map[peer.ID]struct{}
+}
+
+var _ connmgr.ConnectionGater = (*gater)(nil)
+
+func newGater(allow, block []peer.ID) *gater {
+	g := &gater{allow: make(map[peer.ID]struct{}), block: make(map[peer.ID]struct{})}
+	for _, id := range allow {
+		g.allow[id] = struct{}{}
+	}
+	for _, id := range block {
+		g.block[id] = struct{}{}
+	}
+	return g
+}
+
+// permits reports whether id may connect to us or be dialed.
+func (g *gater) permits(id peer.ID) bool {
+	if _, ok := g.block[id]; ok {
+		return false
+	}
+	if len(g.allow) == 0 {
+		return true
+	}
+	_, ok := g.allow[id]
+	return ok
+}
+
+func (g *gater) InterceptPeerDial(id peer.ID) bool {
+	return g.permits(id)
+}
+
+func (g *gater) InterceptAddrDial(id peer.ID, _ ma.Multiaddr) bool {
+	return g.permits(id)
+}
+
+// InterceptAccept allows every inbound connection through; the peer's
+// identity isn't known until the security handshake.
+func (g *gater) InterceptAccept(network.ConnMultiaddrs) bool {
+	return true
+}
+
+func (g *gater) InterceptSecured(dir network.Direction, id peer.ID, _ network.ConnMultiaddrs) bool {
+	if !g.permits(id) {
+		logger.Info("refused connection", "peer_id", id, "direction", dir)
+		return false
+	}
+	return true
+}
+
+func (g *gater) InterceptUpgraded(network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
+
+// parsePeerList turns -allow/-block entries into peer IDs. An entry that
+// isn't a peer ID is read as a file holding one ID per line; blank lines
+// and lines starting with # are skipped.
+func parsePeerList(entries []string) ([]peer.ID, error) {
+	var ids []peer.ID
+	for _, entry := range entries {
+		if id, err := peer.Decode(entry); err == nil {
+			ids = append(ids, id)
+			continue
+		}
+		f, err := os.Open(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q is neither a peer ID nor a readable file: %w", entry, err)
+		}
+		sc := bufio.NewScanner(f)
+		for line := 1; sc.Scan(); line++ {
+			text := strings.TrimSpace(sc.Text())
+			if text == "" || strings.HasPrefix(text, "#") {
+				continue
+			}
+			id, err := peer.Decode(text)
+			if err != nil {
+				f.Close()
+				return nil, fmt.Errorf("%s:%d: invalid peer ID %q: %w", entry, line, text, err)
+			}
+			ids = append(ids, id)
+		}
+		err = sc.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestGater(t *testing.T) {
+	friend, stranger, enemy := newTestPeerID(t), newTestPeerID(t), newTestPeerID(t)
+
+	tests := []struct {
+		name  string
+		g     *gater
+		id    peer.ID
+		allow bool
+	}{
+		{"no lists allows anyone", newGater(nil, nil), stranger, true},
+		{"blocked peer", newGater(nil, []peer.ID{enemy}), enemy, false},
+		{"unblocked peer", newGater(nil, []peer.ID{enemy}), stranger, true},
+		{"allowlisted peer", newGater([]peer.ID{friend}, nil), friend, true},
+		{"allowlist denies by default", newGater([]peer.ID{friend}, nil), stranger, false},
+		{"block beats allow", newGater([]peer.ID{enemy}, []peer.ID{enemy}), enemy, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.g.InterceptPeerDial(tt.id); got != tt.allow {
+				t.Errorf("InterceptPeerDial = %v, want %v", got, tt.allow)
+			}
+			if got := tt.g.InterceptSecured(network.DirInbound, tt.id, nil); got != tt.allow {
+				t.Errorf("InterceptSecured = %v, want %v", got, tt.allow)
+			}
+		})
+	}
+}
+
+func TestParsePeerList(t *testing.T) {
+	a, b, c := newTestPeerID(t), newTestPeerID(t), newTestPeerID(t)
+	path := filepath.Join(t.TempDir(), "allow.txt")
+	content := fmt.Sprintf("# friends\n%s\n\n  %s  \n", b, c)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write list: %v", err)
+	}
+
+	got, err := parsePeerList([]string{a.String(), path})
+	if err != nil {
+		t.Fatalf("Failed to parse list: %v", err)
+	}
+	if len(got) != 3 || got[0] != a || got[1] != b || got[2] != c {
+		t.Errorf("Expected [%s %s %s], got %v", a, b, c, got)
+	}
+
+	if _, err := parsePeerList([]string{"not-a-peer"}); err == nil {
+		t.Error("Expected an error for an entry that is neither an ID nor a file")
+	}
+	bad := filepath.Join(t.TempDir(), "bad.txt")
+	os.WriteFile(bad, []byte("garbage\n"), 0o600)
+	if _, err := parsePeerList([]string{bad}); err == nil {
+		t.Error("Expected an error for a file with an invalid ID")
+	}
+}
+
+func TestNodeRefusesBlockedPeer(t *testing.T) {
+	alice := newTestNode(t, "alice")
+	bob, err := NewNode(context.Background(), Config{
+		IdentityPath:       filepath.Join(t.TempDir(), "identity.key"),
+		NegotiationTimeout: 5 * time.Second,
+		Block:              []peer.ID{alice.host.ID()},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	t.Cleanup(func() { bob.Close() })
+
+	// The dial can look successful from alice's side; bob drops the
+	// connection as soon as alice's identity is known
+	addr := nodeAddr(bob)
+	alice.Connect(addr)
+	alice.Send("let me in")
+	waitFor(t, "bob to drop alice", func() bool {
+		return bob.host.Network().Connectedness(alice.host.ID()) != network.Connected
+	})
+	if got := bob.registry.List(); len(got) != 0 {
+		t.Errorf("Expected no registered peers, got %v", got)
+	}
+	if got := bob.history.Recent(-1); len(got) != 0 {
+		t.Errorf("Expected no messages from a blocked peer, got %+v", got)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// chatProtocolVersion is the message format this build speaks. Peers must
+// agree on the major version; minor versions only add optional fields.
+const chatProtocolVersion = "1.4.0"
+
+// controlFramesVersion is the first version that understands control
+// frames, e.g. contentTypeTyping, on chat streams.
+const controlFramesVersion = "1.2.0"
+
+// maxHandshakeBytes bounds the capabilities frame, which only ever carries
+// a version string, a flag and a nickname.
+const maxHandshakeBytes = 1024
+
+var (
+	errMalformedHandshake  = errors.New("malformed handshake")
+	errIncompatibleVersion = errors.New("incompatible protocol version")
+)
+
+// peerCapabilities is the first frame each side writes on a chat stream.
+type peerCapabilities struct {
+	ProtocolVersion    string `json:"protocolVersion"`
+	SupportsEncryption bool   `json:"supportsEncryption"`
+	Nick               string `json:"nick,omitempty"`
+}
+
+// majorVersion returns the leading number of a "major.minor.patch" version.
+func majorVersion(v string) (int, error) {
+	major, _, _ := strings.Cut(v, ".")
+	n, err := strconv.Atoi(major)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%w: bad protocol version %q", errMalformedHandshake, v)
+	}
+	return n, nil
+}
+
+// versionAtLeast reports whether the "major.minor.patch" version v is at
+// least want, comparing major and minor. A malformed v never is.
+func versionAtLeast(v, want string) bool {
+	parse := func(v string) (major, minor int, ok bool) {
+		parts := strings.SplitN(v, ".", 3)
+		if len(parts) < 2 {
+			return 0, 0, false
+		}
+		major, err1 := strconv.Atoi(parts[0])
+		minor, err2 := strconv.Atoi(parts[1])
+		return major, minor, err1 == nil && err2 == nil
+	}
+	major, minor, ok := parse(v)
+	wantMajor, wantMinor, _ := parse(want)
+	return ok && (major > wantMajor || major == wantMajor && minor >= wantMinor)
+}
+
+// capabilityStore remembers what each peer said in its last handshake.
+type capabilityStore struct {
+	mu   sync.Mutex
+	caps map[peer.ID]peerCapabilities
+}
+
+func newCapabilityStore() *capabilityStore {
+	return &capabilityStore{caps: make(map[peer.ID]peerCapabilities)}
+}
+
+func (c *capabilityStore) Set(id peer.ID, caps peerCapabilities) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.caps[id] = caps
+}
+
+func (c *capabilityStore) Get(id peer.ID) (peerCapabilities, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	caps, ok := c.caps[id]
+	return caps, ok
+}
+
+// handshaker runs the capabilities exchange for a node. local is called
+// per stream so a /nick change is picked up by the next handshake.
+type handshaker struct {
+	local   func() peerCapabilities
+	timeout time.Duration
+	peers   *capabilityStore
+}
+
+func newHandshaker(local func() peerCapabilities, timeout time.Duration) *handshaker {
+	return &handshaker{local: local, timeout: timeout, peers: newCapabilityStore()}
+}
+
+// performHandshake writes our capabilities to s and reads the peer's,
+// recording them on success. Both sides write first, so neither waits on
+// the other. A nil handshaker skips the exchange, which is how bare
+// streams in tests and tools talk to a handler directly.
+func (hs *handshaker) performHandshake(s network.Stream) (peerCapabilities, error) {
+	if hs == nil {
+		return peerCapabilities{}, nil
+	}
+	if hs.timeout > 0 {
+		s.SetDeadline(time.Now().Add(hs.timeout))
+		defer s.SetDeadline(time.Time{})
+	}
+	data, err := json.Marshal(hs.local())
+	if err != nil {
+		return peerCapabilities{}, err
+	}
+	if _, err := s.Write(append(data, '\n')); err != nil {
+		return peerCapabilities{}, err
+	}
+	caps, err := readHandshake(s)
+	if err != nil {
+		return caps, err
+	}
+	hs.peers.Set(s.Conn().RemotePeer(), caps)
+	return caps, nil
+}
+
+// readHandshake reads and checks one capabilities frame. It reads a byte at
+// a time so nothing after the frame is consumed; the stream's chat reader
+// takes over from exactly where the handshake ends.
+func readHandshake(r io.Reader) (peerCapabilities, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return peerCapabilities{}, err
+		}
+		if b[0] == '\n' {
+			break
+		}
+		if len(line) == maxHandshakeBytes {
+			return peerCapabilities{}, fmt.Errorf("%w: frame over %d bytes", errMalformedHandshake, maxHandshakeBytes)
+		}
+		line = append(line, b[0])
+	}
+
+	var caps peerCapabilities
+	if err := json.Unmarshal(line, &caps); err != nil {
+		return caps, fmt.Errorf("%w: %v", errMalformedHandshake, err)
+	}
+	theirs, err := majorVersion(caps.ProtocolVersion)
+	if err != nil {
+		return caps, err
+	}
+	ours, _ := majorVersion(chatProtocolVersion)
+	if theirs != ours {
+		return caps, fmt.Errorf("%w: peer speaks %s, we speak %s", errIncompatibleVersion, caps.ProtocolVersion, chatProtocolVersion)
+	}
+	caps.Nick = sanitizeNick(caps.Nick)
+	return caps, nil
+}
+
+// acceptHandshake runs performHandshake for an inbound chat stream. On
+// failure it logs why and closes the stream, reporting false.
+func (hs *handshaker) acceptHandshake(s network.Stream) bool {
+	if _, err := hs.performHandshake(s); err != nil {
+		remote := s.Conn().RemotePeer()
+		if errors.Is(err, errIncompatibleVersion) {
+			logger.Warn("closing stream from incompatible peer", "peer_id", remote, "error", err)
+		} else {
+			logger.Warn("handshake failed", "peer_id", remote, "error", err)
+		}
+		s.Close()
+		return false
+	}
+	return true
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestReadHandshake(t *testing.T) {
+	tests := []struct {
+		name    string
+		frame   string
+		wantErr error
+	}{
+		{"matching version", `{"protocolVersion":"1.0.0","supportsEncryption":true,"nick":"bob"}`, nil},
+		{"newer minor version", `{"protocolVersion":"1.5.0"}`, nil},
+		{"mismatched major version", `{"protocolVersion":"2.0.0","nick":"bob"}`, errIncompatibleVersion},
+		{"not json", `hello from an old peer`, errMalformedHandshake},
+		{"bad version", `{"protocolVersion":"v1"}`, errMalformedHandshake},
+		{"missing version", `{"nick":"bob"}`, errMalformedHandshake},
+		{"oversized frame", `{"nick":"` + strings.Repeat("a", maxHandshakeBytes) + `"}`, errMalformedHandshake},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readHandshake(strings.NewReader(tt.frame + "\n"))
+			if tt.wantErr == nil && err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("Expected %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestReadHandshakeLeavesChatUnread(t *testing.T) {
+	r := strings.NewReader(`{"protocolVersion":"1.0.0","nick":"bob"}` + "\nfirst message\n")
+	caps, err := readHandshake(r)
+	if err != nil {
+		t.Fatalf("Failed to read handshake: %v", err)
+	}
+	if caps.Nick != "bob" {
+		t.Errorf("Expected nick bob, got %q", caps.Nick)
+	}
+	rest, _ := io.ReadAll(r)
+	if string(rest) != "first message\n" {
+		t.Errorf("Expected the chat line to be left unread, got %q", rest)
+	}
+}
+
+func TestPerformHandshakeRecordsCapabilities(t *testing.T) {
+	ctx := context.Background()
+	hostA, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host A: %v", err)
+	}
+	defer hostA.Close()
+	hostB, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host B: %v", err)
+	}
+	defer hostB.Close()
+
+	hsA := newHandshaker(func() peerCapabilities {
+		return peerCapabilities{ProtocolVersion: chatProtocolVersion, Nick: "alice"}
+	}, 5*time.Second)
+	hsB := newHandshaker(func() peerCapabilities {
+		return peerCapabilities{ProtocolVersion: chatProtocolVersion, SupportsEncryption: true, Nick: "bob"}
+	}, 5*time.Second)
+	hostB.SetStreamHandler("/chat/1.0.0", func(s network.Stream) {
+		defer s.Close()
+		hsB.performHandshake(s)
+	})
+	if err := hostA.Connect(ctx, peer.AddrInfo{ID: hostB.ID(), Addrs: hostB.Addrs()}); err != nil {
+		t.Fatalf("Failed to connect host A to host B: %v", err)
+	}
+
+	s, err := hostA.NewStream(ctx, hostB.ID(), "/chat/1.0.0")
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	defer s.Close()
+	caps, err := hsA.performHandshake(s)
+	if err != nil {
+		t.Fatalf("Failed handshake: %v", err)
+	}
+	if caps.Nick != "bob" || !caps.SupportsEncryption {
+		t.Errorf("Expected bob's capabilities, got %+v", caps)
+	}
+	if stored, ok := hsA.peers.Get(hostB.ID()); !ok || stored != caps {
+		t.Errorf("Expected capabilities stored for host B, got %+v (ok %v)", stored, ok)
+	}
+	waitFor(t, "host B to store alice's capabilities", func() bool {
+		got, ok := hsB.peers.Get(hostA.ID())
+		return ok && got.Nick == "alice" && !got.SupportsEncryption
+	})
+}
+
+func TestChatHandlerClosesIncompatibleStream(t *testing.T) {
+	ctx := context.Background()
+	hostA, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host A: %v", err)
+	}
+	defer hostA.Close()
+	hostB, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host B: %v", err)
+	}
+	defer hostB.Close()
+
+	reg := newPeerRegistry()
+	history := newMessageLog(10)
+	hsB := newHandshaker(func() peerCapabilities {
+		return peerCapabilities{ProtocolVersion: chatProtocolVersion}
+	}, 5*time.Second)
+	hostB.SetStreamHandler("/chat/1.0.0", newChatHandler(reg, history, hsB, nil, nil))
+	if err := hostA.Connect(ctx, peer.AddrInfo{ID: hostB.ID(), Addrs: hostB.Addrs()}); err != nil {
+		t.Fatalf("Failed to connect host A to host B: %v", err)
+	}
+
+	s, err := hostA.NewStream(ctx, hostB.ID(), "/chat/1.0.0")
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	defer s.Close()
+	fmt.Fprintln(s, `{"protocolVersion":"2.0.0","nick":"future"}`)
+	writeMessage(s, newChatMessage("", "future", "hello?"))
+
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := readHandshake(s); err != nil {
+		t.Fatalf("Expected host B's handshake frame, got %v", err)
+	}
+	if _, err := io.ReadAll(s); err != nil {
+		t.Fatalf("Expected host B to close the stream, got %v", err)
+	}
+	if got := history.Recent(-1); len(got) != 0 {
+		t.Errorf("Expected no messages from an incompatible peer, got %+v", got)
+	}
+	if got := reg.List(); len(got) != 0 {
+		t.Errorf("Expected an incompatible peer not to be registered, got %v", got)
+	}
+	if _, ok := hsB.peers.Get(hostA.ID()); ok {
+		t.Error("Expected no capabilities stored for an incompatible peer")
+	}
+}
+
+func TestVersionAtLeast(t *testing.T) {
+	tests := []struct {
+		v    string
+		want bool
+	}{
+		{"1.2.0", true},
+		{"1.10.0", true},
+		{"2.0.0", true},
+		{"1.1.9", false},
+		{"1", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := versionAtLeast(tt.v, "1.2.0"); got != tt.want {
+			t.Errorf("versionAtLeast(%q, 1.2.0) = %v, want %v", tt.v, got, tt.want)
+		}
+	}
+}
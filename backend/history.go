@@ -0,0 +1,418 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	bolt "go.etcd.io/bbolt"
+)
+
+const defaultHistorySize = 500
+
+// errAmbiguousMessage is a message ID prefix matching more than one
+// message in the log.
+var errAmbiguousMessage = errors.New("more than one message starts with that, give more of the ID")
+
+// Values of ChatMessage.Direction.
+const (
+	directionSent     = "sent"
+	directionReceived = "received"
+)
+
+// messageLog is a fixed-size ring buffer of sent and received messages.
+// Stream handlers add to it from their own goroutines.
+type messageLog struct {
+	mu    sync.Mutex
+	buf   []ChatMessage
+	next  int
+	count int
+	subs  map[chan ChatMessage]struct{}
+	// onAdd, if set, sees every message as it's added
+	onAdd func(ChatMessage)
+
+	// saveMu is held across saving each change to store and calling
+	// onAdd, so they happen in the order of the changes to buf without
+	// readers of the log waiting on the disk. It's taken before mu.
+	saveMu sync.Mutex
+	store  *historyStore
+}
+
+func newMessageLog(capacity int) *messageLog {
+	if capacity <= 0 {
+		capacity = defaultHistorySize
+	}
+	return &messageLog{buf: make([]ChatMessage, capacity)}
+}
+
+// Add records m, overwriting the oldest entry once the log is full. It is a
+// no-op on a nil log.
+func (l *messageLog) Add(m ChatMessage) {
+	if l == nil {
+		return
+	}
+	l.saveMu.Lock()
+	defer l.saveMu.Unlock()
+	l.mu.Lock()
+	l.buf[l.next] = m
+	l.next = (l.next + 1) % len(l.buf)
+	if l.count < len(l.buf) {
+		l.count++
+	}
+	for ch := range l.subs {
+		// A subscriber that falls behind misses messages rather than
+		// stalling every stream handler
+		select {
+		case ch <- m:
+		default:
+		}
+	}
+	l.mu.Unlock()
+	if l.store != nil {
+		if err := l.store.Put(m); err != nil {
+			logger.Warn("failed to save history", "error", err)
+		}
+	}
+	if l.onAdd != nil {
+		l.onAdd(m)
+	}
+}
+
+// Subscribe returns a channel receiving every message added from now on,
+// and a function that unsubscribes and closes it.
+func (l *messageLog) Subscribe() (<-chan ChatMessage, func()) {
+	ch := make(chan ChatMessage, 64)
+	l.mu.Lock()
+	if l.subs == nil {
+		l.subs = make(map[chan ChatMessage]struct{})
+	}
+	l.subs[ch] = struct{}{}
+	l.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			l.mu.Lock()
+			delete(l.subs, ch)
+			l.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// Recent returns up to n of the newest messages, oldest first.
+func (l *messageLog) Recent(n int) []ChatMessage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n > l.count || n < 0 {
+		n = l.count
+	}
+	out := make([]ChatMessage, n)
+	start := (l.next - n + len(l.buf)) % len(l.buf)
+	for i := range out {
+		out[i] = l.buf[(start+i)%len(l.buf)]
+	}
+	return out
+}
+
+// With returns up to n of the newest messages exchanged with id, oldest
+// first: those received from it, and ours that went to it directly.
+func (l *messageLog) With(id peer.ID, n int) []ChatMessage {
+	all := l.Recent(-1)
+	var out []ChatMessage
+	for i := len(all) - 1; i >= 0 && (n < 0 || len(out) < n); i-- {
+		m := all[i]
+		if m.Direction == directionReceived && m.From == id || m.Direction == directionSent && slices.Contains(m.To, id) {
+			out = append(out, all[i])
+		}
+	}
+	slices.Reverse(out)
+	return out
+}
+
+// Find returns the newest message with the given ID, reporting false if
+// it isn't in the log. It is safe on a nil log.
+func (l *messageLog) Find(id string) (ChatMessage, bool) {
+	if l == nil || id == "" {
+		return ChatMessage{}, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.count {
+		if m := l.buf[(l.next-1-i+len(l.buf))%len(l.buf)]; m.ID == id {
+			return m, true
+		}
+	}
+	return ChatMessage{}, false
+}
+
+// ResolveID expands ref, a message ID or the start of one as shown by
+// /history, to the full ID of a message in the log. A ref matching nothing
+// is returned as is, so a reply can still name a message we never saw.
+func (l *messageLog) ResolveID(ref string) (string, error) {
+	var match string
+	for _, m := range l.Recent(-1) {
+		if m.ID == ref {
+			return ref, nil
+		}
+		if m.ID == "" || !strings.HasPrefix(m.ID, ref) || m.ID == match {
+			continue
+		}
+		if match != "" {
+			return "", fmt.Errorf("%w: %s", errAmbiguousMessage, ref)
+		}
+		match = m.ID
+	}
+	if match == "" {
+		return ref, nil
+	}
+	return match, nil
+}
+
+// MarkRead records that by has read msgID, a message sent by from, and
+// returns the message. It reports false if the message isn't in the log or
+// by was already known to have read it.
+func (l *messageLog) MarkRead(from peer.ID, msgID string, by peer.ID) (ChatMessage, bool) {
+	if l == nil || msgID == "" {
+		return ChatMessage{}, false
+	}
+	l.saveMu.Lock()
+	defer l.saveMu.Unlock()
+	l.mu.Lock()
+	for i := range l.count {
+		m := &l.buf[(l.next-1-i+len(l.buf))%len(l.buf)]
+		if m.ID != msgID || m.From != from {
+			continue
+		}
+		read := markRead(m, by)
+		marked := *m
+		l.mu.Unlock()
+		if read && l.store != nil {
+			if err := l.store.Update(marked); err != nil {
+				logger.Warn("failed to save history", "error", err)
+			}
+		}
+		return marked, read
+	}
+	l.mu.Unlock()
+	return ChatMessage{}, false
+}
+
+// markRead adds by to m's readers, reporting false if it was there already.
+func markRead(m *ChatMessage, by peer.ID) bool {
+	if slices.Contains(m.ReadBy, by) {
+		return false
+	}
+	// Clip so copies handed out earlier keep their own slice
+	m.ReadBy = append(slices.Clip(m.ReadBy), by)
+	return true
+}
+
+// readMark is " ✓✓" if by has read m, or anyone has when by is "".
+func readMark(m ChatMessage, by peer.ID) string {
+	if by == "" && len(m.ReadBy) > 0 || by != "" && slices.Contains(m.ReadBy, by) {
+		return " ✓✓"
+	}
+	return ""
+}
+
+// formatHistoryLine shows m with its short ID, for /reply, and the short
+// ID of the message it answers, if any.
+func formatHistoryLine(m ChatMessage) string {
+	var reply, id string
+	if m.ReplyTo != "" {
+		reply = "↳ #" + shortMessageID(m.ReplyTo) + " "
+	}
+	if m.ID != "" {
+		id = "  #" + shortMessageID(m.ID)
+	}
+	return fmt.Sprintf("[%s] %s%s: %s%s%s", m.Time().Format("2006-01-02 15:04:05"), channelTag(m.Channel), displayName(m.Nick, m.From), reply, displayBody(m), id)
+}
+
+// attachFile opens the history store at path, loads its newest messages
+// into the log and saves every later Add to it, so history survives
+// restarts. Close releases the store.
+func (l *messageLog) attachFile(path string) error {
+	store, err := openHistoryStore(path)
+	if err != nil {
+		return err
+	}
+	msgs, err := store.Load(len(l.buf))
+	if err != nil {
+		store.Close()
+		return err
+	}
+	l.saveMu.Lock()
+	defer l.saveMu.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, m := range msgs {
+		l.buf[l.next] = m
+		l.next = (l.next + 1) % len(l.buf)
+		if l.count < len(l.buf) {
+			l.count++
+		}
+	}
+	l.store = store
+	return nil
+}
+
+// Close closes the history store, if one is attached. Later messages are
+// still logged, just not saved.
+func (l *messageLog) Close() error {
+	l.saveMu.Lock()
+	defer l.saveMu.Unlock()
+	if l.store == nil {
+		return nil
+	}
+	err := l.store.Close()
+	l.store = nil
+	return err
+}
+
+var (
+	historyMessages = []byte("messages")
+	historyIDs      = []byte("ids")
+	historyOutbox   = []byte("outbox")
+)
+
+// historyStore keeps the chat history in a BoltDB file. Messages are
+// stored as JSON in the messages bucket under an increasing sequence
+// number, and the ids bucket maps each message ID to its key so read
+// receipts can update the stored copy. The outbox bucket holds what's
+// queued for each offline peer, as a JSON array under its ID.
+type historyStore struct {
+	db *bolt.DB
+}
+
+// openHistoryStore opens the store at path, creating it if needed. It gives
+// up after a second if another process has it open.
+func openHistoryStore(path string) (*historyStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{historyMessages, historyIDs, historyOutbox} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &historyStore{db: db}, nil
+}
+
+// Put appends m to the store.
+func (s *historyStore) Put(m ChatMessage) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		msgs := tx.Bucket(historyMessages)
+		seq, err := msgs.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := binary.BigEndian.AppendUint64(nil, seq)
+		if err := msgs.Put(key, data); err != nil {
+			return err
+		}
+		if m.ID == "" {
+			return nil
+		}
+		return tx.Bucket(historyIDs).Put([]byte(m.ID), key)
+	})
+}
+
+// SaveQueue replaces the messages stored as queued for id with msgs,
+// removing the entry when there are none. The queue is written whole in
+// one transaction, so a crash leaves either the old one or the new one.
+func (s *historyStore) SaveQueue(id peer.ID, msgs []ChatMessage) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		queues := tx.Bucket(historyOutbox)
+		if len(msgs) == 0 {
+			return queues.Delete([]byte(id))
+		}
+		data, err := json.Marshal(msgs)
+		if err != nil {
+			return err
+		}
+		return queues.Put([]byte(id), data)
+	})
+}
+
+// LoadQueues returns every stored queue. A malformed one is skipped with a
+// warning rather than failing the rest.
+func (s *historyStore) LoadQueues() (map[peer.ID][]ChatMessage, error) {
+	queues := make(map[peer.ID][]ChatMessage)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(historyOutbox).ForEach(func(k, v []byte) error {
+			var msgs []ChatMessage
+			if err := json.Unmarshal(v, &msgs); err != nil {
+				logger.Warn("skipping malformed queued messages", "peer_id", peer.ID(k), "error", err)
+				return nil
+			}
+			queues[peer.ID(k)] = msgs
+			return nil
+		})
+	})
+	return queues, err
+}
+
+// Update replaces the stored message with m's ID by m. A message that was
+// never stored is left out.
+func (s *historyStore) Update(m ChatMessage) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		key := tx.Bucket(historyIDs).Get([]byte(m.ID))
+		if key == nil {
+			return nil
+		}
+		// Get's result is only valid until the transaction writes
+		return tx.Bucket(historyMessages).Put(slices.Clone(key), data)
+	})
+}
+
+// Load returns the last limit messages in the store, oldest first, or all
+// of them if limit <= 0. Records that don't decode are skipped.
+func (s *historyStore) Load(limit int) ([]ChatMessage, error) {
+	var msgs []ChatMessage
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(historyMessages).Cursor()
+		for k, v := c.Last(); k != nil && (limit <= 0 || len(msgs) < limit); k, v = c.Prev() {
+			var m ChatMessage
+			if err := json.Unmarshal(v, &m); err != nil {
+				logger.Warn("skipping malformed history record", "key", binary.BigEndian.Uint64(k))
+				continue
+			}
+			msgs = append(msgs, m)
+		}
+		return nil
+	})
+	slices.Reverse(msgs)
+	return msgs, err
+}
+
+func (s *historyStore) Close() error {
+	return s.db.Close()
+}
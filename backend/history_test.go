@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestMessageLogWraparound(t *testing.T) {
+	log := newMessageLog(3)
+	for i := 1; i <= 5; i++ {
+		log.Add(ChatMessage{Body: strconv.Itoa(i)})
+	}
+
+	got := log.Recent(10)
+	if len(got) != 3 {
+		t.Fatalf("Expected 3 entries after wraparound, got %d", len(got))
+	}
+	for i, want := range []string{"3", "4", "5"} {
+		if got[i].Body != want {
+			t.Errorf("Entry %d: got %q, want %q", i, got[i].Body, want)
+		}
+	}
+
+	last := log.Recent(2)
+	if len(last) != 2 || last[0].Body != "4" || last[1].Body != "5" {
+		t.Errorf("Unexpected Recent(2): %+v", last)
+	}
+}
+
+func TestMessageLogPartial(t *testing.T) {
+	log := newMessageLog(5)
+	if got := log.Recent(3); len(got) != 0 {
+		t.Errorf("Expected empty history, got %d entries", len(got))
+	}
+	log.Add(ChatMessage{Body: "only"})
+	if got := log.Recent(3); len(got) != 1 || got[0].Body != "only" {
+		t.Errorf("Unexpected history: %+v", got)
+	}
+}
+
+func TestFormatHistoryLine(t *testing.T) {
+	ts := time.Date(2024, 5, 6, 7, 8, 9, 0, time.Local)
+	m := ChatMessage{From: peer.ID("x"), Nick: "alice", Body: "hi", Timestamp: ts.Unix()}
+	got := formatHistoryLine(m)
+	if !strings.HasPrefix(got, "[2024-05-06 07:08:09] alice: hi") {
+		t.Errorf("Unexpected format: %q", got)
+	}
+}
+
+func TestFormatHistoryLineShowsIDs(t *testing.T) {
+	m := ChatMessage{ID: "5f0c2a9e-1111", ReplyTo: "9b7d4e21-2222", Nick: "alice", Body: "yes"}
+	if got := formatHistoryLine(m); !strings.HasSuffix(got, "alice: ↳ #9b7d4e21 yes  #5f0c2a9e") {
+		t.Errorf("Unexpected format: %q", got)
+	}
+}
+
+func TestMessageLogResolveID(t *testing.T) {
+	log := newMessageLog(5)
+	for _, id := range []string{"abc123", "abd456", "xyz789"} {
+		log.Add(ChatMessage{ID: id})
+	}
+	for ref, want := range map[string]string{"abc123": "abc123", "abd": "abd456", "x": "xyz789", "nope": "nope"} {
+		if got, err := log.ResolveID(ref); err != nil || got != want {
+			t.Errorf("ResolveID(%q): got %q, %v, want %q", ref, got, err, want)
+		}
+	}
+	if _, err := log.ResolveID("ab"); !errors.Is(err, errAmbiguousMessage) {
+		t.Errorf("Expected an ambiguous prefix to fail, got %v", err)
+	}
+}
+
+// openTestStore opens a history store in a fresh directory.
+func openTestStore(t *testing.T, path string) *historyStore {
+	t.Helper()
+	s, err := openHistoryStore(path)
+	if err != nil {
+		t.Fatalf("Failed to open history store: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestHistoryStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	s := openTestStore(t, path)
+	if msgs, err := s.Load(10); err != nil || len(msgs) != 0 {
+		t.Fatalf("Expected an empty history for a new store, got %v (err %v)", msgs, err)
+	}
+
+	var want []ChatMessage
+	for i := 0; i < 5; i++ {
+		want = append(want, ChatMessage{ID: strconv.Itoa(i), Nick: "alice", Body: "msg " + strconv.Itoa(i), Timestamp: int64(i), Direction: directionReceived})
+	}
+	want[4].To = []peer.ID{newTestPeerID(t)}
+	want[4].Direction = directionSent
+	for _, m := range want {
+		if err := s.Put(m); err != nil {
+			t.Fatalf("Failed to save message: %v", err)
+		}
+	}
+	s.Close()
+
+	s = openTestStore(t, path)
+	got, err := s.Load(3)
+	if err != nil {
+		t.Fatalf("Failed to load history: %v", err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("Expected 3 messages, got %d", len(got))
+	}
+	for i, m := range got {
+		if !reflect.DeepEqual(m, want[i+2]) {
+			t.Errorf("Message %d: got %+v, want %+v", i, m, want[i+2])
+		}
+	}
+}
+
+func TestMessageLogWith(t *testing.T) {
+	bob, carol := newTestPeerID(t), newTestPeerID(t)
+	l := newMessageLog(10)
+	l.Add(ChatMessage{ID: "1", From: bob, Direction: directionReceived})
+	l.Add(ChatMessage{ID: "2", To: []peer.ID{carol}, Direction: directionSent})
+	l.Add(ChatMessage{ID: "3", To: []peer.ID{bob, carol}, Direction: directionSent})
+	l.Add(ChatMessage{ID: "4", From: carol, Direction: directionReceived})
+	l.Add(ChatMessage{ID: "5", From: bob, Direction: directionReceived})
+	// Our own broadcast isn't a conversation with either of them
+	l.Add(ChatMessage{ID: "6", From: bob, Direction: directionSent})
+
+	ids := func(msgs []ChatMessage) string {
+		var s []string
+		for _, m := range msgs {
+			s = append(s, m.ID)
+		}
+		return strings.Join(s, ",")
+	}
+	if got := ids(l.With(bob, -1)); got != "1,3,5" {
+		t.Errorf("Expected messages 1,3,5 with bob, got %s", got)
+	}
+	if got := ids(l.With(carol, 2)); got != "3,4" {
+		t.Errorf("Expected the newest 2 with carol, got %s", got)
+	}
+}
+
+func TestHistoryStoreSkipsMalformedRecords(t *testing.T) {
+	s := openTestStore(t, filepath.Join(t.TempDir(), "history.db"))
+	s.Put(ChatMessage{ID: "1", Body: "first", Timestamp: 1})
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(historyMessages)
+		seq, _ := b.NextSequence()
+		return b.Put(binary.BigEndian.AppendUint64(nil, seq), []byte("not json at all"))
+	})
+	if err != nil {
+		t.Fatalf("Failed to write a bad record: %v", err)
+	}
+	s.Put(ChatMessage{ID: "2", Body: "second", Timestamp: 2})
+
+	got, err := s.Load(10)
+	if err != nil {
+		t.Fatalf("Failed to load history: %v", err)
+	}
+	if len(got) != 2 || got[0].Body != "first" || got[1].Body != "second" {
+		t.Errorf("Unexpected messages: %+v", got)
+	}
+}
+
+func TestMessageLogAttachFilePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	first := newMessageLog(10)
+	if err := first.attachFile(path); err != nil {
+		t.Fatalf("Failed to attach file: %v", err)
+	}
+	first.Add(ChatMessage{ID: "a", Body: "before restart", Timestamp: 1})
+	first.Close()
+
+	second := newMessageLog(10)
+	if err := second.attachFile(path); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	if got := second.Recent(10); len(got) != 1 || got[0].Body != "before restart" {
+		t.Errorf("Expected reloaded message, got %+v", got)
+	}
+}
+
+func TestMessageLogSavesInOrderWithoutBlockingReaders(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	first := newMessageLog(100)
+	if err := first.attachFile(path); err != nil {
+		t.Fatalf("Failed to attach file: %v", err)
+	}
+	// Reading the log while a message is being saved mustn't wait on it
+	var seen atomic.Int32
+	first.onAdd = func(ChatMessage) { seen.Store(int32(len(first.Recent(-1)))) }
+
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Go(func() { first.Add(ChatMessage{ID: strconv.Itoa(i), Timestamp: int64(i)}) })
+	}
+	wg.Wait()
+	if seen.Load() != 50 {
+		t.Errorf("Expected the last onAdd to see all 50 messages, got %d", seen.Load())
+	}
+	want := first.Recent(-1)
+	first.Close()
+
+	second := newMessageLog(100)
+	if err := second.attachFile(path); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	defer second.Close()
+	if got := second.Recent(-1); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected messages saved in the order they were logged\nwant %v\ngot  %v", want, got)
+	}
+}
+
+func TestMessageLogMarkReadPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	alice, bob := newTestPeerID(t), newTestPeerID(t)
+	first := newMessageLog(10)
+	if err := first.attachFile(path); err != nil {
+		t.Fatalf("Failed to attach file: %v", err)
+	}
+	first.Add(ChatMessage{ID: "a", From: alice, Body: "ours", Timestamp: 1})
+	first.Add(ChatMessage{ID: "b", From: bob, Body: "theirs", Timestamp: 2})
+
+	if _, ok := first.MarkRead(alice, "b", bob); ok {
+		t.Error("Expected a receipt for someone else's message to be ignored")
+	}
+	if m, ok := first.MarkRead(alice, "a", bob); !ok || m.Body != "ours" {
+		t.Errorf("Expected the first receipt to count, got %+v (%v)", m, ok)
+	}
+	if _, ok := first.MarkRead(alice, "a", bob); ok {
+		t.Error("Expected a repeated receipt not to count again")
+	}
+	first.Close()
+
+	second := newMessageLog(10)
+	if err := second.attachFile(path); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	got := second.Recent(10)
+	if len(got) != 2 || !slices.Equal(got[0].ReadBy, []peer.ID{bob}) || got[1].ReadBy != nil {
+		t.Errorf("Expected read state to survive a restart, got %+v", got)
+	}
+}
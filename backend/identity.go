@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	crypto "github.com/libp2p/go-libp2p/core/crypto"
+)
+
+// loadOrCreateIdentity reads the node's private key from path. On first run
+// it generates an Ed25519 key and writes it there with 0600 permissions, so
+// the Peer ID stays the same across restarts. A key file others can read is
+// tightened to 0600 with a warning.
+func loadOrCreateIdentity(path string) (crypto.PrivKey, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		priv, err := crypto.UnmarshalPrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("identity file %s is corrupt: %w", path, err)
+		}
+		if fi, err := os.Stat(path); err == nil && fi.Mode().Perm()&0o077 != 0 {
+			logger.Warn("identity file was readable by other users, restricting it to 0600", "path", path, "mode", fi.Mode().Perm())
+			if err := os.Chmod(path, 0o600); err != nil {
+				logger.Warn("failed to restrict identity file", "path", path, "error", err)
+			}
+		}
+		return priv, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read identity file %s: %w", path, err)
+	}
+	return createIdentity(path)
+}
+
+// regenerateIdentity replaces the key at path with a new one, for
+// -new-identity. The old key, if any, is kept next to it under
+// backupName, so running it again never loses an earlier key.
+func regenerateIdentity(path string) (crypto.PrivKey, error) {
+	old := backupName(path, time.Now())
+	err := os.Rename(path, old)
+	switch {
+	case err == nil:
+		logger.Info("moved the previous identity aside", "path", old)
+	case !errors.Is(err, fs.ErrNotExist):
+		return nil, fmt.Errorf("failed to move the old identity aside: %w", err)
+	}
+	return createIdentity(path)
+}
+
+// backupName is where regenerateIdentity keeps the key at path, e.g.
+// identity.key.old-20260102-150405, with a counter after the time if that
+// name is already taken.
+func backupName(path string, now time.Time) string {
+	base := path + ".old-" + now.Format("20060102-150405")
+	name := base
+	for i := 2; ; i++ {
+		if _, err := os.Lstat(name); errors.Is(err, fs.ErrNotExist) {
+			return name
+		}
+		name = fmt.Sprintf("%s-%d", base, i)
+	}
+}
+
+// ephemeralIdentity generates a key that is only ever kept in memory, for
+// -ephemeral-identity. The path is ignored.
+func ephemeralIdentity(string) (crypto.PrivKey, error) {
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	return priv, err
+}
+
+// createIdentity generates an Ed25519 key and writes it to path with 0600
+// permissions, creating the directory if needed.
+func createIdentity(path string) (crypto.PrivKey, error) {
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	data, err := crypto.MarshalPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create identity directory: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return nil, fmt.Errorf("failed to write identity file %s: %w", path, err)
+	}
+	return priv, nil
+}
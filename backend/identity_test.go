@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	crypto "github.com/libp2p/go-libp2p/core/crypto"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestLoadOrCreateIdentityIsStable(t *testing.T) {
+	// The nested directory doesn't exist yet and must be created
+	path := filepath.Join(t.TempDir(), "nested", "identity.key")
+
+	first, err := loadOrCreateIdentity(path)
+	if err != nil {
+		t.Fatalf("Failed to create identity: %v", err)
+	}
+	second, err := loadOrCreateIdentity(path)
+	if err != nil {
+		t.Fatalf("Failed to load identity: %v", err)
+	}
+
+	idA, err := peer.IDFromPrivateKey(first)
+	if err != nil {
+		t.Fatalf("Failed to get peer ID: %v", err)
+	}
+	idB, err := peer.IDFromPrivateKey(second)
+	if err != nil {
+		t.Fatalf("Failed to get peer ID: %v", err)
+	}
+	if idA != idB {
+		t.Errorf("Peer ID changed between runs: %s != %s", idA, idB)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat identity file: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("Expected 0600 permissions, got %o", perm)
+	}
+}
+
+func TestLoadOrCreateIdentityCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity.key")
+	if err := os.WriteFile(path, []byte("not a key"), 0o600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if _, err := loadOrCreateIdentity(path); err == nil {
+		t.Error("Expected error for corrupt identity file, got nil")
+	}
+}
+
+func TestRegenerateIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity.key")
+	// With nothing to replace it just creates one
+	first, err := regenerateIdentity(path)
+	if err != nil {
+		t.Fatalf("Failed to create identity: %v", err)
+	}
+	second, err := regenerateIdentity(path)
+	if err != nil {
+		t.Fatalf("Failed to regenerate identity: %v", err)
+	}
+	if first.Equals(second) {
+		t.Error("Expected a new key")
+	}
+	loaded, err := loadOrCreateIdentity(path)
+	if err != nil || !loaded.Equals(second) {
+		t.Errorf("Expected the new key to be the one loaded, got %v", err)
+	}
+
+	// Every earlier key survives another regeneration
+	if _, err := regenerateIdentity(path); err != nil {
+		t.Fatalf("Failed to regenerate identity again: %v", err)
+	}
+	backups, _ := filepath.Glob(path + ".old-*")
+	if len(backups) != 2 {
+		t.Fatalf("Expected two backups, got %v", backups)
+	}
+	var kept []crypto.PrivKey
+	for _, b := range backups {
+		key, err := loadOrCreateIdentity(b)
+		if err != nil {
+			t.Fatalf("Failed to load backup %s: %v", b, err)
+		}
+		kept = append(kept, key)
+	}
+	keptKey := func(want crypto.PrivKey) bool {
+		return slices.ContainsFunc(kept, func(k crypto.PrivKey) bool { return k.Equals(want) })
+	}
+	if !keptKey(first) || !keptKey(second) {
+		t.Error("Expected both previous keys to be kept")
+	}
+}
+
+func TestBackupName(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity.key")
+	now := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+	first := backupName(path, now)
+	if first != path+".old-20260102-150405" {
+		t.Errorf("Unexpected backup name %s", first)
+	}
+	os.WriteFile(first, nil, 0o600)
+	if second := backupName(path, now); second != first+"-2" {
+		t.Errorf("Expected a taken name to get a counter, got %s", second)
+	}
+}
+
+func TestLoadIdentityTightensPermissions(t *testing.T) {
+	logs := captureLogs(t)
+	path := filepath.Join(t.TempDir(), "identity.key")
+	if _, err := loadOrCreateIdentity(path); err != nil {
+		t.Fatalf("Failed to create identity: %v", err)
+	}
+	if err := os.Chmod(path, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadOrCreateIdentity(path); err != nil {
+		t.Fatalf("Failed to load identity: %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("Expected the key to be restricted to 0600, got %v, %v", info.Mode().Perm(), err)
+	}
+	if _, ok := logs.find("identity file was readable by other users, restricting it to 0600"); !ok {
+		t.Error("Expected a warning about the loose permissions")
+	}
+}
+
+func TestNewIdentityChangesPeerID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity.key")
+	start := func(fresh bool) peer.ID {
+		n, err := NewNode(context.Background(), Config{
+			IdentityPath:       path,
+			ListenAddrs:        loopbackListenAddrs,
+			NegotiationTimeout: 5 * time.Second,
+			NewIdentity:        fresh,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create node: %v", err)
+		}
+		defer n.Close()
+		return n.host.ID()
+	}
+	first := start(false)
+	if again := start(false); again != first {
+		t.Errorf("Expected the same peer ID across restarts, got %s then %s", first, again)
+	}
+	if fresh := start(true); fresh == first {
+		t.Error("Expected -new-identity to change the peer ID")
+	}
+}
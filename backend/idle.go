@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	host "github.com/libp2p/go-libp2p/core/host"
+)
+
+const offlineNotice = "💤 going offline (idle)"
+
+// idleWatcher calls onIdle once the local user has been inactive for
+// timeout. Every Touch pushes the deadline back and re-arms a watcher that
+// has already fired.
+type idleWatcher struct {
+	mu      sync.Mutex
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func newIdleWatcher(timeout time.Duration, onIdle func()) *idleWatcher {
+	return &idleWatcher{
+		timeout: timeout,
+		timer:   time.AfterFunc(timeout, onIdle),
+	}
+}
+
+// Touch records local activity. It is a no-op on a nil watcher so callers
+// don't need to check whether auto-disconnect is enabled.
+func (w *idleWatcher) Touch() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.timer.Reset(w.timeout)
+}
+
+func (w *idleWatcher) Stop() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.timer.Stop()
+}
+
+// disconnectAll tells every connected peer we're going away, then closes
+// all connections to them.
+func disconnectAll(ctx context.Context, h host.Host, hs *handshaker, notice string) {
+	for _, id := range h.Network().Peers() {
+		if s, err := h.NewStream(ctx, id, chatProtocol, legacyChatProtocol); err == nil {
+			if _, err := hs.performHandshake(s); err == nil {
+				m := newChatMessage(h.ID(), "", notice)
+				signMessage(&m, h.Peerstore().PrivKey(h.ID()))
+				writeMessage(s, m)
+			}
+			s.Close()
+		}
+		h.Network().ClosePeer(id)
+	}
+}
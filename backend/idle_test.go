@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"testing"
+	"time"
+
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestIdleWatcherFiresAfterTimeout(t *testing.T) {
+	fired := make(chan struct{}, 1)
+	w := newIdleWatcher(50*time.Millisecond, func() { fired <- struct{}{} })
+	defer w.Stop()
+
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		t.Fatal("Expected idle callback after timeout")
+	}
+}
+
+func TestIdleWatcherTouchResetsTimer(t *testing.T) {
+	fired := make(chan struct{}, 1)
+	w := newIdleWatcher(100*time.Millisecond, func() { fired <- struct{}{} })
+	defer w.Stop()
+
+	// Keep touching for well past the timeout
+	for i := 0; i < 5; i++ {
+		time.Sleep(50 * time.Millisecond)
+		w.Touch()
+	}
+	select {
+	case <-fired:
+		t.Fatal("Idle callback fired despite recent input")
+	default:
+	}
+
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		t.Fatal("Expected idle callback once input stopped")
+	}
+}
+
+func TestDisconnectAllSendsNotice(t *testing.T) {
+	ctx := context.Background()
+	hostA, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host A: %v", err)
+	}
+	defer hostA.Close()
+	hostB, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host B: %v", err)
+	}
+	defer hostB.Close()
+
+	received := make(chan string, 1)
+	hostB.SetStreamHandler("/chat/1.0.0", func(s network.Stream) {
+		m, err := readMessage(bufio.NewReader(s))
+		if err == nil {
+			received <- m.Body
+		}
+		s.Close()
+	})
+	if err := hostA.Connect(ctx, peer.AddrInfo{ID: hostB.ID(), Addrs: hostB.Addrs()}); err != nil {
+		t.Fatalf("Failed to connect host A to host B: %v", err)
+	}
+
+	disconnectAll(ctx, hostA, nil, offlineNotice)
+
+	select {
+	case got := <-received:
+		if got != offlineNotice {
+			t.Errorf("Expected offline notice, got %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Timeout waiting for offline notice")
+	}
+	if hostA.Network().Connectedness(hostB.ID()) == network.Connected {
+		t.Error("Expected host A to be disconnected from host B")
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// logger carries diagnostics (stream lifecycle, dial and discovery
+// failures) as structured records; chat and command output stay on con.
+// main replaces it from -log-level and -log-json.
+var logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+// newLogger builds a logger writing to w at level (debug, info, warn or
+// error), as JSON lines if asJSON is set.
+func newLogger(w io.Writer, level string, asJSON bool) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q (want debug, info, warn or error)", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	if asJSON {
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return slog.New(slog.NewTextHandler(w, opts)), nil
+}
+
+// LogWriter is where log records should go: into the TUI's message pane or
+// through the line editor on a terminal, so they don't break the prompt,
+// and to fallback (stderr) otherwise, so piped chat output stays free of
+// logs.
+func (c *console) LogWriter(fallback io.Writer) io.Writer {
+	if c.ui != nil {
+		return c.ui
+	}
+	if c.term != nil {
+		return c.term
+	}
+	return fallback
+}
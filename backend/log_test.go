@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// captureHandler records every log record for inspection.
+type captureHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (h *captureHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *captureHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h *captureHandler) WithGroup(string) slog.Handler            { return h }
+
+func (h *captureHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, r.Clone())
+	return nil
+}
+
+// find returns the attributes of the first record with message msg.
+func (h *captureHandler) find(msg string) (map[string]any, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, r := range h.records {
+		if r.Message != msg {
+			continue
+		}
+		attrs := make(map[string]any)
+		r.Attrs(func(a slog.Attr) bool {
+			attrs[a.Key] = a.Value.Any()
+			return true
+		})
+		return attrs, true
+	}
+	return nil, false
+}
+
+// captureLogs swaps the package logger for one that records, until the
+// test ends.
+func captureLogs(t *testing.T) *captureHandler {
+	h := &captureHandler{}
+	old := logger
+	logger = slog.New(h)
+	t.Cleanup(func() { logger = old })
+	return h
+}
+
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := newLogger(&buf, "warn", true)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	l.Info("hidden")
+	l.Warn("send failed", "peer_id", "abc", "error", errors.New("boom"))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected only the warning to be logged, got %q", buf.String())
+	}
+	var rec map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &rec); err != nil {
+		t.Fatalf("Expected JSON output, got %q", lines[0])
+	}
+	if rec["msg"] != "send failed" || rec["peer_id"] != "abc" || rec["error"] != "boom" || rec["level"] != "WARN" {
+		t.Errorf("Unexpected record: %v", rec)
+	}
+
+	if _, err := newLogger(&buf, "DEBUG", false); err != nil {
+		t.Errorf("Expected level names to be case-insensitive, got %v", err)
+	}
+	if _, err := newLogger(&buf, "chatty", false); err == nil {
+		t.Error("Expected error for unknown log level")
+	}
+}
+
+func TestBroadcastLogsFailures(t *testing.T) {
+	logs := captureLogs(t)
+
+	reg := newPeerRegistry()
+	id := peer.ID("failing-peer")
+	reg.Add(peer.AddrInfo{ID: id})
+	send := func(context.Context, peer.ID, ChatMessage) error { return errors.New("stream reset") }
+
+	if res := broadcast(context.Background(), reg.List(), send, newChatMessage("", "", "hi"), 1); res.sent != 0 {
+		t.Errorf("Expected no successful sends, got %d", res.sent)
+	}
+	attrs, ok := logs.find("failed to send")
+	if !ok {
+		t.Fatal("Expected a failed send to be logged")
+	}
+	if attrs["peer_id"] != id {
+		t.Errorf("Expected peer_id %s, got %v", id, attrs["peer_id"])
+	}
+	if err, _ := attrs["error"].(error); err == nil || err.Error() != "stream reset" {
+		t.Errorf("Expected error attribute, got %v", attrs["error"])
+	}
+}
+
+func TestNodeUsesConfiguredLogger(t *testing.T) {
+	h := &captureHandler{}
+	// A directory can't be read as a history file
+	n, err := NewNode(context.Background(), Config{
+		IdentityPath:       filepath.Join(t.TempDir(), "identity.key"),
+		HistoryFile:        t.TempDir(),
+		NegotiationTimeout: 5 * time.Second,
+		Logger:             slog.New(h),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer n.Close()
+
+	if _, ok := h.find("failed to load history"); !ok {
+		t.Error("Expected history failure on the node's logger")
+	}
+}
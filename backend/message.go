@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// chatProtocol carries chat as ChatMessage envelopes, one JSON object per
+// line and nothing else. legacyChatProtocol is the compatibility shim for
+// peers that predate it: the same envelopes, plus bare text lines from
+// the oldest clients. Streams are opened with chatProtocol when the peer
+// has it and legacyChatProtocol otherwise.
+const (
+	chatProtocol       = "/chat/2.0.0"
+	legacyChatProtocol = "/chat/1.0.0"
+)
+
+// errMalformedEnvelope is a chatProtocol line that isn't a JSON envelope.
+var errMalformedEnvelope = errors.New("malformed message envelope")
+
+// ChatMessage is the wire envelope for chatProtocol: one JSON object per
+// line.
+type ChatMessage struct {
+	ID        string  `json:"id"`
+	From      peer.ID `json:"from,omitempty"`
+	Nick      string  `json:"nick,omitempty"`
+	Body      string  `json:"body"`
+	Timestamp int64   `json:"ts"`
+	// ContentType is the MIME type of Body, "" meaning contentTypeText.
+	// Added in protocol 1.1.0; older peers ignore it.
+	ContentType string `json:"contentType,omitempty"`
+	// ReplyTo is the ID of the message this one answers, "" if it isn't a
+	// reply. Added in protocol 1.4.0; older peers show a plain message.
+	ReplyTo string `json:"replyTo,omitempty"`
+	// Channel is the channel the message was sent on, "" for the default
+	// chatProtocol. Receivers set it from the stream's protocol.
+	Channel string `json:"channel,omitempty"`
+	// Encoding is "gzip" when Body is a compressed, base64'd body; see
+	// compressMessage. It's only ever set on the wire.
+	Encoding string `json:"encoding,omitempty"`
+	// Signature is From's base64 signature over the message; see
+	// signMessage. Peers predating signing leave it empty.
+	Signature string `json:"sig,omitempty"`
+	// To lists the peers a direct message of ours went to. It's only set on
+	// the copy kept in the history, for /history <peer>.
+	To []peer.ID `json:"to,omitempty"`
+	// ReadBy lists the peers that sent a read receipt for a message of
+	// ours. Like To it's only kept in the history.
+	ReadBy []peer.ID `json:"readBy,omitempty"`
+	// Direction says whether we sent or received the message. It's only
+	// set on the history's copy; received messages are always marked
+	// directionReceived, whatever the sender put there.
+	Direction string `json:"direction,omitempty"`
+	// Device is which of our other devices mirrored the message to us
+	// over syncProtocol. Like To it's only kept in the history.
+	Device peer.ID `json:"device,omitempty"`
+}
+
+func newChatMessage(from peer.ID, nick, body string) ChatMessage {
+	return ChatMessage{
+		ID:        uuid.NewString(),
+		From:      from,
+		Nick:      nick,
+		Body:      body,
+		Timestamp: time.Now().Unix(),
+	}
+}
+
+// shortMessageID is the start of id that /history shows and /reply
+// accepts. Control characters are dropped, since a reply's ReplyTo is
+// whatever the peer put there.
+func shortMessageID(id string) string {
+	return truncateRunes(sanitizeNick(id), 8)
+}
+
+// contentTypeText is plain UTF-8 text, the only content older peers send.
+const contentTypeText = "text/plain"
+
+// contentTypeTyping marks a control frame saying the sender started or
+// stopped typing, with Body typingStarted or typingStopped. Control frames
+// have no ID, so they're never acknowledged, recorded or shown as chat.
+// Added in protocol 1.2.0.
+const contentTypeTyping = "application/vnd.artivus.typing"
+
+const (
+	typingStarted = "started"
+	typingStopped = "stopped"
+)
+
+// IsControl reports whether m is a control frame rather than chat.
+func (m ChatMessage) IsControl() bool {
+	return m.ContentType == contentTypeTyping
+}
+
+// newTypingFrame returns the control frame for active.
+func newTypingFrame(from peer.ID, nick string, active bool) ChatMessage {
+	body := typingStopped
+	if active {
+		body = typingStarted
+	}
+	return ChatMessage{From: from, Nick: nick, Body: body, ContentType: contentTypeTyping, Timestamp: time.Now().Unix()}
+}
+
+// IsText reports whether Body is text to show as is.
+func (m ChatMessage) IsText() bool {
+	return m.ContentType == "" || m.ContentType == contentTypeText || strings.HasPrefix(m.ContentType, contentTypeText+";")
+}
+
+// displayBody is what the terminal shows for m: the body if it's text,
+// otherwise just its type and size.
+func displayBody(m ChatMessage) string {
+	if m.IsText() {
+		return m.Body
+	}
+	return fmt.Sprintf("(%s, %s, not shown)", m.ContentType, formatBytes(int64(len(m.Body))))
+}
+
+// Time returns the message timestamp as a local time.
+func (m ChatMessage) Time() time.Time {
+	return time.Unix(m.Timestamp, 0)
+}
+
+func writeMessage(w io.Writer, m ChatMessage) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// maxMessageBytes caps one encoded message on the wire, newline included.
+// Set from -max-message-bytes.
+var maxMessageBytes = 64 * 1024
+
+// checkMessageSize reports whether m fits in maxMessageBytes once encoded,
+// so the sender can refuse it before a peer would reset the stream.
+func checkMessageSize(m ChatMessage) error {
+	if len(m.Body) > maxBodyBytes {
+		return fmt.Errorf("%w: body is %d bytes, limit is %d", ErrMessageTooLarge, len(m.Body), maxBodyBytes)
+	}
+	data, err := json.Marshal(compressMessage(m))
+	if err != nil {
+		return err
+	}
+	if len(data)+1 > maxMessageBytes {
+		return fmt.Errorf("%w: %d bytes encoded, limit is %d", ErrMessageTooLarge, len(data)+1, maxMessageBytes)
+	}
+	return nil
+}
+
+// readLine reads the next newline-terminated line from r, without the line
+// ending. A line longer than maxMessageBytes returns ErrMessageTooLarge
+// without buffering the rest of it.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	var buf []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(buf)+len(chunk) > maxMessageBytes {
+			return nil, ErrMessageTooLarge
+		}
+		buf = append(buf, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil && (err != io.EOF || len(buf) == 0) {
+			return nil, err
+		}
+		return bytes.TrimRight(buf, "\r\n"), nil
+	}
+}
+
+// readEnvelope reads the next line from r, which must be a JSON envelope,
+// and expands a compressed body.
+func readEnvelope(r *bufio.Reader) (ChatMessage, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return ChatMessage{}, err
+	}
+	return parseEnvelope(line)
+}
+
+func parseEnvelope(line []byte) (ChatMessage, error) {
+	var m ChatMessage
+	if err := json.Unmarshal(line, &m); err != nil {
+		return ChatMessage{}, fmt.Errorf("%w: %w", errMalformedEnvelope, err)
+	}
+	return decompressMessage(m)
+}
+
+// readMessage is readEnvelope for legacyChatProtocol. Lines that aren't a
+// JSON envelope come from peers speaking the old plaintext format and are
+// returned as the body of an otherwise empty message.
+func readMessage(r *bufio.Reader) (ChatMessage, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return ChatMessage{}, err
+	}
+	m, err := parseEnvelope(line)
+	if errors.Is(err, errMalformedEnvelope) {
+		return ChatMessage{Body: string(line), Timestamp: time.Now().Unix()}, nil
+	}
+	return m, err
+}
+
+const maxNickRunes = 32
+
+// sanitizeNick trims a nickname, drops control characters and caps it at
+// maxNickRunes so a peer can't smuggle terminal escapes or walls of text
+// into every line we print.
+func sanitizeNick(nick string) string {
+	nick = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, nick)
+	return truncateRunes(strings.TrimSpace(nick), maxNickRunes)
+}
+
+// shortID is the tail of a peer ID, which is the part that differs between
+// Ed25519 keys (they all start with 12D3KooW).
+func shortID(id peer.ID) string {
+	s := id.String()
+	if len(s) <= 8 {
+		return s
+	}
+	return s[len(s)-8:]
+}
+
+// displayName is the sanitized nick, or the peer's alias or short ID when
+// none is set.
+func displayName(nick string, id peer.ID) string {
+	if nick = sanitizeNick(nick); nick != "" {
+		return nick
+	}
+	return peerName(id)
+}
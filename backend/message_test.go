@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	crypto "github.com/libp2p/go-libp2p/core/crypto"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	priv, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	from, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		t.Fatalf("Failed to get peer ID: %v", err)
+	}
+
+	var buf bytes.Buffer
+	want := newChatMessage(from, "alice", "hello\nwith a newline")
+	if err := writeMessage(&buf, want); err != nil {
+		t.Fatalf("Failed to write message: %v", err)
+	}
+	if n := strings.Count(buf.String(), "\n"); n != 1 {
+		t.Errorf("Expected exactly one line on the wire, got %d", n)
+	}
+
+	got, err := readMessage(bufio.NewReader(&buf))
+	if err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Round trip mismatch: got %+v, want %+v", got, want)
+	}
+	if want.ID == "" {
+		t.Error("Expected message to have an ID")
+	}
+}
+
+func TestReadMessageLegacyPlaintext(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("hello from an old peer\n"))
+	m, err := readMessage(r)
+	if err != nil {
+		t.Fatalf("Failed to read legacy line: %v", err)
+	}
+	if m.Body != "hello from an old peer" {
+		t.Errorf("Expected legacy body, got %q", m.Body)
+	}
+	if _, err := readMessage(r); err == nil {
+		t.Error("Expected error at end of stream")
+	}
+}
+
+func TestReadMessageSizeLimit(t *testing.T) {
+	old := maxMessageBytes
+	maxMessageBytes = 8 * 1024
+	defer func() { maxMessageBytes = old }()
+
+	// Longer than bufio's default buffer but within the limit
+	fits := strings.Repeat("a", 6*1024)
+	m, err := readMessage(bufio.NewReader(strings.NewReader(fits + "\n")))
+	if err != nil || m.Body != fits {
+		t.Errorf("Expected %d-byte line to be accepted, got err %v", len(fits), err)
+	}
+
+	huge := strings.Repeat("a", 10*1024) + "\n"
+	if _, err := readMessage(bufio.NewReader(strings.NewReader(huge))); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("Expected ErrMessageTooLarge, got %v", err)
+	}
+}
+
+func TestCheckMessageSize(t *testing.T) {
+	old := maxMessageBytes
+	maxMessageBytes = 256
+	defer func() { maxMessageBytes = old }()
+
+	if err := checkMessageSize(newChatMessage("", "", "short")); err != nil {
+		t.Errorf("Expected short message to fit, got %v", err)
+	}
+	if err := checkMessageSize(newChatMessage("", "", strings.Repeat("x", 256))); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("Expected ErrMessageTooLarge, got %v", err)
+	}
+}
+
+func TestDisplayBody(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        string
+	}{
+		{"", "hi"},
+		{"text/plain", "hi"},
+		{"text/plain; charset=utf-8", "hi"},
+		{"image/png", "(image/png, 2B, not shown)"},
+	}
+	for _, tt := range tests {
+		if got := displayBody(ChatMessage{Body: "hi", ContentType: tt.contentType}); got != tt.want {
+			t.Errorf("displayBody with %q = %q, want %q", tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizeNick(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"  alice  ", "alice"},
+		{"bob\x1b[31mred", "bob[31mred"},
+		{"line\nbreak\ttab", "linebreaktab"},
+		{strings.Repeat("é", 40), strings.Repeat("é", 32)},
+		{"\x00\x07", ""},
+	}
+	for _, tt := range tests {
+		if got := sanitizeNick(tt.in); got != tt.want {
+			t.Errorf("sanitizeNick(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDisplayNameFallsBackToShortID(t *testing.T) {
+	id := peer.ID("12D3KooWabcdefghijkl")
+	if got := displayName("", id); got != shortID(id) {
+		t.Errorf("Expected short peer ID, got %q", got)
+	}
+	if got := displayName(" carol ", id); got != "carol" {
+		t.Errorf("Expected nick, got %q", got)
+	}
+}
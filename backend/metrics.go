@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	host "github.com/libp2p/go-libp2p/core/host"
+	metrics "github.com/libp2p/go-libp2p/core/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// nodeMetrics is what -metrics exports. Each Node has its own registry, so
+// several nodes in one process (as in tests) don't collide.
+type nodeMetrics struct {
+	registry         *prometheus.Registry
+	messagesSent     prometheus.Counter
+	messagesReceived prometheus.Counter
+	connFailures     prometheus.Counter
+}
+
+func newNodeMetrics(h host.Host, bw *metrics.BandwidthCounter) *nodeMetrics {
+	m := &nodeMetrics{
+		registry: prometheus.NewRegistry(),
+		messagesSent: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "artivus_messages_sent_total",
+			Help: "Chat messages sent, direct or to a room.",
+		}),
+		messagesReceived: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "artivus_messages_received_total",
+			Help: "Chat messages received, direct or from a room.",
+		}),
+		connFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "artivus_connection_failures_total",
+			Help: "Failed /connect calls and reconnect attempts.",
+		}),
+	}
+	m.registry.MustRegister(
+		m.messagesSent,
+		m.messagesReceived,
+		m.connFailures,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "artivus_active_peers",
+			Help: "Peers with at least one open connection.",
+		}, func() float64 { return float64(len(h.Network().Peers())) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "artivus_bytes_sent_total",
+			Help: "Bytes written to libp2p streams, all protocols.",
+		}, func() float64 { return float64(bw.GetBandwidthTotals().TotalOut) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "artivus_bytes_received_total",
+			Help: "Bytes read from libp2p streams, all protocols.",
+		}, func() float64 { return float64(bw.GetBandwidthTotals().TotalIn) }),
+		streamCollector{h},
+	)
+	return m
+}
+
+// observer returns the history hook that counts messages: ours as sent,
+// everyone else's as received.
+func (m *nodeMetrics) observer() func(ChatMessage) {
+	return func(msg ChatMessage) {
+		if msg.Direction == directionSent {
+			m.messagesSent.Inc()
+		} else {
+			m.messagesReceived.Inc()
+		}
+	}
+}
+
+// connFailed counts a failed dial. It is a no-op on nil metrics.
+func (m *nodeMetrics) connFailed() {
+	if m != nil {
+		m.connFailures.Inc()
+	}
+}
+
+var streamsDesc = prometheus.NewDesc(
+	"artivus_open_streams",
+	"Open streams by protocol and direction.",
+	[]string{"protocol", "direction"}, nil,
+)
+
+// streamCollector counts open streams when scraped, rather than tracking
+// every open and close.
+type streamCollector struct {
+	h host.Host
+}
+
+func (c streamCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- streamsDesc
+}
+
+func (c streamCollector) Collect(ch chan<- prometheus.Metric) {
+	counts := make(map[[2]string]int)
+	for _, conn := range c.h.Network().Conns() {
+		for _, s := range conn.GetStreams() {
+			counts[[2]string{string(s.Protocol()), strings.ToLower(s.Stat().Direction.String())}]++
+		}
+	}
+	for k, n := range counts {
+		ch <- prometheus.MustNewConstMetric(streamsDesc, prometheus.GaugeValue, float64(n), k[0], k[1])
+	}
+}
+
+// startMetrics serves the node's registry on addr at /metrics.
+func startMetrics(addr string, n *Node) (*http.Server, net.Addr, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.HandlerFor(n.metrics.registry, promhttp.HandlerOpts{}))
+	srv := &http.Server{Handler: mux}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("metrics endpoint stopped", "error", err)
+		}
+	}()
+	return srv, ln.Addr(), nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func counterValue(t *testing.T, c interface{ Write(*dto.Metric) error }) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		t.Fatalf("Failed to read metric: %v", err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestMetricsCountMessages(t *testing.T) {
+	alice, bob, _ := newTestPair(t)
+
+	if err := alice.Send("count me"); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	if got := counterValue(t, alice.metrics.messagesSent); got != 1 {
+		t.Errorf("Expected 1 message sent, got %v", got)
+	}
+	waitFor(t, "bob to count the message", func() bool {
+		return counterValue(t, bob.metrics.messagesReceived) == 1
+	})
+	if got := counterValue(t, bob.metrics.messagesSent); got != 0 {
+		t.Errorf("Expected bob to have sent nothing, got %v", got)
+	}
+}
+
+func TestMetricsConnectFailure(t *testing.T) {
+	n := newTestNode(t, "")
+	if err := n.Connect("/ip4/127.0.0.1/tcp/1/p2p/" + newTestPeerID(t).String()); err == nil {
+		t.Fatal("Expected the dial to fail")
+	}
+	if got := counterValue(t, n.metrics.connFailures); got != 1 {
+		t.Errorf("Expected 1 connection failure, got %v", got)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	alice, _, _ := newTestPair(t)
+	if err := alice.Send("scrape me"); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+
+	srv, addr, err := startMetrics("127.0.0.1:0", alice)
+	if err != nil {
+		t.Fatalf("Failed to start metrics endpoint: %v", err)
+	}
+	defer srv.Close()
+	resp, err := http.Get("http://" + addr.String() + "/metrics")
+	if err != nil {
+		t.Fatalf("Failed to GET /metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	for _, want := range []string{
+		"artivus_messages_sent_total 1",
+		"artivus_active_peers 1",
+		"artivus_bytes_sent_total",
+		`artivus_open_streams{direction="outbound",protocol="/chat/2.0.0"}`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("Expected %q in /metrics output:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	host "github.com/libp2p/go-libp2p/core/host"
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	motdProtocol = "/artivus/motd/1.0.0"
+	maxMOTDRunes = 500
+)
+
+// loadText returns the contents of arg if it names a readable file, and arg
+// itself otherwise. Used for both -motd and -banner.
+func loadText(arg string) string {
+	if data, err := os.ReadFile(arg); err == nil {
+		return strings.TrimRight(string(data), "\n")
+	}
+	return arg
+}
+
+func truncateRunes(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n])
+}
+
+// motdSender greets each peer with the message of the day the first time it
+// connects during this session. Reconnects don't repeat it.
+type motdSender struct {
+	h    host.Host
+	text string
+	mu   sync.Mutex
+	sent map[peer.ID]bool
+}
+
+func newMOTDSender(h host.Host, text string) *motdSender {
+	m := &motdSender{
+		h:    h,
+		text: truncateRunes(text, maxMOTDRunes),
+		sent: make(map[peer.ID]bool),
+	}
+	h.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(_ network.Network, c network.Conn) {
+			// Notifiee callbacks run on the swarm's goroutine; don't dial here
+			go m.greet(c.RemotePeer())
+		},
+	})
+	return m
+}
+
+func (m *motdSender) greet(id peer.ID) {
+	m.mu.Lock()
+	if m.sent[id] {
+		m.mu.Unlock()
+		return
+	}
+	m.sent[id] = true
+	m.mu.Unlock()
+
+	s, err := m.h.NewStream(context.Background(), id, motdProtocol)
+	if err != nil {
+		logger.Warn("failed to send MOTD", "peer_id", id, "error", err)
+		return
+	}
+	defer s.Close()
+	s.Write([]byte(m.text))
+}
+
+func handleMOTD(s network.Stream) {
+	defer s.Close()
+	data, err := io.ReadAll(io.LimitReader(s, maxMOTDRunes*4))
+	if err != nil {
+		return
+	}
+	text := truncateRunes(string(data), maxMOTDRunes)
+	out.Printf("📢 MOTD from %s:\n%s\n", s.Conn().RemotePeer(), text)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestMOTDSentOnceOnFirstConnect(t *testing.T) {
+	ctx := context.Background()
+	hostA, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host A: %v", err)
+	}
+	defer hostA.Close()
+	hostB, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host B: %v", err)
+	}
+	defer hostB.Close()
+
+	received := make(chan string, 4)
+	hostB.SetStreamHandler(motdProtocol, func(s network.Stream) {
+		data, _ := io.ReadAll(s)
+		received <- string(data)
+		s.Close()
+	})
+	newMOTDSender(hostA, "welcome to the node")
+
+	infoB := peer.AddrInfo{ID: hostB.ID(), Addrs: hostB.Addrs()}
+	if err := hostA.Connect(ctx, infoB); err != nil {
+		t.Fatalf("Failed to connect host A to host B: %v", err)
+	}
+	select {
+	case got := <-received:
+		if got != "welcome to the node" {
+			t.Errorf("Unexpected MOTD: %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for MOTD")
+	}
+
+	// Reconnecting in the same session must not repeat it
+	hostA.Network().ClosePeer(hostB.ID())
+	if err := hostA.Connect(ctx, infoB); err != nil {
+		t.Fatalf("Failed to reconnect host A to host B: %v", err)
+	}
+	select {
+	case got := <-received:
+		t.Errorf("MOTD repeated on reconnect: %q", got)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestLoadTextAndTruncate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "motd.txt")
+	if err := os.WriteFile(path, []byte("from a file\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if got := loadText(path); got != "from a file" {
+		t.Errorf("Expected file contents, got %q", got)
+	}
+	if got := loadText("plain text"); got != "plain text" {
+		t.Errorf("Expected literal text, got %q", got)
+	}
+	long := strings.Repeat("é", maxMOTDRunes+10)
+	if got := truncateRunes(long, maxMOTDRunes); len([]rune(got)) != maxMOTDRunes {
+		t.Errorf("Expected %d runes, got %d", maxMOTDRunes, len([]rune(got)))
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	libp2p "github.com/libp2p/go-libp2p"
+	event "github.com/libp2p/go-libp2p/core/event"
+	host "github.com/libp2p/go-libp2p/core/host"
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	autonat "github.com/libp2p/go-libp2p/p2p/host/autonat"
+	autorelay "github.com/libp2p/go-libp2p/p2p/host/autorelay"
+	relayproto "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/proto"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// buildNATOptions answers AutoNAT probes for other peers, so nodes running
+// this app can tell each other whether they're reachable, and lets the node
+// reserve a slot on a relay once AutoNAT decides it's behind a NAT: one of
+// relays if any are set, else one of the peers candidates returns. Hole
+// punching (DCUtR) then tries to replace relayed connections with direct
+// ones.
+func buildNATOptions(relays []string, candidates func() []peer.AddrInfo) ([]libp2p.Option, error) {
+	opts := []libp2p.Option{libp2p.EnableNATService(), libp2p.EnableHolePunching()}
+	if len(relays) == 0 {
+		if candidates != nil {
+			opts = append(opts, libp2p.EnableAutoRelayWithPeerSource(relaySource(candidates)))
+		}
+		return opts, nil
+	}
+	infos := make([]peer.AddrInfo, 0, len(relays))
+	for _, addr := range relays {
+		info, err := peer.AddrInfoFromString(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid relay address %q: %w", addr, err)
+		}
+		infos = append(infos, *info)
+	}
+	return append(opts, libp2p.EnableAutoRelayWithStaticRelays(infos)), nil
+}
+
+// relaySource offers AutoRelay up to the number of peers it asks for from
+// candidates.
+func relaySource(candidates func() []peer.AddrInfo) autorelay.PeerSource {
+	return func(ctx context.Context, num int) <-chan peer.AddrInfo {
+		found := candidates()
+		found = found[:min(num, len(found))]
+		ch := make(chan peer.AddrInfo, len(found))
+		for _, info := range found {
+			ch <- info
+		}
+		close(ch)
+		return ch
+	}
+}
+
+// relayCandidates finds relays among the peers we're connected to, such as
+// those the DHT brings in, for nodes given no -relays. It's handed to
+// AutoRelay before the host exists, so the host is set afterwards; AutoRelay
+// doesn't ask for candidates until then.
+type relayCandidates struct {
+	h atomic.Value
+}
+
+func (c *relayCandidates) setHost(h host.Host) {
+	c.h.Store(h)
+}
+
+// List returns every connected peer that offers circuit relay v2.
+func (c *relayCandidates) List() []peer.AddrInfo {
+	h, _ := c.h.Load().(host.Host)
+	if h == nil {
+		return nil
+	}
+	var out []peer.AddrInfo
+	for _, id := range h.Network().Peers() {
+		if ok, _ := h.Peerstore().SupportsProtocols(id, relayproto.ProtoIDv2Hop); len(ok) > 0 {
+			out = append(out, peer.AddrInfo{ID: id, Addrs: h.Peerstore().Addrs(id)})
+		}
+	}
+	return out
+}
+
+// reachability is AutoNAT's current verdict on whether peers can dial h
+// directly. It's unknown until enough peers have probed us, and for hosts
+// not built by libp2p.New.
+func reachability(h host.Host) network.Reachability {
+	if bh, ok := h.(interface{ GetAutoNat() autonat.AutoNAT }); ok {
+		if an := bh.GetAutoNat(); an != nil {
+			return an.Status()
+		}
+	}
+	return network.ReachabilityUnknown
+}
+
+func reachabilityName(r network.Reachability) string {
+	return strings.ToLower(r.String())
+}
+
+// relayAddrs returns h's addresses that go through a relay circuit.
+func relayAddrs(h host.Host) []ma.Multiaddr {
+	var out []ma.Multiaddr
+	for _, addr := range h.Addrs() {
+		if isRelayedAddr(addr) {
+			out = append(out, addr)
+		}
+	}
+	return out
+}
+
+// watchRelayAddrs calls onAdded with every relayed address h gains, such as
+// when AutoRelay gets a reservation, until ctx is done.
+func watchRelayAddrs(ctx context.Context, h host.Host, onAdded func(ma.Multiaddr)) error {
+	sub, err := h.EventBus().Subscribe(new(event.EvtLocalAddressesUpdated))
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer sub.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e, ok := <-sub.Out():
+				if !ok {
+					return
+				}
+				for _, addr := range e.(event.EvtLocalAddressesUpdated).Current {
+					if addr.Action != event.Added {
+						continue
+					}
+					if isRelayedAddr(addr.Address) {
+						onAdded(addr.Address)
+					}
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// watchReachability calls onChange every time AutoNAT's verdict changes
+// until ctx is done.
+func watchReachability(ctx context.Context, h host.Host, onChange func(network.Reachability)) error {
+	sub, err := h.EventBus().Subscribe(new(event.EvtLocalReachabilityChanged))
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer sub.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e, ok := <-sub.Out():
+				if !ok {
+					return
+				}
+				onChange(e.(event.EvtLocalReachabilityChanged).Reachability)
+			}
+		}
+	}()
+	return nil
+}
+
+// printNAT is the /nat command.
+func printNAT(h host.Host, relaysConfigured bool) {
+	r := reachability(h)
+	out.Printf("🌐 Reachability: %s\n", reachabilityName(r))
+	for _, addr := range relayAddrs(h) {
+		out.Printf("   via relay: %s/p2p/%s\n", addr, h.ID())
+	}
+	if r == network.ReachabilityPrivate && !relaysConfigured {
+		out.Println("⚠️ Peers outside your network can't dial you; pass -relays to become reachable through a relay.")
+	}
+}
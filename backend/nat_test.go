@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	libp2p "github.com/libp2p/go-libp2p"
+	event "github.com/libp2p/go-libp2p/core/event"
+	host "github.com/libp2p/go-libp2p/core/host"
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestBuildNATOptions(t *testing.T) {
+	relay := newTestPeerID(t)
+	opts, err := buildNATOptions([]string{"/ip4/1.1.1.1/tcp/4001/p2p/" + relay.String()}, nil)
+	if err != nil {
+		t.Fatalf("Failed to build options: %v", err)
+	}
+	if len(opts) != 3 {
+		t.Errorf("Expected the NAT service, hole punching and auto-relay options, got %d", len(opts))
+	}
+	if opts, _ := buildNATOptions(nil, nil); len(opts) != 2 {
+		t.Errorf("Expected only the NAT service and hole punching without relays, got %d options", len(opts))
+	}
+	if opts, _ := buildNATOptions(nil, func() []peer.AddrInfo { return nil }); len(opts) != 3 {
+		t.Errorf("Expected auto-relay from candidates without relays, got %d options", len(opts))
+	}
+	if _, err := buildNATOptions([]string{"/ip4/1.1.1.1/tcp/4001"}, nil); err == nil {
+		t.Error("Expected an error for a relay address without a peer ID")
+	}
+}
+
+func TestReachability(t *testing.T) {
+	n := newTestNode(t, "")
+	if got := reachability(n.host); got != network.ReachabilityUnknown {
+		t.Errorf("Expected a fresh node to be unknown, got %s", got)
+	}
+
+	h, err := libp2p.New(libp2p.ListenAddrStrings(loopbackListenAddrs...), libp2p.ForceReachabilityPrivate())
+	if err != nil {
+		t.Fatalf("Failed to create host: %v", err)
+	}
+	defer h.Close()
+	if got := reachability(h); got != network.ReachabilityPrivate {
+		t.Errorf("Expected private, got %s", got)
+	}
+	if got := reachabilityName(reachability(h)); got != "private" {
+		t.Errorf("Expected the name private, got %q", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	seen := make(chan network.Reachability, 1)
+	if err := watchReachability(ctx, h, func(r network.Reachability) { seen <- r }); err != nil {
+		t.Fatalf("Failed to watch reachability: %v", err)
+	}
+	if got := <-seen; got != network.ReachabilityPrivate {
+		t.Errorf("Expected the watcher to report private, got %s", got)
+	}
+}
+
+// newTestRelay starts a host that offers circuit relay v2 on loopback.
+func newTestRelay(t *testing.T) host.Host {
+	t.Helper()
+	h, err := libp2p.New(libp2p.ListenAddrStrings(loopbackListenAddrs...), libp2p.EnableRelayService(), libp2p.ForceReachabilityPublic())
+	if err != nil {
+		t.Fatalf("Failed to create relay: %v", err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+func TestRelayCandidates(t *testing.T) {
+	relay := newTestRelay(t)
+	plain, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host: %v", err)
+	}
+	defer plain.Close()
+	client, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host: %v", err)
+	}
+	defer client.Close()
+
+	c := &relayCandidates{}
+	if got := c.List(); got != nil {
+		t.Errorf("Expected no candidates before the host is set, got %v", got)
+	}
+	c.setHost(client)
+	for _, h := range []host.Host{relay, plain} {
+		if err := client.Connect(context.Background(), peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()}); err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+	}
+	waitFor(t, "the relay to be offered", func() bool { return len(c.List()) > 0 })
+	if got := c.List(); len(got) != 1 || got[0].ID != relay.ID() {
+		t.Errorf("Expected only the relay, got %v", got)
+	}
+
+	var offered []peer.ID
+	for info := range relaySource(c.List)(context.Background(), 5) {
+		offered = append(offered, info.ID)
+	}
+	if len(offered) != 1 || offered[0] != relay.ID() {
+		t.Errorf("Expected the source to offer the relay, got %v", offered)
+	}
+}
+
+func TestWatchRelayAddrs(t *testing.T) {
+	h, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host: %v", err)
+	}
+	defer h.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	added := make(chan ma.Multiaddr, 4)
+	if err := watchRelayAddrs(ctx, h, func(addr ma.Multiaddr) { added <- addr }); err != nil {
+		t.Fatalf("Failed to watch relay addresses: %v", err)
+	}
+
+	// AutoRelay only builds circuits from a relay's public addresses, which
+	// loopback hosts don't have, so announce one the way the host would
+	em, err := h.EventBus().Emitter(new(event.EvtLocalAddressesUpdated))
+	if err != nil {
+		t.Fatalf("Failed to get emitter: %v", err)
+	}
+	defer em.Close()
+	direct := ma.StringCast("/ip4/1.2.3.4/tcp/4001")
+	relayed := ma.StringCast("/ip4/5.6.7.8/tcp/4001/p2p/" + newTestPeerID(t).String() + "/p2p-circuit")
+	em.Emit(event.EvtLocalAddressesUpdated{Current: []event.UpdatedAddress{
+		{Address: direct, Action: event.Added},
+		{Address: relayed, Action: event.Added},
+	}})
+	em.Emit(event.EvtLocalAddressesUpdated{Current: []event.UpdatedAddress{
+		{Address: relayed, Action: event.Maintained},
+	}})
+
+	select {
+	case addr := <-added:
+		if !addr.Equal(relayed) {
+			t.Errorf("Expected the relayed address, got %s", addr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for the relayed address")
+	}
+	select {
+	case addr := <-added:
+		t.Errorf("Expected only newly added relayed addresses, also got %s", addr)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestIsRelayedAddr(t *testing.T) {
+	relayed := ma.StringCast("/ip4/1.2.3.4/tcp/4001/p2p/12D3KooWRBy97UB99e3J6hiPesre1MZeuNQvfan4gBziswrRJsNK/p2p-circuit")
+	direct := ma.StringCast("/ip4/1.2.3.4/tcp/4001")
+	if !isRelayedAddr(relayed) || isRelayedAddr(direct) {
+		t.Error("Relayed address detection is wrong")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net"
+	"slices"
+	"time"
+)
+
+// ifaceWatcher polls the machine's interface addresses and reports changes
+// once they have held steady for settle, so a Wi-Fi flap that comes straight
+// back doesn't churn the advertised addresses.
+type ifaceWatcher struct {
+	addrs    func() ([]string, error)
+	interval time.Duration
+	settle   time.Duration
+	onChange func(added, removed []string)
+
+	known        []string
+	pending      []string
+	hasPending   bool
+	pendingSince time.Time
+}
+
+func newIfaceWatcher(interval, settle time.Duration, onChange func(added, removed []string)) *ifaceWatcher {
+	return &ifaceWatcher{
+		addrs:    interfaceAddrs,
+		interval: interval,
+		settle:   settle,
+		onChange: onChange,
+	}
+}
+
+func interfaceAddrs() ([]string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		out = append(out, a.String())
+	}
+	return out, nil
+}
+
+// run polls until ctx is cancelled.
+func (w *ifaceWatcher) run(ctx context.Context) {
+	w.known, _ = w.snapshot()
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			w.poll(now)
+		}
+	}
+}
+
+func (w *ifaceWatcher) snapshot() ([]string, error) {
+	cur, err := w.addrs()
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(cur)
+	return cur, nil
+}
+
+func (w *ifaceWatcher) poll(now time.Time) {
+	cur, err := w.snapshot()
+	if err != nil {
+		return
+	}
+	switch {
+	case slices.Equal(cur, w.known):
+		w.pending, w.hasPending = nil, false
+	case !w.hasPending || !slices.Equal(cur, w.pending):
+		w.pending, w.hasPending = cur, true
+		w.pendingSince = now
+	case now.Sub(w.pendingSince) >= w.settle:
+		added, removed := diffSorted(w.known, cur)
+		w.known, w.pending, w.hasPending = cur, nil, false
+		w.onChange(added, removed)
+	}
+}
+
+// diffSorted returns the entries only in next (added) and only in prev
+// (removed). Both slices must be sorted.
+func diffSorted(prev, next []string) (added, removed []string) {
+	for _, a := range next {
+		if _, found := slices.BinarySearch(prev, a); !found {
+			added = append(added, a)
+		}
+	}
+	for _, a := range prev {
+		if _, found := slices.BinarySearch(next, a); !found {
+			removed = append(removed, a)
+		}
+	}
+	return added, removed
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestIfaceWatcherReportsSettledChange(t *testing.T) {
+	current := []string{"10.0.0.2/24", "127.0.0.1/8"}
+	var changes [][2][]string
+	w := &ifaceWatcher{
+		addrs:  func() ([]string, error) { return slices.Clone(current), nil },
+		settle: 3 * time.Second,
+		onChange: func(added, removed []string) {
+			changes = append(changes, [2][]string{added, removed})
+		},
+	}
+	w.known, _ = w.snapshot()
+	start := time.Now()
+
+	// Switch from Wi-Fi to ethernet and stay there
+	current = []string{"127.0.0.1/8", "192.168.1.5/24"}
+	w.poll(start)
+	w.poll(start.Add(time.Second))
+	if len(changes) != 0 {
+		t.Fatalf("Change reported before it settled: %v", changes)
+	}
+	w.poll(start.Add(4 * time.Second))
+	if len(changes) != 1 {
+		t.Fatalf("Expected exactly one change, got %d", len(changes))
+	}
+	if !slices.Equal(changes[0][0], []string{"192.168.1.5/24"}) || !slices.Equal(changes[0][1], []string{"10.0.0.2/24"}) {
+		t.Errorf("Unexpected diff: added %v, removed %v", changes[0][0], changes[0][1])
+	}
+
+	// Nothing new to report while the interfaces stay put
+	w.poll(start.Add(10 * time.Second))
+	if len(changes) != 1 {
+		t.Errorf("Expected no further changes, got %d", len(changes))
+	}
+}
+
+func TestIfaceWatcherIgnoresFlap(t *testing.T) {
+	current := []string{"10.0.0.2/24"}
+	reported := false
+	w := &ifaceWatcher{
+		addrs:    func() ([]string, error) { return slices.Clone(current), nil },
+		settle:   3 * time.Second,
+		onChange: func(added, removed []string) { reported = true },
+	}
+	w.known, _ = w.snapshot()
+	start := time.Now()
+
+	// Interface drops and comes straight back
+	current = nil
+	w.poll(start)
+	current = []string{"10.0.0.2/24"}
+	w.poll(start.Add(time.Second))
+	w.poll(start.Add(5 * time.Second))
+	if reported {
+		t.Error("Transient flap should not be reported")
+	}
+}
@@ -0,0 +1,1158 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	libp2p "github.com/libp2p/go-libp2p"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	connmgr "github.com/libp2p/go-libp2p/core/connmgr"
+	crypto "github.com/libp2p/go-libp2p/core/crypto"
+	host "github.com/libp2p/go-libp2p/core/host"
+	metrics "github.com/libp2p/go-libp2p/core/metrics"
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	peerstore "github.com/libp2p/go-libp2p/core/peerstore"
+	routing "github.com/libp2p/go-libp2p/core/routing"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+var (
+	errNoAddressBook = errors.New("address book is disabled")
+	errDHTOff        = errors.New("the DHT is off; start with -dht to look peers up")
+)
+
+// Config is everything a Node needs to start. main fills it from flags.
+type Config struct {
+	IdentityPath       string
+	ListenAddrs        []string
+	Nick               string
+	PeerRate           int
+	NegotiationTimeout time.Duration
+	NegotiationRetries int
+	MOTD               string
+	MDNSTag            string
+	DHT                bool
+	Bootstrap          []string
+	DHTNamespace       string
+	WatchInterfaces    bool
+	HistorySize        int
+	HistoryFile        string
+	// DownloadsDir is where received files are saved.
+	DownloadsDir string
+	// MaxFileBytes caps files sent or accepted. Zero means
+	// defaultMaxFileBytes.
+	MaxFileBytes int64
+	// Secure sends chat sealed end to end: over ratchetChatProtocol, with
+	// forward secrecy, to peers new enough and /chat-secure/1.0.0 to the
+	// rest. Secure streams from peers are accepted either way.
+	Secure bool
+	// PlaintextPeers are peers direct chat goes to unencrypted even with
+	// Secure, e.g. a bot that logs what it's sent. Rooms are public and
+	// always go in the clear, as the gossip reaches whoever subscribes.
+	PlaintextPeers []peer.ID
+	// Logger receives the node's diagnostics. Nil means the package logger.
+	Logger *slog.Logger
+	// Relays are relay multiaddrs (with /p2p/ID) to reserve a slot on when
+	// AutoNAT finds the node isn't directly reachable.
+	Relays []string
+	// QueueSize caps how many messages are held per offline peer. Zero
+	// means defaultQueueSize.
+	QueueSize int
+	// AckTimeout is how long a sent message waits for every peer to
+	// confirm it before being reported unacked. Zero means
+	// defaultAckTimeout.
+	AckTimeout time.Duration
+	// Allow, if set, is the only peers that may connect or be dialed.
+	// Block peers are refused either way.
+	Allow []peer.ID
+	Block []peer.ID
+	// SendTimeout is how long a write to a peer may make no progress
+	// before the stream is reset. Zero means defaultSendTimeout.
+	SendTimeout time.Duration
+	// AddressBook is where /save keeps peer aliases. Empty disables the
+	// book.
+	AddressBook string
+	// HeartbeatInterval is how often connected peers are sent a presence
+	// heartbeat. Zero means defaultHeartbeatInterval.
+	HeartbeatInterval time.Duration
+	// Reconnect is the backoff used to redial peers passed to Connect when
+	// they drop. The zero value means defaultBackoff.
+	Reconnect backoff
+	// InboundRate is how many chat messages a second each peer may send
+	// us, in bursts of up to InboundBurst; extra ones are dropped. Zero
+	// disables the limit.
+	InboundRate  float64
+	InboundBurst int
+	// QUIC adds the QUIC transport alongside TCP, listening on both when
+	// ListenAddrs is empty and on the same port over QUIC for each TCP
+	// address otherwise, unless ListenAddrs names a QUIC one. Setting it
+	// along with TCPOnly is an error.
+	QUIC bool
+	// TCPOnly restricts the host to TCP. With neither it nor QUIC set,
+	// libp2p's default transports are used.
+	TCPOnly bool
+	// BroadcastWorkers caps how many peers a message is sent to at once.
+	// Zero means defaultBroadcastWorkers.
+	BroadcastWorkers int
+	// EventLogFile, if set, is where connection events are appended as
+	// JSON lines; they're kept in memory for /events either way.
+	EventLogFile string
+	// ConnLow and ConnHigh are the connection manager's watermarks: past
+	// ConnHigh connections, idle ones older than ConnGrace are closed
+	// until ConnLow remain. Peers we're chatting with are never trimmed.
+	// Zero values mean the defaults.
+	ConnLow   int
+	ConnHigh  int
+	ConnGrace time.Duration
+	// Devices are our other devices, each with its own identity. Every
+	// message we send or receive is mirrored to those connected over
+	// syncProtocol, and they aren't sent chat themselves.
+	Devices []peer.ID
+	// NewIdentity replaces the key at IdentityPath with a fresh one, so
+	// the node comes up with a new peer ID.
+	NewIdentity bool
+	// Ephemeral runs on a fresh key that is never written to disk, so the
+	// peer ID changes every run, and keeps no history file or address
+	// book. IdentityPath, NewIdentity, HistoryFile and AddressBook are
+	// ignored.
+	Ephemeral bool
+	// DHTMode is "client", "server" or "auto" (the default when empty):
+	// whether the DHT answers other peers' queries or only makes its own.
+	DHTMode string
+	// RetryExpiry is how long messages that peers didn't acknowledge keep
+	// being resent to them. Zero means defaultRetryExpiry.
+	RetryExpiry time.Duration
+	// QueueExpiry is how long a message queued for an offline peer waits
+	// before it's dropped unsent. Zero means defaultQueueExpiry.
+	QueueExpiry time.Duration
+	// Watchdog is how often to check that the host still listens and
+	// accepts connections. After watchdogFailures checks in a row fail it
+	// is rebuilt with the same identity and config. Zero disables it.
+	Watchdog time.Duration
+}
+
+// Node is a running chat peer: the libp2p host plus the peers we talk to and
+// the messages we've seen. main drives it from the REPL; tests drive it
+// directly.
+type Node struct {
+	cfg      Config
+	log      *slog.Logger
+	ctx      context.Context
+	cancel   context.CancelFunc
+	host     *swapHost
+	priv     crypto.PrivKey
+	registry *peerRegistry
+	history  *messageLog
+	mgr      *streamManager
+	hs       *handshaker
+	redial   *reconnector
+	outbox   *outbox
+	metrics  *nodeMetrics
+	bw       *metrics.BandwidthCounter
+	seen     *presenceTracker
+	flaps    *flapDebouncer
+	book     *addressBook
+	dedupe   *messageDeduper
+	inbound  *inboundLimiter
+	events   *eventLog
+	chats    *chatProtector
+	retry    *retrier
+	// devices are Config.Devices, less our own ID.
+	devices []peer.ID
+	// workers are the background loops; Close waits for them.
+	workers sync.WaitGroup
+
+	// outLocks serialize direct sends and queue flushes to each peer, so a
+	// message typed just as a peer reconnects can't overtake the ones
+	// queued before it, while sends to different peers run in parallel.
+	outLocks peerLocks
+
+	mu      sync.Mutex
+	nick    string
+	room    *room
+	closers []io.Closer
+	// channels are the channels joined besides the default one; channel
+	// is where Send goes, "" for the default.
+	channels map[string]bool
+	channel  string
+	// router looks up addresses for peers dialed by ID alone; nil until
+	// the DHT is running.
+	router routing.PeerRouting
+	// pubsub carries rooms; recreateHost replaces it with the host.
+	pubsub *pubsub.PubSub
+	// hostCtx ends, and hostClosers are closed, when the current libp2p
+	// host is replaced or the node closes. Services tied to one host, like
+	// pubsub and discovery, run under them.
+	hostCtx     context.Context
+	hostCancel  context.CancelFunc
+	hostClosers []io.Closer
+}
+
+// NewNode loads the identity, creates the host and registers the protocol
+// handlers. Discovery doesn't run until Start.
+func NewNode(ctx context.Context, cfg Config) (*Node, error) {
+	loadIdentity := loadOrCreateIdentity
+	switch {
+	case cfg.Ephemeral:
+		loadIdentity = ephemeralIdentity
+		cfg.HistoryFile, cfg.AddressBook = "", ""
+	case cfg.NewIdentity:
+		loadIdentity = regenerateIdentity
+	}
+	priv, err := loadIdentity(cfg.IdentityPath)
+	if err != nil {
+		return nil, err
+	}
+	bw := metrics.NewBandwidthCounter()
+	raw, cm, err := newHost(cfg, priv, bw)
+	if err != nil {
+		return nil, err
+	}
+	h := newSwapHost(raw)
+
+	keys, err := generateBoxKeys()
+	if err != nil {
+		h.Close()
+		return nil, err
+	}
+	ratchets, err := generateRatchetKeys(h.ID(), h.Peerstore().PrivKey(h.ID()))
+	if err != nil {
+		h.Close()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	hostCtx, hostCancel := context.WithCancel(ctx)
+	ps, err := pubsub.NewGossipSub(hostCtx, raw)
+	if err != nil {
+		hostCancel()
+		cancel()
+		h.Close()
+		return nil, err
+	}
+	opener := streamOpener{timeout: cfg.NegotiationTimeout, retries: cfg.NegotiationRetries}
+	if cfg.Reconnect == (backoff{}) {
+		cfg.Reconnect = defaultBackoff
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = logger
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = defaultQueueSize
+	}
+	if cfg.QueueExpiry <= 0 {
+		cfg.QueueExpiry = defaultQueueExpiry
+	}
+	if cfg.BroadcastWorkers <= 0 {
+		cfg.BroadcastWorkers = defaultBroadcastWorkers
+	}
+	if cfg.AckTimeout <= 0 {
+		cfg.AckTimeout = defaultAckTimeout
+	}
+	if cfg.RetryExpiry <= 0 {
+		cfg.RetryExpiry = defaultRetryExpiry
+	}
+	if cfg.SendTimeout <= 0 {
+		cfg.SendTimeout = defaultSendTimeout
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = defaultHeartbeatInterval
+	}
+	if cfg.MaxFileBytes <= 0 {
+		cfg.MaxFileBytes = defaultMaxFileBytes
+	}
+	n := &Node{
+		cfg:      cfg,
+		log:      cfg.Logger,
+		ctx:      ctx,
+		cancel:   cancel,
+		host:     h,
+		priv:     priv,
+		registry: newPeerRegistry(),
+		history:  newMessageLog(cfg.HistorySize),
+		mgr:      newStreamManager(h, opener, newPeerThrottle(cfg.PeerRate)),
+		outbox:   newOutbox(cfg.QueueSize, cfg.QueueExpiry),
+		seen:     newPresenceTracker(cfg.HeartbeatInterval),
+		dedupe:   newMessageDeduper(defaultDedupeSize),
+		inbound:  newInboundLimiter(cfg.InboundRate, cfg.InboundBurst),
+		events:   newEventLog(defaultEventLogSize, cfg.EventLogFile),
+		metrics:  newNodeMetrics(h, bw),
+		bw:       bw,
+		chats:    newChatProtector(cm, defaultChatIdle),
+		nick:     sanitizeNick(cfg.Nick),
+
+		pubsub:     ps,
+		hostCtx:    hostCtx,
+		hostCancel: hostCancel,
+	}
+	observe := n.metrics.observer()
+	n.history.onAdd = func(m ChatMessage) {
+		if m.Device != "" {
+			// Another device's traffic, not ours
+			return
+		}
+		observe(m)
+		if m.Direction == directionReceived {
+			n.chats.Touch(m.From)
+		}
+		n.mirror(m)
+	}
+	for _, id := range cfg.Devices {
+		if id == h.ID() {
+			n.log.Warn("ignoring a device with this node's own peer ID; give each device its own identity", "peer_id", id)
+			continue
+		}
+		n.devices = append(n.devices, id)
+	}
+	n.addCloser(n.chats)
+	n.inbound.forgetOnDisconnect(h)
+	n.events.watch(h)
+	n.addCloser(n.events)
+	n.flaps = newFlapDebouncer(defaultFlapWindow, n.flapped)
+	n.addCloser(n.flaps)
+	n.seen.onChange = n.presenceChanged
+	n.seen.watch(h)
+	n.workers.Go(func() { n.seen.expireLoop(n.ctx) })
+	n.redial = newReconnector(ctx, h, cfg.Reconnect, n.flushQueue)
+	n.redial.metrics = n.metrics
+	n.redial.events = n.events
+	n.redial.flaps = n.flaps
+	if cfg.HistoryFile != "" {
+		// The outbox shares the history's database, so it stops saving
+		// before that closes
+		if err := n.history.attachFile(cfg.HistoryFile); err != nil {
+			n.log.Warn("failed to load history", "path", cfg.HistoryFile, "error", err)
+		} else if queued, err := n.outbox.attach(n.history.store); err != nil {
+			n.log.Warn("failed to load queued messages", "path", cfg.HistoryFile, "error", err)
+		} else if queued > 0 {
+			n.log.Info("loaded messages queued for offline peers", "count", queued)
+		}
+		n.addCloser(n.outbox)
+		n.addCloser(n.history)
+	}
+
+	if cfg.AddressBook != "" {
+		if n.book, err = loadAddressBook(cfg.AddressBook); err != nil {
+			n.log.Warn("failed to load address book", "path", cfg.AddressBook, "error", err)
+		}
+	}
+
+	n.hs = newHandshaker(func() peerCapabilities {
+		return peerCapabilities{
+			ProtocolVersion:    chatProtocolVersion,
+			SupportsEncryption: cfg.Secure,
+			Nick:               n.Nick(),
+		}
+	}, cfg.NegotiationTimeout)
+	n.mgr.hs = n.hs
+	n.mgr.sendTimeout = cfg.SendTimeout
+	n.retry = newRetrier(cfg.RetryExpiry, func(id peer.ID, m ChatMessage) error {
+		return n.deliver(n.ctx, id, m)
+	}, printDelivery)
+	n.addCloser(n.retry)
+	n.mgr.acks = newAckTracker(cfg.AckTimeout, n.acked)
+	n.mgr.onRead = n.markRead
+
+	if len(n.devices) > 0 {
+		h.SetStreamHandler(syncProtocol, newSyncHandler(n.devices, n.history, n.dedupe))
+	}
+	h.SetStreamHandler(chatProtocol, newChatHandler(n.registry, n.history, n.hs, n.dedupe, n.inbound))
+	h.SetStreamHandler(legacyChatProtocol, newChatHandler(n.registry, n.history, n.hs, n.dedupe, n.inbound))
+	h.SetStreamHandler(secureChatProtocol, newSecureChatHandler(n.registry, n.history, n.hs, n.dedupe, n.inbound, keys, cfg.NegotiationTimeout))
+	h.SetStreamHandler(ratchetChatProtocol, newRatchetChatHandler(n.registry, n.history, n.hs, n.dedupe, n.inbound, ratchets, cfg.NegotiationTimeout))
+	if cfg.Secure {
+		n.mgr.secure = keys
+		n.mgr.ratchets = ratchets
+		n.mgr.plaintext = cfg.PlaintextPeers
+	}
+	h.SetStreamHandler(motdProtocol, handleMOTD)
+	h.SetStreamHandler(pingProtocol, handlePing)
+	h.SetStreamHandler(typingProtocol, newTypingHandler(remoteTyping))
+	h.SetStreamHandler(presenceProtocol, newPresenceHandler(n.seen))
+	if cfg.DownloadsDir != "" {
+		h.SetStreamHandler(fileProtocol, newFileHandler(cfg.DownloadsDir, cfg.MaxFileBytes, n.mgr.throttle))
+	}
+	if cfg.MOTD != "" {
+		newMOTDSender(h, loadText(cfg.MOTD))
+	}
+	return n, nil
+}
+
+// newHost builds the libp2p host for cfg on the key priv, returning its
+// connection manager too. NewNode calls it once, and recreateHost again
+// for each host the watchdog replaces.
+func newHost(cfg Config, priv crypto.PrivKey, bw *metrics.BandwidthCounter) (host.Host, connmgr.ConnManager, error) {
+	transports, defaultListen, err := buildTransportOptions(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	listenAddrs := cfg.ListenAddrs
+	if len(listenAddrs) == 0 {
+		listenAddrs = defaultListen
+	} else if cfg.QUIC {
+		listenAddrs = withQUICListen(listenAddrs)
+	}
+	listen, err := buildListenOptions(listenAddrs)
+	if err != nil {
+		return nil, nil, err
+	}
+	relays := &relayCandidates{}
+	nat, err := buildNATOptions(cfg.Relays, relays.List)
+	if err != nil {
+		return nil, nil, err
+	}
+	cm, err := buildConnManager(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	opts := append([]libp2p.Option{libp2p.Identity(priv), libp2p.BandwidthReporter(bw), libp2p.ConnectionManager(cm)}, listen...)
+	opts = append(opts, transports...)
+	opts = append(opts, nat...)
+	if len(cfg.Allow) > 0 || len(cfg.Block) > 0 {
+		opts = append(opts, libp2p.ConnectionGater(newGater(cfg.Allow, cfg.Block)))
+	}
+	h, err := libp2p.New(opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	relays.setHost(h)
+	return h, cm, nil
+}
+
+// buildListenOptions validates addrs and turns them into a listen option.
+// An empty list returns no options, leaving libp2p's default addresses.
+func buildListenOptions(addrs []string) ([]libp2p.Option, error) {
+	if len(addrs) == 0 {
+		return nil, nil
+	}
+	for _, addr := range addrs {
+		if _, err := ma.NewMultiaddr(addr); err != nil {
+			return nil, fmt.Errorf("invalid listen address %q: %w", addr, err)
+		}
+	}
+	return []libp2p.Option{libp2p.ListenAddrStrings(addrs...)}, nil
+}
+
+// Start begins peer discovery and, if enabled, watching network interfaces
+// and the host's health. Failures are reported but don't stop the node;
+// peers can still be dialed by address.
+func (n *Node) Start() {
+	n.startHostServices()
+
+	// --- Tell connected peers we're alive ---
+	n.workers.Go(func() { sendHeartbeats(n.ctx, n.host, n.cfg.HeartbeatInterval) })
+
+	// --- Expire queued messages and look their peers up ---
+	n.workers.Go(func() { n.watchOutbox(outboxCheckInterval) })
+
+	// --- Re-advertise when Wi-Fi/ethernet/VPN come and go ---
+	if n.cfg.WatchInterfaces {
+		w := newIfaceWatcher(2*time.Second, 5*time.Second, func(added, removed []string) {
+			out.Printf("🌐 Network interfaces changed (added %v, removed %v)\n", added, removed)
+			printShareAddrs(n.host)
+		})
+		n.workers.Go(func() { w.run(n.ctx) })
+	}
+
+	// --- Rebuild the host if it stops working ---
+	if n.cfg.Watchdog > 0 {
+		n.workers.Go(func() { n.watchHost(n.cfg.Watchdog) })
+	}
+}
+
+// startHostServices starts what runs against one libp2p host: discovery
+// and the watchers for reachability and relay addresses. They stop when
+// hostCtx ends, so recreateHost can start them again on the new host.
+func (n *Node) startHostServices() {
+	n.mu.Lock()
+	ctx := n.hostCtx
+	n.mu.Unlock()
+	h := n.host.current()
+
+	// --- Find peers on the LAN ---
+	if n.cfg.MDNSTag != "" {
+		svc, err := startMDNS(h, n.cfg.MDNSTag, n.registry)
+		if err != nil {
+			n.log.Error("failed to start mDNS discovery", "error", err)
+		} else {
+			n.addHostCloser(svc)
+		}
+	}
+
+	// --- Find peers across networks ---
+	if n.cfg.DHT {
+		kdht, err := startDHTDiscovery(ctx, h, n.cfg.Bootstrap, n.cfg.DHTNamespace, dhtModes[n.cfg.DHTMode], n.registry)
+		if err != nil {
+			n.log.Error("failed to start DHT discovery", "error", err)
+		} else {
+			n.addHostCloser(kdht)
+			n.mu.Lock()
+			n.router = kdht
+			n.mu.Unlock()
+			n.log.Info("DHT discovery running", "namespace", n.cfg.DHTNamespace, "mode", cmp.Or(n.cfg.DHTMode, "auto"))
+		}
+	}
+
+	// --- Report AutoNAT's verdict as it changes ---
+	err := watchReachability(ctx, h, func(r network.Reachability) {
+		out.Printf("🌐 Reachability is now %s\n", reachabilityName(r))
+	})
+	if err != nil {
+		n.log.Warn("failed to watch reachability", "error", err)
+	}
+
+	// --- Show relayed addresses as reservations come in ---
+	err = watchRelayAddrs(ctx, h, func(addr ma.Multiaddr) {
+		out.Printf("🔁 Reachable through a relay: %s/p2p/%s\n", addr, h.ID())
+	})
+	if err != nil {
+		n.log.Warn("failed to watch relay addresses", "error", err)
+	}
+}
+
+func (n *Node) addCloser(c io.Closer) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.closers = append(n.closers, c)
+}
+
+// addHostCloser is addCloser for something tied to the current host, which
+// recreateHost closes along with it.
+func (n *Node) addHostCloser(c io.Closer) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.hostClosers = append(n.hostClosers, c)
+}
+
+// Connect dials the peer at the full multiaddr addr, or at an @alias from
+// the address book, and adds it to the broadcast set. If the connection later drops it is redialed with backoff.
+func (n *Node) Connect(addr string) error {
+	n.mu.Lock()
+	router := n.router
+	n.mu.Unlock()
+	info, err := parseAndConnect(n.ctx, n.host, n.book, router, addr)
+	if err != nil {
+		n.metrics.connFailed()
+		// The event already carries the address, so log the bare cause
+		reason := err.Error()
+		var ce *ConnectError
+		if errors.As(err, &ce) && ce.Err != nil {
+			reason = ce.Err.Error()
+		}
+		n.events.Record(connEvent{Kind: eventDialFailed, Addr: addr, Error: reason})
+		return err
+	}
+	n.registry.Add(*info)
+	n.redial.Track(*info)
+	out.Connected(info.ID, false)
+	return nil
+}
+
+// SaveAlias adds alias for addr, a multiaddr or peer ID, to the address
+// book.
+func (n *Node) SaveAlias(alias, addr string) error {
+	if n.book == nil {
+		return errNoAddressBook
+	}
+	return n.book.Save(alias, addr)
+}
+
+// Book lists the address book, which is empty when disabled.
+func (n *Node) Book() []bookEntry {
+	if n.book == nil {
+		return nil
+	}
+	return n.book.List()
+}
+
+// Send records body in the history and delivers it: published to the room
+// if one is joined, otherwise broadcast to every registered peer on the
+// current channel. Per-peer failures are logged by broadcast; ErrNoActivePeer
+// is returned when there is nobody to send to, and ErrPeerUnreachable when
+// no peer could be sent or queued the message.
+func (n *Node) Send(body string) error {
+	return n.send(body, "", nil)
+}
+
+// SendTo is Send to targets alone, on the current channel, even while a
+// room is joined. A target that is offline gets the message queued.
+func (n *Node) SendTo(body string, targets ...peer.ID) error {
+	if len(targets) == 0 {
+		return ErrNoActivePeer
+	}
+	return n.send(body, "", toAddrInfos(targets))
+}
+
+// Reply sends body as a reply to the message with ID replyTo, to targets
+// if any are given and otherwise as Send would.
+func (n *Node) Reply(replyTo, body string, targets ...peer.ID) error {
+	if len(targets) == 0 {
+		return n.send(body, replyTo, nil)
+	}
+	return n.send(body, replyTo, toAddrInfos(targets))
+}
+
+func toAddrInfos(ids []peer.ID) []peer.AddrInfo {
+	peers := make([]peer.AddrInfo, len(ids))
+	for i, id := range ids {
+		peers[i] = peer.AddrInfo{ID: id}
+	}
+	return peers
+}
+
+// send delivers body, a reply to replyTo if that's set, to targets, or to
+// the room or every registered peer when targets is nil.
+func (n *Node) send(body, replyTo string, targets []peer.AddrInfo) error {
+	m := newChatMessage(n.host.ID(), n.Nick(), body)
+	m.ReplyTo = replyTo
+	if err := signMessage(&m, n.host.Peerstore().PrivKey(n.host.ID())); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	var r *room
+	if targets == nil {
+		r = n.room
+	}
+	if r == nil {
+		m.Channel = n.channel
+	}
+	n.mu.Unlock()
+	check := checkMessageSize
+	if n.cfg.Secure {
+		check = checkSealedSize
+	}
+	if err := check(m); err != nil {
+		return err
+	}
+
+	if r != nil {
+		// Only what the room took goes in the history
+		if err := r.Publish(n.ctx, m); err != nil {
+			return err
+		}
+		record := m
+		record.Direction = directionSent
+		n.history.Add(record)
+		out.Sent(m)
+		return nil
+	}
+
+	if targets == nil {
+		// Our devices get a mirrored copy instead
+		targets = slices.DeleteFunc(n.registry.List(), func(info peer.AddrInfo) bool { return n.isDevice(info.ID) })
+	}
+	if len(targets) == 0 {
+		return ErrNoActivePeer
+	}
+	record := m
+	record.Direction = directionSent
+	for _, info := range targets {
+		record.To = append(record.To, info.ID)
+	}
+	n.history.Add(record)
+	res := broadcast(n.ctx, targets, n.deliver, m, n.cfg.BroadcastWorkers)
+	if res.sent == 0 {
+		return fmt.Errorf("%w: message reached none of the connected peers", ErrPeerUnreachable)
+	}
+	if len(res.failed) > 0 {
+		out.Printf("⚠️ %s\n", res)
+	}
+	out.Sent(m)
+	return nil
+}
+
+// FindPeer looks target, as accepted by ResolvePeer, up in the DHT and
+// adds the addresses found to the peerstore, so connecting to it by ID
+// alone dials them. It fails with errDHTOff without -dht.
+func (n *Node) FindPeer(target string) (peer.AddrInfo, error) {
+	id, err := n.ResolvePeer(target)
+	if err != nil {
+		return peer.AddrInfo{}, err
+	}
+	n.mu.Lock()
+	router := n.router
+	n.mu.Unlock()
+	if router == nil {
+		return peer.AddrInfo{}, errDHTOff
+	}
+	addrs, err := lookupPeer(n.ctx, router, id)
+	if err != nil {
+		return peer.AddrInfo{}, err
+	}
+	n.host.Peerstore().AddAddrs(id, addrs, peerstore.TempAddrTTL)
+	return peer.AddrInfo{ID: id, Addrs: addrs}, nil
+}
+
+// ResolvePeer turns target, a peer ID, a multiaddr ending in /p2p/<ID>, an
+// alias from the address book (with or without the @) or a row number of
+// /peers, into the peer's ID.
+func (n *Node) ResolvePeer(target string) (peer.ID, error) {
+	if i, err := strconv.Atoi(target); err == nil {
+		peers := n.Peers()
+		if i < 1 || i > len(peers) {
+			return "", fmt.Errorf("%w: %d", errNoSuchPeer, i)
+		}
+		return peers[i-1].ID, nil
+	}
+	addr, err := resolveTarget(n.book, target)
+	if err != nil {
+		return "", err
+	}
+	if id, err := peer.Decode(addr); err == nil {
+		return id, nil
+	}
+	if saved, ok := n.book.Resolve(target); ok {
+		addr = saved
+	}
+	info, err := peer.AddrInfoFromString(addr)
+	if err != nil {
+		return "", fmt.Errorf("%w: %q is neither a peer ID, an alias nor a multiaddr with /p2p/<ID>", ErrInvalidMultiaddr, target)
+	}
+	return info.ID, nil
+}
+
+// deliver sends m to id, or queues it if id is offline or still has older
+// messages waiting.
+func (n *Node) deliver(ctx context.Context, id peer.ID, m ChatMessage) error {
+	defer n.outLocks.Lock(id)()
+	online := n.host.Network().Connectedness(id) == network.Connected
+	n.chats.Touch(id)
+	if online && n.outbox.Len(id) == 0 {
+		return n.mgr.Send(ctx, id, m)
+	}
+	if n.outbox.Push(id, m) {
+		n.log.Warn("outbound queue full, dropped oldest message", "peer_id", id, "limit", n.cfg.QueueSize)
+	}
+	if !online {
+		out.Printf("📥 %s is offline; message queued (%d waiting)\n", peerName(id), n.outbox.Len(id))
+		return nil
+	}
+	n.flushLocked(id)
+	return nil
+}
+
+// flushQueue sends whatever was queued for id while it was offline. The
+// reconnector calls it on every new connection.
+func (n *Node) flushQueue(id peer.ID) {
+	defer n.outLocks.Lock(id)()
+	n.flushLocked(id)
+}
+
+func (n *Node) flushLocked(id peer.ID) {
+	msgs := n.outbox.Take(id)
+	for i, m := range msgs {
+		if err := n.mgr.Send(n.ctx, id, m); err != nil {
+			n.log.Warn("failed to flush queued messages", "peer_id", id, "remaining", len(msgs)-i, "error", err)
+			n.outbox.Requeue(id, msgs[i:])
+			return
+		}
+	}
+	if len(msgs) > 0 {
+		out.Printf("📤 Sent %d queued message(s) to %s\n", len(msgs), peerName(id))
+	}
+}
+
+// acked is the ACK tracker's callback: a message every peer confirmed is
+// reported delivered, and one some peers didn't is resent to them.
+func (n *Node) acked(m ChatMessage, missing []peer.ID) {
+	if len(missing) == 0 {
+		n.retry.Forget(m.ID)
+		printDelivery(m, nil)
+		return
+	}
+	n.retry.Retry(m, missing)
+}
+
+// markRead is the stream manager's read receipt callback: the first
+// receipt from each peer for a message of ours is recorded and shown.
+func (n *Node) markRead(msgID string, id peer.ID) {
+	if m, ok := n.history.MarkRead(n.host.ID(), msgID, id); ok {
+		out.Read(m, id)
+	}
+}
+
+// outboxCheckInterval is how often queued messages are checked for expiry
+// and their offline peers looked up in the DHT.
+var outboxCheckInterval = 30 * time.Second
+
+// watchOutbox runs checkOutbox every interval until the node closes.
+func (n *Node) watchOutbox(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-t.C:
+			n.checkOutbox()
+		}
+	}
+}
+
+// checkOutbox drops expired queued messages and, with the DHT running,
+// tries to find and dial each peer that still has messages waiting. A
+// connection that comes up flushes the queue through the reconnector, as
+// it does for peers that come back by themselves.
+func (n *Node) checkOutbox() {
+	for id, count := range n.outbox.Expire(time.Now()) {
+		out.Printf("⌛ %d queued message(s) to %s expired unsent\n", count, peerName(id))
+	}
+	n.mu.Lock()
+	router := n.router
+	n.mu.Unlock()
+	if router == nil {
+		return
+	}
+	for _, id := range n.outbox.Waiting() {
+		if n.host.Network().Connectedness(id) == network.Connected {
+			continue
+		}
+		addrs, err := lookupPeer(n.ctx, router, id)
+		if err != nil {
+			n.log.Debug("queued peer not found", "peer_id", id, "error", err)
+			continue
+		}
+		n.host.Peerstore().AddAddrs(id, addrs, peerstore.TempAddrTTL)
+		if err := connectWithFallback(n.ctx, n.host, peer.AddrInfo{ID: id, Addrs: addrs}); err != nil {
+			n.log.Debug("failed to reach queued peer", "peer_id", id, "error", err)
+		}
+	}
+}
+
+// queueDepth is how many messages are waiting for id to come back online.
+func (n *Node) queueDepth(id peer.ID) int {
+	return n.outbox.Len(id)
+}
+
+// SendFile streams the file at path to id and waits for it to confirm the
+// checksum.
+func (n *Node) SendFile(id peer.ID, path string) (fileHeader, error) {
+	return sendFile(n.ctx, n.host, n.mgr.opener, n.mgr.throttle, id, path, n.cfg.MaxFileBytes, n.cfg.SendTimeout)
+}
+
+// Typing tells connected direct peers that the local user started or
+// stopped typing: as a control frame on the chat stream to peers whose
+// handshake says they understand one, and on typingProtocol to the rest.
+// Rooms don't get typing signals.
+func (n *Node) Typing(active bool) {
+	if n.Room() != "" {
+		return
+	}
+	sig := typingSignal{Typing: active, Nick: n.Nick()}
+	frame := newTypingFrame(n.host.ID(), sig.Nick, active)
+	n.mu.Lock()
+	frame.Channel = n.channel
+	n.mu.Unlock()
+	for _, info := range n.registry.List() {
+		if n.host.Network().Connectedness(info.ID) != network.Connected {
+			continue
+		}
+		if caps, ok := n.hs.peers.Get(info.ID); ok && versionAtLeast(caps.ProtocolVersion, controlFramesVersion) {
+			go sendTypingFrame(n.ctx, n.mgr, info.ID, frame)
+		} else {
+			go sendTyping(n.ctx, n.host, info.ID, sig)
+		}
+	}
+}
+
+// JoinChannel starts accepting chat on channel name and makes it the
+// target of direct sends. defaultChannel switches back to chatProtocol,
+// which is always joined.
+func (n *Node) JoinChannel(name string) error {
+	name, err := checkChannel(name)
+	if err != nil {
+		return err
+	}
+	if name != "" && n.cfg.Secure {
+		return errSecureChannels
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if name != "" && !n.channels[name] {
+		if n.channels == nil {
+			n.channels = make(map[string]bool)
+		}
+		n.channels[name] = true
+		n.host.SetStreamHandler(channelProtocol(name), newChatHandler(n.registry, n.history, n.hs, n.dedupe, n.inbound))
+	}
+	n.channel = name
+	return nil
+}
+
+// LeaveChannel stops accepting chat on channel name. Sends go back to the
+// default channel if name was their target.
+func (n *Node) LeaveChannel(name string) error {
+	name, err := checkChannel(name)
+	if err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.channels[name] {
+		return fmt.Errorf("%w: %q", errNotInChannel, name)
+	}
+	delete(n.channels, name)
+	n.host.RemoveStreamHandler(channelProtocol(name))
+	resetChannelStreams(n.host, channelProtocol(name))
+	if n.channel == name {
+		n.channel = ""
+	}
+	return nil
+}
+
+// Channel returns the channel direct sends go to, "" for the default.
+func (n *Node) Channel() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.channel
+}
+
+// Channels lists the joined channels besides the default, sorted.
+func (n *Node) Channels() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return slices.Sorted(maps.Keys(n.channels))
+}
+
+// Join subscribes to the gossipsub topic name and makes it the target of
+// Send, leaving any room joined before. Direct chat streams keep working.
+func (n *Node) Join(name string) error {
+	if err := n.Leave(); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	ps := n.pubsub
+	n.mu.Unlock()
+	r, err := joinRoom(n.ctx, ps, n.host.ID(), name, n.history)
+	if err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.room = r
+	return nil
+}
+
+// Leave leaves the current room, if any, so Send goes back to direct peers.
+func (n *Node) Leave() error {
+	n.mu.Lock()
+	r := n.room
+	n.room = nil
+	n.mu.Unlock()
+	if r == nil {
+		return nil
+	}
+	return r.Leave()
+}
+
+// Room returns the name of the joined room, or "" in direct mode.
+func (n *Node) Room() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.room == nil {
+		return ""
+	}
+	return n.room.name
+}
+
+// presence reports whether id's heartbeats are current and when the last
+// one arrived.
+func (n *Node) presence(id peer.ID) (online bool, lastSeen time.Time) {
+	return n.seen.Status(id)
+}
+
+// presenceChanged records id coming online or going offline, and tells the
+// user when it's a saved contact, unless n.flaps holds the notice back.
+func (n *Node) presenceChanged(id peer.ID, online bool) {
+	kind := eventOffline
+	if online {
+		kind = eventOnline
+	}
+	n.events.Record(connEvent{Kind: kind, Peer: id})
+	if !n.flaps.Change(id, online) {
+		return
+	}
+	if _, ok := n.book.AliasOf(id); ok {
+		printPresence(id, online)
+	}
+}
+
+// flapped sums up the changes held back for a peer whose link kept
+// dropping: a saved contact's, or one the reconnector redials.
+func (n *Node) flapped(id peer.ID, reconnects int, online bool) {
+	_, contact := n.book.AliasOf(id)
+	if !contact && !n.redial.tracking(id) {
+		return
+	}
+	if reconnects == 0 {
+		if contact {
+			printPresence(id, online)
+		}
+		return
+	}
+	state := "offline"
+	if online {
+		state = "online"
+	}
+	out.Printf("🔁 %s reconnected %d× in %s, now %s\n", peerName(id), reconnects, n.flaps.window, state)
+}
+
+func printPresence(id peer.ID, online bool) {
+	if online {
+		out.Printf("🟢 %s is online\n", peerName(id))
+	} else {
+		out.Printf("⚪ %s went offline\n", peerName(id))
+	}
+}
+
+// Who reports every saved contact and every other peer online now,
+// online ones first.
+func (n *Node) Who() []presenceStatus {
+	known := n.book.Peers()
+	if known == nil {
+		known = make(map[peer.ID]string)
+	}
+	for _, id := range n.seen.Online() {
+		if _, ok := known[id]; !ok {
+			known[id] = ""
+		}
+	}
+	statuses := make([]presenceStatus, 0, len(known))
+	for id, alias := range known {
+		online, lastSeen := n.presence(id)
+		statuses = append(statuses, presenceStatus{ID: id, Alias: alias, Online: online, LastSeen: lastSeen})
+	}
+	slices.SortFunc(statuses, func(a, b presenceStatus) int {
+		// Online first, then contacts by alias, then the rest by ID
+		rank := func(st presenceStatus) int {
+			switch {
+			case st.Online:
+				return 0
+			case st.Alias != "":
+				return 1
+			}
+			return 2
+		}
+		return cmp.Or(cmp.Compare(rank(a), rank(b)), cmp.Compare(a.Alias, b.Alias), cmp.Compare(a.ID, b.ID))
+	})
+	return statuses
+}
+
+// Peers reports every registered peer with its live connection state. A
+// peer that hasn't chatted yet is named by its handshake nick, and a
+// connected peer whose heartbeats stopped is "stale".
+func (n *Node) Peers() []peerStatus {
+	statuses := peerStatuses(n.host, n.registry, n.history)
+	for i, st := range statuses {
+		if caps, ok := n.hs.peers.Get(st.ID); ok && st.Nick == "" {
+			statuses[i].Nick = caps.Nick
+		}
+		online, lastSeen := n.presence(st.ID)
+		statuses[i].LastSeen = lastSeen
+		if st.State == "connected" && !lastSeen.IsZero() && !online {
+			statuses[i].State = "stale"
+		}
+	}
+	return statuses
+}
+
+// Traffic reports the bytes sent to and received from each peer this run,
+// across all protocols, with the current rates, busiest peers first.
+func (n *Node) Traffic() []peerTraffic {
+	byPeer := n.bw.GetBandwidthByPeer()
+	rows := make([]peerTraffic, 0, len(byPeer))
+	for id, st := range byPeer {
+		rows = append(rows, peerTraffic{ID: id, Sent: st.TotalOut, Received: st.TotalIn, RateOut: st.RateOut, RateIn: st.RateIn})
+	}
+	slices.SortFunc(rows, func(a, b peerTraffic) int {
+		return cmp.Or(cmp.Compare(b.Sent+b.Received, a.Sent+a.Received), cmp.Compare(a.ID, b.ID))
+	})
+	return rows
+}
+
+// Subscribe streams every message the node records, sent or received,
+// until the returned function is called.
+func (n *Node) Subscribe() (<-chan ChatMessage, func()) {
+	return n.history.Subscribe()
+}
+
+// SubscribeEvents streams connection events as they're recorded, until the
+// returned function is called.
+func (n *Node) SubscribeEvents() (<-chan connEvent, func()) {
+	return n.events.Subscribe()
+}
+
+func (n *Node) Nick() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.nick
+}
+
+// SetNick changes the display name on later messages. It returns the
+// sanitized name, which is empty if nothing usable was left.
+func (n *Node) SetNick(name string) string {
+	name = sanitizeNick(name)
+	if name == "" {
+		return ""
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.nick = name
+	return name
+}
+
+// DisconnectAll sends notice to every connected peer and hangs up, without
+// trying to reconnect afterwards.
+func (n *Node) DisconnectAll(notice string) {
+	n.redial.Forget()
+	disconnectAll(n.ctx, n.host, n.hs, notice)
+}
+
+// closeWait bounds how long Close waits for background loops and
+// reconnect attempts to return before closing the host anyway.
+var closeWait = 5 * time.Second
+
+// Close stops discovery and the background loops, waiting up to closeWait
+// for them, and shuts the host down. Like shutdown, it is safe to call more
+// than once.
+func (n *Node) Close() error {
+	n.Leave()
+	n.cancel()
+	n.mu.Lock()
+	closers := n.closers
+	n.closers = nil
+	n.mu.Unlock()
+	for _, c := range closers {
+		c.Close()
+	}
+	done := make(chan struct{})
+	go func() {
+		n.redial.Close()
+		n.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(closeWait):
+		n.log.Warn("background tasks still running at shutdown", "waited", closeWait)
+	}
+	// Only now, as the watchdog may have just started them on a new host
+	n.mu.Lock()
+	closers = n.hostClosers
+	n.hostClosers = nil
+	n.mu.Unlock()
+	for _, c := range closers {
+		c.Close()
+	}
+	return shutdown(n.host, n.mgr)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNodeToNodeMessaging(t *testing.T) {
+	alice := newTestNode(t, "alice")
+	bob := newTestNode(t, "bob")
+
+	addr := nodeAddr(bob)
+	if err := alice.Connect(addr); err != nil {
+		t.Fatalf("Failed to connect alice to bob: %v", err)
+	}
+	if err := alice.Send("hello bob"); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(bob.history.Recent(1)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Timeout waiting for bob to receive the message")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	got := bob.history.Recent(1)[0]
+	if got.Body != "hello bob" || got.Nick != "alice" || got.From != alice.host.ID() {
+		t.Errorf("Unexpected message on bob: %+v", got)
+	}
+	if sent := alice.history.Recent(1); len(sent) != 1 || sent[0].Body != "hello bob" {
+		t.Errorf("Expected alice to record her own message, got %+v", sent)
+	}
+
+	// Bob learned about alice from her stream and can reply without dialing
+	if err := bob.Send("hi alice"); err != nil {
+		t.Fatalf("Failed to reply: %v", err)
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for alice.history.Recent(1)[0].Body != "hi alice" {
+		if time.Now().After(deadline) {
+			t.Fatal("Timeout waiting for alice to receive the reply")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestNodeReplyRoundTrip(t *testing.T) {
+	var buf syncBuffer
+	oldCon, oldThreads := con, threads
+	con = newPlainConsole(strings.NewReader(""), &buf)
+	t.Cleanup(func() { con, threads = oldCon, oldThreads })
+
+	alice, bob, cleanup := newTestPair(t)
+	defer cleanup()
+	threads = bob.history
+
+	if err := bob.Send("lunch at noon?"); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	waitFor(t, "alice to get the question", func() bool { return len(alice.history.Recent(1)) == 1 })
+	question := alice.history.Recent(1)[0]
+	id, err := alice.history.ResolveID(shortMessageID(question.ID))
+	if err != nil || id != question.ID {
+		t.Fatalf("Expected %q to resolve to %q, got %q, %v", shortMessageID(question.ID), question.ID, id, err)
+	}
+	if err := alice.Reply(id, "sounds good"); err != nil {
+		t.Fatalf("Failed to reply: %v", err)
+	}
+	waitFor(t, "bob to get the reply", func() bool { return len(bob.history.Recent(-1)) == 2 })
+	got := bob.history.Recent(1)[0]
+	if got.Body != "sounds good" || got.ReplyTo != question.ID {
+		t.Fatalf("Expected the reply to keep its reference to %q, got %+v", question.ID, got)
+	}
+	if ok, err := verifyMessage(got); !ok || err != nil {
+		t.Errorf("Expected the reply's signature to cover ReplyTo and verify, got %v, %v", ok, err)
+	}
+	waitFor(t, "the reply to be shown", func() bool { return strings.Contains(buf.String(), "sounds good") })
+	if want := "  ┆ bob: lunch at noon?\n  ↳ 💬"; !strings.Contains(buf.String(), want) {
+		t.Errorf("Expected the reply quoted under its parent as %q, got %q", want, buf.String())
+	}
+
+	// A reply to something bob never saw just names it
+	if err := alice.Reply("0123456789abcdef", "what?"); err != nil {
+		t.Fatalf("Failed to reply: %v", err)
+	}
+	waitFor(t, "the orphan reply to be shown", func() bool { return strings.Contains(buf.String(), "what?") })
+	if want := "  ┆ reply to #01234567\n"; !strings.Contains(buf.String(), want) {
+		t.Errorf("Expected an unknown parent to show as %q, got %q", want, buf.String())
+	}
+}
+
+func TestNodeSendWithoutPeers(t *testing.T) {
+	n := newTestNode(t, "")
+	if err := n.Send("anyone?"); !errors.Is(err, ErrNoActivePeer) {
+		t.Errorf("Expected ErrNoActivePeer, got %v", err)
+	}
+	if len(n.history.Recent(-1)) != 0 {
+		t.Error("Expected unsent message to stay out of history")
+	}
+}
+
+func TestNodeSendRejectsOversizedBody(t *testing.T) {
+	n := newTestNode(t, "")
+	if err := n.Join("lobby"); err != nil {
+		t.Fatalf("Failed to join room: %v", err)
+	}
+	// Random text, so compression can't bring it under the limit
+	noise := make([]byte, maxMessageBytes)
+	rand.Read(noise)
+	err := n.Send(base64.StdEncoding.EncodeToString(noise))
+	if !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("Expected ErrMessageTooLarge, got %v", err)
+	}
+	if len(n.history.Recent(-1)) != 0 {
+		t.Error("Expected rejected message to stay out of history")
+	}
+}
+
+func TestNodeConnectInvalidAddr(t *testing.T) {
+	n := newTestNode(t, "")
+	if err := n.Connect("/invalid/multiaddr"); err == nil {
+		t.Error("Expected error for invalid multiaddr, got nil")
+	}
+}
+
+func TestNodeSetNick(t *testing.T) {
+	n := newTestNode(t, "")
+	if got := n.SetNick("  \t\x07  "); got != "" {
+		t.Errorf("Expected unusable nick to be rejected, got %q", got)
+	}
+	if got := n.SetNick(" carol "); got != "carol" || n.Nick() != "carol" {
+		t.Errorf("Expected nick carol, got %q / %q", got, n.Nick())
+	}
+}
+
+func TestNodeCloseIsIdempotent(t *testing.T) {
+	n := newTestNode(t, "")
+	if err := n.Close(); err != nil {
+		t.Fatalf("Failed to close node: %v", err)
+	}
+	if err := n.Close(); err != nil {
+		t.Errorf("Expected second Close to be harmless, got %v", err)
+	}
+}
+
+func TestNodeCloseStopsBackgroundWork(t *testing.T) {
+	// A reconnect attempt parked in its backoff, alongside the heartbeat,
+	// outbox and presence loops Start runs
+	alice := newReconnectNode(t, backoff{initial: time.Minute, max: time.Minute, attempts: 1})
+	alice.Start()
+	bob := newTestNode(t, "")
+	if err := alice.Connect(nodeAddr(bob)); err != nil {
+		t.Fatalf("Failed to connect alice to bob: %v", err)
+	}
+	bob.Close()
+	waitFor(t, "alice to schedule a reconnect", func() bool { return alice.redial.retrying(bob.host.ID()) })
+
+	closed := make(chan error, 1)
+	go func() { closed <- alice.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Errorf("Failed to close: %v", err)
+		}
+	case <-time.After(closeWait):
+		t.Fatal("Close didn't return")
+	}
+
+	// Close only returns once everything it waits for has stopped
+	stopped := make(chan struct{})
+	go func() {
+		alice.workers.Wait()
+		alice.redial.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Error("Expected the background goroutines to have exited")
+	}
+	if alice.redial.retrying(bob.host.ID()) {
+		t.Error("Expected the reconnect attempt to be abandoned")
+	}
+}
+
+func TestBuildListenOptions(t *testing.T) {
+	opts, err := buildListenOptions(nil)
+	if err != nil || len(opts) != 0 {
+		t.Errorf("Expected no options for empty list, got %d, %v", len(opts), err)
+	}
+	opts, err = buildListenOptions([]string{"/ip4/0.0.0.0/tcp/4001", "/ip4/0.0.0.0/udp/4001/quic-v1"})
+	if err != nil || len(opts) != 1 {
+		t.Errorf("Expected one option for valid addrs, got %d, %v", len(opts), err)
+	}
+	_, err = buildListenOptions([]string{"/ip4/0.0.0.0/tcp/4001", "/ip4/not-an-ip/tcp/1"})
+	if err == nil || !strings.Contains(err.Error(), "/ip4/not-an-ip/tcp/1") {
+		t.Errorf("Expected error naming the malformed addr, got %v", err)
+	}
+}
+
+func TestNodeListenAddrs(t *testing.T) {
+	n, err := NewNode(context.Background(), Config{
+		IdentityPath: filepath.Join(t.TempDir(), "identity.key"),
+		ListenAddrs:  []string{"/ip4/127.0.0.1/tcp/0"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer n.Close()
+
+	addrs := n.host.Addrs()
+	if len(addrs) == 0 {
+		t.Fatal("Expected node to listen on at least one address")
+	}
+	for _, addr := range addrs {
+		if !strings.HasPrefix(addr.String(), "/ip4/127.0.0.1/tcp/") {
+			t.Errorf("Unexpected listen address %s", addr)
+		}
+	}
+}
+
+func TestNewTestPair(t *testing.T) {
+	alice, bob, cleanup := newTestPair(t)
+
+	// Either side can open the conversation
+	if err := bob.Send("bob first"); err != nil {
+		t.Fatalf("Failed to send from bob: %v", err)
+	}
+	waitFor(t, "alice to receive bob's message", func() bool {
+		got := alice.history.Recent(1)
+		return len(got) == 1 && got[0].Body == "bob first"
+	})
+
+	cleanup()
+	if alice.ctx.Err() == nil || bob.ctx.Err() == nil {
+		t.Error("Expected cleanup to cancel both node contexts")
+	}
+}
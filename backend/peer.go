@@ -3,109 +3,380 @@ package main
 import (
 	"bufio"
 	"context"
-	"crypto/rand"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
-	libp2p "github.com/libp2p/go-libp2p"
-	crypto "github.com/libp2p/go-libp2p/core/crypto"
+	host "github.com/libp2p/go-libp2p/core/host"
 	network "github.com/libp2p/go-libp2p/core/network"
 	peer "github.com/libp2p/go-libp2p/core/peer"
-	ma "github.com/multiformats/go-multiaddr"
+	"golang.org/x/term"
 )
 
-func handleStream(s network.Stream) {
-	fmt.Println("📩 Incoming stream opened!")
+// handleStream reads chat messages from s until it ends, recording each one
+// the first time seen reports its ID and acknowledging every one, so a
+// duplicate that took another path is still confirmed to its sender.
+// Messages beyond the peer's rate in limit are dropped unacknowledged.
+func handleStream(s network.Stream, history *messageLog, seen *messageDeduper, limit *inboundLimiter) {
+	remote := s.Conn().RemotePeer()
+	logger.Debug("incoming stream opened", "peer_id", remote)
 	r := bufio.NewReader(s)
+	read := readMessage
+	if s.Protocol() == chatProtocol {
+		read = readEnvelope
+	}
 	for {
-		str, err := r.ReadString('\n')
+		s.SetReadDeadline(time.Now().Add(streamIdleTimeout))
+		m, err := read(r)
+		m.Channel = channelOf(s.Protocol())
+		if errors.Is(err, ErrMessageTooLarge) {
+			logger.Warn("message too large, resetting stream", "peer_id", remote, "limit", maxMessageBytes)
+			s.Reset()
+			return
+		}
+		if errors.Is(err, errMalformedEnvelope) {
+			logger.Warn("dropping malformed message", "peer_id", remote, "error", err)
+			continue
+		}
 		if err != nil {
-			fmt.Println("❌ Stream closed")
+			endStream(s, err)
 			return
 		}
-		fmt.Printf("💬 Received: %s", str)
+		// Control frames come with every spell of typing, so they have a
+		// budget of their own rather than spending the peer's chat one
+		allow := limit.Allow
+		if m.IsControl() {
+			allow = limit.AllowControl
+		}
+		if ok, reset := allow(remote); !ok {
+			if reset {
+				logger.Warn("peer kept flooding, resetting stream", "peer_id", remote)
+				s.Reset()
+				return
+			}
+			continue
+		}
+		if m.IsControl() {
+			handleControl(m, remote)
+			continue
+		}
+		if err := checkAuthor(m); err != nil {
+			logger.Warn("dropping message with a bad signature", "peer_id", remote, "from", m.From, "error", err)
+			continue
+		}
+		shown := !seen.Seen(m.ID)
+		if shown {
+			recordIncoming(m, remote, false, history)
+		}
+		ackIncoming(s, m)
+		if shown {
+			sendReceipt(s, m)
+		}
+	}
+}
+
+// streamIdleTimeout is how long an incoming chat stream may go without a
+// message before it's dropped, so a hung peer doesn't hold its reader
+// forever. Senders open a fresh stream on their next message.
+var streamIdleTimeout = 10 * time.Minute
+
+// endStream finishes an incoming stream whose read failed with err: a clean
+// EOF is the peer hanging up and is closed quietly, while anything else (a
+// reset, a deadline) is logged and reset.
+func endStream(s network.Stream, err error) {
+	remote := s.Conn().RemotePeer()
+	if errors.Is(err, io.EOF) {
+		logger.Debug("stream closed", "peer_id", remote)
+		s.Close()
+		return
+	}
+	logger.Warn("stream failed", "peer_id", remote, "error", err)
+	s.Reset()
+}
+
+// recordIncoming adds a message received from remote to history and shows
+// it, marked as end-to-end encrypted if secure. An unsigned message is
+// credited to remote whatever sender it claims, since nothing backs the
+// claim up.
+func recordIncoming(m ChatMessage, remote peer.ID, secure bool, history *messageLog) {
+	if m.IsControl() {
+		handleControl(m, remote)
+		return
+	}
+	if m.Signature == "" && m.From != "" && m.From != remote {
+		logger.Warn("unsigned message claims another sender", "peer_id", remote, "from", m.From)
+		m.From = ""
+	}
+	if m.From == "" {
+		m.From = remote
+	}
+	m.Direction = directionReceived
+	history.Add(m)
+	out.Received(m, "", secure)
+}
+
+// ackIncoming confirms m back to its sender on s. Plaintext lines from
+// old peers carry no ID and get no ACK.
+func ackIncoming(s network.Stream, m ChatMessage) {
+	if m.ID == "" {
+		return
+	}
+	if err := writeAck(s, m.ID); err != nil {
+		logger.Debug("failed to ack message", "peer_id", s.Conn().RemotePeer(), "error", err)
+	}
+}
+
+// sendReceipt tells m's sender on s that it has been shown. Control frames
+// and plaintext lines from old peers get none.
+func sendReceipt(s network.Stream, m ChatMessage) {
+	if m.ID == "" || m.IsControl() {
+		return
+	}
+	if err := writeReceipt(s, m.ID); err != nil {
+		logger.Debug("failed to send read receipt", "peer_id", s.Conn().RemotePeer(), "error", err)
+	}
+}
+
+func printShareAddrs(h host.Host) {
+	addrs := dialableAddrs(h)
+	for _, addr := range addrs {
+		if name := transportName(addr); name != "" {
+			out.Printf("➡️ Share this multiaddr (%s): %s\n", name, addr)
+		} else {
+			out.Printf("➡️ Share this multiaddr: %s\n", addr)
+		}
+	}
+	if len(addrs) == 0 {
+		out.Println("⚠️ No LAN or public addresses to share; pass -show-local to list loopback ones.")
+	}
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// shutdown closes every cached stream and then the host. It is safe to call
+// more than once, which happens when a signal arrives while exit is already
+// tearing down.
+func shutdown(h host.Host, mgr *streamManager) error {
+	mgr.Close()
+	return h.Close()
+}
+
+// closeNode shuts n down, reporting rather than returning any error.
+func closeNode(n *Node) {
+	if err := n.Close(); err != nil {
+		logger.Error("failed to close host", "error", err)
 	}
 }
 
 func main() {
-	ctx := context.Background()
+	if len(os.Args) > 1 && os.Args[1] == "version" {
+		if err := runVersion(os.Args[2:], os.Stdout); err != nil && !errors.Is(err, flag.ErrHelp) {
+			os.Exit(2)
+		}
+		return
+	}
+	cfg, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "❌", err)
+		os.Exit(2)
+	}
+	if cfg.ShowVersion {
+		fmt.Println(currentBuildInfo())
+		return
+	}
+	if _, err := dataDir(); err != nil {
+		fmt.Fprintln(os.Stderr, "❌", err)
+		os.Exit(2)
+	}
+	maxMessageBytes = cfg.MaxMessageBytes
+	compressThreshold = cfg.CompressAbove
+	showLocalAddrs = cfg.ShowLocal
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// --- Interactive console, or JSON events with no prompts ---
+	if cfg.Output == "json" {
+		con = newPlainConsole(os.Stdin, io.Discard)
+		out = newJSONEmitter(os.Stdout)
+	} else if cfg.TUI {
+		con = newTUIConsole(os.Stdin, os.Stdout)
+	} else {
+		con = newConsole(os.Stdin, os.Stdout)
+	}
+	defer con.Close()
 
-	// --- Generate identity (use persistent keypair in future) ---
-	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	// --- Diagnostics go to stderr, chat stays on stdout ---
+	l, err := newLogger(con.LogWriter(os.Stderr), cfg.LogLevel, cfg.LogJSON)
 	if err != nil {
-		panic(err)
+		con.Close()
+		fmt.Fprintln(os.Stderr, "❌", err)
+		os.Exit(2)
 	}
+	logger = l
+	cfg.Node.Logger = logger
 
-	// --- Create a new libp2p host ---
-	host, err := libp2p.New(
-		libp2p.Identity(priv),
-	)
+	// --- Create the node (identity, host, protocol handlers) ---
+	node, err := NewNode(ctx, cfg.Node)
 	if err != nil {
-		panic(err)
+		logger.Error("failed to start node", "error", err)
+		con.Close()
+		os.Exit(1)
 	}
+	defer closeNode(node)
+	contacts = node.book
+	threads = node.history
+	con.ShowPeers(node.Peers)
 
-	// --- Setup stream handler ---
-	host.SetStreamHandler("/chat/1.0.0", handleStream)
+	// --- Tear down cleanly on Ctrl-C / SIGTERM ---
+	// Ending ctx stops the REPL, and main returns through its defers; a
+	// second signal kills the process the default way
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigCh
+		signal.Stop(sigCh)
+		out.Printf("\n🛑 Received %s, shutting down...\n", sig)
+		cancel()
+	}()
 
-	fmt.Println("✅ Peer started!")
-	fmt.Println("Peer ID:", host.ID())
-	for _, addr := range host.Addrs() {
-		fmt.Printf("➡️ Share this multiaddr: %s/p2p/%s\n", addr, host.ID())
+	if cfg.Banner != "" {
+		out.Println(loadText(cfg.Banner))
+	}
+	out.Println("✅ Peer started!")
+	out.Println("Peer ID:", node.host.ID())
+	if cfg.Node.Ephemeral {
+		out.Println("🕶️ Anonymous mode: throwaway identity, no history or address book saved")
+	} else {
+		out.Println("🔑 Identity loaded from", cfg.Node.IdentityPath)
+	}
+	printShareAddrs(node.host)
+	if cfg.ShowQR {
+		printQR(shareableAddrs(node.host))
 	}
 
-	// --- Prompt for peer to connect to ---
-	fmt.Print("Enter target peer full multiaddr (leave empty to wait): ")
-	scanner := bufio.NewScanner(os.Stdin)
-	scanner.Scan()
-	targetAddr := scanner.Text()
+	node.Start()
+	out.Printf("🌐 Reachability: %s (AutoNAT; /nat to check again)\n", reachabilityName(reachability(node.host)))
+	if cfg.Channel != "" {
+		// validate already checked the name
+		node.JoinChannel(cfg.Channel)
+		out.Printf("📺 Chatting on #%s\n", cfg.Channel)
+	}
 
-	var peerInfo *peer.AddrInfo
-	if targetAddr != "" {
-		maddr, err := ma.NewMultiaddr(targetAddr)
+	// --- Piped stdin: send each line to -to, then exit ---
+	if cfg.To != "" && !term.IsTerminal(int(os.Stdin.Fd())) {
+		if err := runPipe(ctx, node, cfg.To, os.Stdin); err != nil {
+			report(err)
+			closeNode(node)
+			con.Close()
+			os.Exit(1)
+		}
+		return
+	}
+
+	// --- Local API for a browser UI ---
+	if cfg.HTTPAddr != "" {
+		srv, addr, err := startAPI(cfg.HTTPAddr, node)
 		if err != nil {
-			fmt.Println("❌ Invalid multiaddr:", err)
-			return
+			logger.Error("failed to start HTTP API", "addr", cfg.HTTPAddr, "error", err)
+		} else {
+			defer srv.Close()
+			out.Printf("🌐 HTTP API listening on http://%s\n", addr)
+		}
+	}
+
+	// --- Prometheus scrape endpoint ---
+	if cfg.MetricsAddr != "" {
+		srv, addr, err := startMetrics(cfg.MetricsAddr, node)
+		if err != nil {
+			logger.Error("failed to start metrics endpoint", "addr", cfg.MetricsAddr, "error", err)
+		} else {
+			defer srv.Close()
+			out.Printf("📈 Metrics at http://%s/metrics\n", addr)
 		}
-		info, err := peer.AddrInfoFromP2pAddr(maddr)
+	}
+
+	// --- Drop peers when the local user walks away ---
+	var idle *idleWatcher
+	if cfg.AutoDisconnect > 0 {
+		idle = newIdleWatcher(cfg.AutoDisconnect, func() {
+			out.Printf("💤 No input for %s, disconnecting all peers\n", cfg.AutoDisconnect)
+			node.DisconnectAll(offlineNotice)
+			if cfg.ExitOnIdle {
+				cancel()
+			}
+		})
+		defer idle.Stop()
+	}
+
+	// --- Prompt for peer to connect to, unless -to named one ---
+	// Peers mDNS already found can be picked by number instead
+	targetAddr, pick := cfg.To, ""
+	if targetAddr == "" {
+		question := "Enter target peer full multiaddr or @alias (leave empty to wait): "
+		if peers := node.Peers(); len(peers) > 0 {
+			out.Println(formatPeers(peers))
+			question = "Enter a peer number to chat with it alone, or a full multiaddr or @alias (leave empty to wait): "
+		}
+		addr, err := readInput(ctx, con, question)
 		if err != nil {
-			fmt.Println("❌ Failed to parse peer info:", err)
+			if !errors.Is(err, io.EOF) && ctx.Err() == nil {
+				out.Error("Failed to read input", err)
+			}
+			out.Println("👋 Exiting...")
 			return
 		}
-		peerInfo = info
+		targetAddr = strings.TrimSpace(addr)
+		idle.Touch()
+	}
 
-		// --- Connect to peer ---
-		if err := host.Connect(ctx, *info); err != nil {
-			fmt.Println("❌ Connection failed:", err)
+	if _, err := strconv.Atoi(targetAddr); err == nil {
+		pick, targetAddr = targetAddr, ""
+	}
+	if targetAddr != "" {
+		if err := node.Connect(targetAddr); err != nil {
+			report(err)
 			return
 		}
-		fmt.Println("✅ Connected to peer:", info.ID)
 	}
 
-	// --- Chat loop ---
-	for {
-		fmt.Print("✏️ Enter message (or 'exit'): ")
-		scanner.Scan()
-		msg := scanner.Text()
-		if strings.TrimSpace(msg) == "exit" {
-			break
-		}
-		if peerInfo != nil {
-			s, err := host.NewStream(ctx, peerInfo.ID, "/chat/1.0.0")
-			if err != nil {
-				fmt.Println("❌ Failed to open stream:", err)
-				continue
-			}
-			_, err = s.Write([]byte(msg + "\n"))
-			if err != nil {
-				fmt.Println("❌ Failed to send:", err)
-			}
-			s.Close()
-		} else {
-			fmt.Println("⚠️ No peer connected.")
+	// --- Tell peers when we're typing a message (not a command) ---
+	typing := newTypingNotifier(typingInterval, typingIdle, node.Typing)
+	con.OnKeystroke(func(line string, key rune) {
+		if !strings.HasPrefix(line+string(key), "/") {
+			typing.Keystroke()
 		}
+	})
+
+	// --- Chat loop ---
+	commands := newREPL(ctx, node, len(cfg.Node.Relays) > 0)
+	con.OnTab(commands.complete)
+	if pick != "" {
+		report(commands.dispatch("/dm " + pick))
 	}
+	commands.run(con, func() {
+		typing.Done()
+		idle.Touch()
+	})
 
-	fmt.Println("👋 Exiting...")
-	select {}
+	out.Println("👋 Exiting...")
 }
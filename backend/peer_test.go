@@ -6,13 +6,16 @@ import (
 	"context"
 	"errors"
 	"io"
+	"slices"
 	"testing"
+	"time"
 
 	libp2p "github.com/libp2p/go-libp2p"
 	crypto "github.com/libp2p/go-libp2p/core/crypto"
 	host "github.com/libp2p/go-libp2p/core/host"
 	network "github.com/libp2p/go-libp2p/core/network"
 	peer "github.com/libp2p/go-libp2p/core/peer"
+	protocol "github.com/libp2p/go-libp2p/core/protocol"
 	ma "github.com/multiformats/go-multiaddr"
 )
 
@@ -22,7 +25,7 @@ func createTestHost(t *testing.T) (host.Host, error) {
 	if err != nil {
 		t.Fatalf("Failed to generate key: %v", err)
 	}
-	h, err := libp2p.New(libp2p.Identity(priv))
+	h, err := libp2p.New(libp2p.Identity(priv), libp2p.ListenAddrStrings(loopbackListenAddrs...))
 	return h, err
 }
 
@@ -169,3 +172,183 @@ func TestPeerToPeerMessaging(t *testing.T) {
 		t.Error("Timeout waiting for message on host B")
 	}
 }
+
+func TestShutdownIsIdempotent(t *testing.T) {
+	ctx := context.Background()
+	hostA, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host A: %v", err)
+	}
+	hostB, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host B: %v", err)
+	}
+	defer hostB.Close()
+	hostB.SetStreamHandler("/chat/1.0.0", func(s network.Stream) {
+		io.Copy(io.Discard, s)
+	})
+	if err := hostA.Connect(ctx, peer.AddrInfo{ID: hostB.ID(), Addrs: hostB.Addrs()}); err != nil {
+		t.Fatalf("Failed to connect host A to host B: %v", err)
+	}
+
+	mgr := newStreamManager(hostA, streamOpener{timeout: 5 * time.Second}, nil)
+	if err := mgr.Send(ctx, hostB.ID(), newChatMessage(hostA.ID(), "", "bye")); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+
+	// Signal and exit can both fire; the second call must be harmless
+	shutdown(hostA, mgr)
+	shutdown(hostA, mgr)
+
+	if len(hostA.Network().Conns()) != 0 {
+		t.Error("Expected all connections to be closed after shutdown")
+	}
+}
+
+func TestHandleStreamRejectsOversizedLine(t *testing.T) {
+	old := maxMessageBytes
+	maxMessageBytes = 1024
+	defer func() { maxMessageBytes = old }()
+
+	ctx := context.Background()
+	hostA, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host A: %v", err)
+	}
+	defer hostA.Close()
+	hostB, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host B: %v", err)
+	}
+	defer hostB.Close()
+
+	history := newMessageLog(10)
+	done := make(chan struct{})
+	hostB.SetStreamHandler("/chat/1.0.0", func(s network.Stream) {
+		handleStream(s, history, nil, nil)
+		close(done)
+	})
+	if err := hostA.Connect(ctx, peer.AddrInfo{ID: hostB.ID(), Addrs: hostB.Addrs()}); err != nil {
+		t.Fatalf("Failed to connect host A to host B: %v", err)
+	}
+	s, err := hostA.NewStream(ctx, hostB.ID(), "/chat/1.0.0")
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	defer s.Close()
+
+	s.Write(bytes.Repeat([]byte("a"), 4096))
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for oversized line to be rejected")
+	}
+	if len(history.Recent(-1)) != 0 {
+		t.Error("Expected oversized line to be dropped")
+	}
+
+	// The reset reaches our side as an error rather than a clean EOF
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := s.Read(make([]byte, 1)); err == nil || errors.Is(err, io.EOF) {
+		t.Errorf("Expected stream reset, got %v", err)
+	}
+}
+
+func TestHandleStreamChatProtocolNeedsEnvelopes(t *testing.T) {
+	ctx := context.Background()
+	hostA, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host A: %v", err)
+	}
+	defer hostA.Close()
+	hostB, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host B: %v", err)
+	}
+	defer hostB.Close()
+
+	history := newMessageLog(10)
+	for _, proto := range []protocol.ID{chatProtocol, legacyChatProtocol} {
+		hostB.SetStreamHandler(proto, func(s network.Stream) { handleStream(s, history, nil, nil) })
+	}
+	if err := hostA.Connect(ctx, peer.AddrInfo{ID: hostB.ID(), Addrs: hostB.Addrs()}); err != nil {
+		t.Fatalf("Failed to connect host A to host B: %v", err)
+	}
+	send := func(proto protocol.ID, bare, body string) {
+		s, err := hostA.NewStream(ctx, hostB.ID(), proto)
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", proto, err)
+		}
+		defer s.Close()
+		s.Write([]byte(bare + "\n"))
+		writeMessage(s, newChatMessage("", "", body))
+	}
+
+	// The bare line is skipped on chatProtocol, and the stream carries on
+	send(chatProtocol, "bare on 2.0.0", "envelope on 2.0.0")
+	waitFor(t, "the envelope", func() bool { return len(history.Recent(-1)) == 1 })
+	send(legacyChatProtocol, "bare on 1.0.0", "envelope on 1.0.0")
+	waitFor(t, "the legacy messages", func() bool { return len(history.Recent(-1)) == 3 })
+
+	var got []string
+	for _, m := range history.Recent(-1) {
+		got = append(got, m.Body)
+	}
+	if want := []string{"envelope on 2.0.0", "bare on 1.0.0", "envelope on 1.0.0"}; !slices.Equal(got, want) {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+func TestHandleStreamEndings(t *testing.T) {
+	old := streamIdleTimeout
+	defer func() { streamIdleTimeout = old }()
+
+	tests := []struct {
+		name    string
+		idle    time.Duration
+		end     func(s network.Stream)
+		wantLog string
+		other   string
+	}{
+		{"truncated then EOF", time.Minute, func(s network.Stream) { s.CloseWrite() }, "stream closed", "stream failed"},
+		{"reset by peer", time.Minute, func(s network.Stream) { s.Reset() }, "stream failed", "stream closed"},
+		{"idle peer", 200 * time.Millisecond, func(network.Stream) {}, "stream failed", "stream closed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			streamIdleTimeout = tt.idle
+			logs := captureLogs(t)
+			a, b, cleanup := newTestPair(t)
+			defer cleanup()
+
+			history := newMessageLog(10)
+			done := make(chan struct{})
+			b.host.SetStreamHandler("/chat/1.0.0", func(s network.Stream) {
+				handleStream(s, history, nil, nil)
+				close(done)
+			})
+			s, err := a.host.NewStream(context.Background(), b.host.ID(), "/chat/1.0.0")
+			if err != nil {
+				t.Fatalf("Failed to open stream: %v", err)
+			}
+			defer s.Close()
+
+			// Half a line with no newline, as if the peer died mid-message
+			s.Write([]byte(`{"body":"cut o`))
+			time.Sleep(50 * time.Millisecond)
+			tt.end(s)
+
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Timeout waiting for handleStream to return")
+			}
+			if _, ok := logs.find(tt.wantLog); !ok {
+				t.Errorf("Expected %q to be logged", tt.wantLog)
+			}
+			if _, ok := logs.find(tt.other); ok {
+				t.Errorf("Expected no %q log", tt.other)
+			}
+		})
+	}
+}
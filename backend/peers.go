@@ -0,0 +1,112 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	host "github.com/libp2p/go-libp2p/core/host"
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// peerStatus is one row of /peers: a registry entry checked against the
+// host's live connections.
+type peerStatus struct {
+	ID     peer.ID `json:"id"`
+	Nick   string  `json:"nick,omitempty"`
+	State  string  `json:"state"`
+	Remote string  `json:"remote,omitempty"`
+	// Link is "direct", or "relayed" while the only connections go through
+	// a relay circuit, e.g. before hole punching succeeds.
+	Link string `json:"link,omitempty"`
+	// LastSeen is when the peer's last heartbeat arrived.
+	LastSeen time.Time `json:"lastSeen,omitzero"`
+}
+
+// connState maps libp2p connectedness onto the words /peers shows. A peer
+// without a usable connection is "disconnected" however libp2p rates it.
+func connState(c network.Connectedness) string {
+	switch c {
+	case network.Connected:
+		return "connected"
+	case network.Limited:
+		return "limited"
+	default:
+		return "disconnected"
+	}
+}
+
+// peerStatuses describes every registered peer, ordered by ID. Nicknames
+// come from the newest message each peer sent that's still in history.
+func peerStatuses(h host.Host, reg *peerRegistry, history *messageLog) []peerStatus {
+	nicks := make(map[peer.ID]string)
+	for _, m := range history.Recent(-1) {
+		if m.Nick != "" {
+			nicks[m.From] = sanitizeNick(m.Nick)
+		}
+	}
+
+	var out []peerStatus
+	for _, info := range reg.List() {
+		st := peerStatus{
+			ID:    info.ID,
+			Nick:  nicks[info.ID],
+			State: connState(h.Network().Connectedness(info.ID)),
+		}
+		if c := bestConn(h.Network().ConnsToPeer(info.ID)); c != nil {
+			st.Remote = c.RemoteMultiaddr().String()
+			st.Link = "direct"
+			if isRelayedAddr(c.RemoteMultiaddr()) {
+				st.Link = "relayed"
+			}
+		}
+		out = append(out, st)
+	}
+	return out
+}
+
+// bestConn picks the connection /peers describes: a direct one if there
+// is one, since that's what traffic uses once hole punching succeeds.
+func bestConn(conns []network.Conn) network.Conn {
+	for _, c := range conns {
+		if !isRelayedAddr(c.RemoteMultiaddr()) {
+			return c
+		}
+	}
+	if len(conns) > 0 {
+		return conns[0]
+	}
+	return nil
+}
+
+func isRelayedAddr(addr ma.Multiaddr) bool {
+	return hasProtocol(addr, ma.P_CIRCUIT)
+}
+
+// errNoSuchPeer is a peer number that isn't a row of /peers.
+var errNoSuchPeer = errors.New("no such peer number, see /peers")
+
+// formatPeers renders statuses as an aligned table followed by a count.
+// Rows are numbered from 1 so a peer can be picked by number.
+func formatPeers(statuses []peerStatus) string {
+	var b strings.Builder
+	connected := 0
+	if len(statuses) > 0 {
+		tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "#\tPEER\tNICK\tSTATUS\tLINK\tADDRESS")
+		for i, st := range statuses {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", i+1, peerName(st.ID), cmp.Or(st.Nick, "-"), st.State, cmp.Or(st.Link, "-"), cmp.Or(st.Remote, "-"))
+			if st.State == "connected" {
+				connected++
+			}
+		}
+		tw.Flush()
+	}
+	fmt.Fprintf(&b, "%d peer(s), %d connected", len(statuses), connected)
+	return b.String()
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	crypto "github.com/libp2p/go-libp2p/core/crypto"
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestConnState(t *testing.T) {
+	tests := map[network.Connectedness]string{
+		network.Connected:     "connected",
+		network.Limited:       "limited",
+		network.NotConnected:  "disconnected",
+		network.CanConnect:    "disconnected",
+		network.CannotConnect: "disconnected",
+	}
+	for c, want := range tests {
+		if got := connState(c); got != want {
+			t.Errorf("connState(%s) = %q, want %q", c, got, want)
+		}
+	}
+}
+
+func TestPeerStatusesFlagsStaleEntries(t *testing.T) {
+	ctx := context.Background()
+	hostA, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host A: %v", err)
+	}
+	defer hostA.Close()
+	hostB, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host B: %v", err)
+	}
+	defer hostB.Close()
+	hostC, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host C: %v", err)
+	}
+	hostC.Close()
+
+	if err := hostA.Connect(ctx, peer.AddrInfo{ID: hostB.ID(), Addrs: hostB.Addrs()}); err != nil {
+		t.Fatalf("Failed to connect host A to host B: %v", err)
+	}
+	reg := newPeerRegistry()
+	reg.Add(peer.AddrInfo{ID: hostB.ID()})
+	reg.Add(peer.AddrInfo{ID: hostC.ID()})
+	history := newMessageLog(10)
+	history.Add(newChatMessage(hostB.ID(), "bob", "hi"))
+
+	statuses := peerStatuses(hostA, reg, history)
+	if len(statuses) != 2 {
+		t.Fatalf("Expected 2 statuses, got %d", len(statuses))
+	}
+	for _, st := range statuses {
+		switch st.ID {
+		case hostB.ID():
+			if st.State != "connected" || st.Nick != "bob" || st.Remote == "" || st.Link != "direct" {
+				t.Errorf("Unexpected status for connected peer: %+v", st)
+			}
+		case hostC.ID():
+			if st.State != "disconnected" || st.Nick != "" || st.Remote != "" || st.Link != "" {
+				t.Errorf("Unexpected status for stale peer: %+v", st)
+			}
+		}
+	}
+}
+
+func newTestPeerID(t *testing.T) peer.ID {
+	t.Helper()
+	priv, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		t.Fatalf("Failed to get peer ID: %v", err)
+	}
+	return id
+}
+
+func TestFormatPeers(t *testing.T) {
+	bob, carol := newTestPeerID(t), newTestPeerID(t)
+	statuses := []peerStatus{
+		{ID: bob, Nick: "bob", State: "connected", Remote: "/ip4/10.0.0.2/tcp/4001", Link: "direct"},
+		{ID: carol, State: "disconnected"},
+	}
+	want := strings.Join([]string{
+		"#  PEER      NICK  STATUS        LINK    ADDRESS",
+		"1  " + shortID(bob) + "  bob   connected     direct  /ip4/10.0.0.2/tcp/4001",
+		"2  " + shortID(carol) + "  -     disconnected  -       -",
+		"2 peer(s), 1 connected",
+	}, "\n")
+	if got := formatPeers(statuses); got != want {
+		t.Errorf("Unexpected table:\n%s\nwant:\n%s", got, want)
+	}
+	if got := formatPeers(nil); got != "0 peer(s), 0 connected" {
+		t.Errorf("Unexpected empty table: %q", got)
+	}
+}
+
+func TestResolvePeerByNumber(t *testing.T) {
+	alice, bob, _ := newTestPair(t)
+	if id, err := alice.ResolvePeer("1"); err != nil || id != bob.host.ID() {
+		t.Errorf("Expected peer 1 to be bob, got %s, %v", id, err)
+	}
+	for _, n := range []string{"0", "2", "-1"} {
+		if _, err := alice.ResolvePeer(n); !errors.Is(err, errNoSuchPeer) {
+			t.Errorf("ResolvePeer(%q): expected errNoSuchPeer, got %v", n, err)
+		}
+	}
+}
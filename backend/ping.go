@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	host "github.com/libp2p/go-libp2p/core/host"
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	pingProtocol     = "/artivus/ping/1.0.0"
+	pingNonceSize    = 32
+	defaultPingCount = 3
+)
+
+// pingTimeout bounds a single probe. A var so tests can shorten it.
+var pingTimeout = 5 * time.Second
+
+var errNotConnected = errors.New("peer is not connected")
+
+// pingStats summarises one /ping run. min/avg/max only cover the probes
+// that came back.
+type pingStats struct {
+	sent, received int
+	min, avg, max  time.Duration
+}
+
+func (s pingStats) String() string {
+	if s.received == 0 {
+		return fmt.Sprintf("%d/%d received", s.received, s.sent)
+	}
+	return fmt.Sprintf("%d/%d received, min %s, avg %s, max %s",
+		s.received, s.sent, roundRTT(s.min), roundRTT(s.avg), roundRTT(s.max))
+}
+
+// roundRTT keeps LAN pings readable without flattening them to 0ms.
+func roundRTT(d time.Duration) time.Duration {
+	if d >= time.Millisecond {
+		return d.Round(time.Millisecond)
+	}
+	return d.Round(time.Microsecond)
+}
+
+// handlePing echoes every nonce back until the caller closes the stream.
+func handlePing(s network.Stream) {
+	defer s.Close()
+	buf := make([]byte, pingNonceSize)
+	for {
+		if _, err := io.ReadFull(s, buf); err != nil {
+			return
+		}
+		if _, err := s.Write(buf); err != nil {
+			return
+		}
+	}
+}
+
+// pingPeer sends count random nonces to an already connected peer over one
+// stream and times each echo. A failed probe ends the run, since the stream
+// is unusable afterwards; the remaining probes count as lost.
+func pingPeer(ctx context.Context, h host.Host, id peer.ID, count int) (pingStats, error) {
+	stats := pingStats{sent: count}
+	if h.Network().Connectedness(id) != network.Connected {
+		return stats, fmt.Errorf("%w: %s", errNotConnected, id)
+	}
+	s, err := h.NewStream(network.WithNoDial(ctx, "ping"), id, pingProtocol)
+	if err != nil {
+		return stats, err
+	}
+	defer s.Close()
+
+	nonce := make([]byte, pingNonceSize)
+	echo := make([]byte, pingNonceSize)
+	var total time.Duration
+	for i := 0; i < count; i++ {
+		rand.Read(nonce)
+		s.SetDeadline(time.Now().Add(pingTimeout))
+		start := time.Now()
+		if _, err := s.Write(nonce); err != nil {
+			s.Reset()
+			break
+		}
+		if _, err := io.ReadFull(s, echo); err != nil {
+			s.Reset()
+			break
+		}
+		rtt := time.Since(start)
+		if !bytes.Equal(nonce, echo) {
+			s.Reset()
+			return stats, errors.New("ping reply doesn't match the nonce sent")
+		}
+		stats.received++
+		total += rtt
+		if stats.min == 0 || rtt < stats.min {
+			stats.min = rtt
+		}
+		if rtt > stats.max {
+			stats.max = rtt
+		}
+	}
+	if stats.received > 0 {
+		stats.avg = total / time.Duration(stats.received)
+	}
+	return stats, nil
+}
+
+func printPing(ctx context.Context, h host.Host, target string, count int) {
+	id, err := peer.Decode(target)
+	if err != nil {
+		out.Printf("❌ Invalid peer ID %q: %v\n", target, err)
+		return
+	}
+	stats, err := pingPeer(ctx, h, id, count)
+	if err != nil {
+		out.Printf("❌ ping %s: %v\n", id, err)
+		return
+	}
+	out.Printf("🏓 ping %s: %s\n", id, stats)
+}
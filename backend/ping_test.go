@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestPingPeer(t *testing.T) {
+	ctx := context.Background()
+	hostA, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host A: %v", err)
+	}
+	defer hostA.Close()
+	hostB, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host B: %v", err)
+	}
+	defer hostB.Close()
+	hostB.SetStreamHandler(pingProtocol, handlePing)
+
+	if err := hostA.Connect(ctx, peer.AddrInfo{ID: hostB.ID(), Addrs: hostB.Addrs()}); err != nil {
+		t.Fatalf("Failed to connect host A to host B: %v", err)
+	}
+
+	stats, err := pingPeer(ctx, hostA, hostB.ID(), 3)
+	if err != nil {
+		t.Fatalf("Failed to ping: %v", err)
+	}
+	if stats.sent != 3 || stats.received != 3 {
+		t.Errorf("Expected 3/3 received, got %s", stats)
+	}
+	if stats.min <= 0 || stats.min > stats.avg || stats.avg > stats.max {
+		t.Errorf("Expected min <= avg <= max, got %s", stats)
+	}
+}
+
+func TestPingPeerNotConnected(t *testing.T) {
+	hostA, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host A: %v", err)
+	}
+	defer hostA.Close()
+	hostB, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host B: %v", err)
+	}
+	defer hostB.Close()
+
+	_, err = pingPeer(context.Background(), hostA, hostB.ID(), 1)
+	if !errors.Is(err, errNotConnected) {
+		t.Errorf("Expected errNotConnected, got %v", err)
+	}
+}
+
+func TestPingPeerNoEcho(t *testing.T) {
+	old := pingTimeout
+	pingTimeout = 200 * time.Millisecond
+	defer func() { pingTimeout = old }()
+
+	ctx := context.Background()
+	hostA, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host A: %v", err)
+	}
+	defer hostA.Close()
+	hostB, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host B: %v", err)
+	}
+	defer hostB.Close()
+	// Accepts the protocol but never answers
+	hostB.SetStreamHandler(pingProtocol, func(s network.Stream) {})
+
+	if err := hostA.Connect(ctx, peer.AddrInfo{ID: hostB.ID(), Addrs: hostB.Addrs()}); err != nil {
+		t.Fatalf("Failed to connect host A to host B: %v", err)
+	}
+
+	stats, err := pingPeer(ctx, hostA, hostB.ID(), 2)
+	if err != nil {
+		t.Fatalf("Expected lost probes rather than an error, got %v", err)
+	}
+	if stats.received != 0 || stats.String() != "0/2 received" {
+		t.Errorf("Expected 0/2 received, got %s", stats)
+	}
+}
+
+func TestPingStatsString(t *testing.T) {
+	s := pingStats{sent: 3, received: 3, min: 20 * time.Millisecond, avg: 24400 * time.Microsecond, max: 30 * time.Millisecond}
+	want := "3/3 received, min 20ms, avg 24ms, max 30ms"
+	if got := s.String(); got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
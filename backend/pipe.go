@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strings"
+	"time"
+)
+
+// deliveryPollInterval is how often waitDelivered checks for outstanding
+// ACKs.
+const deliveryPollInterval = 50 * time.Millisecond
+
+// sendLines sends every non-blank line of r with send, stopping at the
+// first error. It returns how many lines were sent.
+func sendLines(r io.Reader, send func(body string) error) (int, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), maxBodyBytes)
+	sent := 0
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if err := send(line); err != nil {
+			return sent, err
+		}
+		sent++
+	}
+	return sent, sc.Err()
+}
+
+// waitDelivered blocks until every message n sent has been acknowledged or
+// timed out, or ctx is done.
+func (n *Node) waitDelivered(ctx context.Context) {
+	ticker := time.NewTicker(deliveryPollInterval)
+	defer ticker.Stop()
+	for n.mgr.acks.Pending() > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runPipe is the non-interactive mode used when stdin is not a terminal:
+// it connects to target (if set), sends each line of in as a message and
+// waits for delivery before returning. Empty input sends nothing.
+func runPipe(ctx context.Context, n *Node, target string, in io.Reader) error {
+	if target != "" {
+		if err := n.Connect(target); err != nil {
+			return err
+		}
+	}
+	// Reading in can block until the writer closes it, so Ctrl-C is
+	// watched for alongside
+	type result struct {
+		sent int
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		sent, err := sendLines(in, n.Send)
+		done <- result{sent, err}
+	}()
+	select {
+	case <-ctx.Done():
+		return nil
+	case res := <-done:
+		logger.Debug("sent piped messages", "count", res.sent)
+		if res.err != nil {
+			return res.err
+		}
+	}
+	n.waitDelivered(ctx)
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestSendLines(t *testing.T) {
+	var sent []string
+	send := func(body string) error {
+		sent = append(sent, body)
+		return nil
+	}
+
+	n, err := sendLines(strings.NewReader("deploy done\n\nrollback ready\n"), send)
+	if err != nil {
+		t.Fatalf("Failed to send lines: %v", err)
+	}
+	if n != 2 || len(sent) != 2 || sent[0] != "deploy done" || sent[1] != "rollback ready" {
+		t.Errorf("Expected two sends, got %d: %q", n, sent)
+	}
+
+	sent = nil
+	if n, err := sendLines(strings.NewReader(""), send); n != 0 || err != nil || len(sent) != 0 {
+		t.Errorf("Expected empty input to send nothing, got %d sends, err %v", n, err)
+	}
+}
+
+func TestRunPipe(t *testing.T) {
+	alice, bob, _ := newTestPair(t)
+
+	if err := runPipe(context.Background(), alice, "", strings.NewReader("one\ntwo\n")); err != nil {
+		t.Fatalf("Failed to run pipe: %v", err)
+	}
+	if pending := alice.mgr.acks.Pending(); pending != 0 {
+		t.Errorf("Expected every message acknowledged before returning, %d pending", pending)
+	}
+	waitFor(t, "both piped messages", func() bool { return len(bob.history.Recent(-1)) == 2 })
+}
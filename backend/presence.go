@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	host "github.com/libp2p/go-libp2p/core/host"
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	presenceProtocol         = "/artivus/presence/1.0.0"
+	defaultHeartbeatInterval = 15 * time.Second
+	// missedHeartbeats is how many intervals may pass without a heartbeat
+	// before a peer is considered stale.
+	missedHeartbeats = 3
+)
+
+// presenceTracker remembers when each peer's last heartbeat arrived, and
+// tells onChange, if set, whenever a peer comes online or goes offline.
+type presenceTracker struct {
+	interval time.Duration
+	now      func() time.Time
+	onChange func(id peer.ID, online bool)
+
+	mu       sync.Mutex
+	lastSeen map[peer.ID]time.Time
+	// online is each peer's state as last reported to onChange.
+	online map[peer.ID]bool
+}
+
+func newPresenceTracker(interval time.Duration) *presenceTracker {
+	return &presenceTracker{
+		interval: interval,
+		now:      time.Now,
+		lastSeen: make(map[peer.ID]time.Time),
+		online:   make(map[peer.ID]bool),
+	}
+}
+
+// Seen records a heartbeat, or a new connection, from id.
+func (p *presenceTracker) Seen(id peer.ID) {
+	p.mu.Lock()
+	p.lastSeen[id] = p.now()
+	changed := !p.online[id]
+	p.online[id] = true
+	p.mu.Unlock()
+	if changed {
+		p.changed(id, true)
+	}
+}
+
+// Gone marks id offline straight away, e.g. when its last connection
+// closed.
+func (p *presenceTracker) Gone(id peer.ID) {
+	p.mu.Lock()
+	changed := p.online[id]
+	delete(p.online, id)
+	p.mu.Unlock()
+	if changed {
+		p.changed(id, false)
+	}
+}
+
+// Expire marks offline every peer whose heartbeats have stopped.
+func (p *presenceTracker) Expire() {
+	var gone []peer.ID
+	p.mu.Lock()
+	for id := range p.online {
+		if p.now().Sub(p.lastSeen[id]) >= missedHeartbeats*p.interval {
+			delete(p.online, id)
+			gone = append(gone, id)
+		}
+	}
+	p.mu.Unlock()
+	for _, id := range gone {
+		p.changed(id, false)
+	}
+}
+
+// Online returns the peers currently online.
+func (p *presenceTracker) Online() []peer.ID {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ids := make([]peer.ID, 0, len(p.online))
+	for id := range p.online {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (p *presenceTracker) changed(id peer.ID, online bool) {
+	if p.onChange != nil {
+		p.onChange(id, online)
+	}
+}
+
+// defaultFlapWindow is how long after a peer's online or offline notice
+// its further changes are held back, to be summed up in one line when the
+// window closes.
+const defaultFlapWindow = 30 * time.Second
+
+// flapDebouncer keeps a peer whose link keeps dropping from flooding the
+// console: the first change in a window is shown as it happens, the rest
+// are counted, and summary is called with the count when the window
+// closes. summary isn't called for a window with one change.
+type flapDebouncer struct {
+	window  time.Duration
+	summary func(id peer.ID, reconnects int, online bool)
+
+	mu     sync.Mutex
+	peers  map[peer.ID]*flapState
+	closed bool
+}
+
+// flapState is one peer's open window.
+type flapState struct {
+	timer *time.Timer
+	// shown is the state the peer's notice reported, online the latest.
+	shown, online bool
+	// held counts the changes since the notice, reconnects those that
+	// brought the peer back online.
+	held, reconnects int
+}
+
+func newFlapDebouncer(window time.Duration, summary func(id peer.ID, reconnects int, online bool)) *flapDebouncer {
+	return &flapDebouncer{window: window, summary: summary, peers: make(map[peer.ID]*flapState)}
+}
+
+// Change records id coming online or going offline, and reports whether
+// to show it now: only the first change in each window is shown.
+func (d *flapDebouncer) Change(id peer.ID, online bool) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return true
+	}
+	if st, ok := d.peers[id]; ok {
+		st.online = online
+		st.held++
+		if online {
+			st.reconnects++
+		}
+		return false
+	}
+	d.peers[id] = &flapState{
+		timer:  time.AfterFunc(d.window, func() { d.flush(id) }),
+		shown:  online,
+		online: online,
+	}
+	return true
+}
+
+// Held reports whether id's latest change was held back, so other notices
+// about it, like the reconnector's, can hold back too.
+func (d *flapDebouncer) Held(id peer.ID) bool {
+	if d == nil {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	st, ok := d.peers[id]
+	return ok && st.held > 0
+}
+
+// flush closes id's window, summing up what was held back in it.
+func (d *flapDebouncer) flush(id peer.ID) {
+	d.mu.Lock()
+	st, ok := d.peers[id]
+	delete(d.peers, id)
+	closed := d.closed
+	d.mu.Unlock()
+	if !ok || closed || st.held == 0 {
+		return
+	}
+	if st.reconnects > 0 || st.online != st.shown {
+		d.summary(id, st.reconnects, st.online)
+	}
+}
+
+// Close drops the open windows without summing them up.
+func (d *flapDebouncer) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed = true
+	for id, st := range d.peers {
+		st.timer.Stop()
+		delete(d.peers, id)
+	}
+	return nil
+}
+
+// watch keeps presence in step with h's connections.
+func (p *presenceTracker) watch(h host.Host) {
+	h.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(_ network.Network, c network.Conn) {
+			p.Seen(c.RemotePeer())
+		},
+		DisconnectedF: func(net network.Network, c network.Conn) {
+			if net.Connectedness(c.RemotePeer()) != network.Connected {
+				p.Gone(c.RemotePeer())
+			}
+		},
+	})
+}
+
+// expireLoop expires peers whose heartbeats stopped every interval until
+// ctx is done.
+func (p *presenceTracker) expireLoop(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.Expire()
+		}
+	}
+}
+
+// Status reports whether id has sent a heartbeat within the last
+// missedHeartbeats intervals, and when it last did. A peer never heard
+// from is offline with a zero lastSeen.
+func (p *presenceTracker) Status(id peer.ID) (online bool, lastSeen time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	lastSeen, ok := p.lastSeen[id]
+	if !ok {
+		return false, time.Time{}
+	}
+	return p.now().Sub(lastSeen) < missedHeartbeats*p.interval, lastSeen
+}
+
+// sendHeartbeats sends a heartbeat to every connected peer each interval
+// until ctx is done.
+func sendHeartbeats(ctx context.Context, h host.Host, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, id := range h.Network().Peers() {
+				go sendHeartbeat(ctx, h, id, interval)
+			}
+		}
+	}
+}
+
+// sendHeartbeat writes a single newline on a fresh presence stream. Peers
+// that don't speak the protocol are skipped quietly.
+func sendHeartbeat(ctx context.Context, h host.Host, id peer.ID, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	s, err := h.NewStream(network.WithNoDial(ctx, "heartbeats never dial"), id, presenceProtocol)
+	if err != nil {
+		logger.Debug("failed to send heartbeat", "peer_id", id, "error", err)
+		return
+	}
+	defer s.Close()
+	s.SetWriteDeadline(time.Now().Add(timeout))
+	s.Write([]byte("\n"))
+}
+
+// presenceStatus is one line of /who: a known peer and whether it's
+// reachable.
+type presenceStatus struct {
+	ID       peer.ID   `json:"id"`
+	Alias    string    `json:"alias,omitempty"`
+	Online   bool      `json:"online"`
+	LastSeen time.Time `json:"lastSeen,omitzero"`
+}
+
+// formatWho renders statuses for /who, relative to now.
+func formatWho(statuses []presenceStatus, now time.Time) string {
+	if len(statuses) == 0 {
+		return "👥 Nobody known yet; save contacts with /alias <name> <peerID|multiaddr>"
+	}
+	var b strings.Builder
+	b.WriteString("👥 Who's around:")
+	for _, st := range statuses {
+		name := shortID(st.ID)
+		if st.Alias != "" {
+			name = "@" + st.Alias
+		}
+		switch {
+		case st.Online:
+			fmt.Fprintf(&b, "\n   🟢 %s online", name)
+		case st.LastSeen.IsZero():
+			fmt.Fprintf(&b, "\n   ⚪ %s never seen", name)
+		default:
+			fmt.Fprintf(&b, "\n   ⚪ %s offline, last seen %s ago", name, now.Sub(st.LastSeen).Round(time.Second))
+		}
+	}
+	return b.String()
+}
+
+func newPresenceHandler(p *presenceTracker) network.StreamHandler {
+	return func(s network.Stream) {
+		defer s.Close()
+		p.Seen(s.Conn().RemotePeer())
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestPresenceTracker(t *testing.T) {
+	p := newPresenceTracker(time.Second)
+	clock := time.Unix(1700000000, 0)
+	p.now = func() time.Time { return clock }
+	id := peer.ID("alice")
+
+	if online, seen := p.Status(id); online || !seen.IsZero() {
+		t.Errorf("Expected an unknown peer to be offline, got %v %v", online, seen)
+	}
+	p.Seen(id)
+	clock = clock.Add(2 * time.Second)
+	if online, seen := p.Status(id); !online || !seen.Equal(clock.Add(-2*time.Second)) {
+		t.Errorf("Expected alice online after the heartbeat, got %v %v", online, seen)
+	}
+	clock = clock.Add(time.Second)
+	if online, _ := p.Status(id); online {
+		t.Error("Expected alice to go stale after 3 missed heartbeats")
+	}
+}
+
+func TestHeartbeatUpdatesPresence(t *testing.T) {
+	a, b, cleanup := newTestPair(t)
+	defer cleanup()
+
+	before := time.Now()
+	sendHeartbeat(context.Background(), a.host, b.host.ID(), 5*time.Second)
+	// The connection already counts as seen, so wait for a newer time
+	waitFor(t, "heartbeat", func() bool {
+		online, seen := b.presence(a.host.ID())
+		return online && !seen.Before(before)
+	})
+	if st := b.Peers()[0]; st.State != "connected" || st.LastSeen.IsZero() {
+		t.Errorf("Expected alice connected with a lastSeen, got %+v", st)
+	}
+
+	// Jump past the timeout without closing the connection
+	b.seen.now = func() time.Time { return time.Now().Add(missedHeartbeats * b.cfg.HeartbeatInterval) }
+	if online, _ := b.presence(a.host.ID()); online {
+		t.Error("Expected alice offline once heartbeats stop")
+	}
+	if st := b.Peers()[0]; st.State != "stale" {
+		t.Errorf("Expected alice to show as stale, got %q", st.State)
+	}
+}
+
+func TestPresenceChanges(t *testing.T) {
+	p := newPresenceTracker(time.Second)
+	clock := time.Unix(1700000000, 0)
+	p.now = func() time.Time { return clock }
+	var changes []string
+	p.onChange = func(id peer.ID, online bool) {
+		changes = append(changes, fmt.Sprintf("%s %v", string(id), online))
+	}
+	alice, bob := peer.ID("alice"), peer.ID("bob")
+
+	p.Seen(alice)
+	p.Seen(alice)
+	p.Seen(bob)
+	clock = clock.Add(2 * time.Second)
+	p.Seen(bob)
+	clock = clock.Add(time.Second)
+	p.Expire()
+	p.Gone(bob)
+	p.Gone(bob)
+
+	want := []string{"alice true", "bob true", "alice false", "bob false"}
+	if !slices.Equal(changes, want) {
+		t.Errorf("Expected changes %v, got %v", want, changes)
+	}
+	if online := p.Online(); len(online) != 0 {
+		t.Errorf("Expected nobody online, got %v", online)
+	}
+}
+
+func TestWhoListsContactsAndOnlinePeers(t *testing.T) {
+	a, b, cleanup := newTestPair(t)
+	defer cleanup()
+	a.book, _ = loadAddressBook(filepath.Join(t.TempDir(), "peers.json"))
+	carol := newTestPeerID(t)
+	if err := a.SaveAlias("carol", carol.String()); err != nil {
+		t.Fatalf("Failed to save alias: %v", err)
+	}
+	events, stop := a.SubscribeEvents()
+	defer stop()
+
+	who := a.Who()
+	if len(who) != 2 || who[0].ID != b.host.ID() || !who[0].Online || who[1].Alias != "carol" || who[1].Online {
+		t.Fatalf("Expected bob online then carol offline, got %+v", who)
+	}
+	now := time.Now()
+	text := formatWho(who, now)
+	if !strings.Contains(text, "🟢 "+shortID(b.host.ID())+" online") || !strings.Contains(text, "⚪ @carol never seen") {
+		t.Errorf("Unexpected /who output:\n%s", text)
+	}
+
+	b.Close()
+	waitFor(t, "an OFFLINE event for bob", func() bool {
+		select {
+		case e := <-events:
+			return e.Kind == eventOffline && e.Peer == b.host.ID()
+		default:
+			return false
+		}
+	})
+	// bob isn't a contact, so is only listed while online
+	if who := a.Who(); len(who) != 1 || who[0].Alias != "carol" {
+		t.Errorf("Expected only carol once bob left, got %+v", who)
+	}
+}
+
+func TestFlappingPeerIsSummarized(t *testing.T) {
+	var buf syncBuffer
+	oldCon, oldContacts := con, contacts
+	con = newPlainConsole(strings.NewReader(""), &buf)
+	t.Cleanup(func() { con, contacts = oldCon, oldContacts })
+
+	n := newTestNode(t, "alice")
+	n.book, _ = loadAddressBook(filepath.Join(t.TempDir(), "peers.json"))
+	contacts = n.book
+	bob := newTestPeerID(t)
+	if err := n.SaveAlias("bob", bob.String()); err != nil {
+		t.Fatalf("Failed to save alias: %v", err)
+	}
+	n.flaps.window = 200 * time.Millisecond
+
+	for i := range 7 {
+		n.presenceChanged(bob, i%2 == 0)
+	}
+	if got := buf.String(); got != "🟢 @bob is online\n" {
+		t.Fatalf("Expected only the first change to be shown straight away, got %q", got)
+	}
+	waitFor(t, "the summary", func() bool { return strings.Contains(buf.String(), "🔁") })
+	if got, want := buf.String(), "🟢 @bob is online\n🔁 @bob reconnected 3× in 200ms, now online\n"; got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+
+	// Once the window has closed the next change shows again
+	n.presenceChanged(bob, false)
+	if got := buf.String(); !strings.HasSuffix(got, "⚪ @bob went offline\n") {
+		t.Errorf("Expected the next change to be shown, got %q", got)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	host "github.com/libp2p/go-libp2p/core/host"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	protocol "github.com/libp2p/go-libp2p/core/protocol"
+)
+
+var errProtocolsUnknown = errors.New("protocols not known yet (identify hasn't completed with this peer)")
+
+// listProtocols returns our own registered protocol handlers when target is
+// empty, or the protocols a remote peer advertised via identify.
+func listProtocols(h host.Host, target string) ([]protocol.ID, error) {
+	var protos []protocol.ID
+	if target == "" {
+		protos = h.Mux().Protocols()
+	} else {
+		id, err := peer.Decode(target)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer ID %q: %w", target, err)
+		}
+		protos, err = h.Peerstore().GetProtocols(id)
+		if err != nil {
+			return nil, err
+		}
+		if len(protos) == 0 {
+			return nil, errProtocolsUnknown
+		}
+	}
+	slices.Sort(protos)
+	return protos, nil
+}
+
+func printProtocols(h host.Host, target string) {
+	protos, err := listProtocols(h, target)
+	if err != nil {
+		out.Error("Failed to list protocols", err)
+		return
+	}
+	if target == "" {
+		out.Println("🧩 Local protocols:")
+	} else {
+		out.Printf("🧩 Protocols advertised by %s:\n", target)
+	}
+	for _, p := range protos {
+		out.Println("  ", p)
+	}
+}
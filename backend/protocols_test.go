@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	protocol "github.com/libp2p/go-libp2p/core/protocol"
+)
+
+func TestListProtocols(t *testing.T) {
+	hostA, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host A: %v", err)
+	}
+	defer hostA.Close()
+	hostB, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host B: %v", err)
+	}
+	defer hostB.Close()
+	hostB.SetStreamHandler("/chat/1.0.0", func(s network.Stream) { s.Close() })
+
+	local, err := listProtocols(hostB, "")
+	if err != nil {
+		t.Fatalf("Failed to list local protocols: %v", err)
+	}
+	if !slices.Contains(local, protocol.ID("/chat/1.0.0")) {
+		t.Errorf("Expected /chat/1.0.0 among local protocols, got %v", local)
+	}
+
+	// Before identify has run the remote list is unknown
+	if _, err := listProtocols(hostA, hostB.ID().String()); !errors.Is(err, errProtocolsUnknown) {
+		t.Errorf("Expected unknown protocols error, got %v", err)
+	}
+
+	if err := hostA.Connect(context.Background(), peer.AddrInfo{ID: hostB.ID(), Addrs: hostB.Addrs()}); err != nil {
+		t.Fatalf("Failed to connect host A to host B: %v", err)
+	}
+	var remote []protocol.ID
+	for i := 0; i < 50; i++ {
+		if remote, err = listProtocols(hostA, hostB.ID().String()); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !slices.Contains(remote, protocol.ID("/chat/1.0.0")) {
+		t.Errorf("Expected /chat/1.0.0 among remote protocols, got %v (err %v)", remote, err)
+	}
+
+	if _, err := listProtocols(hostA, "not-a-peer-id"); err == nil {
+		t.Error("Expected error for invalid peer ID")
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	defaultQueueSize   = 100
+	defaultQueueExpiry = 24 * time.Hour
+)
+
+// outbox holds messages typed while a peer was offline, oldest first, until
+// it connects again. Each peer's queue is capped at limit; past that the
+// oldest message is dropped. Messages older than expiry are dropped too,
+// unless expiry is zero. With a store attached, every change to a queue
+// is saved, so queued messages survive restarts.
+type outbox struct {
+	limit  int
+	expiry time.Duration
+
+	mu     sync.Mutex
+	queues map[peer.ID][]ChatMessage
+
+	// saveMu orders the writes to store, which is nil until attach; see
+	// persist.
+	saveMu sync.Mutex
+	store  *historyStore
+}
+
+func newOutbox(limit int, expiry time.Duration) *outbox {
+	return &outbox{limit: limit, expiry: expiry, queues: make(map[peer.ID][]ChatMessage)}
+}
+
+// Push queues m for id and reports whether the oldest message had to be
+// dropped to make room.
+func (o *outbox) Push(id peer.ID, m ChatMessage) bool {
+	o.mu.Lock()
+	q := append(o.queues[id], m)
+	dropped := len(q) > o.limit
+	if dropped {
+		q = q[len(q)-o.limit:]
+	}
+	o.queues[id] = q
+	o.mu.Unlock()
+	o.persist(id)
+	return dropped
+}
+
+// Take removes and returns everything queued for id that hasn't expired.
+func (o *outbox) Take(id peer.ID) []ChatMessage {
+	o.mu.Lock()
+	_, queued := o.queues[id]
+	o.expireLocked(id, time.Now())
+	q := o.queues[id]
+	delete(o.queues, id)
+	o.mu.Unlock()
+	if queued {
+		o.persist(id)
+	}
+	return q
+}
+
+// Expire drops every message that has expired by now, returning how many
+// went from each peer's queue.
+func (o *outbox) Expire(now time.Time) map[peer.ID]int {
+	o.mu.Lock()
+	expired := make(map[peer.ID]int)
+	for id := range o.queues {
+		if n := o.expireLocked(id, now); n > 0 {
+			expired[id] = n
+		}
+	}
+	o.mu.Unlock()
+	for id := range expired {
+		o.persist(id)
+	}
+	return expired
+}
+
+// expireLocked drops id's expired messages, which are at the front since
+// the queue is oldest first, and returns how many there were. Callers
+// hold mu.
+func (o *outbox) expireLocked(id peer.ID, now time.Time) int {
+	if o.expiry <= 0 {
+		return 0
+	}
+	q := o.queues[id]
+	n := 0
+	for n < len(q) && now.Sub(q[n].Time()) >= o.expiry {
+		n++
+	}
+	if n == len(q) {
+		delete(o.queues, id)
+	} else if n > 0 {
+		o.queues[id] = q[n:]
+	}
+	return n
+}
+
+// Waiting returns the peers with messages queued.
+func (o *outbox) Waiting() []peer.ID {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	ids := make([]peer.ID, 0, len(o.queues))
+	for id := range o.queues {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Requeue puts msgs back in front of whatever has been queued for id since
+// they were taken, e.g. after a flush failed part way.
+func (o *outbox) Requeue(id peer.ID, msgs []ChatMessage) {
+	o.mu.Lock()
+	q := append(append([]ChatMessage(nil), msgs...), o.queues[id]...)
+	if len(q) > o.limit {
+		q = q[len(q)-o.limit:]
+	}
+	o.queues[id] = q
+	o.mu.Unlock()
+	o.persist(id)
+}
+
+func (o *outbox) Len(id peer.ID) int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.queues[id])
+}
+
+// attach loads the queues saved in store and saves every later change to
+// them there. Loaded queues are held to limit and expiry like new ones,
+// and written back trimmed. It returns how many messages are waiting.
+func (o *outbox) attach(store *historyStore) (int, error) {
+	saved, err := store.LoadQueues()
+	if err != nil {
+		return 0, err
+	}
+	o.saveMu.Lock()
+	o.store = store
+	o.saveMu.Unlock()
+	for id, msgs := range saved {
+		o.Requeue(id, msgs)
+	}
+	o.Expire(time.Now())
+	total := 0
+	for _, id := range o.Waiting() {
+		total += o.Len(id)
+	}
+	return total, nil
+}
+
+// persist saves ids' queues to the store, if one is attached. Each queue
+// is copied under mu but written after, so a slow disk doesn't hold up
+// sends; holding saveMu throughout keeps the writes in the order the
+// copies were made, so the newest copy is always the one left on disk.
+func (o *outbox) persist(ids ...peer.ID) {
+	o.saveMu.Lock()
+	defer o.saveMu.Unlock()
+	if o.store == nil {
+		return
+	}
+	for _, id := range ids {
+		o.mu.Lock()
+		q := slices.Clone(o.queues[id])
+		o.mu.Unlock()
+		if err := o.store.SaveQueue(id, q); err != nil {
+			logger.Warn("failed to save queued messages", "peer_id", id, "error", err)
+		}
+	}
+}
+
+// Close stops saving to the store, before its owner closes it.
+func (o *outbox) Close() error {
+	o.saveMu.Lock()
+	defer o.saveMu.Unlock()
+	o.store = nil
+	return nil
+}
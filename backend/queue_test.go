@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestOutboxDropsOldest(t *testing.T) {
+	o := newOutbox(2, 0)
+	id := newTestPeerID(t)
+	for i, body := range []string{"one", "two", "three"} {
+		dropped := o.Push(id, newChatMessage("", "", body))
+		if want := i == 2; dropped != want {
+			t.Errorf("Push(%q) dropped = %v, want %v", body, dropped, want)
+		}
+	}
+	got := o.Take(id)
+	if len(got) != 2 || got[0].Body != "two" || got[1].Body != "three" {
+		t.Errorf("Expected [two three], got %+v", got)
+	}
+	if o.Len(id) != 0 {
+		t.Errorf("Expected an empty queue after Take, got %d", o.Len(id))
+	}
+}
+
+func TestOutboxRequeueKeepsOrder(t *testing.T) {
+	o := newOutbox(10, 0)
+	id := newTestPeerID(t)
+	o.Push(id, newChatMessage("", "", "one"))
+	o.Push(id, newChatMessage("", "", "two"))
+	taken := o.Take(id)
+	o.Push(id, newChatMessage("", "", "three"))
+	o.Requeue(id, taken[1:])
+
+	got := o.Take(id)
+	if len(got) != 2 || got[0].Body != "two" || got[1].Body != "three" {
+		t.Errorf("Expected [two three], got %+v", got)
+	}
+}
+
+func TestNodeFlushesQueueOnConnect(t *testing.T) {
+	alice := newTestNode(t, "alice")
+	bob := newTestNode(t, "bob")
+
+	// alice knows bob, e.g. from an earlier session, but isn't connected
+	alice.registry.Add(peer.AddrInfo{ID: bob.host.ID(), Addrs: bob.host.Addrs()})
+	for _, body := range []string{"first", "second"} {
+		if err := alice.Send(body); err != nil {
+			t.Fatalf("Failed to send %q: %v", body, err)
+		}
+	}
+	if got := alice.queueDepth(bob.host.ID()); got != 2 {
+		t.Fatalf("Expected 2 queued messages, got %d", got)
+	}
+
+	addr := nodeAddr(bob)
+	if err := alice.Connect(addr); err != nil {
+		t.Fatalf("Failed to connect alice to bob: %v", err)
+	}
+	waitFor(t, "bob to receive both queued messages", func() bool {
+		return len(bob.history.Recent(-1)) == 2
+	})
+	got := bob.history.Recent(-1)
+	if got[0].Body != "first" || got[1].Body != "second" {
+		t.Errorf("Expected [first second] in order, got [%s %s]", got[0].Body, got[1].Body)
+	}
+	if depth := alice.queueDepth(bob.host.ID()); depth != 0 {
+		t.Errorf("Expected an empty queue after flushing, got %d", depth)
+	}
+}
+
+func TestOutboxExpiresOldMessages(t *testing.T) {
+	o := newOutbox(10, time.Hour)
+	bob, carol := newTestPeerID(t), newTestPeerID(t)
+	stale := newChatMessage("", "", "stale")
+	stale.Timestamp = time.Now().Add(-2 * time.Hour).Unix()
+	o.Push(bob, stale)
+	o.Push(bob, newChatMessage("", "", "fresh"))
+	o.Push(carol, newChatMessage("", "", "fresh"))
+
+	if got := o.Expire(time.Now()); len(got) != 1 || got[bob] != 1 {
+		t.Errorf("Expected one of bob's messages expired, got %v", got)
+	}
+	if got := o.Waiting(); len(got) != 2 {
+		t.Errorf("Expected both peers still waiting, got %v", got)
+	}
+	if got := o.Expire(time.Now().Add(2 * time.Hour)); got[bob] != 1 || got[carol] != 1 {
+		t.Errorf("Expected the rest expired later on, got %v", got)
+	}
+	if got := o.Waiting(); len(got) != 0 {
+		t.Errorf("Expected no peers waiting once everything expired, got %v", got)
+	}
+}
+
+func TestOutboxTakeSkipsExpired(t *testing.T) {
+	o := newOutbox(10, time.Hour)
+	id := newTestPeerID(t)
+	stale := newChatMessage("", "", "stale")
+	stale.Timestamp = time.Now().Add(-2 * time.Hour).Unix()
+	o.Push(id, stale)
+	o.Push(id, newChatMessage("", "", "fresh"))
+	if got := o.Take(id); len(got) != 1 || got[0].Body != "fresh" {
+		t.Errorf("Expected only [fresh], got %+v", got)
+	}
+}
+
+func TestNodeFindsQueuedPeerInDHT(t *testing.T) {
+	alice := newTestNode(t, "alice")
+	bob := newTestNode(t, "bob")
+
+	// alice has no address for bob, only the DHT does
+	alice.registry.Add(peer.AddrInfo{ID: bob.host.ID()})
+	if err := alice.Send("found you"); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	alice.mu.Lock()
+	alice.router = stubRouter{bob.host.ID(): {ID: bob.host.ID(), Addrs: bob.host.Addrs()}}
+	alice.mu.Unlock()
+
+	alice.checkOutbox()
+	waitFor(t, "bob to receive the queued message", func() bool {
+		got := bob.history.Recent(1)
+		return len(got) == 1 && got[0].Body == "found you"
+	})
+}
+
+func TestOutboxAttachTrimsSavedQueues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	store := openTestStore(t, path)
+	alice, bob := newTestPeerID(t), newTestPeerID(t)
+	now := time.Now()
+	stale := ChatMessage{ID: "stale", Body: "stale", Timestamp: now.Add(-2 * time.Hour).Unix()}
+	older := ChatMessage{ID: "older", Body: "older", Timestamp: now.Unix()}
+	newest := ChatMessage{ID: "newest", Body: "newest", Timestamp: now.Unix()}
+	if err := store.SaveQueue(alice, []ChatMessage{stale, older, newest}); err != nil {
+		t.Fatalf("Failed to save queue: %v", err)
+	}
+	if err := store.SaveQueue(bob, []ChatMessage{stale}); err != nil {
+		t.Fatalf("Failed to save queue: %v", err)
+	}
+
+	o := newOutbox(1, time.Hour)
+	if n, err := o.attach(store); err != nil || n != 1 {
+		t.Fatalf("Expected 1 message loaded, got %d, %v", n, err)
+	}
+	if got := o.Take(alice); len(got) != 1 || got[0].ID != "newest" {
+		t.Errorf("Expected only the newest unexpired message, got %+v", got)
+	}
+	if got := o.Len(bob); got != 0 {
+		t.Errorf("Expected bob's expired queue dropped, got %d", got)
+	}
+	saved, err := store.LoadQueues()
+	if err != nil {
+		t.Fatalf("Failed to load queues: %v", err)
+	}
+	if len(saved) != 0 {
+		t.Errorf("Expected the store to follow the outbox, got %+v", saved)
+	}
+}
+
+func TestNodeQueueSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	start := func() *Node {
+		n, err := NewNode(context.Background(), Config{
+			IdentityPath:       filepath.Join(dir, "identity.key"),
+			HistoryFile:        filepath.Join(dir, "history.db"),
+			ListenAddrs:        loopbackListenAddrs,
+			Nick:               "alice",
+			NegotiationTimeout: 5 * time.Second,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create node: %v", err)
+		}
+		t.Cleanup(func() { n.Close() })
+		n.Start()
+		return n
+	}
+	bob := newTestNode(t, "bob")
+
+	alice := start()
+	alice.registry.Add(peer.AddrInfo{ID: bob.host.ID(), Addrs: bob.host.Addrs()})
+	if err := alice.Send("while you were out"); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	if err := alice.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	alice = start()
+	if got := alice.queueDepth(bob.host.ID()); got != 1 {
+		t.Fatalf("Expected the queued message back after restart, got %d", got)
+	}
+	if err := alice.Connect(nodeAddr(bob)); err != nil {
+		t.Fatalf("Failed to connect alice to bob: %v", err)
+	}
+	waitFor(t, "bob to receive the queued message", func() bool {
+		got := bob.history.Recent(1)
+		return len(got) == 1 && got[0].Body == "while you were out"
+	})
+	waitFor(t, "the delivered message to leave the store", func() bool { return alice.queueDepth(bob.host.ID()) == 0 })
+	if err := alice.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	saved, err := openTestStore(t, filepath.Join(dir, "history.db")).LoadQueues()
+	if err != nil || len(saved) != 0 {
+		t.Errorf("Expected nothing left queued on disk, got %+v, %v", saved, err)
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"sync"
+	"time"
+
+	crypto "github.com/libp2p/go-libp2p/core/crypto"
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// ratchetChatProtocol is secure chat over a double ratchet. Each side's
+// hello carries an X25519 identity key and prekey, both generated per run
+// and signed with its libp2p key, and both sides derive a shared secret
+// from three DH exchanges between those static keys. This is not X3DH:
+// there is no ephemeral key and no one-time prekey, so the first chain
+// is only as safe as the prekeys, which live in memory until the process
+// exits. From there every message is sealed under a key used once, and a
+// DH step with fresh keys each time the conversation changes direction
+// means a leaked key can't open older messages. Both directions share one
+// ratchet per peer, whichever stream carries them.
+const ratchetChatProtocol = "/chat-secure/2.0.0"
+
+// ratchetVersion is the first chat protocol version whose peers accept
+// ratchetChatProtocol; older ones get /chat-secure/1.0.0.
+const ratchetVersion = "1.3.0"
+
+const (
+	// ratchetHeaderSize is the sender's ratchet key, the length of its
+	// previous sending chain and the message number, in front of every
+	// sealed frame.
+	ratchetHeaderSize = 32 + 4 + 4
+	// maxSkippedKeys bounds the keys kept for messages that haven't
+	// arrived, so a peer can't make us derive keys without end.
+	maxSkippedKeys = 1000
+)
+
+var (
+	errBadPrekey      = errors.New("prekeys aren't signed by the peer")
+	errTooManySkipped = errors.New("too many skipped messages")
+)
+
+// ratchetKeys are a node's keys for ratchetChatProtocol, generated per
+// run, and its ratchet with each peer.
+type ratchetKeys struct {
+	self     peer.ID
+	signer   crypto.PrivKey
+	identity *ecdh.PrivateKey
+	prekey   *ecdh.PrivateKey
+
+	mu       sync.Mutex
+	sessions map[peer.ID]*ratchetSession
+}
+
+func generateRatchetKeys(self peer.ID, signer crypto.PrivKey) (*ratchetKeys, error) {
+	identity, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	prekey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &ratchetKeys{self: self, signer: signer, identity: identity, prekey: prekey, sessions: make(map[peer.ID]*ratchetSession)}, nil
+}
+
+// ratchetHello is the first line each side writes on a ratchet stream.
+// Sig is the sender's libp2p signature over Identity and Prekey.
+type ratchetHello struct {
+	Identity []byte `json:"identity"`
+	Prekey   []byte `json:"prekey"`
+	Sig      []byte `json:"sig"`
+}
+
+func (k *ratchetKeys) hello() (ratchetHello, error) {
+	h := ratchetHello{Identity: k.identity.PublicKey().Bytes(), Prekey: k.prekey.PublicKey().Bytes()}
+	sig, err := k.signer.Sign(append(bytes.Clone(h.Identity), h.Prekey...))
+	h.Sig = sig
+	return h, err
+}
+
+// session returns the ratchet with id for the keys in its hello, once
+// they check out against its libp2p key pub. The ratchet is kept for as
+// long as the peer sends the same keys, i.e. until it restarts.
+func (k *ratchetKeys) session(id peer.ID, pub crypto.PubKey, h ratchetHello) (*ratchetSession, error) {
+	if pub == nil {
+		return nil, errBadPrekey
+	}
+	if ok, err := pub.Verify(append(bytes.Clone(h.Identity), h.Prekey...), h.Sig); err != nil || !ok {
+		return nil, errBadPrekey
+	}
+	theirIdentity, err := ecdh.X25519().NewPublicKey(h.Identity)
+	if err != nil {
+		return nil, fmt.Errorf("bad identity key: %w", err)
+	}
+	theirPrekey, err := ecdh.X25519().NewPublicKey(h.Prekey)
+	if err != nil {
+		return nil, fmt.Errorf("bad prekey: %w", err)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if s, ok := k.sessions[id]; ok && s.theirIdentity.Equal(theirIdentity) && s.theirPrekey.Equal(theirPrekey) {
+		return s, nil
+	}
+	// Either side may open the first stream, so the lower peer ID always
+	// plays the initiator
+	s, err := newRatchetSession(k, k.self < id, theirIdentity, theirPrekey)
+	if err != nil {
+		return nil, err
+	}
+	k.sessions[id] = s
+	return s, nil
+}
+
+// ratchetHandshake swaps hellos on s like secureHandshake, giving up after
+// timeout (if set), and returns the ratchet with the peer.
+func ratchetHandshake(s network.Stream, r *bufio.Reader, w *bufio.Writer, keys *ratchetKeys, timeout time.Duration) (*ratchetSession, error) {
+	if timeout > 0 {
+		s.SetDeadline(time.Now().Add(timeout))
+		defer s.SetDeadline(time.Time{})
+	}
+	ours, err := keys.hello()
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(ours)
+	if err != nil {
+		return nil, err
+	}
+	w.Write(append(data, '\n'))
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	var theirs ratchetHello
+	if err := json.Unmarshal(line, &theirs); err != nil {
+		return nil, fmt.Errorf("malformed hello frame: %w", err)
+	}
+	return keys.session(s.Conn().RemotePeer(), s.Conn().RemotePublicKey(), theirs)
+}
+
+// ratchetSession is one side of a double ratchet.
+type ratchetSession struct {
+	theirIdentity *ecdh.PublicKey
+	theirPrekey   *ecdh.PublicKey
+	// ad binds every message to both identity keys, initiator's first.
+	ad []byte
+
+	mu sync.Mutex
+	ratchetState
+}
+
+// ratchetState is the part of a session a message can advance; Open works
+// on a copy so a forged frame leaves the session as it was.
+type ratchetState struct {
+	rk       []byte
+	dhs      *ecdh.PrivateKey
+	dhr      *ecdh.PublicKey
+	cks, ckr []byte
+	ns, nr   uint32
+	pn       uint32
+	skipped  map[skippedKey][]byte
+}
+
+// skippedKey names the key for message n of the chain under ratchet key
+// dh.
+type skippedKey struct {
+	dh string
+	n  uint32
+}
+
+func newRatchetSession(k *ratchetKeys, initiator bool, theirIdentity, theirPrekey *ecdh.PublicKey) (*ratchetSession, error) {
+	// The same three DH outputs on both sides, initiator's keys first
+	dh1, err1 := k.identity.ECDH(theirPrekey)
+	dh2, err2 := k.prekey.ECDH(theirIdentity)
+	dh3, err3 := k.prekey.ECDH(theirPrekey)
+	if err := errors.Join(err1, err2, err3); err != nil {
+		return nil, err
+	}
+	ad := append(k.identity.PublicKey().Bytes(), theirIdentity.Bytes()...)
+	if !initiator {
+		dh1, dh2 = dh2, dh1
+		ad = append(theirIdentity.Bytes(), k.identity.PublicKey().Bytes()...)
+	}
+	sk, err := hkdf.Key(sha256.New, append(append(dh1, dh2...), dh3...), nil, "artivus triple dh", 32)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each side starts as if the initiator's first message, under its
+	// prekey, had already arrived: the initiator sends on that chain and
+	// the responder receives on it and sends on a fresh one of its own.
+	s := &ratchetSession{theirIdentity: theirIdentity, theirPrekey: theirPrekey, ad: ad}
+	s.skipped = make(map[skippedKey][]byte)
+	s.dhr = theirPrekey
+	if initiator {
+		s.dhs = k.prekey
+		s.rk, s.cks, err = kdfRoot(sk, dh3)
+		return s, err
+	}
+	if s.rk, s.ckr, err = kdfRoot(sk, dh3); err != nil {
+		return nil, err
+	}
+	return s, s.newSendingChain()
+}
+
+// Seal encrypts the envelope of m under the next sending key.
+func (s *ratchetSession) Seal(m ChatMessage) ([]byte, error) {
+	data, err := json.Marshal(compressMessage(m))
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var mk []byte
+	s.cks, mk = kdfChain(s.cks)
+	header := binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(s.dhs.PublicKey().Bytes(), s.pn), s.ns)
+	s.ns++
+	aead, err := chacha20poly1305.New(mk)
+	if err != nil {
+		return nil, err
+	}
+	// Every key seals one message, so a fixed nonce is safe
+	nonce := make([]byte, aead.NonceSize())
+	return aead.Seal(header, nonce, data, append(bytes.Clone(s.ad), header...)), nil
+}
+
+// Open reverses Seal, stepping the ratchet when the peer has started a new
+// chain and keeping keys for messages it skipped. Anything that doesn't
+// authenticate returns errDecrypt.
+func (s *ratchetSession) Open(frame []byte) (ChatMessage, error) {
+	if len(frame) < ratchetHeaderSize+chacha20poly1305.Overhead {
+		return ChatMessage{}, errDecrypt
+	}
+	header, ciphertext := frame[:ratchetHeaderSize], frame[ratchetHeaderSize:]
+	dh := header[:32]
+	pn := binary.BigEndian.Uint32(header[32:36])
+	n := binary.BigEndian.Uint32(header[36:40])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next := s.ratchetState
+	next.skipped = maps.Clone(s.skipped)
+
+	key := skippedKey{string(dh), n}
+	mk, ok := next.skipped[key]
+	if ok {
+		delete(next.skipped, key)
+	} else {
+		if !bytes.Equal(dh, next.dhr.Bytes()) {
+			if err := next.skip(pn); err != nil {
+				return ChatMessage{}, err
+			}
+			if err := next.step(dh); err != nil {
+				return ChatMessage{}, fmt.Errorf("%w: %v", errDecrypt, err)
+			}
+		}
+		if err := next.skip(n); err != nil {
+			return ChatMessage{}, err
+		}
+		next.ckr, mk = kdfChain(next.ckr)
+		next.nr++
+	}
+
+	aead, err := chacha20poly1305.New(mk)
+	if err != nil {
+		return ChatMessage{}, err
+	}
+	data, err := aead.Open(nil, make([]byte, aead.NonceSize()), ciphertext, append(bytes.Clone(s.ad), header...))
+	if err != nil {
+		return ChatMessage{}, errDecrypt
+	}
+	var m ChatMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return ChatMessage{}, fmt.Errorf("%w: %v", errDecrypt, err)
+	}
+	s.ratchetState = next
+	return decompressMessage(m)
+}
+
+// skip derives and keeps the receiving keys up to message until.
+func (st *ratchetState) skip(until uint32) error {
+	if st.ckr == nil || until <= st.nr {
+		return nil
+	}
+	if until-st.nr > maxSkippedKeys || len(st.skipped)+int(until-st.nr) > maxSkippedKeys {
+		return errTooManySkipped
+	}
+	for ; st.nr < until; st.nr++ {
+		var mk []byte
+		st.ckr, mk = kdfChain(st.ckr)
+		st.skipped[skippedKey{string(st.dhr.Bytes()), st.nr}] = mk
+	}
+	return nil
+}
+
+// step moves to the peer's new ratchet key dh: a receiving chain from it,
+// then a sending chain from a fresh key of ours.
+func (st *ratchetState) step(dh []byte) error {
+	pub, err := ecdh.X25519().NewPublicKey(dh)
+	if err != nil {
+		return err
+	}
+	shared, err := st.dhs.ECDH(pub)
+	if err != nil {
+		return err
+	}
+	st.pn, st.ns, st.nr, st.dhr = st.ns, 0, 0, pub
+	if st.rk, st.ckr, err = kdfRoot(st.rk, shared); err != nil {
+		return err
+	}
+	return st.newSendingChain()
+}
+
+// newSendingChain starts a sending chain from a fresh ratchet key.
+func (st *ratchetState) newSendingChain() error {
+	dhs, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	shared, err := dhs.ECDH(st.dhr)
+	if err != nil {
+		return err
+	}
+	st.dhs = dhs
+	st.rk, st.cks, err = kdfRoot(st.rk, shared)
+	return err
+}
+
+// kdfRoot mixes a DH output into the root key, returning the new root key
+// and a chain key.
+func kdfRoot(rk, dh []byte) (root, chain []byte, err error) {
+	out, err := hkdf.Key(sha256.New, dh, rk, "artivus ratchet", 64)
+	if err != nil {
+		return nil, nil, err
+	}
+	return out[:32], out[32:], nil
+}
+
+// kdfChain advances a chain key, returning the next one and the message
+// key for this step.
+func kdfChain(ck []byte) (next, mk []byte) {
+	mac := func(b byte) []byte {
+		h := hmac.New(sha256.New, ck)
+		h.Write([]byte{b})
+		return h.Sum(nil)
+	}
+	return mac(2), mac(1)
+}
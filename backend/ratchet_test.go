@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	crypto "github.com/libp2p/go-libp2p/core/crypto"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// newTestRatchetKeys returns ratchet keys for a fresh libp2p identity.
+func newTestRatchetKeys(t *testing.T) (*ratchetKeys, crypto.PubKey) {
+	t.Helper()
+	priv, pub, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		t.Fatalf("Failed to derive peer ID: %v", err)
+	}
+	keys, err := generateRatchetKeys(id, priv)
+	if err != nil {
+		t.Fatalf("Failed to generate ratchet keys: %v", err)
+	}
+	return keys, pub
+}
+
+// newTestSessions returns both ends of a ratchet, as after a handshake.
+func newTestSessions(t *testing.T) (alice, bob *ratchetSession) {
+	t.Helper()
+	aliceKeys, alicePub := newTestRatchetKeys(t)
+	bobKeys, bobPub := newTestRatchetKeys(t)
+	hello := func(k *ratchetKeys) ratchetHello {
+		h, err := k.hello()
+		if err != nil {
+			t.Fatalf("Failed to sign hello: %v", err)
+		}
+		return h
+	}
+	alice, err := aliceKeys.session(bobKeys.self, bobPub, hello(bobKeys))
+	if err != nil {
+		t.Fatalf("Alice failed to start a session: %v", err)
+	}
+	bob, err = bobKeys.session(aliceKeys.self, alicePub, hello(aliceKeys))
+	if err != nil {
+		t.Fatalf("Bob failed to start a session: %v", err)
+	}
+	return alice, bob
+}
+
+func sealTest(t *testing.T, s *ratchetSession, body string) []byte {
+	t.Helper()
+	frame, err := s.Seal(newChatMessage("", "", body))
+	if err != nil {
+		t.Fatalf("Failed to seal: %v", err)
+	}
+	return frame
+}
+
+func openTest(t *testing.T, s *ratchetSession, frame []byte, want string) {
+	t.Helper()
+	m, err := s.Open(frame)
+	if err != nil {
+		t.Fatalf("Failed to open %q: %v", want, err)
+	}
+	if m.Body != want {
+		t.Errorf("Expected %q, got %q", want, m.Body)
+	}
+}
+
+func TestRatchetConversation(t *testing.T) {
+	alice, bob := newTestSessions(t)
+	// Either side can speak first, and turns can run in either order
+	openTest(t, alice, sealTest(t, bob, "bob first"), "bob first")
+	openTest(t, bob, sealTest(t, alice, "hi bob"), "hi bob")
+	openTest(t, bob, sealTest(t, alice, "still me"), "still me")
+	openTest(t, alice, sealTest(t, bob, "hi alice"), "hi alice")
+}
+
+func TestRatchetOutOfOrder(t *testing.T) {
+	alice, bob := newTestSessions(t)
+	first := sealTest(t, alice, "one")
+	second := sealTest(t, alice, "two")
+	openTest(t, alice, sealTest(t, bob, "reply"), "reply")
+	third := sealTest(t, alice, "three")
+
+	// third is on a new chain; one and two come from the skipped keys
+	openTest(t, bob, third, "three")
+	openTest(t, bob, second, "two")
+	openTest(t, bob, first, "one")
+	if _, err := bob.Open(first); !errors.Is(err, errDecrypt) {
+		t.Errorf("Expected a replayed frame to fail, got %v", err)
+	}
+}
+
+func TestRatchetRejectsTampering(t *testing.T) {
+	alice, bob := newTestSessions(t)
+	frame := sealTest(t, alice, "hello")
+	for _, i := range []int{0, ratchetHeaderSize - 1, len(frame) - 1} {
+		bad := append([]byte(nil), frame...)
+		bad[i] ^= 0xff
+		if _, err := bob.Open(bad); err == nil {
+			t.Errorf("Expected a frame tampered at byte %d to fail", i)
+		}
+	}
+	if _, err := bob.Open(frame[:ratchetHeaderSize]); !errors.Is(err, errDecrypt) {
+		t.Errorf("Expected errDecrypt for a truncated frame, got %v", err)
+	}
+	// The forgeries mustn't have moved the ratchet
+	openTest(t, bob, frame, "hello")
+
+	_, eve := newTestSessions(t)
+	if _, err := eve.Open(sealTest(t, alice, "not for eve")); err == nil {
+		t.Error("Expected another conversation's frame to fail")
+	}
+}
+
+func TestRatchetLimitsSkippedKeys(t *testing.T) {
+	alice, bob := newTestSessions(t)
+	for range maxSkippedKeys + 1 {
+		sealTest(t, alice, "lost")
+	}
+	if _, err := bob.Open(sealTest(t, alice, "too late")); !errors.Is(err, errTooManySkipped) {
+		t.Errorf("Expected errTooManySkipped, got %v", err)
+	}
+}
+
+func TestRatchetForwardSecrecy(t *testing.T) {
+	alice, bob := newTestSessions(t)
+	old := sealTest(t, alice, "before")
+	openTest(t, bob, old, "before")
+	openTest(t, alice, sealTest(t, bob, "after"), "after")
+
+	// Bob's current state can't open a message already read
+	bob.mu.Lock()
+	stolen := &ratchetSession{ad: bob.ad, ratchetState: bob.ratchetState}
+	bob.mu.Unlock()
+	if _, err := stolen.Open(old); err == nil {
+		t.Error("Expected an old message to stay sealed under the current keys")
+	}
+}
+
+func TestRatchetSessionReusedUntilKeysChange(t *testing.T) {
+	aliceKeys, _ := newTestRatchetKeys(t)
+	bobKeys, bobPub := newTestRatchetKeys(t)
+	hello, _ := bobKeys.hello()
+	first, err := aliceKeys.session(bobKeys.self, bobPub, hello)
+	if err != nil {
+		t.Fatalf("Failed to start a session: %v", err)
+	}
+	if again, _ := aliceKeys.session(bobKeys.self, bobPub, hello); again != first {
+		t.Error("Expected the same keys to reuse the session")
+	}
+
+	_, evePub := newTestRatchetKeys(t)
+	if _, err := aliceKeys.session(bobKeys.self, evePub, hello); !errors.Is(err, errBadPrekey) {
+		t.Errorf("Expected errBadPrekey for a hello signed by someone else, got %v", err)
+	}
+
+	// A restarted peer has new keys and gets a new session
+	restarted, err := generateRatchetKeys(bobKeys.self, bobKeys.signer)
+	if err != nil {
+		t.Fatalf("Failed to generate keys: %v", err)
+	}
+	hello, _ = restarted.hello()
+	if next, err := aliceKeys.session(bobKeys.self, bobPub, hello); err != nil || next == first {
+		t.Errorf("Expected a new session for new keys, got %v", err)
+	}
+}
+
+func TestSecureNodeConversation(t *testing.T) {
+	newSecureNode := func(nick string) *Node {
+		n, err := NewNode(context.Background(), Config{
+			IdentityPath:       filepath.Join(t.TempDir(), "identity.key"),
+			Nick:               nick,
+			NegotiationTimeout: 5 * time.Second,
+			Secure:             true,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create node: %v", err)
+		}
+		t.Cleanup(func() { n.Close() })
+		return n
+	}
+	alice := newSecureNode("alice")
+	bob := newSecureNode("bob")
+	if err := alice.Connect(nodeAddr(bob)); err != nil {
+		t.Fatalf("Failed to connect alice to bob: %v", err)
+	}
+	if err := alice.Send("ratcheted hello"); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	waitFor(t, "bob to receive the message", func() bool {
+		got := bob.history.Recent(1)
+		return len(got) == 1 && got[0].Body == "ratcheted hello"
+	})
+	if err := bob.Send("ratcheted reply"); err != nil {
+		t.Fatalf("Failed to reply: %v", err)
+	}
+	waitFor(t, "alice to receive the reply", func() bool {
+		got := alice.history.Recent(1)
+		return len(got) == 1 && got[0].Body == "ratcheted reply"
+	})
+
+	// Both streams went through the one ratchet each side keeps for the other
+	for _, n := range []*Node{alice, bob} {
+		n.mgr.ratchets.mu.Lock()
+		sessions := len(n.mgr.ratchets.sessions)
+		n.mgr.ratchets.mu.Unlock()
+		if sessions != 1 {
+			t.Errorf("Expected one ratchet session, got %d", sessions)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	host "github.com/libp2p/go-libp2p/core/host"
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/time/rate"
+)
+
+const (
+	defaultInboundRate  = 10
+	defaultInboundBurst = 20
+	// floodWindow is the period over which dropped messages are counted,
+	// and the least time between two warnings about the same peer.
+	floodWindow = 10 * time.Second
+	// floodResetAfter is how many messages a peer may have dropped within
+	// floodWindow before its stream is reset.
+	floodResetAfter = 200
+	// controlRate and controlBurst are each peer's separate budget for
+	// control frames. A typing peer sends one every typingInterval at
+	// most, so this only holds back a peer abusing them.
+	controlRate  = 2
+	controlBurst = 10
+)
+
+// inboundLimiter caps how many chat messages each peer may deliver per
+// second, with one token bucket per peer so a flood from one peer never
+// costs another its budget. Control frames have a bucket of their own.
+type inboundLimiter struct {
+	limit rate.Limit
+	burst int
+	now   func() time.Time
+
+	mu    sync.Mutex
+	peers map[peer.ID]*inboundPeer
+}
+
+type inboundPeer struct {
+	bucket  *rate.Limiter
+	control *rate.Limiter
+	// windowStart and dropped count drops of both kinds.
+	windowStart time.Time
+	dropped     int
+}
+
+// newInboundLimiter allows perSec messages a second from each peer, in
+// bursts of up to burst. A perSec <= 0 disables limiting.
+func newInboundLimiter(perSec float64, burst int) *inboundLimiter {
+	return &inboundLimiter{
+		limit: rate.Limit(perSec),
+		burst: burst,
+		now:   time.Now,
+		peers: make(map[peer.ID]*inboundPeer),
+	}
+}
+
+func (l *inboundLimiter) enabled() bool {
+	return l != nil && l.limit > 0
+}
+
+// Allow reports whether a message just read from id may be handled. When
+// it may not, reset reports whether id has kept flooding long enough that
+// its stream should be dropped. It always allows on a nil or disabled
+// limiter.
+func (l *inboundLimiter) Allow(id peer.ID) (ok, reset bool) {
+	if !l.enabled() {
+		return true, false
+	}
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	p := l.peer(id)
+	if p.bucket.AllowN(now, 1) {
+		return true, false
+	}
+	if p.drop(now) {
+		logger.Warn("peer exceeded message rate, dropping messages", "peer_id", id, "rate", float64(l.limit), "burst", l.burst)
+	}
+	return false, p.dropped > floodResetAfter
+}
+
+// AllowControl is Allow for a control frame, such as a typing notice,
+// which spends the peer's control budget rather than its chat one.
+func (l *inboundLimiter) AllowControl(id peer.ID) (ok, reset bool) {
+	if !l.enabled() {
+		return true, false
+	}
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	p := l.peer(id)
+	if p.control.AllowN(now, 1) {
+		return true, false
+	}
+	if p.drop(now) {
+		logger.Warn("peer exceeded control frame rate, dropping them", "peer_id", id, "rate", controlRate, "burst", controlBurst)
+	}
+	return false, p.dropped > floodResetAfter
+}
+
+// peer returns id's buckets, creating them on first use. l.mu must be
+// held.
+func (l *inboundLimiter) peer(id peer.ID) *inboundPeer {
+	p, found := l.peers[id]
+	if !found {
+		p = &inboundPeer{
+			bucket:  rate.NewLimiter(l.limit, l.burst),
+			control: rate.NewLimiter(controlRate, controlBurst),
+		}
+		l.peers[id] = p
+	}
+	return p
+}
+
+// drop counts a dropped frame at now, and reports whether it's the first
+// in this flood window, the one to warn about.
+func (p *inboundPeer) drop(now time.Time) (first bool) {
+	if now.Sub(p.windowStart) >= floodWindow {
+		p.windowStart, p.dropped = now, 0
+	}
+	p.dropped++
+	return p.dropped == 1
+}
+
+// Forget drops id's bucket.
+func (l *inboundLimiter) Forget(id peer.ID) {
+	if !l.enabled() {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.peers, id)
+}
+
+// forgetOnDisconnect drops a peer's bucket once its last connection to h
+// closes.
+func (l *inboundLimiter) forgetOnDisconnect(h host.Host) {
+	h.Network().Notify(&network.NotifyBundle{
+		DisconnectedF: func(net network.Network, c network.Conn) {
+			if id := c.RemotePeer(); net.Connectedness(id) != network.Connected {
+				l.Forget(id)
+			}
+		},
+	})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInboundLimiter(t *testing.T) {
+	alice, bob := newTestPeerID(t), newTestPeerID(t)
+	now := time.Unix(1700000000, 0)
+	l := newInboundLimiter(2, 5)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 5; i++ {
+		if ok, _ := l.Allow(alice); !ok {
+			t.Fatalf("Expected message %d of a burst within the limit to pass", i+1)
+		}
+	}
+	if ok, reset := l.Allow(alice); ok || reset {
+		t.Errorf("Expected the message past the burst to be dropped without a reset, got ok=%v reset=%v", ok, reset)
+	}
+	if ok, _ := l.Allow(bob); !ok {
+		t.Error("Expected bob's budget to be unaffected by alice's flood")
+	}
+
+	now = now.Add(time.Second)
+	passed := 0
+	for i := 0; i < 10; i++ {
+		if ok, _ := l.Allow(alice); ok {
+			passed++
+		}
+	}
+	if passed != 2 {
+		t.Errorf("Expected 2 of a 10-message flood to pass after one second at 2/s, got %d", passed)
+	}
+
+	var reset bool
+	for i := 0; i <= floodResetAfter && !reset; i++ {
+		_, reset = l.Allow(alice)
+	}
+	if !reset {
+		t.Errorf("Expected a sustained flood to ask for a stream reset")
+	}
+
+	l.Forget(alice)
+	if ok, _ := l.Allow(alice); !ok {
+		t.Error("Expected a forgotten peer to start with a full bucket")
+	}
+}
+
+func TestInboundLimiterControlBudget(t *testing.T) {
+	alice := newTestPeerID(t)
+	now := time.Unix(1700000000, 0)
+	l := newInboundLimiter(2, 5)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < controlBurst; i++ {
+		if ok, _ := l.AllowControl(alice); !ok {
+			t.Fatalf("Expected control frame %d of a burst within the limit to pass", i+1)
+		}
+	}
+	if ok, _ := l.AllowControl(alice); ok {
+		t.Error("Expected the control frame past the burst to be dropped")
+	}
+	if ok, _ := l.Allow(alice); !ok {
+		t.Error("Expected control frames not to spend the chat budget")
+	}
+
+	var reset bool
+	for i := 0; i <= floodResetAfter && !reset; i++ {
+		_, reset = l.AllowControl(alice)
+	}
+	if !reset {
+		t.Error("Expected a sustained flood of control frames to ask for a stream reset")
+	}
+}
+
+func TestInboundLimiterDisabled(t *testing.T) {
+	alice := newTestPeerID(t)
+	var nilLimiter *inboundLimiter
+	for _, l := range []*inboundLimiter{nilLimiter, newInboundLimiter(0, 0)} {
+		for i := 0; i < 100; i++ {
+			if ok, _ := l.Allow(alice); !ok {
+				t.Fatalf("Expected a disabled limiter to allow everything, dropped message %d", i+1)
+			}
+		}
+		l.Forget(alice)
+	}
+}
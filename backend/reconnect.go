@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	host "github.com/libp2p/go-libp2p/core/host"
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// backoff is a reconnect schedule: the wait doubles from initial up to max,
+// for at most attempts tries.
+type backoff struct {
+	initial  time.Duration
+	max      time.Duration
+	attempts int
+}
+
+var defaultBackoff = backoff{initial: time.Second, max: 30 * time.Second, attempts: 10}
+
+// reconnectDialTimeout bounds each attempt, so a peer whose address now
+// black-holes packets doesn't stall the schedule.
+var reconnectDialTimeout = 10 * time.Second
+
+// delay returns how long to wait before the given attempt, counting from 1.
+func (b backoff) delay(attempt int) time.Duration {
+	d := b.initial
+	for i := 1; i < attempt && d < b.max; i++ {
+		d *= 2
+	}
+	return min(d, b.max)
+}
+
+// reconnector redials peers we connected to ourselves when their connection
+// drops. Peers that found us, or that discovery found, are left alone;
+// they'll come back on their own. Every new connection, redialed or not,
+// is passed to onConnected.
+type reconnector struct {
+	ctx         context.Context
+	h           host.Host
+	backoff     backoff
+	onConnected func(peer.ID)
+	metrics     *nodeMetrics
+	events      *eventLog
+	// flaps, if set, holds back the reconnected notice along with the
+	// presence one for a peer that keeps dropping.
+	flaps *flapDebouncer
+
+	mu      sync.Mutex
+	tracked map[peer.ID]peer.AddrInfo
+	retries map[peer.ID]bool
+	// closed is set by Close, after which no goroutine is started; wg
+	// counts the ones already running.
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func newReconnector(ctx context.Context, h host.Host, b backoff, onConnected func(peer.ID)) *reconnector {
+	r := &reconnector{
+		ctx:         ctx,
+		h:           h,
+		backoff:     b,
+		onConnected: onConnected,
+		tracked:     make(map[peer.ID]peer.AddrInfo),
+		retries:     make(map[peer.ID]bool),
+	}
+	h.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(_ network.Network, c network.Conn) {
+			if r.onConnected != nil {
+				r.spawn(func() { r.onConnected(c.RemotePeer()) })
+			}
+		},
+		DisconnectedF: func(_ network.Network, c network.Conn) {
+			r.disconnected(c.RemotePeer())
+		},
+	})
+	return r
+}
+
+// spawn runs f on its own goroutine unless r is closed.
+func (r *reconnector) spawn(f func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.closed {
+		r.wg.Go(f)
+	}
+}
+
+// Close stops starting retries and waits for running ones, which return
+// once r's context is done.
+func (r *reconnector) Close() error {
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+	r.wg.Wait()
+	return nil
+}
+
+// Track marks info as a peer to reconnect to.
+func (r *reconnector) Track(info peer.AddrInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tracked[info.ID] = info
+}
+
+// Forget stops reconnecting to every tracked peer, e.g. before we drop them
+// on purpose. Retry loops already running give up at their next attempt.
+func (r *reconnector) Forget() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	clear(r.tracked)
+}
+
+// tracking reports whether id is a peer to reconnect to.
+func (r *reconnector) tracking(id peer.ID) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.tracked[id]
+	return ok
+}
+
+func (r *reconnector) retrying(id peer.ID) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.retries[id]
+}
+
+func (r *reconnector) disconnected(id peer.ID) {
+	if r.ctx.Err() != nil || r.h.Network().Connectedness(id) == network.Connected {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	info, ok := r.tracked[id]
+	if !ok || r.retries[id] || r.closed {
+		return
+	}
+	r.retries[id] = true
+	// Notifiee callbacks run on the swarm's goroutine; don't dial here
+	r.wg.Go(func() { r.retry(info) })
+}
+
+func (r *reconnector) retry(info peer.AddrInfo) {
+	defer func() {
+		r.mu.Lock()
+		delete(r.retries, info.ID)
+		r.mu.Unlock()
+	}()
+
+	for attempt := 1; attempt <= r.backoff.attempts; attempt++ {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-time.After(r.backoff.delay(attempt)):
+		}
+		r.mu.Lock()
+		_, ok := r.tracked[info.ID]
+		r.mu.Unlock()
+		if !ok {
+			return
+		}
+		if r.h.Network().Connectedness(info.ID) == network.Connected {
+			return
+		}
+
+		out.Printf("🔁 Reconnecting to %s (attempt %d)\n", info.ID, attempt)
+		ctx, cancel := context.WithTimeout(r.ctx, reconnectDialTimeout)
+		err := connectWithFallback(ctx, r.h, info)
+		cancel()
+		if err == nil {
+			if !r.flaps.Held(info.ID) {
+				out.Connected(info.ID, true)
+			}
+			return
+		}
+		r.metrics.connFailed()
+		r.events.Record(connEvent{Kind: eventDialFailed, Peer: info.ID, Error: err.Error()})
+	}
+	if r.ctx.Err() == nil {
+		out.Printf("❌ Gave up reconnecting to %s after %d attempts\n", info.ID, r.backoff.attempts)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	b := backoff{initial: time.Second, max: 30 * time.Second, attempts: 10}
+	want := []time.Duration{1, 2, 4, 8, 16, 30, 30}
+	for i, w := range want {
+		if got := b.delay(i + 1); got != w*time.Second {
+			t.Errorf("delay(%d) = %s, want %s", i+1, got, w*time.Second)
+		}
+	}
+}
+
+// newReconnectNode is newTestNode with a fast reconnect schedule.
+func newReconnectNode(t *testing.T, b backoff) *Node {
+	t.Helper()
+	n, err := NewNode(context.Background(), Config{
+		IdentityPath:       filepath.Join(t.TempDir(), "identity.key"),
+		NegotiationTimeout: 5 * time.Second,
+		Reconnect:          b,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	t.Cleanup(func() { n.Close() })
+	return n
+}
+
+func TestNodeReconnectsAfterDrop(t *testing.T) {
+	alice := newReconnectNode(t, backoff{initial: 10 * time.Millisecond, max: 50 * time.Millisecond, attempts: 20})
+	bob := newTestNode(t, "")
+
+	addr := nodeAddr(bob)
+	if err := alice.Connect(addr); err != nil {
+		t.Fatalf("Failed to connect alice to bob: %v", err)
+	}
+
+	before := alice.host.Network().ConnsToPeer(bob.host.ID())[0].ID()
+
+	// Bob hangs up; alice dialed him, so she should dial again
+	bob.host.Network().ClosePeer(alice.host.ID())
+	waitFor(t, "alice to reconnect", func() bool {
+		conns := alice.host.Network().ConnsToPeer(bob.host.ID())
+		return len(conns) > 0 && conns[0].ID() != before
+	})
+}
+
+func TestNodeGivesUpReconnecting(t *testing.T) {
+	old := reconnectDialTimeout
+	reconnectDialTimeout = 500 * time.Millisecond
+	defer func() { reconnectDialTimeout = old }()
+
+	alice := newReconnectNode(t, backoff{initial: 10 * time.Millisecond, max: 20 * time.Millisecond, attempts: 3})
+	bob := newTestNode(t, "")
+
+	addr := nodeAddr(bob)
+	if err := alice.Connect(addr); err != nil {
+		t.Fatalf("Failed to connect alice to bob: %v", err)
+	}
+	bob.Close()
+
+	waitFor(t, "alice to start reconnecting", func() bool { return alice.redial.retrying(bob.host.ID()) })
+	waitFor(t, "alice to give up", func() bool { return !alice.redial.retrying(bob.host.ID()) })
+	if alice.host.Network().Connectedness(bob.host.ID()) == network.Connected {
+		t.Error("Expected alice to stay disconnected from a closed peer")
+	}
+}
+
+func TestReconnectIgnoresUntrackedPeers(t *testing.T) {
+	alice := newReconnectNode(t, backoff{initial: 10 * time.Millisecond, max: 10 * time.Millisecond, attempts: 3})
+	bob := newTestNode(t, "")
+
+	// Dialed outside Connect, so not ours to redial
+	if err := alice.host.Connect(context.Background(), peer.AddrInfo{ID: bob.host.ID(), Addrs: bob.host.Addrs()}); err != nil {
+		t.Fatalf("Failed to connect alice to bob: %v", err)
+	}
+	alice.host.Network().ClosePeer(bob.host.ID())
+	time.Sleep(100 * time.Millisecond)
+	if alice.redial.retrying(bob.host.ID()) || alice.host.Network().Connectedness(bob.host.ID()) == network.Connected {
+		t.Error("Expected no reconnect for a peer alice didn't Connect to")
+	}
+}
+
+func TestNodeDisconnectAllDoesNotReconnect(t *testing.T) {
+	alice := newReconnectNode(t, backoff{initial: 10 * time.Millisecond, max: 10 * time.Millisecond, attempts: 5})
+	bob := newTestNode(t, "")
+
+	addr := nodeAddr(bob)
+	if err := alice.Connect(addr); err != nil {
+		t.Fatalf("Failed to connect alice to bob: %v", err)
+	}
+	alice.DisconnectAll(offlineNotice)
+	time.Sleep(100 * time.Millisecond)
+	if alice.host.Network().Connectedness(bob.host.ID()) == network.Connected {
+		t.Error("Expected alice to stay offline after DisconnectAll")
+	}
+}
+
+func TestReconnectStopsOnClose(t *testing.T) {
+	alice := newReconnectNode(t, backoff{initial: time.Hour, max: time.Hour, attempts: 3})
+	bob := newTestNode(t, "")
+
+	addr := nodeAddr(bob)
+	if err := alice.Connect(addr); err != nil {
+		t.Fatalf("Failed to connect alice to bob: %v", err)
+	}
+	bob.Close()
+	waitFor(t, "alice to start reconnecting", func() bool { return alice.redial.retrying(bob.host.ID()) })
+
+	alice.Close()
+	waitFor(t, "the retry loop to stop", func() bool { return !alice.redial.retrying(bob.host.ID()) })
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"sync"
+
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// peerRegistry is the set of peers we chat with. Typed messages are
+// broadcast to every entry.
+type peerRegistry struct {
+	mu    sync.Mutex
+	peers map[peer.ID]peer.AddrInfo
+}
+
+func newPeerRegistry() *peerRegistry {
+	return &peerRegistry{peers: make(map[peer.ID]peer.AddrInfo)}
+}
+
+func (r *peerRegistry) Add(info peer.AddrInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.peers[info.ID] = info
+}
+
+func (r *peerRegistry) Remove(id peer.ID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.peers, id)
+}
+
+// List returns a snapshot of the registered peers ordered by ID.
+func (r *peerRegistry) List() []peer.AddrInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]peer.AddrInfo, 0, len(r.peers))
+	for _, info := range r.peers {
+		out = append(out, info)
+	}
+	slices.SortFunc(out, func(a, b peer.AddrInfo) int {
+		return strings.Compare(string(a.ID), string(b.ID))
+	})
+	return out
+}
+
+// newChatHandler wraps handleStream so that anyone who opens a chat stream
+// to us, and passes the capabilities handshake, is registered and receives
+// our replies.
+func newChatHandler(reg *peerRegistry, history *messageLog, hs *handshaker, seen *messageDeduper, limit *inboundLimiter) network.StreamHandler {
+	return func(s network.Stream) {
+		if !hs.acceptHandshake(s) {
+			return
+		}
+		reg.Add(peer.AddrInfo{
+			ID:    s.Conn().RemotePeer(),
+			Addrs: []ma.Multiaddr{s.Conn().RemoteMultiaddr()},
+		})
+		handleStream(s, history, seen, limit)
+	}
+}
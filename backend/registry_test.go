@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"testing"
+	"time"
+
+	host "github.com/libp2p/go-libp2p/core/host"
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestPeerRegistryAddRemoveList(t *testing.T) {
+	reg := newPeerRegistry()
+	reg.Add(peer.AddrInfo{ID: peer.ID("b")})
+	reg.Add(peer.AddrInfo{ID: peer.ID("a")})
+	reg.Add(peer.AddrInfo{ID: peer.ID("a")})
+
+	list := reg.List()
+	if len(list) != 2 || list[0].ID != "a" || list[1].ID != "b" {
+		t.Fatalf("Unexpected registry contents: %v", list)
+	}
+	reg.Remove(peer.ID("a"))
+	if list := reg.List(); len(list) != 1 || list[0].ID != "b" {
+		t.Errorf("Expected only b after removal, got %v", list)
+	}
+}
+
+func TestBroadcastReachesAllPeers(t *testing.T) {
+	ctx := context.Background()
+	sender, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create sender host: %v", err)
+	}
+	defer sender.Close()
+
+	received := make(chan string, 2)
+	reg := newPeerRegistry()
+	for i := 0; i < 2; i++ {
+		h, err := createTestHost(t)
+		if err != nil {
+			t.Fatalf("Failed to create receiver host: %v", err)
+		}
+		defer h.Close()
+		h.SetStreamHandler("/chat/1.0.0", func(s network.Stream) {
+			m, err := readMessage(bufio.NewReader(s))
+			if err == nil {
+				received <- m.Body
+			}
+			s.Close()
+		})
+		info := peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()}
+		if err := sender.Connect(ctx, info); err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		reg.Add(info)
+	}
+
+	mgr := newStreamManager(sender, streamOpener{timeout: 5 * time.Second}, nil)
+	defer mgr.Close()
+	if res := broadcast(ctx, reg.List(), mgr.Send, newChatMessage(sender.ID(), "", "hello all"), defaultBroadcastWorkers); res.sent != 2 {
+		t.Errorf("Expected broadcast to reach 2 peers, reached %d", res.sent)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case got := <-received:
+			if got != "hello all" {
+				t.Errorf("Unexpected message: %q", got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout waiting for broadcast")
+		}
+	}
+}
+
+func TestChatHandlerRegistersRemotePeer(t *testing.T) {
+	ctx := context.Background()
+	hosts := make([]host.Host, 2)
+	for i := range hosts {
+		h, err := createTestHost(t)
+		if err != nil {
+			t.Fatalf("Failed to create host: %v", err)
+		}
+		defer h.Close()
+		hosts[i] = h
+	}
+	reg := newPeerRegistry()
+	hosts[1].SetStreamHandler("/chat/1.0.0", newChatHandler(reg, nil, nil, nil, nil))
+
+	if err := hosts[0].Connect(ctx, peer.AddrInfo{ID: hosts[1].ID(), Addrs: hosts[1].Addrs()}); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	mgr := newStreamManager(hosts[0], streamOpener{timeout: 5 * time.Second}, nil)
+	defer mgr.Close()
+	if err := mgr.Send(ctx, hosts[1].ID(), newChatMessage(hosts[0].ID(), "", "hi")); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	for i := 0; i < 50 && len(reg.List()) == 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if list := reg.List(); len(list) != 1 || list[0].ID != hosts[0].ID() {
+		t.Errorf("Expected sender to be registered, got %v", list)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// defaultRetryExpiry is how long after it was written a message is still
+// resent to peers that haven't acknowledged it.
+const defaultRetryExpiry = 10 * time.Minute
+
+// retryBackoff spaces out resends of an unacknowledged message; only its
+// delays are used, expiry decides when to stop.
+var retryBackoff = backoff{initial: 2 * time.Second, max: time.Minute}
+
+type retryKey struct {
+	msgID string
+	id    peer.ID
+}
+
+// retrier resends messages whose ACK timed out, to each peer that didn't
+// confirm them, with exponential backoff until the peer acknowledges or
+// the message is older than expiry. Each resend goes through the ACK
+// tracker again, which calls Retry or Forget with the outcome.
+type retrier struct {
+	expiry time.Duration
+	resend func(id peer.ID, m ChatMessage) error
+	// gaveUp is told about peers that never acknowledged m in time
+	gaveUp func(m ChatMessage, missing []peer.ID)
+
+	mu       sync.Mutex
+	closed   bool
+	attempts map[retryKey]int
+	timers   map[retryKey]*time.Timer
+}
+
+func newRetrier(expiry time.Duration, resend func(peer.ID, ChatMessage) error, gaveUp func(ChatMessage, []peer.ID)) *retrier {
+	return &retrier{
+		expiry:   expiry,
+		resend:   resend,
+		gaveUp:   gaveUp,
+		attempts: make(map[retryKey]int),
+		timers:   make(map[retryKey]*time.Timer),
+	}
+}
+
+// Retry schedules m to be sent again to each of missing, reporting the
+// peers it won't retry any more to gaveUp.
+func (r *retrier) Retry(m ChatMessage, missing []peer.ID) {
+	expired := time.Since(m.Time()) >= r.expiry
+	var given []peer.ID
+	r.mu.Lock()
+	for _, id := range missing {
+		k := retryKey{m.ID, id}
+		if expired || r.closed {
+			delete(r.attempts, k)
+			given = append(given, id)
+			continue
+		}
+		r.attempts[k]++
+		r.timers[k] = time.AfterFunc(retryBackoff.delay(r.attempts[k]), func() { r.fire(k, m) })
+	}
+	r.mu.Unlock()
+	if len(given) > 0 {
+		r.gaveUp(m, given)
+	}
+}
+
+func (r *retrier) fire(k retryKey, m ChatMessage) {
+	r.mu.Lock()
+	_, ok := r.timers[k]
+	delete(r.timers, k)
+	r.mu.Unlock()
+	if !ok {
+		return
+	}
+	logger.Debug("resending unacknowledged message", "peer_id", k.id, "msg_id", k.msgID)
+	if err := r.resend(k.id, m); err != nil {
+		logger.Debug("resend failed", "peer_id", k.id, "msg_id", k.msgID, "error", err)
+		r.Retry(m, []peer.ID{k.id})
+	}
+}
+
+// Forget drops what's known about msgID once every peer it was waiting on
+// has acknowledged it. Peers with a resend still scheduled are kept.
+func (r *retrier) Forget(msgID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for k := range r.attempts {
+		if _, scheduled := r.timers[k]; k.msgID == msgID && !scheduled {
+			delete(r.attempts, k)
+		}
+	}
+}
+
+// Pending reports how many resends are scheduled.
+func (r *retrier) Pending() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.timers)
+}
+
+// Close cancels every scheduled resend.
+func (r *retrier) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	for k, t := range r.timers {
+		t.Stop()
+		delete(r.timers, k)
+	}
+	return nil
+}
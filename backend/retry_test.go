@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// useFastRetries shrinks retryBackoff for the test.
+func useFastRetries(t *testing.T) {
+	old := retryBackoff
+	retryBackoff = backoff{initial: 10 * time.Millisecond, max: 40 * time.Millisecond}
+	t.Cleanup(func() { retryBackoff = old })
+}
+
+func TestRetrierResendsUntilItWorks(t *testing.T) {
+	useFastRetries(t)
+	bob := newTestPeerID(t)
+	var mu sync.Mutex
+	var sent []time.Time
+	r := newRetrier(time.Minute, func(id peer.ID, m ChatMessage) error {
+		mu.Lock()
+		defer mu.Unlock()
+		sent = append(sent, time.Now())
+		if len(sent) < 3 {
+			return errors.New("still offline")
+		}
+		return nil
+	}, func(m ChatMessage, missing []peer.ID) {
+		t.Errorf("Expected no give-up, got %v", missing)
+	})
+	defer r.Close()
+
+	msg := newChatMessage("", "", "are you there?")
+	r.Retry(msg, []peer.ID{bob})
+	waitFor(t, "three resends", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(sent) == 3
+	})
+	waitFor(t, "nothing left scheduled", func() bool { return r.Pending() == 0 })
+	mu.Lock()
+	defer mu.Unlock()
+	if gap1, gap2 := sent[1].Sub(sent[0]), sent[2].Sub(sent[1]); gap2 < gap1 {
+		t.Errorf("Expected the wait to grow between resends, got %s then %s", gap1, gap2)
+	}
+}
+
+func TestRetrierGivesUpOnExpiredMessages(t *testing.T) {
+	bob, carol := newTestPeerID(t), newTestPeerID(t)
+	var given []peer.ID
+	r := newRetrier(time.Minute, func(peer.ID, ChatMessage) error {
+		t.Error("Expected an expired message not to be resent")
+		return nil
+	}, func(m ChatMessage, missing []peer.ID) {
+		given = missing
+	})
+	defer r.Close()
+
+	msg := newChatMessage("", "", "too late")
+	msg.Timestamp = time.Now().Add(-time.Hour).Unix()
+	r.Retry(msg, []peer.ID{bob, carol})
+	if len(given) != 2 || r.Pending() != 0 {
+		t.Errorf("Expected both peers given up on at once, got %v with %d pending", given, r.Pending())
+	}
+}
+
+func TestRetrierClose(t *testing.T) {
+	useFastRetries(t)
+	var resent atomic.Int32
+	r := newRetrier(time.Minute, func(peer.ID, ChatMessage) error {
+		resent.Add(1)
+		return nil
+	}, func(ChatMessage, []peer.ID) {})
+
+	r.Retry(newChatMessage("", "", "never mind"), []peer.ID{newTestPeerID(t)})
+	r.Close()
+	time.Sleep(50 * time.Millisecond)
+	if resent.Load() != 0 || r.Pending() != 0 {
+		t.Errorf("Expected Close to cancel the resend, got %d sent and %d pending", resent.Load(), r.Pending())
+	}
+}
+
+func TestNodeResendsUnackedMessage(t *testing.T) {
+	useFastRetries(t)
+	alice, bob, _ := newTestPair(t)
+	alice.mgr.acks = newAckTracker(100*time.Millisecond, alice.acked)
+
+	// Bob's first stream takes the message and then drops it unacked, as
+	// if bob had crashed before recording it
+	var dropped atomic.Bool
+	handler := newChatHandler(bob.registry, bob.history, bob.hs, bob.dedupe, bob.inbound)
+	bob.host.SetStreamHandler(chatProtocol, func(s network.Stream) {
+		if dropped.CompareAndSwap(false, true) {
+			if bob.hs.acceptHandshake(s) {
+				readMessage(bufio.NewReader(s))
+			}
+			s.Reset()
+			return
+		}
+		handler(s)
+	})
+	alice.mgr.Close()
+
+	if err := alice.Send("second time lucky"); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	waitFor(t, "bob to get the resent message", func() bool {
+		got := bob.history.Recent(1)
+		return len(got) == 1 && got[0].Body == "second time lucky"
+	})
+	if !dropped.Load() {
+		t.Error("Expected the first delivery to be dropped")
+	}
+	waitFor(t, "the retry to be settled", func() bool { return alice.retry.Pending() == 0 && alice.mgr.acks.Pending() == 0 })
+}
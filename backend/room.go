@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// room is a gossipsub topic we've joined. Every member receives what any
+// member publishes, so it scales past the one-stream-per-peer direct mode.
+type room struct {
+	name    string
+	self    peer.ID
+	topic   *pubsub.Topic
+	sub     *pubsub.Subscription
+	history *messageLog
+	cancel  context.CancelFunc
+}
+
+// joinRoom subscribes to name and starts printing what other members
+// publish. Incoming messages are also added to history.
+func joinRoom(ctx context.Context, ps *pubsub.PubSub, self peer.ID, name string, history *messageLog) (*room, error) {
+	topic, err := ps.Join(name)
+	if err != nil {
+		return nil, err
+	}
+	sub, err := topic.Subscribe()
+	if err != nil {
+		topic.Close()
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	r := &room{
+		name:    name,
+		self:    self,
+		topic:   topic,
+		sub:     sub,
+		history: history,
+		cancel:  cancel,
+	}
+	go r.readLoop(ctx)
+	return r, nil
+}
+
+// roomEnvelopeBytes is headroom for what gossipsub wraps each message in:
+// the author, sequence number, topic, key and signature.
+const roomEnvelopeBytes = 1024
+
+// roomMaxBytes is the largest encoded message sent or accepted in a room,
+// counted like maxMessageBytes. It's lower than that when -max-message-bytes
+// is beyond what gossipsub carries, which it would refuse opaquely.
+func roomMaxBytes() int {
+	return min(maxMessageBytes, pubsub.DefaultMaxMessageSize-roomEnvelopeBytes)
+}
+
+// Publish sends m to the room, or fails with ErrMessageTooLarge if it's
+// over roomMaxBytes.
+func (r *room) Publish(ctx context.Context, m ChatMessage) error {
+	data, err := json.Marshal(compressMessage(m))
+	if err != nil {
+		return err
+	}
+	if limit := roomMaxBytes(); len(data)+1 > limit {
+		return fmt.Errorf("%w: %d bytes encoded, room limit is %d", ErrMessageTooLarge, len(data)+1, limit)
+	}
+	return r.topic.Publish(ctx, data)
+}
+
+func (r *room) readLoop(ctx context.Context) {
+	for {
+		msg, err := r.sub.Next(ctx)
+		if err != nil {
+			return
+		}
+		// We already printed and recorded our own message when we sent it
+		if msg.ReceivedFrom == r.self {
+			continue
+		}
+		if len(msg.Data)+1 > roomMaxBytes() {
+			logger.Warn("dropping oversized room message", "room", r.name, "peer_id", msg.GetFrom(), "bytes", len(msg.Data)+1, "limit", roomMaxBytes())
+			continue
+		}
+		var m ChatMessage
+		if err := json.Unmarshal(msg.Data, &m); err != nil {
+			continue
+		}
+		m, err = decompressMessage(m)
+		if err != nil {
+			logger.Warn("dropping room message", "room", r.name, "peer_id", msg.GetFrom(), "error", err)
+			continue
+		}
+		// Gossipsub signs messages, so the author is trustworthy even when
+		// the envelope says otherwise
+		m.From = msg.GetFrom()
+		m.Channel = ""
+		if err := checkAuthor(m); err != nil {
+			logger.Warn("dropping room message with a bad signature", "room", r.name, "peer_id", m.From, "error", err)
+			continue
+		}
+		m.Direction = directionReceived
+		r.history.Add(m)
+		out.Received(m, r.name, false)
+	}
+}
+
+// Leave unsubscribes and stops the read loop. The topic is closed too, so
+// the same name can be joined again later.
+func (r *room) Leave() error {
+	r.cancel()
+	r.sub.Cancel()
+	return r.topic.Close()
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// publishUntilReceived sends body from one room member until another has
+// it. Gossipsub drops messages published before the mesh has formed, and
+// there's no event for that, so retrying is the only reliable wait.
+func publishUntilReceived(t *testing.T, from, to *Node, body string) ChatMessage {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if err := from.Send(body); err != nil {
+			t.Fatalf("Failed to publish: %v", err)
+		}
+		for wait := time.Now().Add(500 * time.Millisecond); time.Now().Before(wait); {
+			if got := to.history.Recent(1); len(got) == 1 && got[0].Body == body {
+				return got[0]
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout waiting for %q", body)
+		}
+	}
+}
+
+func TestRoomMessaging(t *testing.T) {
+	alice, bob, _ := newTestPair(t)
+	if err := alice.Join("lobby"); err != nil {
+		t.Fatalf("Failed to join room on alice: %v", err)
+	}
+	if err := bob.Join("lobby"); err != nil {
+		t.Fatalf("Failed to join room on bob: %v", err)
+	}
+
+	got := publishUntilReceived(t, alice, bob, "hello room")
+	if got.From != alice.host.ID() || got.Nick != "alice" {
+		t.Errorf("Unexpected room message on bob: %+v", got)
+	}
+
+	got = publishUntilReceived(t, bob, alice, "hi alice")
+	if got.From != bob.host.ID() {
+		t.Errorf("Unexpected room message on alice: %+v", got)
+	}
+}
+
+func TestRoomLeaveAndRejoin(t *testing.T) {
+	n := newTestNode(t, "")
+	if err := n.Join("lobby"); err != nil {
+		t.Fatalf("Failed to join room: %v", err)
+	}
+	if n.Room() != "lobby" {
+		t.Errorf("Expected room lobby, got %q", n.Room())
+	}
+	if err := n.Leave(); err != nil {
+		t.Fatalf("Failed to leave room: %v", err)
+	}
+	if n.Room() != "" {
+		t.Errorf("Expected direct mode after leave, got room %q", n.Room())
+	}
+	if err := n.Join("lobby"); err != nil {
+		t.Fatalf("Failed to rejoin room: %v", err)
+	}
+	// Joining another room replaces the current one
+	if err := n.Join("other"); err != nil {
+		t.Fatalf("Failed to switch rooms: %v", err)
+	}
+	if n.Room() != "other" {
+		t.Errorf("Expected room other, got %q", n.Room())
+	}
+}
+
+func TestRoomRejectsOversizedMessages(t *testing.T) {
+	old := maxMessageBytes
+	maxMessageBytes = 2048
+	t.Cleanup(func() { maxMessageBytes = old })
+
+	alice, bob, _ := newTestPair(t)
+	for _, n := range []*Node{alice, bob} {
+		if err := n.Join("lobby"); err != nil {
+			t.Fatalf("Failed to join room: %v", err)
+		}
+	}
+	publishUntilReceived(t, alice, bob, "mesh is up")
+	alice.mu.Lock()
+	r := alice.room
+	alice.mu.Unlock()
+
+	// Random bytes don't compress below the limit
+	noise := make([]byte, 4096)
+	rand.Read(noise)
+	big := newChatMessage(alice.host.ID(), "alice", base64.StdEncoding.EncodeToString(noise))
+	if err := r.Publish(context.Background(), big); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("Expected ErrMessageTooLarge before publishing, got %v", err)
+	}
+
+	// A peer that skips the check still doesn't get it through
+	data, _ := json.Marshal(big)
+	if err := r.topic.Publish(context.Background(), data); err != nil {
+		t.Fatalf("Failed to publish raw: %v", err)
+	}
+	publishUntilReceived(t, alice, bob, "after the big one")
+	time.Sleep(200 * time.Millisecond)
+	for _, m := range bob.history.Recent(-1) {
+		if m.ID == big.ID {
+			t.Error("Expected the oversized room message to be dropped")
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// secureChatProtocol carries the same envelopes as chatProtocol, sealed
+// with NaCl box so they stay private beyond the transport, e.g. through a
+// relay. Each side opens with a hello frame carrying its box public key;
+// after that every line is one base64 sealed message.
+const secureChatProtocol = "/chat-secure/1.0.0"
+
+var errDecrypt = errors.New("message could not be decrypted")
+
+// boxKeys is a node's X25519 key pair for secure chat. It is generated per
+// run and only ever shared through the hello frame.
+type boxKeys struct {
+	pub, priv *[32]byte
+}
+
+func generateBoxKeys() (*boxKeys, error) {
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &boxKeys{pub: pub, priv: priv}, nil
+}
+
+type secureHello struct {
+	BoxPub []byte `json:"box_pub"`
+}
+
+func writeHello(w io.Writer, pub *[32]byte) error {
+	data, err := json.Marshal(secureHello{BoxPub: pub[:]})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+func readHello(r *bufio.Reader) (*[32]byte, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	var hello secureHello
+	if err := json.Unmarshal(line, &hello); err != nil {
+		return nil, fmt.Errorf("malformed hello frame: %w", err)
+	}
+	if len(hello.BoxPub) != 32 {
+		return nil, fmt.Errorf("hello frame has a %d-byte key, want 32", len(hello.BoxPub))
+	}
+	var pub [32]byte
+	copy(pub[:], hello.BoxPub)
+	return &pub, nil
+}
+
+// sealMessage encrypts the JSON envelope of m for peerPub. The random nonce
+// is prepended to the ciphertext.
+func sealMessage(m ChatMessage, peerPub, myPriv *[32]byte) ([]byte, error) {
+	data, err := json.Marshal(compressMessage(m))
+	if err != nil {
+		return nil, err
+	}
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	return box.Seal(nonce[:], data, &nonce, peerPub, myPriv), nil
+}
+
+// openMessage reverses sealMessage. Anything that doesn't authenticate
+// against peerPub returns errDecrypt.
+func openMessage(ciphertext []byte, peerPub, myPriv *[32]byte) (ChatMessage, error) {
+	if len(ciphertext) < 24+box.Overhead {
+		return ChatMessage{}, errDecrypt
+	}
+	var nonce [24]byte
+	copy(nonce[:], ciphertext[:24])
+	data, ok := box.Open(nil, ciphertext[24:], &nonce, peerPub, myPriv)
+	if !ok {
+		return ChatMessage{}, errDecrypt
+	}
+	var m ChatMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return ChatMessage{}, fmt.Errorf("%w: %v", errDecrypt, err)
+	}
+	return decompressMessage(m)
+}
+
+// checkSealedSize is checkMessageSize for a sealed frame, which is larger
+// than the plain envelope by the ratchet header (or box nonce), the AEAD
+// overhead and base64.
+func checkSealedSize(m ChatMessage) error {
+	if len(m.Body) > maxBodyBytes {
+		return fmt.Errorf("%w: body is %d bytes, limit is %d", ErrMessageTooLarge, len(m.Body), maxBodyBytes)
+	}
+	data, err := json.Marshal(compressMessage(m))
+	if err != nil {
+		return err
+	}
+	overhead := max(24+box.Overhead, ratchetHeaderSize+chacha20poly1305.Overhead)
+	n := base64.StdEncoding.EncodedLen(overhead+len(data)) + 1
+	if n > maxMessageBytes {
+		return fmt.Errorf("%w: %d bytes sealed, limit is %d", ErrMessageTooLarge, n, maxMessageBytes)
+	}
+	return nil
+}
+
+// writeSealed writes m to w as one sealed frame.
+func writeSealed(w io.Writer, m ChatMessage, peerPub, myPriv *[32]byte) error {
+	sealed, err := sealMessage(m, peerPub, myPriv)
+	if err != nil {
+		return err
+	}
+	return writeFrame(w, sealed)
+}
+
+// writeFrame writes a sealed frame to w as one base64 line.
+func writeFrame(w io.Writer, sealed []byte) error {
+	line := base64.StdEncoding.AppendEncode(nil, sealed)
+	_, err := w.Write(append(line, '\n'))
+	return err
+}
+
+// secureHandshake sends our hello and reads the peer's, giving up after
+// timeout (if set) so a peer that never answers can't hold the stream open.
+func secureHandshake(s network.Stream, r *bufio.Reader, w *bufio.Writer, keys *boxKeys, timeout time.Duration) (*[32]byte, error) {
+	if timeout > 0 {
+		s.SetDeadline(time.Now().Add(timeout))
+		defer s.SetDeadline(time.Time{})
+	}
+	if err := writeHello(w, keys.pub); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return readHello(r)
+}
+
+// newSecureChatHandler is newChatHandler for /chat-secure/1.0.0. Frames
+// that fail to decrypt are dropped with a warning; the stream stays open.
+func newSecureChatHandler(reg *peerRegistry, history *messageLog, hs *handshaker, seen *messageDeduper, limit *inboundLimiter, keys *boxKeys, timeout time.Duration) network.StreamHandler {
+	return func(s network.Stream) {
+		if !acceptSecure(s, reg, hs) {
+			return
+		}
+		r := bufio.NewReader(s)
+		peerPub, err := secureHandshake(s, r, bufio.NewWriter(s), keys, timeout)
+		if err != nil {
+			logger.Warn("secure handshake failed", "peer_id", s.Conn().RemotePeer(), "error", err)
+			s.Reset()
+			return
+		}
+		readSealed(s, r, func(sealed []byte) (ChatMessage, error) {
+			return openMessage(sealed, peerPub, keys.priv)
+		}, history, seen, limit)
+	}
+}
+
+// newRatchetChatHandler is newSecureChatHandler for ratchetChatProtocol.
+func newRatchetChatHandler(reg *peerRegistry, history *messageLog, hs *handshaker, seen *messageDeduper, limit *inboundLimiter, keys *ratchetKeys, timeout time.Duration) network.StreamHandler {
+	return func(s network.Stream) {
+		if !acceptSecure(s, reg, hs) {
+			return
+		}
+		r := bufio.NewReader(s)
+		session, err := ratchetHandshake(s, r, bufio.NewWriter(s), keys, timeout)
+		if err != nil {
+			logger.Warn("secure handshake failed", "peer_id", s.Conn().RemotePeer(), "error", err)
+			s.Reset()
+			return
+		}
+		readSealed(s, r, session.Open, history, seen, limit)
+	}
+}
+
+// acceptSecure runs the capabilities handshake on an inbound secure
+// stream and registers the peer, reporting false if the stream was closed.
+func acceptSecure(s network.Stream, reg *peerRegistry, hs *handshaker) bool {
+	if !hs.acceptHandshake(s) {
+		return false
+	}
+	reg.Add(peer.AddrInfo{
+		ID:    s.Conn().RemotePeer(),
+		Addrs: []ma.Multiaddr{s.Conn().RemoteMultiaddr()},
+	})
+	return true
+}
+
+// readSealed reads sealed frames from s until it ends, decrypting each
+// with open and handling it as handleStream does a plain message.
+func readSealed(s network.Stream, r *bufio.Reader, open func([]byte) (ChatMessage, error), history *messageLog, seen *messageDeduper, limit *inboundLimiter) {
+	remote := s.Conn().RemotePeer()
+	logger.Debug("secure stream opened", "peer_id", remote)
+	for {
+		s.SetReadDeadline(time.Now().Add(streamIdleTimeout))
+		line, err := readLine(r)
+		if errors.Is(err, ErrMessageTooLarge) {
+			logger.Warn("message too large, resetting stream", "peer_id", remote, "limit", maxMessageBytes)
+			s.Reset()
+			return
+		}
+		if err != nil {
+			endStream(s, err)
+			return
+		}
+		sealed, err := base64.StdEncoding.DecodeString(string(line))
+		if err != nil {
+			logger.Warn("dropping malformed secure frame", "peer_id", remote)
+			continue
+		}
+		m, err := open(sealed)
+		if err != nil {
+			logger.Warn("dropping undecryptable message", "peer_id", remote, "error", err)
+			continue
+		}
+		// Frames are opened before the rate limit is applied, which is
+		// safe: a frame is a bounded line that cost more to read than to
+		// decrypt, and a ratchet has to open every frame to stay in step.
+		// Opening tells control frames apart, as in handleStream.
+		allow := limit.Allow
+		if m.IsControl() {
+			allow = limit.AllowControl
+		}
+		if ok, reset := allow(remote); !ok {
+			if reset {
+				logger.Warn("peer kept flooding, resetting stream", "peer_id", remote)
+				s.Reset()
+				return
+			}
+			continue
+		}
+		if m.IsControl() {
+			handleControl(m, remote)
+			continue
+		}
+		m.Channel = ""
+		if err := checkAuthor(m); err != nil {
+			logger.Warn("dropping message with a bad signature", "peer_id", remote, "from", m.From, "error", err)
+			continue
+		}
+		shown := !seen.Seen(m.ID)
+		if shown {
+			recordIncoming(m, remote, true, history)
+		}
+		ackIncoming(s, m)
+		if shown {
+			sendReceipt(s, m)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	protocol "github.com/libp2p/go-libp2p/core/protocol"
+)
+
+func TestSealOpenRoundTrip(t *testing.T) {
+	alice, err := generateBoxKeys()
+	if err != nil {
+		t.Fatalf("Failed to generate keys: %v", err)
+	}
+	bob, err := generateBoxKeys()
+	if err != nil {
+		t.Fatalf("Failed to generate keys: %v", err)
+	}
+
+	want := newChatMessage("", "alice", "top secret")
+	sealed, err := sealMessage(want, bob.pub, alice.priv)
+	if err != nil {
+		t.Fatalf("Failed to seal: %v", err)
+	}
+	got, err := openMessage(sealed, alice.pub, bob.priv)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Round trip mismatch: got %+v, want %+v", got, want)
+	}
+}
+
+func TestOpenMessageRejectsBadCiphertext(t *testing.T) {
+	alice, _ := generateBoxKeys()
+	bob, _ := generateBoxKeys()
+	eve, _ := generateBoxKeys()
+
+	sealed, err := sealMessage(newChatMessage("", "", "hi"), bob.pub, alice.priv)
+	if err != nil {
+		t.Fatalf("Failed to seal: %v", err)
+	}
+	if _, err := openMessage(sealed, alice.pub, eve.priv); !errors.Is(err, errDecrypt) {
+		t.Errorf("Expected errDecrypt for the wrong recipient, got %v", err)
+	}
+	sealed[len(sealed)-1] ^= 0xff
+	if _, err := openMessage(sealed, alice.pub, bob.priv); !errors.Is(err, errDecrypt) {
+		t.Errorf("Expected errDecrypt for tampered ciphertext, got %v", err)
+	}
+	if _, err := openMessage([]byte("short"), alice.pub, bob.priv); !errors.Is(err, errDecrypt) {
+		t.Errorf("Expected errDecrypt for truncated ciphertext, got %v", err)
+	}
+}
+
+func TestCheckSealedSize(t *testing.T) {
+	old := maxMessageBytes
+	maxMessageBytes = 256
+	defer func() { maxMessageBytes = old }()
+
+	// Fits as plain JSON but not once sealed and base64-encoded
+	m := newChatMessage("", "", strings.Repeat("x", 120))
+	if err := checkMessageSize(m); err != nil {
+		t.Fatalf("Expected plain message to fit, got %v", err)
+	}
+	if err := checkSealedSize(m); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("Expected ErrMessageTooLarge, got %v", err)
+	}
+}
+
+func TestSecureNodeMessaging(t *testing.T) {
+	newSecureNode := func(nick string) *Node {
+		n, err := NewNode(context.Background(), Config{
+			IdentityPath:       filepath.Join(t.TempDir(), "identity.key"),
+			Nick:               nick,
+			NegotiationTimeout: 5 * time.Second,
+			Secure:             true,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create node: %v", err)
+		}
+		t.Cleanup(func() { n.Close() })
+		return n
+	}
+	alice := newSecureNode("alice")
+	bob := newSecureNode("bob")
+
+	addr := nodeAddr(bob)
+	if err := alice.Connect(addr); err != nil {
+		t.Fatalf("Failed to connect alice to bob: %v", err)
+	}
+	if err := alice.Send("sealed hello"); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	waitFor(t, "bob to receive the sealed message", func() bool {
+		got := bob.history.Recent(1)
+		return len(got) == 1 && got[0].Body == "sealed hello" && got[0].Nick == "alice"
+	})
+}
+
+func TestSecureNodeFallsBackForPlainPeer(t *testing.T) {
+	alice, err := NewNode(context.Background(), Config{
+		IdentityPath:       filepath.Join(t.TempDir(), "identity.key"),
+		Nick:               "alice",
+		NegotiationTimeout: 5 * time.Second,
+		Secure:             true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	t.Cleanup(func() { alice.Close() })
+	bob := newTestNode(t, "bob")
+
+	addr := nodeAddr(bob)
+	if err := alice.Connect(addr); err != nil {
+		t.Fatalf("Failed to connect alice to bob: %v", err)
+	}
+	if err := alice.Send("plain hello"); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	waitFor(t, "bob to receive the message", func() bool {
+		got := bob.history.Recent(1)
+		return len(got) == 1 && got[0].Body == "plain hello"
+	})
+	if caps, ok := alice.hs.peers.Get(bob.host.ID()); !ok || caps.SupportsEncryption {
+		t.Errorf("Expected bob's handshake to report no encryption, got %+v (ok %v)", caps, ok)
+	}
+}
+
+func TestSecureHandlerDropsUndecryptableFrames(t *testing.T) {
+	ctx := context.Background()
+	hostA, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host A: %v", err)
+	}
+	defer hostA.Close()
+	hostB, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host B: %v", err)
+	}
+	defer hostB.Close()
+
+	bobKeys, _ := generateBoxKeys()
+	history := newMessageLog(10)
+	hostB.SetStreamHandler(secureChatProtocol, newSecureChatHandler(newPeerRegistry(), history, nil, nil, nil, bobKeys, 5*time.Second))
+	if err := hostA.Connect(ctx, peer.AddrInfo{ID: hostB.ID(), Addrs: hostB.Addrs()}); err != nil {
+		t.Fatalf("Failed to connect host A to host B: %v", err)
+	}
+
+	s, err := hostA.NewStream(ctx, hostB.ID(), secureChatProtocol)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	defer s.Close()
+	aliceKeys, _ := generateBoxKeys()
+	w := bufio.NewWriter(s)
+	bobPub, err := secureHandshake(s, bufio.NewReader(s), w, aliceKeys, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Failed handshake: %v", err)
+	}
+
+	// A frame sealed for someone else, then garbage, then a good one
+	eve, _ := generateBoxKeys()
+	writeSealed(w, newChatMessage("", "", "not for bob"), eve.pub, aliceKeys.priv)
+	w.WriteString("!!not base64!!\n")
+	writeSealed(w, newChatMessage("", "", "for bob"), bobPub, aliceKeys.priv)
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Failed to write frames: %v", err)
+	}
+
+	waitFor(t, "the good frame", func() bool { return len(history.Recent(-1)) > 0 })
+	got := history.Recent(-1)
+	if len(got) != 1 || got[0].Body != "for bob" {
+		t.Errorf("Expected only the decryptable message, got %+v", got)
+	}
+}
+
+// newSecureTestNode is newTestNode with Secure on, sending in the clear to
+// the plaintext peers.
+func newSecureTestNode(t *testing.T, nick string, plaintext ...peer.ID) *Node {
+	t.Helper()
+	n, err := NewNode(context.Background(), Config{
+		IdentityPath:       filepath.Join(t.TempDir(), "identity.key"),
+		ListenAddrs:        loopbackListenAddrs,
+		Nick:               nick,
+		NegotiationTimeout: 5 * time.Second,
+		Secure:             true,
+		PlaintextPeers:     plaintext,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	t.Cleanup(func() { n.Close() })
+	n.Start()
+	return n
+}
+
+func TestSecureNodeEncryptsPerDestination(t *testing.T) {
+	bob := newSecureTestNode(t, "bob")
+	carol := newSecureTestNode(t, "carol")
+	alice := newSecureTestNode(t, "alice", carol.host.ID())
+	for _, n := range []*Node{bob, carol} {
+		if err := alice.Connect(nodeAddr(n)); err != nil {
+			t.Fatalf("Failed to connect alice: %v", err)
+		}
+	}
+	protocolTo := func(id peer.ID) protocol.ID {
+		ms := alice.mgr.entry(streamKey{id, ""})
+		ms.mu.Lock()
+		defer ms.mu.Unlock()
+		if ms.s == nil {
+			return ""
+		}
+		return ms.s.Protocol()
+	}
+
+	// Direct chat is sealed by default, and in the clear to carol
+	if err := alice.SendTo("for bob only", bob.host.ID()); err != nil {
+		t.Fatalf("Failed to send to bob: %v", err)
+	}
+	if err := alice.SendTo("for carol's logs", carol.host.ID()); err != nil {
+		t.Fatalf("Failed to send to carol: %v", err)
+	}
+	if got := protocolTo(bob.host.ID()); got != ratchetChatProtocol {
+		t.Errorf("Expected bob's stream to be %s, got %q", ratchetChatProtocol, got)
+	}
+	if got := protocolTo(carol.host.ID()); got != chatProtocol {
+		t.Errorf("Expected carol's stream to be %s, got %q", chatProtocol, got)
+	}
+	waitFor(t, "both direct messages", func() bool {
+		b, c := bob.history.Recent(1), carol.history.Recent(1)
+		return len(b) == 1 && b[0].Body == "for bob only" && len(c) == 1 && c[0].Body == "for carol's logs"
+	})
+
+	// A room message is plain JSON to anyone on the topic
+	topic, err := carol.pubsub.Join("lobby")
+	if err != nil {
+		t.Fatalf("Failed to join the topic: %v", err)
+	}
+	sub, err := topic.Subscribe()
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	defer sub.Cancel()
+	if err := alice.Join("lobby"); err != nil {
+		t.Fatalf("Failed to join the room: %v", err)
+	}
+	if err := bob.Join("lobby"); err != nil {
+		t.Fatalf("Failed to join the room: %v", err)
+	}
+	publishUntilReceived(t, alice, bob, "hello room")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for {
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			t.Fatalf("Timeout waiting for the room message on the wire: %v", err)
+		}
+		var m ChatMessage
+		if json.Unmarshal(msg.Data, &m) == nil && m.Body == "hello room" {
+			break
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	host "github.com/libp2p/go-libp2p/core/host"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// showLocalAddrs keeps loopback and link-local addresses in dialableAddrs.
+// Set from -show-local.
+var showLocalAddrs bool
+
+// dialableAddrs is h's addresses as full /p2p/ multiaddrs a peer can dial,
+// public ones first. Loopback and link-local addresses are left out unless
+// showLocalAddrs is set, since they only work from this machine or link.
+func dialableAddrs(h host.Host) []ma.Multiaddr {
+	return filterDialable(h.Addrs(), h.ID(), showLocalAddrs)
+}
+
+func filterDialable(addrs []ma.Multiaddr, id peer.ID, showLocal bool) []ma.Multiaddr {
+	var keep []ma.Multiaddr
+	for _, addr := range addrs {
+		if showLocal || !isLocalAddr(addr) {
+			keep = append(keep, addr)
+		}
+	}
+	if len(keep) == 0 {
+		return nil
+	}
+	slices.SortStableFunc(keep, func(a, b ma.Multiaddr) int {
+		switch pa, pb := manet.IsPublicAddr(a), manet.IsPublicAddr(b); {
+		case pa && !pb:
+			return -1
+		case pb && !pa:
+			return 1
+		}
+		return 0
+	})
+	out, err := peer.AddrInfoToP2pAddrs(&peer.AddrInfo{ID: id, Addrs: keep})
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+// isLocalAddr reports whether addr is loopback or link-local.
+func isLocalAddr(addr ma.Multiaddr) bool {
+	if manet.IsIPLoopback(addr) || manet.IsIP6LinkLocal(addr) {
+		return true
+	}
+	ip, err := manet.ToIP(addr)
+	return err == nil && ip.IsLinkLocalUnicast()
+}
+
+// shareableAddrs is what -qr renders: the first public address when the
+// host has one, since that's the one a peer elsewhere can dial, and every
+// address otherwise.
+func shareableAddrs(h host.Host) []string {
+	return selectShareable(h.Addrs(), h.ID())
+}
+
+func selectShareable(addrs []ma.Multiaddr, id peer.ID) []string {
+	for _, addr := range addrs {
+		if manet.IsPublicAddr(addr) && !manet.IsIPLoopback(addr) {
+			return []string{fmt.Sprintf("%s/p2p/%s", addr, id)}
+		}
+	}
+	out := make([]string, len(addrs))
+	for i, addr := range addrs {
+		out[i] = fmt.Sprintf("%s/p2p/%s", addr, id)
+	}
+	return out
+}
+
+// printQR renders each address as a QR code in half-height blocks, which
+// fits a typical terminal.
+func printQR(addrs []string) {
+	for _, addr := range addrs {
+		qr, err := qrcode.New(addr, qrcode.Low)
+		if err != nil {
+			logger.Warn("failed to render QR code", "addr", addr, "error", err)
+			continue
+		}
+		out.Printf("📷 %s\n%s", addr, qr.ToSmallString(false))
+	}
+}
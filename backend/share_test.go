@@ -0,0 +1,83 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	ma "github.com/multiformats/go-multiaddr"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+func TestSelectShareable(t *testing.T) {
+	id := newTestPeerID(t)
+	loopback := ma.StringCast("/ip4/127.0.0.1/tcp/4001")
+	lan := ma.StringCast("/ip4/192.168.1.20/tcp/4001")
+	public := ma.StringCast("/ip4/8.8.4.4/tcp/4001")
+	public2 := ma.StringCast("/ip4/1.1.1.1/tcp/4001")
+
+	got := selectShareable([]ma.Multiaddr{loopback, lan, public, public2}, id)
+	if want := public.String() + "/p2p/" + id.String(); len(got) != 1 || got[0] != want {
+		t.Errorf("Expected only %s, got %v", want, got)
+	}
+
+	got = selectShareable([]ma.Multiaddr{loopback, lan}, id)
+	if len(got) != 2 || !strings.HasPrefix(got[0], loopback.String()) || !strings.HasPrefix(got[1], lan.String()) {
+		t.Errorf("Expected every address without a public one, got %v", got)
+	}
+}
+
+func TestShareableAddrsOnLoopbackHost(t *testing.T) {
+	n := newTestNode(t, "")
+	got := shareableAddrs(n.host)
+	if len(got) != len(n.host.Addrs()) {
+		t.Fatalf("Expected all %d addresses, got %v", len(n.host.Addrs()), got)
+	}
+	for _, addr := range got {
+		if !strings.HasSuffix(addr, "/p2p/"+n.host.ID().String()) {
+			t.Errorf("Expected %s to end in the peer ID", addr)
+		}
+		if _, err := qrcode.New(addr, qrcode.Low); err != nil {
+			t.Errorf("Failed to encode %s as a QR code: %v", addr, err)
+		}
+	}
+}
+
+func TestFilterDialable(t *testing.T) {
+	id := newTestPeerID(t)
+	loopback := ma.StringCast("/ip4/127.0.0.1/tcp/4001")
+	loopback6 := ma.StringCast("/ip6/::1/udp/4001/quic-v1")
+	linkLocal := ma.StringCast("/ip4/169.254.10.1/tcp/4001")
+	linkLocal6 := ma.StringCast("/ip6/fe80::1/tcp/4001")
+	lan := ma.StringCast("/ip4/192.168.1.20/tcp/4001")
+	public := ma.StringCast("/ip4/8.8.4.4/tcp/4001")
+	public6 := ma.StringCast("/ip6/2001:4860:4860::8888/udp/4001/quic-v1")
+	all := []ma.Multiaddr{loopback, lan, linkLocal, public, loopback6, linkLocal6, public6}
+
+	p2p := func(addrs ...ma.Multiaddr) []string {
+		out := make([]string, len(addrs))
+		for i, a := range addrs {
+			out[i] = a.String() + "/p2p/" + id.String()
+		}
+		return out
+	}
+	strs := func(addrs []ma.Multiaddr) []string {
+		out := make([]string, len(addrs))
+		for i, a := range addrs {
+			out[i] = a.String()
+		}
+		return out
+	}
+
+	got := strs(filterDialable(all, id, false))
+	if want := p2p(public, public6, lan); !slices.Equal(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	got = strs(filterDialable(all, id, true))
+	if want := p2p(public, public6, loopback, lan, linkLocal, loopback6, linkLocal6); !slices.Equal(got, want) {
+		t.Errorf("Expected local addresses kept after public ones, got %v", got)
+	}
+	if got := filterDialable([]ma.Multiaddr{loopback}, id, false); len(got) != 0 {
+		t.Errorf("Expected nothing dialable on a loopback-only host, got %v", got)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	crypto "github.com/libp2p/go-libp2p/core/crypto"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// newTestKey returns an Ed25519 key and its peer ID.
+func newTestKey(t *testing.T) (crypto.PrivKey, peer.ID) {
+	t.Helper()
+	priv, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		t.Fatalf("Failed to get peer ID: %v", err)
+	}
+	return priv, id
+}
+
+func TestSignAndVerifyMessage(t *testing.T) {
+	priv, alice := newTestKey(t)
+	_, mallory := newTestKey(t)
+
+	m := newChatMessage(alice, "alice", "meet at noon")
+	if err := signMessage(&m, priv); err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	if ok, err := verifyMessage(m); !ok || err != nil {
+		t.Errorf("Expected a valid signature, got %v, %v", ok, err)
+	}
+	// Channel and encoding change in transit and aren't covered
+	relayed := m
+	relayed.Channel = "dev"
+	if err := checkAuthor(relayed); err != nil {
+		t.Errorf("Expected the channel tag not to affect the signature, got %v", err)
+	}
+
+	tampered := m
+	tampered.Body = "meet at midnight"
+	if ok, _ := verifyMessage(tampered); ok {
+		t.Error("Expected a tampered body to fail verification")
+	}
+	if err := checkAuthor(tampered); !errors.Is(err, errBadSignature) {
+		t.Errorf("Expected errBadSignature for a tampered body, got %v", err)
+	}
+
+	retyped := m
+	retyped.ContentType = "image/png"
+	if ok, _ := verifyMessage(retyped); ok {
+		t.Error("Expected a changed content type to fail verification")
+	}
+
+	spoofed := m
+	spoofed.From = mallory
+	if ok, _ := verifyMessage(spoofed); ok {
+		t.Error("Expected a mismatched sender to fail verification")
+	}
+	if err := checkAuthor(spoofed); !errors.Is(err, errBadSignature) {
+		t.Errorf("Expected errBadSignature for a mismatched sender, got %v", err)
+	}
+
+	unsigned := newChatMessage(alice, "alice", "from an old peer")
+	if _, err := verifyMessage(unsigned); err == nil {
+		t.Error("Expected an unsigned message not to verify")
+	}
+	if err := checkAuthor(unsigned); err != nil {
+		t.Errorf("Expected unsigned messages to be accepted, got %v", err)
+	}
+}
+
+func TestSentMessagesAreSigned(t *testing.T) {
+	alice, bob, _ := newTestPair(t)
+	if err := alice.Send("signed hello"); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	waitFor(t, "the message", func() bool { return len(bob.history.Recent(-1)) > 0 })
+	got := bob.history.Recent(1)[0]
+	if ok, err := verifyMessage(got); !ok || got.From != alice.host.ID() {
+		t.Errorf("Expected bob to receive alice's signed message, got %+v (%v)", got, err)
+	}
+}
+
+func TestUnsignedMessageCreditedToStreamPeer(t *testing.T) {
+	useJSONOutput(t)
+	_, remote := newTestKey(t)
+	_, alice := newTestKey(t)
+	history := newMessageLog(10)
+
+	recordIncoming(newChatMessage(alice, "alice", "it's really me"), remote, false, history)
+	if got := history.Recent(1); len(got) != 1 || got[0].From != remote {
+		t.Errorf("Expected an unsigned message to be credited to the stream's peer, got %+v", got)
+	}
+}
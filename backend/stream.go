@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	host "github.com/libp2p/go-libp2p/core/host"
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	protocol "github.com/libp2p/go-libp2p/core/protocol"
+)
+
+var (
+	errNegotiationTimeout = errors.New("protocol negotiation timed out")
+	errSendTimeout        = errors.New("peer stopped reading")
+)
+
+const defaultSendTimeout = 15 * time.Second
+
+// deadlineWriter sets a fresh write deadline on s before every write, so a
+// peer that stops reading fails the write after timeout instead of
+// blocking it forever, while a slow but steady transfer keeps going.
+type deadlineWriter struct {
+	s       network.Stream
+	timeout time.Duration
+}
+
+func (w deadlineWriter) Write(p []byte) (int, error) {
+	if w.timeout <= 0 {
+		return w.s.Write(p)
+	}
+	w.s.SetWriteDeadline(time.Now().Add(w.timeout))
+	n, err := w.s.Write(p)
+	var ne net.Error
+	if errors.Is(err, os.ErrDeadlineExceeded) || errors.As(err, &ne) && ne.Timeout() {
+		err = fmt.Errorf("%w: no progress for %s", errSendTimeout, w.timeout)
+	}
+	return n, err
+}
+
+// deadlineReader is deadlineWriter for reads: a peer that stops sending
+// fails the read after timeout, however long the whole transfer takes.
+type deadlineReader struct {
+	s       network.Stream
+	timeout time.Duration
+}
+
+func (r deadlineReader) Read(p []byte) (int, error) {
+	r.s.SetReadDeadline(time.Now().Add(r.timeout))
+	return r.s.Read(p)
+}
+
+// streamOpener opens outbound streams with a negotiation deadline that is
+// separate from the dial: connecting uses the caller's context, then each
+// multistream negotiation attempt gets its own timeout so a peer that
+// accepts the connection but never answers can't hang the REPL.
+type streamOpener struct {
+	timeout time.Duration
+	retries int
+}
+
+func (o streamOpener) open(ctx context.Context, h host.Host, id peer.ID, protos ...protocol.ID) (network.Stream, error) {
+	if err := h.Connect(ctx, peer.AddrInfo{ID: id}); err != nil {
+		return nil, err
+	}
+	for attempt := 0; attempt <= o.retries; attempt++ {
+		nctx, cancel := context.WithTimeout(ctx, o.timeout)
+		s, err := h.NewStream(network.WithNoDial(nctx, "already connected"), id, protos...)
+		cancel()
+		if err == nil {
+			return s, nil
+		}
+		if !errors.Is(err, context.DeadlineExceeded) || ctx.Err() != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("%w after %d attempt(s) of %s", errNegotiationTimeout, o.retries+1, o.timeout)
+}
+
+// streamManager keeps one outbound chat stream per peer and channel and
+// writes every message to it, instead of paying for a new stream per line. A
+// stream that fails a write is dropped and reopened on the next send.
+// With secure set it speaks /chat-secure/1.0.0 to peers whose handshake
+// says they support encryption too, or ratchetChatProtocol when ratchets is
+// set as well and the peer is new enough, except to the peers in
+// plaintext. Which protocol the stream speaks tells the receiver whether
+// its frames are sealed.
+type streamManager struct {
+	h        host.Host
+	opener   streamOpener
+	throttle *peerThrottle
+	hs       *handshaker
+	secure   *boxKeys
+	ratchets *ratchetKeys
+	acks     *ackTracker
+	// plaintext are the peers chat goes to unencrypted even with secure.
+	plaintext []peer.ID
+	// onRead, if set, is told about each read receipt a peer sends.
+	onRead func(msgID string, id peer.ID)
+	// sendTimeout bounds each write; a peer that won't read for that long
+	// has its stream reset.
+	sendTimeout time.Duration
+
+	mu      sync.Mutex
+	streams map[streamKey]*managedStream
+}
+
+// streamKey names the stream for messages to a peer on a channel.
+type streamKey struct {
+	id      peer.ID
+	channel string
+}
+
+type managedStream struct {
+	mu sync.Mutex
+	s  network.Stream
+	w  *bufio.Writer
+	// seal, on a secure stream, encrypts each message into a frame.
+	seal func(ChatMessage) ([]byte, error)
+}
+
+func newStreamManager(h host.Host, opener streamOpener, throttle *peerThrottle) *streamManager {
+	return &streamManager{
+		h:        h,
+		opener:   opener,
+		throttle: throttle,
+		streams:  make(map[streamKey]*managedStream),
+	}
+}
+
+func (m *streamManager) entry(key streamKey) *managedStream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ms, ok := m.streams[key]
+	if !ok {
+		ms = &managedStream{}
+		m.streams[key] = ms
+	}
+	return ms
+}
+
+// Send writes msg to id on msg's channel, opening the stream on first use.
+// If the cached stream turns out to be dead, e.g. the peer restarted, it's
+// replaced by a fresh one and the write retried once; a peer that stopped
+// reading isn't given another stream.
+func (m *streamManager) Send(ctx context.Context, id peer.ID, msg ChatMessage) error {
+	ms := m.entry(streamKey{id, msg.Channel})
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	reused := ms.s != nil
+	err := m.write(ctx, id, ms, msg)
+	if err != nil && reused && !errors.Is(err, errSendTimeout) && ctx.Err() == nil {
+		logger.Debug("chat stream failed, reopening", "peer_id", id, "error", err)
+		err = m.write(ctx, id, ms, msg)
+	}
+	return err
+}
+
+// write sends msg on ms, opening the stream if there is none. A stream
+// that fails is reset and forgotten. ms.mu must be held.
+func (m *streamManager) write(ctx context.Context, id peer.ID, ms *managedStream, msg ChatMessage) error {
+	if ms.s == nil {
+		open := m.open
+		if msg.Channel != "" {
+			open = m.openChannel(msg.Channel)
+		}
+		if err := open(ctx, id, ms); err != nil {
+			return err
+		}
+	}
+
+	m.acks.Expect(msg, id)
+	var err error
+	w := m.throttle.Writer(ctx, id, ms.w)
+	if ms.seal != nil {
+		var sealed []byte
+		if sealed, err = ms.seal(msg); err == nil {
+			err = writeFrame(w, sealed)
+		}
+	} else {
+		err = writeMessage(w, compressMessage(msg))
+	}
+	if err == nil {
+		err = ms.w.Flush()
+	}
+	if err != nil {
+		m.acks.Drop(msg.ID, id)
+		ms.s.Reset()
+		ms.s, ms.w, ms.seal = nil, nil, nil
+	}
+	return err
+}
+
+// open starts the outbound stream for ms. With secure chat on, a peer we
+// haven't shaken hands with yet is asked over a plain stream first; that
+// stream is kept if the peer doesn't do encryption, and otherwise replaced
+// by a secure one that exchanges keys. Peers in plaintext always get a
+// plain stream.
+func (m *streamManager) open(ctx context.Context, id peer.ID, ms *managedStream) error {
+	secure := false
+	var caps peerCapabilities
+	if m.secure != nil && !slices.Contains(m.plaintext, id) {
+		var known bool
+		caps, known = m.hs.peers.Get(id)
+		if !known {
+			s, err := m.openStream(ctx, id, chatProtocol, legacyChatProtocol)
+			if err != nil {
+				return err
+			}
+			if caps, _ = m.hs.peers.Get(id); !caps.SupportsEncryption {
+				m.attach(id, ms, s, bufio.NewReader(s), nil)
+				return nil
+			}
+			s.Close()
+		}
+		secure = caps.SupportsEncryption
+	}
+
+	if !secure {
+		s, err := m.openStream(ctx, id, chatProtocol, legacyChatProtocol)
+		if err != nil {
+			return err
+		}
+		m.attach(id, ms, s, bufio.NewReader(s), nil)
+		return nil
+	}
+	if m.ratchets != nil && versionAtLeast(caps.ProtocolVersion, ratchetVersion) {
+		s, err := m.openStream(ctx, id, ratchetChatProtocol)
+		if err != nil {
+			return err
+		}
+		r := bufio.NewReader(s)
+		session, err := ratchetHandshake(s, r, bufio.NewWriter(s), m.ratchets, m.opener.timeout)
+		if err != nil {
+			s.Reset()
+			return fmt.Errorf("secure handshake failed: %w", err)
+		}
+		m.attach(id, ms, s, r, session.Seal)
+		return nil
+	}
+	s, err := m.openStream(ctx, id, secureChatProtocol)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(s)
+	peerPub, err := secureHandshake(s, r, bufio.NewWriter(s), m.secure, m.opener.timeout)
+	if err != nil {
+		s.Reset()
+		return fmt.Errorf("secure handshake failed: %w", err)
+	}
+	m.attach(id, ms, s, r, func(msg ChatMessage) ([]byte, error) {
+		return sealMessage(msg, peerPub, m.secure.priv)
+	})
+	return nil
+}
+
+// openChannel returns an open func for the plain stream of channel name.
+func (m *streamManager) openChannel(name string) func(context.Context, peer.ID, *managedStream) error {
+	return func(ctx context.Context, id peer.ID, ms *managedStream) error {
+		s, err := m.openStream(ctx, id, channelProtocol(name))
+		if err != nil {
+			return err
+		}
+		m.attach(id, ms, s, bufio.NewReader(s), nil)
+		return nil
+	}
+}
+
+// attach makes s the stream for ms and starts reading the ACKs the peer
+// writes back on it. r must be the stream's only reader.
+func (m *streamManager) attach(id peer.ID, ms *managedStream, s network.Stream, r *bufio.Reader, seal func(ChatMessage) ([]byte, error)) {
+	ms.s, ms.w, ms.seal = s, bufio.NewWriter(deadlineWriter{s, m.sendTimeout}), seal
+	go func() {
+		for {
+			ack, err := readAckFrame(r)
+			if err != nil {
+				// The peer closed or reset the stream, e.g. after
+				// streamIdleTimeout; forget it so the next Send reopens.
+				ms.mu.Lock()
+				if ms.s == s {
+					s.Reset()
+					ms.s, ms.w, ms.seal = nil, nil, nil
+				}
+				ms.mu.Unlock()
+				return
+			}
+			if ack.AckFor != "" {
+				m.acks.Ack(ack.AckFor, id)
+			}
+			if ack.ReadFor != "" && m.onRead != nil {
+				m.onRead(ack.ReadFor, id)
+			}
+		}
+	}()
+}
+
+// openStream opens proto to id and exchanges capabilities on it.
+func (m *streamManager) openStream(ctx context.Context, id peer.ID, protos ...protocol.ID) (network.Stream, error) {
+	s, err := m.opener.open(ctx, m.h, id, protos...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := m.hs.performHandshake(s); err != nil {
+		s.Reset()
+		return nil, fmt.Errorf("handshake failed: %w", err)
+	}
+	return s, nil
+}
+
+// Close closes every cached stream.
+func (m *streamManager) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, ms := range m.streams {
+		ms.mu.Lock()
+		if ms.s != nil {
+			ms.s.Close()
+		}
+		ms.mu.Unlock()
+		delete(m.streams, key)
+	}
+}
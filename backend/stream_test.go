@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	protocol "github.com/libp2p/go-libp2p/core/protocol"
+)
+
+func TestStreamOpenerNegotiationTimeout(t *testing.T) {
+	ctx := context.Background()
+	hostA, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host A: %v", err)
+	}
+	defer hostA.Close()
+	hostB, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host B: %v", err)
+	}
+	defer hostB.Close()
+
+	// Host B accepts connections but swallows every stream without ever
+	// answering multistream-select
+	stalled := make(chan struct{})
+	defer close(stalled)
+	hostB.Network().SetStreamHandler(func(s network.Stream) {
+		<-stalled
+		s.Reset()
+	})
+
+	if err := hostA.Connect(ctx, peer.AddrInfo{ID: hostB.ID(), Addrs: hostB.Addrs()}); err != nil {
+		t.Fatalf("Failed to connect host A to host B: %v", err)
+	}
+
+	opener := streamOpener{timeout: 200 * time.Millisecond, retries: 2}
+	start := time.Now()
+	_, err = opener.open(ctx, hostA, hostB.ID(), "/chat/1.0.0")
+	elapsed := time.Since(start)
+
+	if !errors.Is(err, errNegotiationTimeout) {
+		t.Fatalf("Expected negotiation timeout, got %v", err)
+	}
+	if elapsed > 2*time.Second {
+		t.Errorf("Expected failure within the configured bound, took %v", elapsed)
+	}
+}
+
+func TestStreamManagerReusesStream(t *testing.T) {
+	ctx := context.Background()
+	hostA, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host A: %v", err)
+	}
+	defer hostA.Close()
+	hostB, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host B: %v", err)
+	}
+	defer hostB.Close()
+
+	streams := make(chan struct{}, 4)
+	received := make(chan string, 4)
+	hostB.SetStreamHandler("/chat/1.0.0", func(s network.Stream) {
+		streams <- struct{}{}
+		r := bufio.NewReader(s)
+		for {
+			m, err := readMessage(r)
+			if err != nil {
+				return
+			}
+			received <- m.Body
+		}
+	})
+	if err := hostA.Connect(ctx, peer.AddrInfo{ID: hostB.ID(), Addrs: hostB.Addrs()}); err != nil {
+		t.Fatalf("Failed to connect host A to host B: %v", err)
+	}
+
+	mgr := newStreamManager(hostA, streamOpener{timeout: 5 * time.Second}, nil)
+	defer mgr.Close()
+	want := []string{"one", "two", "three"}
+	for _, msg := range want {
+		if err := mgr.Send(ctx, hostB.ID(), newChatMessage(hostA.ID(), "", msg)); err != nil {
+			t.Fatalf("Failed to send %q: %v", msg, err)
+		}
+	}
+
+	for _, w := range want {
+		select {
+		case got := <-received:
+			if got != w {
+				t.Errorf("Out of order: got %q, want %q", got, w)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout waiting for message")
+		}
+	}
+	if n := len(streams); n != 1 {
+		t.Errorf("Expected a single reused stream, got %d", n)
+	}
+}
+
+func TestStreamManagerPrefersChatProtocol(t *testing.T) {
+	ctx := context.Background()
+	hostA, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host A: %v", err)
+	}
+	defer hostA.Close()
+	hostB, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host B: %v", err)
+	}
+	defer hostB.Close()
+
+	protos := make(chan protocol.ID, 1)
+	for _, proto := range []protocol.ID{chatProtocol, legacyChatProtocol} {
+		hostB.SetStreamHandler(proto, func(s network.Stream) {
+			protos <- s.Protocol()
+			io.Copy(io.Discard, s)
+		})
+	}
+	if err := hostA.Connect(ctx, peer.AddrInfo{ID: hostB.ID(), Addrs: hostB.Addrs()}); err != nil {
+		t.Fatalf("Failed to connect host A to host B: %v", err)
+	}
+
+	mgr := newStreamManager(hostA, streamOpener{timeout: 5 * time.Second}, nil)
+	defer mgr.Close()
+	if err := mgr.Send(ctx, hostB.ID(), newChatMessage(hostA.ID(), "", "hi")); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	select {
+	case got := <-protos:
+		if got != chatProtocol {
+			t.Errorf("Expected %s to a peer that has it, got %s", chatProtocol, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for the stream")
+	}
+}
+
+func TestStreamManagerReopensDeadStream(t *testing.T) {
+	ctx := context.Background()
+	hostA, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host A: %v", err)
+	}
+	defer hostA.Close()
+	hostB, err := createTestHost(t)
+	if err != nil {
+		t.Fatalf("Failed to create host B: %v", err)
+	}
+	defer hostB.Close()
+
+	streams := make(chan struct{}, 4)
+	received := make(chan string, 4)
+	hostB.SetStreamHandler("/chat/1.0.0", func(s network.Stream) {
+		streams <- struct{}{}
+		r := bufio.NewReader(s)
+		for {
+			m, err := readMessage(r)
+			if err != nil {
+				return
+			}
+			received <- m.Body
+		}
+	})
+	if err := hostA.Connect(ctx, peer.AddrInfo{ID: hostB.ID(), Addrs: hostB.Addrs()}); err != nil {
+		t.Fatalf("Failed to connect host A to host B: %v", err)
+	}
+
+	mgr := newStreamManager(hostA, streamOpener{timeout: 5 * time.Second}, nil)
+	defer mgr.Close()
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case got := <-received:
+			if got != want {
+				t.Errorf("Got %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timeout waiting for %q", want)
+		}
+	}
+	if err := mgr.Send(ctx, hostB.ID(), newChatMessage(hostA.ID(), "", "one")); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	expect("one")
+
+	// The cached stream dies without its reader noticing
+	ms := mgr.entry(streamKey{id: hostB.ID()})
+	ms.mu.Lock()
+	ms.s.CloseWrite()
+	ms.mu.Unlock()
+
+	if err := mgr.Send(ctx, hostB.ID(), newChatMessage(hostA.ID(), "", "two")); err != nil {
+		t.Fatalf("Expected the send to go out on a new stream, got %v", err)
+	}
+	expect("two")
+	if n := len(streams); n != 2 {
+		t.Errorf("Expected the dead stream to be replaced once, got %d streams", n)
+	}
+}
+
+func TestStreamManagerSendTimeout(t *testing.T) {
+	alice, bob, cleanup := newTestPair(t)
+	defer cleanup()
+	alice.mgr.sendTimeout = 300 * time.Millisecond
+
+	// Bob answers the handshake and then never reads another byte
+	stop := make(chan struct{})
+	defer close(stop)
+	bob.host.SetStreamHandler(chatProtocol, func(s network.Stream) {
+		if bob.hs.acceptHandshake(s) {
+			<-stop
+		}
+	})
+
+	// Random bodies don't compress, so they fill the flow-control window
+	noise := make([]byte, maxMessageBytes/2)
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 500; i++ {
+			rand.Read(noise)
+			msg := newChatMessage(alice.host.ID(), "alice", base64.StdEncoding.EncodeToString(noise))
+			if err := alice.mgr.Send(context.Background(), bob.host.ID(), msg); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, errSendTimeout) {
+			t.Errorf("Expected errSendTimeout, got %v", err)
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("Send blocked on a peer that never reads")
+	}
+}
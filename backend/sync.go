@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"slices"
+	"time"
+
+	host "github.com/libp2p/go-libp2p/core/host"
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// syncProtocol mirrors chat between one person's devices: every message a
+// node sends or receives is copied, one per stream, to each connected peer
+// in Config.Devices. Each device needs its own identity, since libp2p never
+// connects a peer to its own ID.
+const syncProtocol = "/artivus/sync/1.0.0"
+
+// isDevice reports whether id is one of our other devices.
+func (n *Node) isDevice(id peer.ID) bool {
+	return slices.Contains(n.devices, id)
+}
+
+// mirror copies m to each of our connected devices. Copies that came from
+// a device aren't sent on, so nothing bounces between them, and m's ID is
+// marked seen so a device can't hand our own message back to us.
+func (n *Node) mirror(m ChatMessage) {
+	if len(n.devices) == 0 || m.ID == "" || m.Device != "" {
+		return
+	}
+	n.dedupe.Seen(m.ID)
+	for _, id := range n.devices {
+		if n.host.Network().Connectedness(id) != network.Connected {
+			continue
+		}
+		n.workers.Go(func() { sendMirror(n.ctx, n.host, id, m, n.mgr.sendTimeout) })
+	}
+}
+
+// sendMirror writes m on a fresh sync stream to id, which must already be
+// connected.
+func sendMirror(ctx context.Context, h host.Host, id peer.ID, m ChatMessage, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	s, err := h.NewStream(network.WithNoDial(ctx, "mirrors only go to connected devices"), id, syncProtocol)
+	if err != nil {
+		logger.Debug("failed to mirror message", "peer_id", id, "error", err)
+		return
+	}
+	defer s.Close()
+	s.SetWriteDeadline(time.Now().Add(timeout))
+	if err := writeMessage(s, m); err != nil {
+		logger.Debug("failed to mirror message", "peer_id", id, "error", err)
+	}
+}
+
+// newSyncHandler records the messages our other devices mirror to us.
+// Streams from anyone else are refused, and a message already seen, e.g.
+// one both devices received from the same peer, is dropped.
+func newSyncHandler(devices []peer.ID, history *messageLog, seen *messageDeduper) network.StreamHandler {
+	return func(s network.Stream) {
+		remote := s.Conn().RemotePeer()
+		if !slices.Contains(devices, remote) {
+			logger.Warn("refusing mirrored messages from a peer that isn't one of our devices", "peer_id", remote)
+			s.Reset()
+			return
+		}
+		defer s.Close()
+		s.SetReadDeadline(time.Now().Add(streamIdleTimeout))
+		m, err := readEnvelope(bufio.NewReader(s))
+		if err != nil {
+			logger.Warn("failed to read mirrored message", "peer_id", remote, "error", err)
+			return
+		}
+		if m.ID == "" || m.IsControl() || seen.Seen(m.ID) {
+			return
+		}
+		m.Device = remote
+		history.Add(m)
+		out.Mirrored(m, remote)
+	}
+}
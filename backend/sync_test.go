@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// newDeviceNodes starts two nodes, laptop and phone, each listing the
+// other as a device, and connects them.
+func newDeviceNodes(t *testing.T) (laptop, phone *Node) {
+	t.Helper()
+	paths := []string{filepath.Join(t.TempDir(), "identity.key"), filepath.Join(t.TempDir(), "identity.key")}
+	ids := make([]peer.ID, len(paths))
+	for i, path := range paths {
+		priv, err := createIdentity(path)
+		if err != nil {
+			t.Fatalf("Failed to create identity: %v", err)
+		}
+		if ids[i], err = peer.IDFromPrivateKey(priv); err != nil {
+			t.Fatalf("Failed to derive peer ID: %v", err)
+		}
+	}
+	nodes := make([]*Node, len(paths))
+	for i, path := range paths {
+		n, err := NewNode(context.Background(), Config{
+			IdentityPath:       path,
+			ListenAddrs:        loopbackListenAddrs,
+			Nick:               "alice",
+			NegotiationTimeout: 5 * time.Second,
+			Devices:            []peer.ID{ids[1-i]},
+		})
+		if err != nil {
+			t.Fatalf("Failed to create node: %v", err)
+		}
+		t.Cleanup(func() { n.Close() })
+		n.Start()
+		nodes[i] = n
+	}
+	if err := nodes[0].Connect(nodeAddr(nodes[1])); err != nil {
+		t.Fatalf("Failed to connect the devices: %v", err)
+	}
+	return nodes[0], nodes[1]
+}
+
+func TestDevicesMirrorMessages(t *testing.T) {
+	laptop, phone := newDeviceNodes(t)
+	bob := newTestNode(t, "bob")
+	if err := laptop.Connect(nodeAddr(bob)); err != nil {
+		t.Fatalf("Failed to connect laptop to bob: %v", err)
+	}
+	bob.registry.Add(peer.AddrInfo{ID: laptop.host.ID()})
+
+	// The phone isn't sent the chat itself, only the mirrored copy
+	if err := laptop.Send("hi bob"); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	waitFor(t, "the phone to mirror the sent message", func() bool {
+		got := phone.history.Recent(-1)
+		return len(got) == 1 && got[0].Body == "hi bob" && got[0].Direction == directionSent && got[0].Device == laptop.host.ID()
+	})
+	if err := bob.Send("hi alice"); err != nil {
+		t.Fatalf("Failed to reply: %v", err)
+	}
+	waitFor(t, "the phone to mirror the received message", func() bool {
+		got := phone.history.Recent(-1)
+		return len(got) == 2 && got[1].Body == "hi alice" && got[1].Direction == directionReceived && got[1].From == bob.host.ID()
+	})
+
+	// Both devices get this one from bob, and keep it once each
+	if err := bob.Connect(nodeAddr(phone)); err != nil {
+		t.Fatalf("Failed to connect bob to phone: %v", err)
+	}
+	if err := bob.Send("to both"); err != nil {
+		t.Fatalf("Failed to send to both: %v", err)
+	}
+	for _, n := range []*Node{laptop, phone} {
+		waitFor(t, "both devices to get the message", func() bool {
+			got := n.history.Recent(1)
+			return len(got) == 1 && got[0].Body == "to both"
+		})
+	}
+	time.Sleep(200 * time.Millisecond)
+	for name, n := range map[string]*Node{"laptop": laptop, "phone": phone} {
+		count := 0
+		for _, m := range n.history.Recent(-1) {
+			if m.Body == "to both" {
+				count++
+			}
+		}
+		if count != 1 {
+			t.Errorf("Expected the %s to keep the message once, got %d copies", name, count)
+		}
+	}
+	// Nothing the phone was mirrored bounced back to the laptop
+	if got := len(laptop.history.Recent(-1)); got != 3 {
+		t.Errorf("Expected 3 messages on the laptop, got %d", got)
+	}
+}
+
+func TestSyncRefusesStrangers(t *testing.T) {
+	_, phone := newDeviceNodes(t)
+	eve := newTestNode(t, "eve")
+	if err := eve.Connect(nodeAddr(phone)); err != nil {
+		t.Fatalf("Failed to connect eve to phone: %v", err)
+	}
+	sendMirror(context.Background(), eve.host, phone.host.ID(), newChatMessage(eve.host.ID(), "eve", "I'm your laptop"), 5*time.Second)
+	time.Sleep(200 * time.Millisecond)
+	if got := phone.history.Recent(-1); len(got) != 0 {
+		t.Errorf("Expected a stranger's mirror to be refused, got %+v", got)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// loopbackListenAddrs keeps test nodes off the machine's real interfaces.
+var loopbackListenAddrs = []string{"/ip4/127.0.0.1/tcp/0", "/ip4/127.0.0.1/udp/0/quic-v1"}
+
+// newTestNode starts a Node on loopback with a throwaway identity and no
+// discovery or history file.
+func newTestNode(t *testing.T, nick string) *Node {
+	t.Helper()
+	n, err := NewNode(context.Background(), Config{
+		IdentityPath:       filepath.Join(t.TempDir(), "identity.key"),
+		ListenAddrs:        loopbackListenAddrs,
+		Nick:               nick,
+		NegotiationTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	t.Cleanup(func() { n.Close() })
+	n.Start()
+	return n
+}
+
+// nodeAddr is the full multiaddr other nodes dial n on.
+func nodeAddr(n *Node) string {
+	return fmt.Sprintf("%s/p2p/%s", n.host.Addrs()[0], n.host.ID())
+}
+
+// newTestPair starts two loopback nodes, alice and bob, with alice
+// connected to bob and each registered with the other so either can send
+// first. cleanup closes both nodes and cancels their contexts; it also
+// runs when the test ends, so calling it is only needed to stop early.
+func newTestPair(t *testing.T) (a, b *Node, cleanup func()) {
+	t.Helper()
+	a = newTestNode(t, "alice")
+	b = newTestNode(t, "bob")
+	if err := a.Connect(nodeAddr(b)); err != nil {
+		t.Fatalf("Failed to connect alice to bob: %v", err)
+	}
+	b.registry.Add(peer.AddrInfo{ID: a.host.ID(), Addrs: a.host.Addrs()})
+	return a, b, func() {
+		a.Close()
+		b.Close()
+	}
+}
+
+// waitFor polls cond until it holds, failing the test after 10s.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/time/rate"
+)
+
+// peerThrottle paces outgoing bytes with one token bucket per peer, so a
+// large transfer to one peer never eats into another peer's budget.
+type peerThrottle struct {
+	mu       sync.Mutex
+	limit    rate.Limit
+	burst    int
+	limiters map[peer.ID]*rate.Limiter
+}
+
+// newPeerThrottle returns a throttle allowing bytesPerSec per peer.
+// A value <= 0 disables throttling.
+func newPeerThrottle(bytesPerSec int) *peerThrottle {
+	return &peerThrottle{
+		limit:    rate.Limit(bytesPerSec),
+		burst:    bytesPerSec,
+		limiters: make(map[peer.ID]*rate.Limiter),
+	}
+}
+
+func (t *peerThrottle) enabled() bool {
+	return t != nil && t.burst > 0
+}
+
+func (t *peerThrottle) limiter(id peer.ID) *rate.Limiter {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l, ok := t.limiters[id]
+	if !ok {
+		// The bucket holds one second worth of bytes, so ordinary chat
+		// lines go out immediately and only bulk writes get paced.
+		l = rate.NewLimiter(t.limit, t.burst)
+		t.limiters[id] = l
+	}
+	return l
+}
+
+// Writer wraps w so that writes to id are paced by that peer's bucket.
+func (t *peerThrottle) Writer(ctx context.Context, id peer.ID, w io.Writer) io.Writer {
+	if !t.enabled() {
+		return w
+	}
+	return &throttledWriter{ctx: ctx, w: w, l: t.limiter(id)}
+}
+
+type throttledWriter struct {
+	ctx context.Context
+	w   io.Writer
+	l   *rate.Limiter
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > tw.l.Burst() {
+			chunk = chunk[:tw.l.Burst()]
+		}
+		if err := tw.l.WaitN(tw.ctx, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := tw.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// peerTraffic is one row of /traffic. Rates are bytes per second.
+type peerTraffic struct {
+	ID       peer.ID `json:"id"`
+	Sent     int64   `json:"sent"`
+	Received int64   `json:"received"`
+	RateOut  float64 `json:"rateOut"`
+	RateIn   float64 `json:"rateIn"`
+}
+
+// formatTraffic renders rows for /traffic, under the per-peer send limit
+// (bytes per second, 0 for none).
+func formatTraffic(rows []peerTraffic, limit int) string {
+	var b strings.Builder
+	if limit > 0 {
+		fmt.Fprintf(&b, "📶 Traffic per peer, sends paced to %s/s each", formatBytes(int64(limit)))
+	} else {
+		b.WriteString("📶 Traffic per peer, sends unpaced (-peer-rate)")
+	}
+	if len(rows) == 0 {
+		b.WriteString("\n   No traffic yet")
+		return b.String()
+	}
+	b.WriteString("\n")
+	tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PEER\tSENT\tRECEIVED\tOUT\tIN")
+	for _, r := range rows {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s/s\t%s/s\n", shortID(r.ID), formatBytes(r.Sent), formatBytes(r.Received), formatBytes(int64(r.RateOut)), formatBytes(int64(r.RateIn)))
+	}
+	tw.Flush()
+	return strings.TrimRight(b.String(), "\n")
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestPeerThrottlePacesLargeSendOnly(t *testing.T) {
+	ctx := context.Background()
+	throttle := newPeerThrottle(50_000)
+
+	// 100KB at 50KB/s: the first 50KB drains the bucket, the rest waits ~1s
+	var bulk bytes.Buffer
+	bulkDone := make(chan time.Duration, 1)
+	go func() {
+		start := time.Now()
+		if _, err := throttle.Writer(ctx, peer.ID("alice"), &bulk).Write(make([]byte, 100_000)); err != nil {
+			t.Errorf("Bulk write failed: %v", err)
+		}
+		bulkDone <- time.Since(start)
+	}()
+
+	// A short chat line to another peer must not wait behind the bulk send
+	time.Sleep(50 * time.Millisecond)
+	var chat bytes.Buffer
+	start := time.Now()
+	if _, err := throttle.Writer(ctx, peer.ID("bob"), &chat).Write([]byte("hi bob\n")); err != nil {
+		t.Fatalf("Chat write failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Send to second peer was blocked for %v", elapsed)
+	}
+
+	elapsed := <-bulkDone
+	if elapsed < 800*time.Millisecond {
+		t.Errorf("Expected bulk send to be paced, finished in %v", elapsed)
+	}
+	if bulk.Len() != 100_000 {
+		t.Errorf("Expected 100000 bytes written, got %d", bulk.Len())
+	}
+}
+
+func TestPeerThrottleDisabled(t *testing.T) {
+	var buf bytes.Buffer
+	w := newPeerThrottle(0).Writer(context.Background(), peer.ID("alice"), &buf)
+	if w != &buf {
+		t.Error("Expected unthrottled writer when rate is 0")
+	}
+}
+
+func TestFormatTraffic(t *testing.T) {
+	bob := newTestPeerID(t)
+	text := formatTraffic([]peerTraffic{{ID: bob, Sent: 2048, Received: 512, RateOut: 1024}}, 65536)
+	for _, want := range []string{"paced to 64.0KB/s each", "PEER", shortID(bob), "2.0KB", "512B", "1.0KB/s"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("Expected %q in:\n%s", want, text)
+		}
+	}
+	if text := formatTraffic(nil, 0); !strings.Contains(text, "unpaced") || !strings.Contains(text, "No traffic yet") {
+		t.Errorf("Unexpected output without traffic or a limit:\n%s", text)
+	}
+}
+
+func TestNodeTrafficCountsPeers(t *testing.T) {
+	alice, bob, _ := newTestPair(t)
+	if err := alice.Send("hello"); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	waitFor(t, "traffic to bob", func() bool {
+		for _, r := range alice.Traffic() {
+			if r.ID == bob.host.ID() && r.Sent > 0 {
+				return true
+			}
+		}
+		return false
+	})
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	libp2p "github.com/libp2p/go-libp2p"
+	quic "github.com/libp2p/go-libp2p/p2p/transport/quic"
+	tcp "github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+var errConflictingTransports = errors.New("-quic and -tcp-only can't be combined")
+
+// Listen addresses implied by the transport flags when -listen is empty.
+var (
+	tcpListenAddrs  = []string{"/ip4/0.0.0.0/tcp/0", "/ip6/::/tcp/0"}
+	quicListenAddrs = []string{"/ip4/0.0.0.0/udp/0/quic-v1", "/ip6/::/udp/0/quic-v1"}
+)
+
+// buildTransportOptions turns cfg.QUIC and cfg.TCPOnly into transport
+// options, plus the listen addresses to use if cfg.ListenAddrs is empty.
+// Neither flag returns nothing, leaving libp2p's default transports and
+// addresses.
+func buildTransportOptions(cfg Config) ([]libp2p.Option, []string, error) {
+	switch {
+	case cfg.QUIC && cfg.TCPOnly:
+		return nil, nil, errConflictingTransports
+	case cfg.TCPOnly:
+		for _, addr := range cfg.ListenAddrs {
+			if maddr, err := ma.NewMultiaddr(addr); err == nil && !isTCPAddr(maddr) {
+				return nil, nil, fmt.Errorf("listen address %q isn't TCP, which -tcp-only requires", addr)
+			}
+		}
+		return []libp2p.Option{libp2p.Transport(tcp.NewTCPTransport)}, tcpListenAddrs, nil
+	case cfg.QUIC:
+		opts := []libp2p.Option{
+			libp2p.Transport(tcp.NewTCPTransport),
+			libp2p.Transport(quic.NewTransport),
+		}
+		return opts, append(append([]string{}, tcpListenAddrs...), quicListenAddrs...), nil
+	default:
+		return nil, nil, nil
+	}
+}
+
+// withQUICListen adds a QUIC address on the same host and port for each
+// plain TCP one in addrs, so -quic with a fixed -listen port is reachable
+// over both. addrs that already name a QUIC address are left alone.
+func withQUICListen(addrs []string) []string {
+	var extra []string
+	for _, addr := range addrs {
+		maddr, err := ma.NewMultiaddr(addr)
+		if err != nil || isQUICAddr(maddr) {
+			return addrs
+		}
+		parts := ma.Split(maddr)
+		if len(parts) != 2 || !isTCPAddr(maddr) {
+			continue
+		}
+		port, _ := maddr.ValueForProtocol(ma.P_TCP)
+		extra = append(extra, parts[0].String()+"/udp/"+port+"/quic-v1")
+	}
+	return append(slices.Clone(addrs), extra...)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	libp2p "github.com/libp2p/go-libp2p"
+)
+
+func TestBuildTransportOptions(t *testing.T) {
+	tests := []struct {
+		name       string
+		cfg        Config
+		transports int
+		addrs      []string
+	}{
+		{"defaults", Config{}, 0, nil},
+		{"quic", Config{QUIC: true}, 2, append(slices.Clone(tcpListenAddrs), quicListenAddrs...)},
+		{"tcp only", Config{TCPOnly: true}, 1, tcpListenAddrs},
+		{"tcp only with tcp listen", Config{TCPOnly: true, ListenAddrs: []string{"/ip4/127.0.0.1/tcp/4001"}}, 1, tcpListenAddrs},
+	}
+	for _, tt := range tests {
+		opts, addrs, err := buildTransportOptions(tt.cfg)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		}
+		var cfg libp2p.Config
+		if err := cfg.Apply(opts...); err != nil {
+			t.Errorf("%s: failed to apply options: %v", tt.name, err)
+			continue
+		}
+		if len(cfg.Transports) != tt.transports {
+			t.Errorf("%s: expected %d transports, got %d", tt.name, tt.transports, len(cfg.Transports))
+		}
+		if !slices.Equal(addrs, tt.addrs) {
+			t.Errorf("%s: expected listen addresses %v, got %v", tt.name, tt.addrs, addrs)
+		}
+	}
+}
+
+func TestBuildTransportOptionsConflicts(t *testing.T) {
+	if _, _, err := buildTransportOptions(Config{QUIC: true, TCPOnly: true}); !errors.Is(err, errConflictingTransports) {
+		t.Errorf("Expected -quic with -tcp-only to be rejected, got %v", err)
+	}
+	if _, _, err := buildTransportOptions(Config{TCPOnly: true, ListenAddrs: []string{"/ip4/0.0.0.0/udp/4001/quic-v1"}}); err == nil {
+		t.Error("Expected a QUIC listen address with -tcp-only to be rejected")
+	}
+}
+
+func TestWithQUICListen(t *testing.T) {
+	tests := []struct {
+		addrs, want []string
+	}{
+		{[]string{"/ip4/0.0.0.0/tcp/4001"}, []string{"/ip4/0.0.0.0/tcp/4001", "/ip4/0.0.0.0/udp/4001/quic-v1"}},
+		{[]string{"/ip4/0.0.0.0/tcp/4001/ws"}, []string{"/ip4/0.0.0.0/tcp/4001/ws"}},
+		{[]string{"/ip4/0.0.0.0/tcp/4001", "/ip4/0.0.0.0/udp/4002/quic-v1"}, []string{"/ip4/0.0.0.0/tcp/4001", "/ip4/0.0.0.0/udp/4002/quic-v1"}},
+	}
+	for _, tt := range tests {
+		if got := withQUICListen(tt.addrs); !slices.Equal(got, tt.want) {
+			t.Errorf("withQUICListen(%v) = %v, want %v", tt.addrs, got, tt.want)
+		}
+	}
+}
+
+func TestQUICNodeSharesBothTransports(t *testing.T) {
+	buf := useJSONOutput(t)
+	n, err := NewNode(context.Background(), Config{
+		IdentityPath: filepath.Join(t.TempDir(), "identity.key"),
+		ListenAddrs:  []string{"/ip4/127.0.0.1/tcp/0"},
+		QUIC:         true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer n.Close()
+	old := showLocalAddrs
+	showLocalAddrs = true
+	defer func() { showLocalAddrs = old }()
+	printShareAddrs(n.host)
+	var tcp, quic bool
+	for _, ev := range events(t, buf) {
+		text, _ := ev["text"].(string)
+		tcp = tcp || strings.HasPrefix(text, "➡️ Share this multiaddr (TCP): /ip4/127.0.0.1/tcp/")
+		quic = quic || strings.HasPrefix(text, "➡️ Share this multiaddr (QUIC): /ip4/127.0.0.1/udp/")
+	}
+	if !tcp || !quic {
+		t.Errorf("Expected TCP and QUIC addresses to share, got %s", buf.String())
+	}
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// tuiScrollback is how many lines the message pane keeps.
+const tuiScrollback = 1000
+
+// tuiRefresh is how often the peer list is reread and the screen redrawn,
+// which also picks up a resized terminal.
+const tuiRefresh = time.Second
+
+// tuiScreen is the full-screen interface behind -tui: output scrolls in a
+// pane on the left, peers are listed on the right and input is edited on
+// the bottom line, so incoming messages never land in the middle of what's
+// being typed. Everything is redrawn on each change; the screen is small.
+type tuiScreen struct {
+	in   *bufio.Reader
+	out  io.Writer
+	size func() (width, height int, err error)
+	// every is how often refresh rereads the peer list.
+	every time.Duration
+
+	// keystroke and complete are the console's OnKeystroke and OnTab
+	// callbacks.
+	keystroke func(line string, key rune)
+	complete  func(line string) []string
+
+	mu       sync.Mutex
+	closed   bool
+	stop     chan struct{}
+	peers    func() []peerStatus
+	peerList []peerStatus
+	// lines is the message pane, oldest first; partial is output written
+	// since the last newline.
+	lines   []string
+	partial string
+	// scroll is how many rows the pane is scrolled back from the bottom.
+	scroll  int
+	prompt  string
+	input   []rune
+	cursor  int
+	history []string
+	// browsing indexes history while up/down walk through it, and is
+	// len(history) when editing a new line.
+	browsing int
+}
+
+// newTUIScreen takes over out and redraws the peer list every refresh.
+func newTUIScreen(in io.Reader, out io.Writer, size func() (int, int, error), refresh time.Duration) *tuiScreen {
+	t := &tuiScreen{in: bufio.NewReader(in), out: out, size: size, every: refresh, stop: make(chan struct{})}
+	fmt.Fprint(out, "\x1b[?1049h\x1b[2J")
+	t.render()
+	go t.refresh()
+	return t
+}
+
+// ShowPeers lists what peers returns in the sidebar, reread on every
+// refresh.
+func (t *tuiScreen) ShowPeers(peers func() []peerStatus) {
+	t.mu.Lock()
+	t.peers = peers
+	t.mu.Unlock()
+	t.reloadPeers()
+}
+
+func (t *tuiScreen) refresh() {
+	tick := time.NewTicker(t.every)
+	defer tick.Stop()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-tick.C:
+			t.reloadPeers()
+		}
+	}
+}
+
+// reloadPeers rereads the peer list and redraws. peers runs without mu
+// held, since anything it logs comes back through Write.
+func (t *tuiScreen) reloadPeers() {
+	t.mu.Lock()
+	peers := t.peers
+	t.mu.Unlock()
+	var list []peerStatus
+	if peers != nil {
+		list = peers()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.peerList = list
+	t.render()
+}
+
+// Write adds p to the message pane. Control characters and escape
+// sequences are dropped, so a peer's message can't drive the terminal.
+func (t *tuiScreen) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return t.out.Write(p)
+	}
+	text := t.partial + string(p)
+	lines := strings.Split(text, "\n")
+	t.partial = lines[len(lines)-1]
+	width, _ := t.dims()
+	width -= sidebarWidth(width)
+	for _, line := range lines[:len(lines)-1] {
+		line = stripControl(line)
+		t.lines = append(t.lines, line)
+		// Keep the view still while scrolled back
+		if t.scroll > 0 {
+			t.scroll += len(wrapText(line, width))
+		}
+	}
+	if extra := len(t.lines) - tuiScrollback; extra > 0 {
+		t.lines = append([]string(nil), t.lines[extra:]...)
+	}
+	t.render()
+	return len(p), nil
+}
+
+// ReadLine edits a line on the input row behind prompt until Enter, and
+// returns io.EOF on Ctrl-D or Ctrl-C with nothing typed.
+func (t *tuiScreen) ReadLine(prompt string) (string, error) {
+	t.mu.Lock()
+	t.prompt, t.input, t.cursor, t.browsing = prompt, nil, 0, len(t.history)
+	t.render()
+	t.mu.Unlock()
+	for {
+		key, err := t.readKey()
+		if err != nil {
+			return "", err
+		}
+		t.mu.Lock()
+		before := string(t.input)
+		t.mu.Unlock()
+		line, done, err := t.handleKey(key)
+		if done || err != nil {
+			return line, err
+		}
+		// Like the line editor, report the line as it was before the key
+		if t.keystroke != nil && key < unicode.MaxRune && unicode.IsPrint(key) {
+			t.keystroke(before, key)
+		}
+	}
+}
+
+// Keys that arrive as escape sequences.
+const (
+	keyUp rune = unicode.MaxRune + 1 + iota
+	keyDown
+	keyLeft
+	keyRight
+	keyHome
+	keyEnd
+	keyPageUp
+	keyPageDown
+	keyUnknown
+)
+
+// readKey reads one key press, decoding the escape sequences terminals
+// send for arrows, Home/End and Page Up/Down.
+func (t *tuiScreen) readKey() (rune, error) {
+	r, _, err := t.in.ReadRune()
+	if err != nil || r != '\x1b' {
+		return r, err
+	}
+	if b, err := t.in.ReadByte(); err != nil || (b != '[' && b != 'O') {
+		return keyUnknown, err
+	}
+	var seq []byte
+	for {
+		b, err := t.in.ReadByte()
+		if err != nil {
+			return keyUnknown, err
+		}
+		seq = append(seq, b)
+		if b >= 0x40 && b <= 0x7e {
+			break
+		}
+	}
+	switch string(seq) {
+	case "A":
+		return keyUp, nil
+	case "B":
+		return keyDown, nil
+	case "C":
+		return keyRight, nil
+	case "D":
+		return keyLeft, nil
+	case "H", "1~", "7~":
+		return keyHome, nil
+	case "F", "4~", "8~":
+		return keyEnd, nil
+	case "5~":
+		return keyPageUp, nil
+	case "6~":
+		return keyPageDown, nil
+	}
+	return keyUnknown, nil
+}
+
+// handleKey applies key to the input line and returns the line, with done
+// set once Enter is pressed.
+func (t *tuiScreen) handleKey(key rune) (line string, done bool, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer t.render()
+
+	_, height := t.dims()
+	page := max(height-3, 1)
+	switch key {
+	case '\r', '\n':
+		line := string(t.input)
+		if strings.TrimSpace(line) != "" {
+			t.history = append(t.history, line)
+		}
+		t.input, t.cursor, t.scroll = nil, 0, 0
+		return line, true, nil
+	case 3, 4: // Ctrl-C, Ctrl-D
+		if len(t.input) == 0 {
+			return "", true, io.EOF
+		}
+	case 127, 8: // Backspace
+		if t.cursor > 0 {
+			t.input = append(t.input[:t.cursor-1], t.input[t.cursor:]...)
+			t.cursor--
+		}
+	case 21: // Ctrl-U
+		t.input, t.cursor = append([]rune(nil), t.input[t.cursor:]...), 0
+	case 1, keyHome: // Ctrl-A
+		t.cursor = 0
+	case 5, keyEnd: // Ctrl-E
+		t.cursor = len(t.input)
+	case keyLeft:
+		t.cursor = max(t.cursor-1, 0)
+	case keyRight:
+		t.cursor = min(t.cursor+1, len(t.input))
+	case keyUp, keyDown:
+		if key == keyUp && t.browsing > 0 {
+			t.browsing--
+		} else if key == keyDown && t.browsing < len(t.history) {
+			t.browsing++
+		}
+		t.input = nil
+		if t.browsing < len(t.history) {
+			t.input = []rune(t.history[t.browsing])
+		}
+		t.cursor = len(t.input)
+	case keyPageUp:
+		t.scroll += page
+	case keyPageDown:
+		t.scroll = max(t.scroll-page, 0)
+	case '\t':
+		if t.complete != nil {
+			line := string(t.input)
+			pos := len(string(t.input[:t.cursor]))
+			newLine, newPos, candidates := completeLine(line, pos, t.complete(line[:pos]))
+			if len(candidates) > 1 && newPos == pos {
+				t.lines = append(t.lines, strings.Join(candidates, "  "))
+			}
+			t.input, t.cursor = []rune(newLine), len([]rune(newLine[:newPos]))
+		}
+	default:
+		if key < unicode.MaxRune && unicode.IsPrint(key) {
+			t.input = append(t.input[:t.cursor], append([]rune{key}, t.input[t.cursor:]...)...)
+			t.cursor++
+		}
+	}
+	return string(t.input), false, nil
+}
+
+// dims returns the terminal size, or 80x24 if it can't be read.
+func (t *tuiScreen) dims() (width, height int) {
+	width, height, err := t.size()
+	if err != nil || width <= 0 || height <= 0 {
+		return 80, 24
+	}
+	return width, height
+}
+
+// sidebarWidth is how many columns the peer list and its border take, none
+// on a narrow screen.
+func sidebarWidth(width int) int {
+	if width < 60 {
+		return 0
+	}
+	return min(width/3, 30)
+}
+
+// render redraws the whole screen. Callers hold mu.
+func (t *tuiScreen) render() {
+	if t.closed {
+		return
+	}
+	width, height := t.dims()
+	paneWidth := width - sidebarWidth(width)
+	rows := max(height-2, 0)
+
+	var wrapped []string
+	for _, line := range t.lines {
+		wrapped = append(wrapped, wrapText(line, paneWidth)...)
+	}
+	t.scroll = min(t.scroll, max(len(wrapped)-rows, 0))
+	end := len(wrapped) - t.scroll
+	visible := wrapped[max(end-rows, 0):end]
+
+	var b strings.Builder
+	b.WriteString("\x1b[?25l")
+	for row := range rows {
+		fmt.Fprintf(&b, "\x1b[%d;1H\x1b[K", row+1)
+		// Short panes fill from the bottom, like a terminal
+		if i := row - (rows - len(visible)); i >= 0 {
+			b.WriteString(visible[i])
+		}
+		if paneWidth < width {
+			fmt.Fprintf(&b, "\x1b[%d;%dH\x1b[K│ %s", row+1, paneWidth+1, fitText(t.sidebarRow(row), width-paneWidth-2))
+		}
+	}
+
+	status := ""
+	if t.scroll > 0 {
+		status = fmt.Sprintf(" ↑ %d more below (PgDn) ", t.scroll)
+	}
+	fmt.Fprintf(&b, "\x1b[%d;1H\x1b[K%s", height-1, status+strings.Repeat("─", max(width-textWidth(status), 0)))
+
+	// Scroll the input sideways so the cursor stays on screen
+	room := max(width-textWidth(t.prompt)-1, 1)
+	start := 0
+	for textWidth(string(t.input[start:t.cursor])) >= room {
+		start++
+	}
+	shown := fitText(string(t.input[start:]), room)
+	fmt.Fprintf(&b, "\x1b[%d;1H\x1b[K%s%s", height, t.prompt, shown)
+	fmt.Fprintf(&b, "\x1b[%d;%dH\x1b[?25h", height, textWidth(t.prompt)+textWidth(string(t.input[start:t.cursor]))+1)
+	io.WriteString(t.out, b.String())
+}
+
+// sidebarRow is the text of the peer list on the given screen row.
+func (t *tuiScreen) sidebarRow(row int) string {
+	if row == 0 {
+		connected := 0
+		for _, st := range t.peerList {
+			if st.State == "connected" {
+				connected++
+			}
+		}
+		return fmt.Sprintf("Peers %d/%d", connected, len(t.peerList))
+	}
+	if row > len(t.peerList) {
+		return ""
+	}
+	st := t.peerList[row-1]
+	mark := "○"
+	switch st.State {
+	case "connected":
+		mark = "●"
+	case "limited":
+		mark = "◐"
+	}
+	line := fmt.Sprintf("%s %d %s", mark, row, peerName(st.ID))
+	if st.Nick != "" {
+		line += " (" + st.Nick + ")"
+	}
+	return line
+}
+
+// wrapText breaks s into rows of at most width terminal columns.
+func wrapText(s string, width int) []string {
+	if width <= 0 || textWidth(s) <= width {
+		return []string{s}
+	}
+	var rows []string
+	var row strings.Builder
+	cols := 0
+	for _, r := range s {
+		w := runeWidth(r)
+		if cols+w > width && cols > 0 {
+			rows = append(rows, row.String())
+			row.Reset()
+			cols = 0
+		}
+		row.WriteRune(r)
+		cols += w
+	}
+	return append(rows, row.String())
+}
+
+// fitText cuts s to at most width terminal columns.
+func fitText(s string, width int) string {
+	cols := 0
+	for i, r := range s {
+		if cols += runeWidth(r); cols > width {
+			return s[:i]
+		}
+	}
+	return s
+}
+
+// textWidth is how many terminal columns s takes.
+func textWidth(s string) int {
+	n := 0
+	for _, r := range s {
+		n += runeWidth(r)
+	}
+	return n
+}
+
+// wideRanges are the East Asian wide and fullwidth blocks, including the
+// emoji this app prints, that terminals draw two columns wide.
+var wideRanges = []struct{ lo, hi rune }{
+	{0x1100, 0x115f}, {0x231a, 0x231b}, {0x2329, 0x232a}, {0x23e9, 0x23ec},
+	{0x23f0, 0x23f0}, {0x23f3, 0x23f3}, {0x25fd, 0x25fe}, {0x2614, 0x2615},
+	{0x2648, 0x2653}, {0x267f, 0x267f}, {0x2693, 0x2693}, {0x26a1, 0x26a1},
+	{0x26aa, 0x26ab}, {0x26bd, 0x26be}, {0x26c4, 0x26c5}, {0x26ce, 0x26ce},
+	{0x26d4, 0x26d4}, {0x26ea, 0x26ea}, {0x26f2, 0x26f3}, {0x26f5, 0x26f5},
+	{0x26fa, 0x26fa}, {0x26fd, 0x26fd}, {0x2705, 0x2705}, {0x270a, 0x270b},
+	{0x2728, 0x2728}, {0x274c, 0x274c}, {0x274e, 0x274e}, {0x2753, 0x2755},
+	{0x2757, 0x2757}, {0x2795, 0x2797}, {0x27b0, 0x27b0}, {0x27bf, 0x27bf},
+	{0x2b1b, 0x2b1c}, {0x2b50, 0x2b50}, {0x2b55, 0x2b55}, {0x2e80, 0x303e},
+	{0x3041, 0x33ff}, {0x3400, 0x4dbf}, {0x4e00, 0x9fff}, {0xa000, 0xa4cf},
+	{0xac00, 0xd7a3}, {0xf900, 0xfaff}, {0xfe30, 0xfe4f}, {0xff00, 0xff60},
+	{0xffe0, 0xffe6}, {0x1f004, 0x1f004}, {0x1f0cf, 0x1f0cf}, {0x1f18e, 0x1f18e},
+	{0x1f191, 0x1f19a}, {0x1f200, 0x1f251}, {0x1f300, 0x1f64f}, {0x1f680, 0x1f6ff},
+	{0x1f7e0, 0x1f7eb}, {0x1f900, 0x1f9ff}, {0x1fa70, 0x1faff}, {0x20000, 0x3fffd},
+}
+
+// runeWidth is how many terminal columns r takes: none for combining marks
+// and format characters such as variation selectors, two for wide ones.
+func runeWidth(r rune) int {
+	if unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf) || unicode.IsControl(r) {
+		return 0
+	}
+	for _, wr := range wideRanges {
+		if r < wr.lo {
+			break
+		}
+		if r <= wr.hi {
+			return 2
+		}
+	}
+	return 1
+}
+
+// stripControl drops escape sequences and other control characters from
+// s, turning tabs into spaces.
+func stripControl(s string) string {
+	var b strings.Builder
+	rs := []rune(s)
+	for i := 0; i < len(rs); i++ {
+		switch r := rs[i]; {
+		case r == '\t':
+			b.WriteByte(' ')
+		case r == '\x1b' && i+1 < len(rs) && rs[i+1] == '[':
+			// Skip a CSI sequence through its final byte
+			for i += 2; i < len(rs) && (rs[i] < 0x40 || rs[i] > 0x7e); i++ {
+			}
+		case r == '\x1b' && i+1 < len(rs) && rs[i+1] == ']':
+			// Skip an OSC sequence through BEL or ESC \
+			for i += 2; i < len(rs) && rs[i] != '\a' && !(rs[i] == '\\' && rs[i-1] == '\x1b'); i++ {
+			}
+		case r == '\x1b':
+			i++
+		case unicode.IsControl(r):
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// Close stops redrawing and leaves the full-screen mode.
+func (t *tuiScreen) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+	t.closed = true
+	close(t.stop)
+	fmt.Fprint(t.out, "\x1b[?1049l")
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestScreen returns an 80x10 tuiScreen reading keys from in.
+// Its refresh is held off so tests can look at its fields.
+func newTestScreen(t *testing.T, in string) (*tuiScreen, *syncBuffer) {
+	var out syncBuffer
+	s := newTUIScreen(strings.NewReader(in), &out, func() (int, int, error) { return 80, 10, nil }, time.Hour)
+	t.Cleanup(s.Close)
+	return s, &out
+}
+
+func TestTUIReadLineEditing(t *testing.T) {
+	// Type "helo", go left, fix the typo, then finish the line
+	s, _ := newTestScreen(t, "helo\x1b[Dl\x1b[F!\rsecond\x15third\r")
+	var keys []string
+	s.keystroke = func(line string, key rune) { keys = append(keys, line+string(key)) }
+
+	line, err := s.ReadLine("> ")
+	if err != nil || line != "hello!" {
+		t.Errorf("Expected hello!, got %q (%v)", line, err)
+	}
+	if got := keys[len(keys)-1]; got != "hello!" {
+		t.Errorf("Expected the keystroke callback to see hello!, got %q", got)
+	}
+	if line, _ := s.ReadLine("> "); line != "third" {
+		t.Errorf("Expected Ctrl-U to clear the line, got %q", line)
+	}
+	if _, err := s.ReadLine("> "); err != io.EOF {
+		t.Errorf("Expected io.EOF at the end of input, got %v", err)
+	}
+}
+
+func TestTUIHistory(t *testing.T) {
+	s, _ := newTestScreen(t, "one\rtwo\r\x1b[A\x1b[A\r")
+	s.ReadLine("> ")
+	s.ReadLine("> ")
+	if line, _ := s.ReadLine("> "); line != "one" {
+		t.Errorf("Expected up twice to recall one, got %q", line)
+	}
+}
+
+func TestTUIMessagePaneScrolls(t *testing.T) {
+	s, out := newTestScreen(t, "")
+	for i := range 30 {
+		fmt.Fprintf(s, "line %d\n", i)
+	}
+	if screen := out.String(); !strings.Contains(screen, "line 29") {
+		t.Error("Expected the newest line on screen")
+	}
+
+	s.handleKey(keyPageUp)
+	if s.scroll != 7 {
+		t.Errorf("Expected Page Up to scroll back a page of 7 rows, got %d", s.scroll)
+	}
+	if !strings.Contains(out.String(), "more below") {
+		t.Error("Expected the status line to say the pane is scrolled back")
+	}
+	// New output doesn't move the view while scrolled back
+	fmt.Fprintln(s, "line 30")
+	if s.scroll != 8 {
+		t.Errorf("Expected the scroll to follow new output, got %d", s.scroll)
+	}
+
+	// Enter jumps back to the newest output
+	s.handleKey('\r')
+	if s.scroll != 0 {
+		t.Errorf("Expected Enter to scroll to the bottom, got %d", s.scroll)
+	}
+}
+
+func TestTUIListsPeers(t *testing.T) {
+	s, out := newTestScreen(t, "")
+	bob, carol := newTestPeerID(t), newTestPeerID(t)
+	s.ShowPeers(func() []peerStatus {
+		return []peerStatus{{ID: bob, Nick: "bob", State: "connected"}, {ID: carol, State: "disconnected"}}
+	})
+	screen := out.String()
+	for _, want := range []string{"Peers 1/2", "● 1 " + shortID(bob) + " (bob)", "○ 2 " + shortID(carol)} {
+		if !strings.Contains(screen, want) {
+			t.Errorf("Expected %q in the sidebar", want)
+		}
+	}
+}
+
+func TestTUIWritesPassThroughAfterClose(t *testing.T) {
+	s, out := newTestScreen(t, "")
+	s.Close()
+	fmt.Fprint(s, "👋 Exiting...\n")
+	if !strings.HasSuffix(out.String(), "\x1b[?1049l👋 Exiting...\n") {
+		t.Errorf("Expected output after Close to go straight through, got %q", out.String())
+	}
+}
+
+func TestWrapText(t *testing.T) {
+	if got := wrapText("abcdefg", 3); strings.Join(got, "|") != "abc|def|g" {
+		t.Errorf("wrapText = %q", got)
+	}
+	// Emoji and CJK take two columns each
+	if got := wrapText("👋ab你", 3); strings.Join(got, "|") != "👋a|b你" {
+		t.Errorf("Expected wrapping by display width, got %q", got)
+	}
+	if got := fitText("⌛ok", 3); got != "⌛o" {
+		t.Errorf("Expected fitText to count ⌛ as two columns, got %q", got)
+	}
+	if got := textWidth("⚠️ ✓"); got != 3 {
+		t.Errorf("Expected the variation selector to take no columns, got %d", got)
+	}
+	if got := wrapText("", 3); len(got) != 1 || got[0] != "" {
+		t.Errorf("Expected an empty line to stay one row, got %q", got)
+	}
+}
+
+func TestTUIStripsEscapeSequences(t *testing.T) {
+	s, _ := newTestScreen(t, "")
+	fmt.Fprint(s, "bob: \x1b[2J\x1b]0;pwned\x07hi\x1bc\tthere\u009b\x1b]8;;x\x1b\\!\n")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if got := s.lines[len(s.lines)-1]; got != "bob: hi there!" {
+		t.Errorf("Expected control characters stripped, got %q", got)
+	}
+}
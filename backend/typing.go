@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	host "github.com/libp2p/go-libp2p/core/host"
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	typingProtocol = "/artivus/typing/1.0.0"
+	maxTypingBytes = 256
+)
+
+var (
+	// typingInterval is the least time between two "typing" signals while
+	// the user keeps typing.
+	typingInterval = 2 * time.Second
+	// typingIdle is how long after the last keystroke we send "stopped".
+	typingIdle = 3 * time.Second
+	// typingExpiry is how long a receiver trusts a "typing" signal, in
+	// case the "stopped" one is lost.
+	typingExpiry = 5 * time.Second
+)
+
+// typingSignal is the single JSON value written on a typing stream.
+type typingSignal struct {
+	Typing bool   `json:"typing"`
+	Nick   string `json:"nick,omitempty"`
+}
+
+// typingNotifier turns keystrokes into debounced typing signals: "typing"
+// on the first key and at most once per interval after that, and "stopped"
+// once no key has come for idle or the line is submitted.
+type typingNotifier struct {
+	interval time.Duration
+	idle     time.Duration
+	send     func(active bool)
+	now      func() time.Time
+
+	mu       sync.Mutex
+	active   bool
+	lastSent time.Time
+	stop     *time.Timer
+}
+
+func newTypingNotifier(interval, idle time.Duration, send func(active bool)) *typingNotifier {
+	return &typingNotifier{interval: interval, idle: idle, send: send, now: time.Now}
+}
+
+// Keystroke records a key press. It is a no-op on a nil notifier.
+func (t *typingNotifier) Keystroke() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if now := t.now(); !t.active || now.Sub(t.lastSent) >= t.interval {
+		t.active, t.lastSent = true, now
+		t.send(true)
+	}
+	if t.stop == nil {
+		t.stop = time.AfterFunc(t.idle, t.Done)
+	} else {
+		t.stop.Reset(t.idle)
+	}
+}
+
+// Done sends "stopped" if a "typing" signal is outstanding. It is a no-op
+// on a nil notifier.
+func (t *typingNotifier) Done() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stop != nil {
+		t.stop.Stop()
+	}
+	if !t.active {
+		return
+	}
+	t.active = false
+	t.send(false)
+}
+
+// sendTypingFrame sends m, a typing control frame, on id's chat stream.
+// It never dials, and gives up after typingInterval.
+func sendTypingFrame(ctx context.Context, mgr *streamManager, id peer.ID, m ChatMessage) {
+	ctx, cancel := context.WithTimeout(ctx, typingInterval)
+	defer cancel()
+	if err := mgr.Send(network.WithNoDial(ctx, "typing signals never dial"), id, m); err != nil {
+		logger.Debug("failed to send typing frame", "peer_id", id, "error", err)
+	}
+}
+
+// sendTyping writes sig to id on a fresh stream. Peers that don't speak
+// the typing protocol are skipped quietly.
+func sendTyping(ctx context.Context, h host.Host, id peer.ID, sig typingSignal) {
+	ctx, cancel := context.WithTimeout(ctx, typingInterval)
+	defer cancel()
+	s, err := h.NewStream(network.WithNoDial(ctx, "typing signals never dial"), id, typingProtocol)
+	if err != nil {
+		logger.Debug("failed to send typing signal", "peer_id", id, "error", err)
+		return
+	}
+	defer s.Close()
+	s.SetWriteDeadline(time.Now().Add(typingInterval))
+	json.NewEncoder(s).Encode(sig)
+}
+
+// remoteTyping is who is typing to us, whether they said so on
+// typingProtocol or in a control frame on a chat stream.
+var remoteTyping = newTypingStatus()
+
+// typingStatus tracks which peers are typing, so the receiver prints
+// "is typing" once per spell rather than on every signal.
+type typingStatus struct {
+	mu    sync.Mutex
+	until map[peer.ID]time.Time
+}
+
+func newTypingStatus() *typingStatus {
+	return &typingStatus{until: make(map[peer.ID]time.Time)}
+}
+
+// update records a signal from id at now and reports whether it starts a
+// new spell of typing worth showing.
+func (t *typingStatus) update(id peer.ID, active bool, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !active {
+		delete(t.until, id)
+		return false
+	}
+	shown := now.Before(t.until[id])
+	t.until[id] = now.Add(typingExpiry)
+	return !shown
+}
+
+func newTypingHandler(status *typingStatus) network.StreamHandler {
+	return func(s network.Stream) {
+		defer s.Close()
+		remote := s.Conn().RemotePeer()
+		s.SetReadDeadline(time.Now().Add(typingInterval))
+		var sig typingSignal
+		if err := json.NewDecoder(io.LimitReader(s, maxTypingBytes)).Decode(&sig); err != nil {
+			logger.Debug("dropping malformed typing signal", "peer_id", remote, "error", err)
+			return
+		}
+		showTyping(status, remote, sig.Nick, sig.Typing)
+	}
+}
+
+// showTyping prints that remote, going by nick, is typing when active
+// starts a new spell.
+func showTyping(status *typingStatus, remote peer.ID, nick string, active bool) {
+	if status.update(remote, active, time.Now()) {
+		out.Printf("✍️ %s is typing…\n", displayName(nick, remote))
+	}
+}
+
+// handleControl acts on a control frame remote sent on a chat stream.
+func handleControl(m ChatMessage, remote peer.ID) {
+	switch m.ContentType {
+	case contentTypeTyping:
+		showTyping(remoteTyping, remote, m.Nick, m.Body == typingStarted)
+	}
+}
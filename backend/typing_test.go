@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// fakeTyping records what a typingNotifier sends, on a clock the test moves.
+type fakeTyping struct {
+	mu    sync.Mutex
+	sent  []bool
+	clock time.Time
+}
+
+func (f *fakeTyping) send(active bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sent = append(f.sent, active)
+}
+
+func (f *fakeTyping) signals() []bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]bool(nil), f.sent...)
+}
+
+func newFakeNotifier(idle time.Duration) (*typingNotifier, *fakeTyping) {
+	f := &fakeTyping{clock: time.Unix(1700000000, 0)}
+	t := newTypingNotifier(2*time.Second, idle, f.send)
+	t.now = func() time.Time { return f.clock }
+	return t, f
+}
+
+func TestTypingNotifierDebounces(t *testing.T) {
+	n, f := newFakeNotifier(time.Hour)
+	defer n.Done()
+
+	n.Keystroke()
+	for i := 0; i < 10; i++ {
+		f.clock = f.clock.Add(100 * time.Millisecond)
+		n.Keystroke()
+	}
+	if got := f.signals(); len(got) != 1 || !got[0] {
+		t.Fatalf("Expected one typing signal within the interval, got %v", got)
+	}
+
+	f.clock = f.clock.Add(2 * time.Second)
+	n.Keystroke()
+	if got := f.signals(); len(got) != 2 || !got[1] {
+		t.Fatalf("Expected a repeat typing signal after the interval, got %v", got)
+	}
+
+	n.Done()
+	n.Done()
+	if got := f.signals(); len(got) != 3 || got[2] {
+		t.Fatalf("Expected exactly one stopped signal, got %v", got)
+	}
+
+	// A new spell starts right away, whatever the interval says
+	n.Keystroke()
+	if got := f.signals(); len(got) != 4 || !got[3] {
+		t.Fatalf("Expected a typing signal for the next line, got %v", got)
+	}
+}
+
+func TestTypingNotifierStopsWhenIdle(t *testing.T) {
+	n, f := newFakeNotifier(50 * time.Millisecond)
+	n.Keystroke()
+	waitFor(t, "stopped signal", func() bool { return len(f.signals()) == 2 })
+	if got := f.signals(); !got[0] || got[1] {
+		t.Errorf("Expected typing then stopped, got %v", got)
+	}
+}
+
+func TestTypingNotifierNil(t *testing.T) {
+	var n *typingNotifier
+	n.Keystroke()
+	n.Done()
+}
+
+func TestTypingStatus(t *testing.T) {
+	s := newTypingStatus()
+	id := peer.ID("alice")
+	now := time.Unix(1700000000, 0)
+
+	if !s.update(id, true, now) {
+		t.Error("Expected the first typing signal to be shown")
+	}
+	if s.update(id, true, now.Add(2*time.Second)) {
+		t.Error("Expected a repeat signal not to be shown again")
+	}
+	if s.update(id, false, now.Add(3*time.Second)) {
+		t.Error("Expected a stopped signal never to be shown")
+	}
+	if !s.update(id, true, now.Add(4*time.Second)) {
+		t.Error("Expected typing after stopped to be shown")
+	}
+	if !s.update(id, true, now.Add(4*time.Second+typingExpiry)) {
+		t.Error("Expected typing after a lost stopped signal to be shown once the old one expired")
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe to print to from stream handlers.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestTypingBetweenPeers(t *testing.T) {
+	var out syncBuffer
+	old := con
+	con = newPlainConsole(strings.NewReader(""), &out)
+	defer func() { con = old }()
+
+	a, _, cleanup := newTestPair(t)
+	defer cleanup()
+
+	a.Typing(true)
+	waitFor(t, "typing status", func() bool { return strings.Contains(out.String(), "alice is typing") })
+	time.Sleep(200 * time.Millisecond)
+	if n := strings.Count(out.String(), "is typing"); n != 1 {
+		t.Errorf("Expected the status once per spell, got it %d times in %q", n, out.String())
+	}
+}
+
+func TestTypingFrameOnChatStream(t *testing.T) {
+	buf := useJSONOutput(t)
+	a, b, cleanup := newTestPair(t)
+	defer cleanup()
+
+	// A message first, so alice knows from the handshake that bob takes
+	// control frames; without the typing protocol that's the only way
+	b.host.RemoveStreamHandler(typingProtocol)
+	if err := a.Send("hi"); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	waitFor(t, "bob to get the message", func() bool { return len(b.history.Recent(-1)) == 1 })
+
+	a.Typing(true)
+	waitFor(t, "typing status", func() bool { return strings.Contains(buf.String(), "alice is typing") })
+	a.Typing(false)
+	if err := a.Send("done"); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	waitFor(t, "the second message", func() bool { return len(b.history.Recent(-1)) >= 2 })
+	if got := b.history.Recent(-1); len(got) != 2 || got[1].Body != "done" {
+		t.Errorf("Expected control frames kept out of history, got %+v", got)
+	}
+}
+
+func TestTypingFramesSkipRateLimit(t *testing.T) {
+	useJSONOutput(t)
+	a, b, cleanup := newTestPair(t)
+	defer cleanup()
+
+	// Room for one message a minute: typing mustn't use it up
+	history := newMessageLog(10)
+	limit := newInboundLimiter(1.0/60, 1)
+	b.host.SetStreamHandler("/chat/1.0.0", func(s network.Stream) {
+		handleStream(s, history, newMessageDeduper(defaultDedupeSize), limit)
+	})
+	s, err := a.host.NewStream(context.Background(), b.host.ID(), "/chat/1.0.0")
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	defer s.Close()
+
+	for _, active := range []bool{true, false, true, false} {
+		writeMessage(s, newTypingFrame(a.host.ID(), "alice", active))
+	}
+	msg := newChatMessage(a.host.ID(), "alice", "after typing")
+	writeMessage(s, msg)
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if id, err := readAck(bufio.NewReader(s)); err != nil || id != msg.ID {
+		t.Fatalf("Expected the message acked, got %q, %v", id, err)
+	}
+	if got := history.Recent(-1); len(got) != 1 || got[0].Body != "after typing" {
+		t.Errorf("Expected the message kept, got %+v", got)
+	}
+}
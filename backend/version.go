@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"runtime/debug"
+)
+
+// Build metadata, set at link time:
+//
+//	go build -ldflags "-X main.version=v1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.date=$(date -u +%FT%TZ)"
+//
+// Anything left empty falls back to what the Go toolchain embedded.
+var version, commit, date string
+
+// buildInfo is what `version` reports.
+type buildInfo struct {
+	Version         string `json:"version"`
+	Commit          string `json:"commit"`
+	Date            string `json:"date"`
+	GoVersion       string `json:"goVersion"`
+	Protocol        string `json:"protocol"`
+	ProtocolVersion string `json:"protocolVersion"`
+}
+
+// currentBuildInfo describes this binary.
+func currentBuildInfo() buildInfo {
+	return resolveBuildInfo(version, commit, date, debug.ReadBuildInfo)
+}
+
+// resolveBuildInfo prefers the ldflags values and fills any gaps from
+// read, which is debug.ReadBuildInfo outside tests.
+func resolveBuildInfo(version, commit, date string, read func() (*debug.BuildInfo, bool)) buildInfo {
+	b := buildInfo{
+		Version:         version,
+		Commit:          commit,
+		Date:            date,
+		Protocol:        string(channelProtocol("")),
+		ProtocolVersion: chatProtocolVersion,
+	}
+	if info, ok := read(); ok {
+		b.GoVersion = info.GoVersion
+		if b.Version == "" {
+			b.Version = info.Main.Version
+		}
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && b.Commit == "":
+				b.Commit = s.Value
+			case s.Key == "vcs.time" && b.Date == "":
+				b.Date = s.Value
+			}
+		}
+	}
+	for _, field := range []*string{&b.Version, &b.Commit, &b.Date, &b.GoVersion} {
+		if *field == "" {
+			*field = "unknown"
+		}
+	}
+	return b
+}
+
+func (b buildInfo) String() string {
+	return fmt.Sprintf("artivus %s\ncommit:   %s\nbuilt:    %s\ngo:       %s\nprotocol: %s (message format %s)",
+		b.Version, b.Commit, b.Date, b.GoVersion, b.Protocol, b.ProtocolVersion)
+}
+
+// runVersion implements the `version` subcommand.
+func runVersion(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("version", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print build metadata as a JSON object")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	b := currentBuildInfo()
+	if *asJSON {
+		return json.NewEncoder(w).Encode(b)
+	}
+	_, err := fmt.Fprintln(w, b)
+	return err
+}
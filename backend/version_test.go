@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"runtime/debug"
+	"testing"
+)
+
+func TestBuildInfoFallback(t *testing.T) {
+	b := resolveBuildInfo("", "", "", debug.ReadBuildInfo)
+	if b.Version == "" || b.GoVersion == "" || b.GoVersion == "unknown" {
+		t.Errorf("Expected build info from the toolchain without ldflags, got %+v", b)
+	}
+	if b.Protocol != "/chat/2.0.0" || b.ProtocolVersion != chatProtocolVersion {
+		t.Errorf("Expected the chat protocol to be reported, got %+v", b)
+	}
+}
+
+func TestBuildInfoPrefersLdflags(t *testing.T) {
+	read := func() (*debug.BuildInfo, bool) {
+		return &debug.BuildInfo{
+			GoVersion: "go1.25.0",
+			Main:      debug.Module{Version: "(devel)"},
+			Settings:  []debug.BuildSetting{{Key: "vcs.revision", Value: "abc123"}, {Key: "vcs.time", Value: "2025-01-01T00:00:00Z"}},
+		}, true
+	}
+	b := resolveBuildInfo("v1.2.0", "", "2025-06-01", read)
+	want := buildInfo{Version: "v1.2.0", Commit: "abc123", Date: "2025-06-01", GoVersion: "go1.25.0", Protocol: "/chat/2.0.0", ProtocolVersion: chatProtocolVersion}
+	if b != want {
+		t.Errorf("Expected %+v, got %+v", want, b)
+	}
+}
+
+func TestRunVersionJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := runVersion([]string{"-json"}, &buf); err != nil {
+		t.Fatalf("Failed to run version: %v", err)
+	}
+	var b buildInfo
+	if err := json.Unmarshal(buf.Bytes(), &b); err != nil {
+		t.Fatalf("Expected a JSON object, got %q: %v", buf.String(), err)
+	}
+	if b.Version == "" || b.Protocol == "" {
+		t.Errorf("Expected version and protocol in %+v", b)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	connmgr "github.com/libp2p/go-libp2p/core/connmgr"
+	event "github.com/libp2p/go-libp2p/core/event"
+	host "github.com/libp2p/go-libp2p/core/host"
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	peerstore "github.com/libp2p/go-libp2p/core/peerstore"
+	protocol "github.com/libp2p/go-libp2p/core/protocol"
+	autonat "github.com/libp2p/go-libp2p/p2p/host/autonat"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// watchdogFailures is how many health checks in a row must fail before the
+// watchdog gives up on the host and rebuilds it. One failure can be a
+// passing hiccup, e.g. an interface coming back up.
+const watchdogFailures = 3
+
+// swapHost is the host.Host a Node hands out. It forwards to the libp2p
+// host underneath and remembers the stream handlers and connection
+// watchers set through it, so swap can carry them over when the watchdog
+// replaces a broken host. Services with their own ties to a host, like
+// pubsub and the DHT, are given the underlying host and restarted instead.
+type swapHost struct {
+	mu        sync.RWMutex
+	h         host.Host
+	handlers  map[protocol.ID]swapHandler
+	notifiees []network.Notifiee
+}
+
+type swapHandler struct {
+	match   func(protocol.ID) bool
+	handler network.StreamHandler
+}
+
+func newSwapHost(h host.Host) *swapHost {
+	return &swapHost{h: h, handlers: make(map[protocol.ID]swapHandler)}
+}
+
+// current is the libp2p host in use.
+func (s *swapHost) current() host.Host {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.h
+}
+
+// swap makes h the host in use, setting every handler and watcher on it
+// that was set on the one before.
+func (s *swapHost) swap(h host.Host) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.h = h
+	for pid, sh := range s.handlers {
+		if sh.match != nil {
+			h.SetStreamHandlerMatch(pid, sh.match, sh.handler)
+		} else {
+			h.SetStreamHandler(pid, sh.handler)
+		}
+	}
+	for _, nf := range s.notifiees {
+		h.Network().Notify(nf)
+	}
+}
+
+func (s *swapHost) ID() peer.ID                      { return s.current().ID() }
+func (s *swapHost) Peerstore() peerstore.Peerstore   { return s.current().Peerstore() }
+func (s *swapHost) Addrs() []ma.Multiaddr            { return s.current().Addrs() }
+func (s *swapHost) Mux() protocol.Switch             { return s.current().Mux() }
+func (s *swapHost) Close() error                     { return s.current().Close() }
+func (s *swapHost) ConnManager() connmgr.ConnManager { return s.current().ConnManager() }
+func (s *swapHost) EventBus() event.Bus              { return s.current().EventBus() }
+
+func (s *swapHost) Network() network.Network {
+	return swapNetwork{Network: s.current().Network(), s: s}
+}
+
+func (s *swapHost) Connect(ctx context.Context, pi peer.AddrInfo) error {
+	return s.current().Connect(ctx, pi)
+}
+
+func (s *swapHost) NewStream(ctx context.Context, p peer.ID, pids ...protocol.ID) (network.Stream, error) {
+	return s.current().NewStream(ctx, p, pids...)
+}
+
+func (s *swapHost) SetStreamHandler(pid protocol.ID, handler network.StreamHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[pid] = swapHandler{handler: handler}
+	s.h.SetStreamHandler(pid, handler)
+}
+
+func (s *swapHost) SetStreamHandlerMatch(pid protocol.ID, match func(protocol.ID) bool, handler network.StreamHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[pid] = swapHandler{match: match, handler: handler}
+	s.h.SetStreamHandlerMatch(pid, match, handler)
+}
+
+func (s *swapHost) RemoveStreamHandler(pid protocol.ID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.handlers, pid)
+	s.h.RemoveStreamHandler(pid)
+}
+
+// GetAutoNat is the underlying host's, for reachability.
+func (s *swapHost) GetAutoNat() autonat.AutoNAT {
+	if bh, ok := s.current().(interface{ GetAutoNat() autonat.AutoNAT }); ok {
+		return bh.GetAutoNat()
+	}
+	return nil
+}
+
+// swapNetwork is the current host's network, with watchers registered
+// through swapHost so they follow it to a replacement.
+type swapNetwork struct {
+	network.Network
+	s *swapHost
+}
+
+func (n swapNetwork) Notify(nf network.Notifiee) {
+	n.s.mu.Lock()
+	defer n.s.mu.Unlock()
+	n.s.notifiees = append(n.s.notifiees, nf)
+	n.s.h.Network().Notify(nf)
+}
+
+func (n swapNetwork) StopNotify(nf network.Notifiee) {
+	n.s.mu.Lock()
+	defer n.s.mu.Unlock()
+	n.s.notifiees = slices.DeleteFunc(n.s.notifiees, func(other network.Notifiee) bool { return other == nf })
+	n.s.h.Network().StopNotify(nf)
+}
+
+// checkHost reports why h is no longer usable, or nil if it is: it has to
+// be listening, and its TCP listeners have to accept a connection from
+// this machine. libp2p won't open a stream to its own peer ID, so the
+// loopback check dials the listener directly.
+func checkHost(ctx context.Context, h host.Host) error {
+	addrs := h.Network().ListenAddresses()
+	if len(addrs) == 0 {
+		return errors.New("not listening on any address")
+	}
+	var d net.Dialer
+	for _, addr := range addrs {
+		na, err := manet.ToNetAddr(addr)
+		tcp, ok := na.(*net.TCPAddr)
+		if err != nil || !ok {
+			continue
+		}
+		switch {
+		case tcp.IP.Equal(net.IPv4zero):
+			tcp.IP = net.IPv4(127, 0, 0, 1)
+		case tcp.IP.IsUnspecified():
+			tcp.IP = net.IPv6loopback
+		}
+		c, err := d.DialContext(ctx, "tcp", tcp.String())
+		if err != nil {
+			return fmt.Errorf("listener %s refused a loopback connection: %w", addr, err)
+		}
+		c.Close()
+	}
+	return nil
+}
+
+// watchHost checks the host every interval and rebuilds it with
+// recreateHost once watchdogFailures checks in a row have failed.
+func (n *Node) watchHost(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	failures := 0
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-t.C:
+		}
+		ctx, cancel := context.WithTimeout(n.ctx, interval)
+		err := checkHost(ctx, n.host)
+		cancel()
+		if err == nil || n.ctx.Err() != nil {
+			failures = 0
+			continue
+		}
+		failures++
+		n.log.Warn("host health check failed", "error", err, "failures", failures)
+		if failures < watchdogFailures {
+			continue
+		}
+		failures = 0
+		if err := n.recreateHost(err); err != nil {
+			n.log.Error("failed to recreate the host", "error", err)
+		}
+	}
+}
+
+// recreateHost replaces the host, which failed with cause, by a new one
+// built from the same key and config. Handlers and connection watchers
+// move over through swapHost; pubsub and discovery are started afresh, the
+// peers we were talking to are redialed and the room is joined again.
+func (n *Node) recreateHost(cause error) error {
+	old := n.host.current()
+	peers := n.registry.List()
+	for i, info := range peers {
+		if addrs := old.Peerstore().Addrs(info.ID); len(addrs) > 0 {
+			peers[i].Addrs = addrs
+		}
+	}
+	room := n.Room()
+	n.Leave()
+
+	n.mu.Lock()
+	n.hostCancel()
+	closers := n.hostClosers
+	n.hostClosers, n.router = nil, nil
+	n.mu.Unlock()
+	for _, c := range closers {
+		c.Close()
+	}
+	n.mgr.Close()
+	if err := old.Close(); err != nil {
+		n.log.Debug("failed to close the old host", "error", err)
+	}
+
+	h, cm, err := newHost(n.cfg, n.priv, n.bw)
+	if err != nil {
+		return fmt.Errorf("failed to build a new host: %w", err)
+	}
+	ctx, cancel := context.WithCancel(n.ctx)
+	ps, err := pubsub.NewGossipSub(ctx, h)
+	if err != nil {
+		cancel()
+		h.Close()
+		return fmt.Errorf("failed to start pubsub: %w", err)
+	}
+	n.mu.Lock()
+	if n.ctx.Err() != nil {
+		// Closed meanwhile, and with the old host; don't leave this one
+		n.mu.Unlock()
+		cancel()
+		return h.Close()
+	}
+	n.pubsub, n.hostCtx, n.hostCancel = ps, ctx, cancel
+	n.mu.Unlock()
+	n.host.swap(h)
+	n.chats.rebind(cm)
+	n.startHostServices()
+
+	n.log.Error("the libp2p host stopped working and was recreated", "cause", cause, "peer_id", h.ID(), "addrs", h.Addrs())
+	out.Printf("🔄 The network host stopped working (%v) and was restarted with the same identity\n", cause)
+
+	for _, info := range peers {
+		n.workers.Go(func() {
+			ctx, cancel := context.WithTimeout(n.ctx, reconnectDialTimeout)
+			defer cancel()
+			if err := connectWithFallback(ctx, n.host, info); err != nil {
+				n.log.Debug("failed to reconnect after recreating the host", "peer_id", info.ID, "error", err)
+			}
+		})
+	}
+	if room != "" {
+		if err := n.Join(room); err != nil {
+			n.log.Warn("failed to rejoin room after recreating the host", "room", room, "error", err)
+		}
+	}
+	return nil
+}
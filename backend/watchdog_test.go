@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	network "github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestCheckHost(t *testing.T) {
+	n := newTestNode(t, "")
+	if err := checkHost(context.Background(), n.host); err != nil {
+		t.Fatalf("Expected a fresh host to be healthy, got %v", err)
+	}
+	n.host.current().Network().Close()
+	if err := checkHost(context.Background(), n.host); err == nil {
+		t.Error("Expected a host with its network closed to fail the check")
+	}
+}
+
+func TestWatchdogRecreatesBrokenHost(t *testing.T) {
+	alice, err := NewNode(context.Background(), Config{
+		IdentityPath:       filepath.Join(t.TempDir(), "identity.key"),
+		ListenAddrs:        loopbackListenAddrs,
+		Nick:               "alice",
+		NegotiationTimeout: 5 * time.Second,
+		Watchdog:           50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	t.Cleanup(func() { alice.Close() })
+	alice.Start()
+	bob := newTestNode(t, "bob")
+	if err := alice.Connect(nodeAddr(bob)); err != nil {
+		t.Fatalf("Failed to connect alice to bob: %v", err)
+	}
+	bob.registry.Add(peer.AddrInfo{ID: alice.host.ID()})
+	for _, n := range []*Node{alice, bob} {
+		if err := n.Join("lobby"); err != nil {
+			t.Fatalf("Failed to join the room: %v", err)
+		}
+	}
+	publishUntilReceived(t, alice, bob, "before")
+
+	// Every transport dies at once, as after an interface flap
+	id, broken := alice.host.ID(), alice.host.current()
+	broken.Network().Close()
+	waitFor(t, "the watchdog to recreate the host", func() bool { return alice.host.current() != broken })
+	if alice.host.ID() != id {
+		t.Errorf("Expected the new host to keep peer ID %s, got %s", id, alice.host.ID())
+	}
+	waitFor(t, "alice to reconnect to bob", func() bool {
+		return alice.host.Network().Connectedness(bob.host.ID()) == network.Connected
+	})
+	if alice.Room() != "lobby" {
+		t.Errorf("Expected alice back in lobby, got %q", alice.Room())
+	}
+	publishUntilReceived(t, alice, bob, "after")
+
+	// The chat handler moved over to the new host
+	if err := alice.Leave(); err != nil {
+		t.Fatalf("Failed to leave: %v", err)
+	}
+	if err := bob.Leave(); err != nil {
+		t.Fatalf("Failed to leave: %v", err)
+	}
+	if err := bob.Send("welcome back"); err != nil {
+		t.Fatalf("Failed to send to alice: %v", err)
+	}
+	waitFor(t, "alice to get bob's message", func() bool {
+		got := alice.history.Recent(1)
+		return len(got) == 1 && got[0].Body == "welcome back"
+	})
+}
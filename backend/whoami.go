@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// nodeInfo is what /whoami reports about the local node.
+type nodeInfo struct {
+	ID              peer.ID  `json:"id"`
+	Nick            string   `json:"nick"`
+	Addrs           []string `json:"addrs"`
+	Protocol        string   `json:"protocol"`
+	ProtocolVersion string   `json:"protocolVersion"`
+	Reachability    string   `json:"reachability"`
+}
+
+// Info reads the node's identity and addresses as they are now, so
+// addresses learned since startup (from identify or AutoNAT) are included.
+func (n *Node) Info() nodeInfo {
+	info := nodeInfo{
+		ID:              n.host.ID(),
+		Nick:            n.Nick(),
+		Addrs:           []string{},
+		Protocol:        string(channelProtocol("")),
+		ProtocolVersion: chatProtocolVersion,
+		Reachability:    reachabilityName(reachability(n.host)),
+	}
+	for _, addr := range dialableAddrs(n.host) {
+		info.Addrs = append(info.Addrs, addr.String())
+	}
+	return info
+}
+
+// formatNodeInfo renders info for /whoami.
+func formatNodeInfo(info nodeInfo) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "🪪 Peer ID: %s\n", info.ID)
+	fmt.Fprintf(&b, "   Nickname: %s\n", info.Nick)
+	fmt.Fprintf(&b, "   Protocol: %s (message format %s)\n", info.Protocol, info.ProtocolVersion)
+	fmt.Fprintf(&b, "   Reachability: %s\n", info.Reachability)
+	if len(info.Addrs) == 0 {
+		b.WriteString("   No LAN or public addresses to share; pass -show-local to list loopback ones.")
+		return b.String()
+	}
+	b.WriteString("   Share one of:")
+	for _, addr := range info.Addrs {
+		fmt.Fprintf(&b, "\n   %s", addr)
+	}
+	return b.String()
+}
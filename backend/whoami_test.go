@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNodeInfo(t *testing.T) {
+	old := showLocalAddrs
+	showLocalAddrs = true
+	t.Cleanup(func() { showLocalAddrs = old })
+	n := newTestNode(t, "alice")
+
+	info := n.Info()
+	if info.ID != n.host.ID() || info.Nick != "alice" {
+		t.Errorf("Expected our ID and nick, got %+v", info)
+	}
+	if len(info.Addrs) == 0 || !strings.HasSuffix(info.Addrs[0], "/p2p/"+n.host.ID().String()) {
+		t.Errorf("Expected dialable /p2p/ addresses, got %v", info.Addrs)
+	}
+	if info.Protocol != "/chat/2.0.0" || info.ProtocolVersion != chatProtocolVersion || info.Reachability == "" {
+		t.Errorf("Expected protocol and reachability to be filled in, got %+v", info)
+	}
+	if text := formatNodeInfo(info); !strings.Contains(text, info.Addrs[0]) || !strings.Contains(text, "alice") {
+		t.Errorf("Expected /whoami output to list the address and nick, got %q", text)
+	}
+
+	n.SetNick("alice2")
+	if got := n.Info().Nick; got != "alice2" {
+		t.Errorf("Expected the live nick, got %q", got)
+	}
+}
+
+func TestAPIWhoami(t *testing.T) {
+	n := newTestNode(t, "alice")
+	srv := httptest.NewServer(newAPIHandler(n))
+	t.Cleanup(srv.Close)
+
+	resp, err := http.Get(srv.URL + "/whoami")
+	if err != nil {
+		t.Fatalf("Failed to GET /whoami: %v", err)
+	}
+	defer resp.Body.Close()
+	var info nodeInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		t.Fatalf("Failed to decode /whoami: %v", err)
+	}
+	if info.ID != n.host.ID() || info.Addrs == nil {
+		t.Errorf("Unexpected /whoami response: %+v", info)
+	}
+}